@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// AgencyInfo mirrors a row of a GTFS agency.txt file. Agencies belong to a project, and
+// every route in the project is operated by one of them.
+type AgencyInfo struct {
+	ID        string `gorm:"primaryKey" json:"id" msgpack:"id"`
+	ProjectID string `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	Name      string `gorm:"name" json:"name" msgpack:"name"`
+	URL       string `gorm:"url" json:"url" msgpack:"url"`
+	Timezone  string `gorm:"timezone" json:"timezone" msgpack:"timezone"`
+	Lang      string `gorm:"lang" json:"lang,omitempty" msgpack:"lang,omitempty"`
+	Phone     string `gorm:"phone" json:"phone,omitempty" msgpack:"phone,omitempty"`
+	FareURL   string `gorm:"fare_url" json:"fare_url,omitempty" msgpack:"fare_url,omitempty"`
+	Email     string `gorm:"email" json:"email,omitempty" msgpack:"email,omitempty"`
+}
+
+func (AgencyInfo) TableName() string {
+	return "agencies"
+}
+
+func listAgencies(s *Server, u *UserConn, payload []byte) (any, error) {
+	var projectID string
+	if err := msgpack.Unmarshal(payload, &projectID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, projectID); err != nil {
+		return nil, err
+	}
+
+	var agencies []AgencyInfo
+	if err := s.Database.Find(&agencies, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	return agencies, nil
+}
+
+func createAgency(s *Server, u *UserConn, payload []byte) (any, error) {
+	var info AgencyInfo
+	if err := msgpack.Unmarshal(payload, &info); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, info.ProjectID); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+	info.ID = id.String()
+
+	if err := s.Database.Create(info).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "agency:created", Data: info})
+
+	return info, nil
+}
+
+func modifyAgency(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to modify the ID or project of the agency, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	changes := map[string]any{}
+
+	for _, field := range []string{
+		"name", "url", "timezone", "lang", "phone", "fare_url", "email",
+	} {
+		if str, ok := untrustedChanges[field].(string); ok {
+			changes[field] = str
+		}
+	}
+
+	agency := AgencyInfo{ID: id}
+	if len(changes) > 0 {
+		if err := s.Database.Model(&agency).Updates(changes).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	if err := s.Database.Take(&agency).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrorWithCode{
+				Code:    "agency-not-found",
+				Message: fmt.Sprintf("there is no agency with ID %q", id),
+				Details: id,
+			}
+		}
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: agency.ProjectID, Type: "agency:modified", Data: agency})
+
+	return agency, nil
+}
+
+// deleteAgency deletes an agency. Its routes are kept, but no longer refer to it.
+func deleteAgency(s *Server, u *UserConn, payload []byte) (any, error) {
+	var id string
+	if err := msgpack.Unmarshal(payload, &id); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	// Look up the project first so we know who to notify
+	var agency AgencyInfo
+	if err := s.Database.Select("project_id").Take(&agency, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
+		// TODO
+		return nil, err
+	}
+
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&RouteInfo{}).Where("agency_id = ?", id).Update("agency_id", "").Error; err != nil {
+			return err
+		}
+		return tx.Delete(&AgencyInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: agency.ProjectID, Type: "agency:deleted", Data: id})
+
+	return nil, nil
+}
@@ -162,22 +162,31 @@ func writeHandshakeErrorOrLog(ws *websocket.Conn, errRes ErrorWithCode) {
 	}
 }
 
-// ServeHTTP implements the http.Handler interface for Server. The only HTTP route provided
-// is '/connect', which immediately upgrades request connections to websockets and authenticates
-// them as either a new user (registering) or existing user (logging in).
+// ServeHTTP implements the http.Handler interface for Server. The main HTTP route is '/connect',
+// which immediately upgrades request connections to websockets and authenticates them as either
+// a new user (registering) or existing user (logging in). Everything else happens over the
+// websocket, except for transferring large files, which is authorized by random IDs that are
+// handed out over the websocket.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// We COULD just ignore the URL and try to upgrade to a websocket no matter what, but I want
-	// to establish a strict API going forward and there likely WILL be HTTP-based APIs added in
-	// the future
-	if r.URL.Path != "/connect" {
+	switch {
+	case r.URL.Path == "/connect":
+		s.serveConnect(w, r)
+	case strings.HasPrefix(r.URL.Path, "/upload/"):
+		s.serveUpload(w, r, strings.TrimPrefix(r.URL.Path, "/upload/"))
+	case strings.HasPrefix(r.URL.Path, "/download/"):
+		s.serveDownload(w, r, strings.TrimPrefix(r.URL.Path, "/download/"))
+	default:
 		http.Error(
 			w,
 			"Resource not found - use the '/connect' URL to register/login and communicate over a WebSocket.",
 			http.StatusNotFound,
 		)
-		return
 	}
+}
 
+// serveConnect upgrades a request to a websocket, authenticates the user, and then serves the
+// connection until it is closed.
+func (s *Server) serveConnect(w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true },
 	}
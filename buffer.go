@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// DefaultBufferDistances are the quarter, half and three-quarter mile buffers planners
+// usually look at, in meters.
+var DefaultBufferDistances = []float64{0.25 * MetersPerMile, 0.5 * MetersPerMile, 0.75 * MetersPerMile}
+
+// StopSelection picks a set of stops in a project: the listed stops if there are any,
+// otherwise the stops served by the route if one is given, otherwise every stop in the
+// project.
+type StopSelection struct {
+	ProjectID string   `msgpack:"project_id"`
+	RouteID   string   `msgpack:"route_id"`
+	StopIDs   []string `msgpack:"stop_ids"`
+}
+
+// BufferRequest is the payload of a 'stop:buffers' request. Distances are in meters and
+// default to DefaultBufferDistances. If Shapefile is set, the buffers are also made available
+// for download as a zipped shapefile.
+type BufferRequest struct {
+	StopSelection `msgpack:",inline"`
+	Distances     []float64 `msgpack:"distances"`
+	Shapefile     bool      `msgpack:"shapefile"`
+}
+
+// StopBuffer is the area within some distance of any of the selected stops. Overlapping
+// circles are dissolved into polygons, which may have holes. Area is in square meters.
+type StopBuffer struct {
+	Distance float64      `msgpack:"distance"`
+	Area     float64      `msgpack:"area"`
+	Polygons MultiPolygon `msgpack:"polygons"`
+}
+
+// BufferAnalysis is the reply to a 'stop:buffers' request.
+type BufferAnalysis struct {
+	ProjectID string        `msgpack:"project_id"`
+	StopIDs   []string      `msgpack:"stop_ids"`
+	Buffers   []StopBuffer  `msgpack:"buffers"`
+	Download  *DownloadInfo `msgpack:"download,omitempty"`
+}
+
+// selectStops loads the stops picked by a StopSelection.
+func selectStops(db *gorm.DB, sel StopSelection) ([]StopInfo, error) {
+	if err := requireProject(db, sel.ProjectID); err != nil {
+		return nil, err
+	}
+
+	var stops []StopInfo
+	q := db.Where("project_id = ?", sel.ProjectID)
+
+	switch {
+	case len(sel.StopIDs) > 0:
+		q = q.Where("id IN ?", sel.StopIDs)
+	case sel.RouteID != "":
+		if err := requireInProject(db, &RouteInfo{}, "route", sel.RouteID, sel.ProjectID); err != nil {
+			return nil, err
+		}
+		ids, err := routeStopIDs(db, sel.RouteID)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Where("id IN ?", ids)
+	}
+
+	if err := q.Order("id").Find(&stops).Error; err != nil {
+		return nil, err
+	}
+	return stops, nil
+}
+
+// routeStopIDs returns the IDs of every stop served by a route, either as part of one of its
+// patterns or by one of its trips.
+func routeStopIDs(db *gorm.DB, routeID string) ([]string, error) {
+	var fromPatterns, fromTrips []string
+
+	routePatterns := db.Model(&PatternInfo{}).Select("id").Where("route_id = ?", routeID)
+	if err := db.Model(&PatternStopInfo{}).Distinct().Where("pattern_id IN (?)", routePatterns).
+		Pluck("stop_id", &fromPatterns).Error; err != nil {
+		return nil, err
+	}
+
+	routeTrips := db.Model(&TripInfo{}).Select("id").Where("route_id = ?", routeID)
+	if err := db.Model(&StopTimeInfo{}).Distinct().Where("trip_id IN (?)", routeTrips).
+		Pluck("stop_id", &fromTrips).Error; err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, id := range append(fromPatterns, fromTrips...) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func stopBuffers(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req BufferRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	distances := req.Distances
+	if len(distances) == 0 {
+		distances = DefaultBufferDistances
+	}
+	for _, d := range distances {
+		if d <= 0 {
+			// TODO
+			return nil, errors.New("buffer distances must be positive")
+		}
+	}
+
+	stops, err := selectStops(s.Database, req.StopSelection)
+	if err != nil {
+		return nil, err
+	}
+
+	analysis := BufferAnalysis{
+		ProjectID: req.ProjectID,
+		StopIDs:   make([]string, len(stops)),
+		Buffers:   make([]StopBuffer, len(distances)),
+	}
+	for i, stop := range stops {
+		analysis.StopIDs[i] = stop.ID
+	}
+
+	for i, d := range distances {
+		analysis.Buffers[i] = StopBuffer{Distance: d, Polygons: MultiPolygon{}}
+
+		if field := newDiscField(stopDiscs(stops, d)); field != nil {
+			analysis.Buffers[i].Polygons = field.polygons()
+			analysis.Buffers[i].Area = analysis.Buffers[i].Polygons.area()
+		}
+	}
+
+	if req.Shapefile {
+		fields := []dbfField{
+			{Name: "DISTANCE", Type: 'N', Decimals: 1},
+			{Name: "AREA_M2", Type: 'N'},
+			{Name: "STOPS", Type: 'N'},
+		}
+		polygons := make([]MultiPolygon, len(analysis.Buffers))
+		records := make([]map[string]string, len(analysis.Buffers))
+		for i, b := range analysis.Buffers {
+			polygons[i] = b.Polygons
+			records[i] = map[string]string{
+				"DISTANCE": strconv.FormatFloat(b.Distance, 'f', 1, 64),
+				"AREA_M2":  strconv.FormatFloat(b.Area, 'f', 0, 64),
+				"STOPS":    strconv.Itoa(len(stops)),
+			}
+		}
+		if analysis.Download, err = s.addPolygonDownload("stop-buffers", fields, polygons, records); err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	return analysis, nil
+}
+
+// stopDiscs returns a disc of the given radius around each stop.
+func stopDiscs(stops []StopInfo, radius float64) []disc {
+	discs := make([]disc, len(stops))
+	for i, stop := range stops {
+		discs[i] = disc{LatLng{stop.Lat, stop.Lng}, radius}
+	}
+	return discs
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// CalendarInfo describes a service pattern, i.e., a row of a GTFS calendar.txt file. Trips
+// refer to it by ID. Name is the human-readable service ID from the feed (e.g., "Weekday").
+// Services that are only defined by calendar_dates.txt exceptions have empty start/end dates.
+type CalendarInfo struct {
+	ID        string `gorm:"primaryKey" json:"id" msgpack:"id"`
+	ProjectID string `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	Name      string `gorm:"name" json:"name" msgpack:"name"`
+	Monday    bool   `gorm:"monday" json:"monday" msgpack:"monday"`
+	Tuesday   bool   `gorm:"tuesday" json:"tuesday" msgpack:"tuesday"`
+	Wednesday bool   `gorm:"wednesday" json:"wednesday" msgpack:"wednesday"`
+	Thursday  bool   `gorm:"thursday" json:"thursday" msgpack:"thursday"`
+	Friday    bool   `gorm:"friday" json:"friday" msgpack:"friday"`
+	Saturday  bool   `gorm:"saturday" json:"saturday" msgpack:"saturday"`
+	Sunday    bool   `gorm:"sunday" json:"sunday" msgpack:"sunday"`
+	// StartDate and EndDate are formatted as YYYYMMDD, like in GTFS.
+	StartDate string `gorm:"start_date" json:"start_date" msgpack:"start_date"`
+	EndDate   string `gorm:"end_date" json:"end_date" msgpack:"end_date"`
+}
+
+func (CalendarInfo) TableName() string {
+	return "calendars"
+}
+
+// CalendarDateInfo mirrors a row of a GTFS calendar_dates.txt file, which adds (exception
+// type 1) or removes (exception type 2) service on a single date.
+type CalendarDateInfo struct {
+	ServiceID     string `gorm:"primaryKey" json:"service_id" msgpack:"service_id"`
+	Date          string `gorm:"primaryKey" json:"date" msgpack:"date"`
+	ProjectID     string `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	ExceptionType uint   `gorm:"exception_type" json:"exception_type" msgpack:"exception_type"`
+}
+
+func (CalendarDateInfo) TableName() string {
+	return "calendar_dates"
+}
+
+// MaxServiceSpanDays limits how many days of a service are enumerated when counting its
+// service days, so that a calendar running until 9999 does not take forever.
+const MaxServiceSpanDays = 10 * 366
+
+// ServiceDays describes when a service runs. Weekdays is indexed by time.Weekday (Sunday
+// first) and says whether the service runs on that day of a typical week; for services whose
+// calendar runs on no weekdays, that means the weekday recurs on at least two added dates.
+// AnnualDays is the number of days the service runs per year. Feeds usually publish a few
+// months of service at a time, so the days the service runs are scaled from the span of its
+// dates to a full year, which keeps the share of holidays and other exceptions. Services
+// without a weekly pattern (one-off dates) are not extrapolated.
+type ServiceDays struct {
+	Weekdays   [7]bool
+	AnnualDays float64
+}
+
+// countServiceDays works out when a service runs from its calendar and exceptions.
+func countServiceDays(cal CalendarInfo, exceptions []CalendarDateInfo) ServiceDays {
+	var days ServiceDays
+	weekdayFlags := [7]bool{
+		cal.Sunday, cal.Monday, cal.Tuesday, cal.Wednesday, cal.Thursday, cal.Friday, cal.Saturday,
+	}
+
+	active := map[time.Time]bool{}
+	var first, last time.Time
+
+	extend := func(d time.Time) {
+		if first.IsZero() || d.Before(first) {
+			first = d
+		}
+		if last.IsZero() || d.After(last) {
+			last = d
+		}
+	}
+
+	start, startErr := time.Parse("20060102", cal.StartDate)
+	end, endErr := time.Parse("20060102", cal.EndDate)
+	hasRange := startErr == nil && endErr == nil && !end.Before(start)
+
+	if hasRange {
+		if limit := start.AddDate(0, 0, MaxServiceSpanDays-1); end.After(limit) {
+			end = limit
+		}
+		days.Weekdays = weekdayFlags
+		extend(start)
+		extend(end)
+
+		for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+			if weekdayFlags[d.Weekday()] {
+				active[d] = true
+			}
+		}
+	}
+
+	for _, ex := range exceptions {
+		d, err := time.Parse("20060102", ex.Date)
+		if err != nil {
+			continue
+		}
+		extend(d)
+
+		switch ex.ExceptionType {
+		case 1:
+			active[d] = true
+		case 2:
+			delete(active, d)
+		}
+	}
+
+	if days.Weekdays == [7]bool{} {
+		var dates [7]int
+		for d := range active {
+			dates[d.Weekday()]++
+		}
+		for wd, n := range dates {
+			days.Weekdays[wd] = n >= 2
+		}
+	}
+
+	weekly := 0
+	for _, runs := range days.Weekdays {
+		if runs {
+			weekly++
+		}
+	}
+
+	// Without a date range, the span ends on the last date the service runs, so it is rounded
+	// up to whole weeks to cover the rest of that week
+	spanDays := last.Sub(first).Hours()/24 + 1
+	if !hasRange {
+		spanDays = math.Ceil(spanDays/7) * 7
+	}
+
+	days.AnnualDays = float64(len(active))
+	switch {
+	case weekly == 0:
+		// One-off dates
+	case spanDays >= 7:
+		days.AnnualDays *= 365 / spanDays
+	default:
+		// Less than a week of dates says little about exceptions, so use the weekly pattern
+		days.AnnualDays = float64(weekly) * 365 / 7
+	}
+
+	return days
+}
+
+// servicesOn returns the IDs of the services of a project that run on a date, formatted as
+// YYYYMMDD.
+func servicesOn(db *gorm.DB, projectID, date string) (map[string]bool, error) {
+	day, err := time.Parse("20060102", date)
+	if err != nil {
+		return nil, err
+	}
+
+	var calendars []CalendarInfo
+	if err := db.Find(&calendars, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	var exceptions []CalendarDateInfo
+	if err := db.Find(&exceptions, "project_id = ? AND date = ?", projectID, date).Error; err != nil {
+		return nil, err
+	}
+
+	weekday := day.Weekday()
+	active := map[string]bool{}
+	for _, cal := range calendars {
+		flags := [7]bool{
+			cal.Sunday, cal.Monday, cal.Tuesday, cal.Wednesday, cal.Thursday, cal.Friday, cal.Saturday,
+		}
+		// YYYYMMDD dates sort the same as strings
+		if cal.StartDate <= date && date <= cal.EndDate && flags[weekday] {
+			active[cal.ID] = true
+		}
+	}
+	for _, ex := range exceptions {
+		switch ex.ExceptionType {
+		case 1:
+			active[ex.ServiceID] = true
+		case 2:
+			delete(active, ex.ServiceID)
+		}
+	}
+
+	return active, nil
+}
+
+func listCalendars(s *Server, u *UserConn, payload []byte) (any, error) {
+	var projectID string
+	if err := msgpack.Unmarshal(payload, &projectID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, projectID); err != nil {
+		return nil, err
+	}
+
+	var calendars []CalendarInfo
+	if err := s.Database.Find(&calendars, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	return calendars, nil
+}
+
+func createCalendar(s *Server, u *UserConn, payload []byte) (any, error) {
+	var info CalendarInfo
+	if err := msgpack.Unmarshal(payload, &info); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, info.ProjectID); err != nil {
+		return nil, err
+	}
+	if !isGTFSDate(info.StartDate) || !isGTFSDate(info.EndDate) {
+		// TODO
+		return nil, errors.New("start and end dates must be formatted as YYYYMMDD")
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+	info.ID = id.String()
+
+	if err := s.Database.Create(info).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "calendar:created", Data: info})
+
+	return info, nil
+}
+
+func modifyCalendar(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to modify the ID or project of the calendar, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	changes := map[string]any{}
+
+	if name, ok := untrustedChanges["name"].(string); ok {
+		changes["name"] = name
+	}
+	for _, field := range []string{
+		"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday",
+	} {
+		if b, ok := untrustedChanges[field].(bool); ok {
+			changes[field] = b
+		}
+	}
+	for _, field := range []string{"start_date", "end_date"} {
+		if date, ok := untrustedChanges[field].(string); ok {
+			if !isGTFSDate(date) {
+				// TODO
+				return nil, errors.New("start and end dates must be formatted as YYYYMMDD")
+			}
+			changes[field] = date
+		}
+	}
+
+	calendar := CalendarInfo{ID: id}
+	if len(changes) > 0 {
+		if err := s.Database.Model(&calendar).Updates(changes).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	if err := s.Database.Take(&calendar).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrorWithCode{
+				Code:    "service-not-found",
+				Message: fmt.Sprintf("there is no service with ID %q", id),
+				Details: id,
+			}
+		}
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: calendar.ProjectID, Type: "calendar:modified", Data: calendar})
+
+	return calendar, nil
+}
+
+// deleteCalendar deletes a service and its exceptions. Services that are still used by trips
+// cannot be deleted.
+func deleteCalendar(s *Server, u *UserConn, payload []byte) (any, error) {
+	var id string
+	if err := msgpack.Unmarshal(payload, &id); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	// Look up the project first so we know who to notify
+	var calendar CalendarInfo
+	if err := s.Database.Select("project_id").Take(&calendar, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
+		// TODO
+		return nil, err
+	}
+
+	var tripCount int64
+	if err := s.Database.Model(&TripInfo{}).Where("service_id = ?", id).Count(&tripCount).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+	if tripCount > 0 {
+		return nil, &ErrorWithCode{
+			Code:    "service-in-use",
+			Message: fmt.Sprintf("service is still used by %d trip(s)", tripCount),
+			Details: tripCount,
+		}
+	}
+
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&CalendarDateInfo{}, "service_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&CalendarInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: calendar.ProjectID, Type: "calendar:deleted", Data: id})
+
+	return nil, nil
+}
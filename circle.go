@@ -2,16 +2,20 @@ package main
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/google/uuid"
 	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
 )
 
 type CircleSpec struct {
-	Center       *msgpack.RawMessage `gorm:"center" json:"center" msgpack:"center"`
+	ProjectID    string              `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	Center       LatLng              `gorm:"center" json:"center" msgpack:"center"`
 	RadiusMeters uint                `gorm:"radius_meters" json:"radius_meters" msgpack:"radius_meters"`
 	Name         string              `gorm:"name" json:"name" msgpack:"name"`
 	Styles       *msgpack.RawMessage `gorm:"styles" json:"styles" msgpack:"styles"`
+	Properties   FeatureProperties   `gorm:"properties" json:"properties,omitempty" msgpack:"properties,omitempty"`
 }
 
 type CircleInfo struct {
@@ -23,13 +27,31 @@ func (CircleInfo) TableName() string {
 	return "circles"
 }
 
-func createCircle(s *Server, u *UserInfo, payload []byte) (any, error) {
+// validate checks that a circle has a real center and a radius.
+func (spec *CircleSpec) validate() error {
+	if !spec.Center.valid() {
+		return invalidGeometry("[%v, %v] is not a valid latitude and longitude", spec.Center.Lat, spec.Center.Lng)
+	}
+	if spec.RadiusMeters == 0 {
+		return invalidGeometry("a circle must have a radius")
+	}
+	return nil
+}
+
+func createCircle(s *Server, u *UserConn, payload []byte) (any, error) {
 	var spec CircleSpec
 	if err := msgpack.Unmarshal(payload, &spec); err != nil {
 		// TODO
 		return nil, err
 	}
 
+	if err := requireProject(s.Database, spec.ProjectID); err != nil {
+		return nil, err
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
 	id, err := uuid.NewRandom()
 	if err != nil {
 		// TODO
@@ -43,10 +65,91 @@ func createCircle(s *Server, u *UserInfo, payload []byte) (any, error) {
 		return nil, err
 	}
 
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "circle:created", Data: info})
+
 	return info, nil
 }
 
-func deleteCircle(s *Server, u *UserInfo, payload []byte) (any, error) {
+func modifyCircle(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to modify the ID or project of the circle, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	circle := CircleInfo{ID: id}
+	if err := s.Database.Take(&circle).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrorWithCode{
+				Code:    "circle-not-found",
+				Message: fmt.Sprintf("there is no circle with ID %q", id),
+				Details: id,
+			}
+		}
+		// TODO
+		return nil, err
+	}
+
+	changes := map[string]any{}
+
+	if radius, ok := toUint(untrustedChanges["radius_meters"]); ok {
+		changes["radius_meters"] = radius
+		circle.RadiusMeters = radius
+	}
+	if name, ok := untrustedChanges["name"].(string); ok {
+		changes["name"] = name
+		circle.Name = name
+	}
+	if val, present := untrustedChanges["center"]; present {
+		var center LatLng
+		if err := convertValue(val, &center); err != nil {
+			return nil, invalidGeometry("center must be a [lat, lng] pair")
+		}
+		changes["center"] = center
+		circle.Center = center
+	}
+	if val, present := untrustedChanges["styles"]; present {
+		raw, err := toRawMessage(val)
+		if err != nil {
+			// TODO
+			return nil, err
+		}
+		changes["styles"] = raw
+		circle.Styles = raw
+	}
+	if val, present := untrustedChanges["properties"]; present {
+		var props FeatureProperties
+		if err := convertValue(val, &props); err != nil {
+			return nil, &ErrorWithCode{Code: "invalid-properties", Message: "properties must be a map"}
+		}
+		changes["properties"] = props
+		circle.Properties = props
+	}
+
+	if err := circle.validate(); err != nil {
+		return nil, err
+	}
+
+	if len(changes) > 0 {
+		if err := s.Database.Model(&circle).Updates(changes).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: circle.ProjectID, Type: "circle:modified", Data: circle})
+
+	return circle, nil
+}
+
+func deleteCircle(s *Server, u *UserConn, payload []byte) (any, error) {
 	var id string
 	if err := msgpack.Unmarshal(payload, &id); err != nil {
 		// TODO
@@ -58,10 +161,22 @@ func deleteCircle(s *Server, u *UserInfo, payload []byte) (any, error) {
 		return nil, errors.New("a non-empty string ID must be supplied")
 	}
 
+	// Look up the project first so we know who to notify
+	var circle CircleInfo
+	if err := s.Database.Select("project_id").Take(&circle, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
+		// TODO
+		return nil, err
+	}
+
 	if err := s.Database.Delete(&CircleInfo{}, "id = ?", id).Error; err != nil {
 		// TODO
 		return nil, err
 	}
 
+	s.publish(u, ProjectEvent{ProjectID: circle.ProjectID, Type: "circle:deleted", Data: id})
+
 	return nil, nil
 }
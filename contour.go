@@ -0,0 +1,431 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// MaxFieldCells limits the size of the grids used to compute buffers, isochrones and
+	// similar areas. Large areas get coarser cells instead of more of them.
+	MaxFieldCells = 4_000_000
+	// fieldCellsPerRadius is how many grid cells span the smallest disc of a field, which
+	// decides how faithfully its edges are traced.
+	fieldCellsPerRadius = 16
+)
+
+// localProjection maps coordinates to meters east (x) and north (y) of an origin. It is an
+// equirectangular projection, which is accurate enough at the scale of a city.
+type localProjection struct {
+	origin LatLng
+	kx, ky float64
+}
+
+func newLocalProjection(origin LatLng) localProjection {
+	ky := EarthRadius * math.Pi / 180
+	return localProjection{origin, ky * math.Cos(origin.Lat*math.Pi/180), ky}
+}
+
+func (p localProjection) toXY(c LatLng) (x, y float64) {
+	return (c.Lng - p.origin.Lng) * p.kx, (c.Lat - p.origin.Lat) * p.ky
+}
+
+func (p localProjection) toLatLng(x, y float64) LatLng {
+	return LatLng{p.origin.Lat + y/p.ky, p.origin.Lng + x/p.kx}
+}
+
+// disc is a circle on the ground with its radius in meters.
+type disc struct {
+	Center LatLng
+	Radius float64
+}
+
+// discField is a grid of signed distances to the union of a set of discs: negative inside,
+// positive outside. Tracing where it crosses zero dissolves all the discs into polygons.
+type discField struct {
+	proj   localProjection
+	x0, y0 float64
+	cell   float64
+	nx, ny int
+	values []float32
+}
+
+// newDiscField computes the field for a set of discs. It returns nil if there are no discs
+// with a positive radius.
+func newDiscField(discs []disc) *discField {
+	var (
+		minR, maxR             = math.Inf(1), 0.0
+		sumLat, sumLng         float64
+		count                  int
+		minX, minY, maxX, maxY = math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	)
+
+	for _, d := range discs {
+		if d.Radius <= 0 {
+			continue
+		}
+		sumLat += d.Center.Lat
+		sumLng += d.Center.Lng
+		count++
+		minR = math.Min(minR, d.Radius)
+		maxR = math.Max(maxR, d.Radius)
+	}
+	if count == 0 {
+		return nil
+	}
+
+	g := &discField{proj: newLocalProjection(LatLng{sumLat / float64(count), sumLng / float64(count)})}
+
+	for _, d := range discs {
+		if d.Radius <= 0 {
+			continue
+		}
+		x, y := g.proj.toXY(d.Center)
+		minX, maxX = math.Min(minX, x-d.Radius), math.Max(maxX, x+d.Radius)
+		minY, maxY = math.Min(minY, y-d.Radius), math.Max(maxY, y+d.Radius)
+	}
+
+	// Pick the cell size, then pad the grid so that the outermost nodes are always outside
+	g.cell = minR / fieldCellsPerRadius
+	for {
+		g.nx = int(math.Ceil((maxX-minX)/g.cell)) + 5
+		g.ny = int(math.Ceil((maxY-minY)/g.cell)) + 5
+		if g.nx*g.ny <= MaxFieldCells {
+			break
+		}
+		g.cell *= math.Sqrt(float64(g.nx*g.ny) / MaxFieldCells * 1.05)
+	}
+	g.x0, g.y0 = minX-2*g.cell, minY-2*g.cell
+
+	g.values = make([]float32, g.nx*g.ny)
+	for i := range g.values {
+		g.values[i] = float32(maxR)
+	}
+
+	for _, d := range discs {
+		if d.Radius <= 0 {
+			continue
+		}
+		cx, cy := g.proj.toXY(d.Center)
+		reach := d.Radius + 2*g.cell
+
+		i0, i1 := g.clampX(cx-reach), g.clampX(cx+reach)
+		j0, j1 := g.clampY(cy-reach), g.clampY(cy+reach)
+
+		for j := j0; j <= j1; j++ {
+			dy := g.y0 + float64(j)*g.cell - cy
+			row := g.values[j*g.nx : (j+1)*g.nx]
+			for i := i0; i <= i1; i++ {
+				dx := g.x0 + float64(i)*g.cell - cx
+				if v := float32(math.Hypot(dx, dy) - d.Radius); v < row[i] {
+					row[i] = v
+				}
+			}
+		}
+	}
+
+	return g
+}
+
+func (g *discField) clampX(x float64) int {
+	return clampInt(int(math.Floor((x-g.x0)/g.cell)), 0, g.nx-1)
+}
+
+func (g *discField) clampY(y float64) int {
+	return clampInt(int(math.Floor((y-g.y0)/g.cell)), 0, g.ny-1)
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// contains reports whether a coordinate is inside the union of the discs, interpolating
+// between grid nodes.
+func (g *discField) contains(c LatLng) bool {
+	return g.containsXY(g.proj.toXY(c))
+}
+
+// containsXY is like contains, but takes a point that has already been projected.
+func (g *discField) containsXY(x, y float64) bool {
+	fx, fy := (x-g.x0)/g.cell, (y-g.y0)/g.cell
+	if fx < 0 || fy < 0 || fx >= float64(g.nx-1) || fy >= float64(g.ny-1) {
+		return false
+	}
+
+	i, j := int(fx), int(fy)
+	tx, ty := fx-float64(i), fy-float64(j)
+	v00, v10 := float64(g.values[j*g.nx+i]), float64(g.values[j*g.nx+i+1])
+	v01, v11 := float64(g.values[(j+1)*g.nx+i]), float64(g.values[(j+1)*g.nx+i+1])
+
+	v := (v00*(1-tx)+v10*tx)*(1-ty) + (v01*(1-tx)+v11*tx)*ty
+	return v < 0
+}
+
+// contourSegment is a piece of the zero contour within a single grid cell. Its ends are
+// identified by the grid edge they lie on, which is how segments are chained into rings.
+type contourSegment struct {
+	fromEdge, toEdge int
+	from             [2]float64
+}
+
+// polygons traces the boundary of the union of the discs with marching squares and returns
+// it as polygons with holes. Rings are simplified so that straight stretches of the boundary
+// do not carry a vertex per grid cell.
+func (g *discField) polygons() MultiPolygon {
+	segments := map[int]contourSegment{}
+
+	// Corners and edges of a cell in counter-clockwise order, starting at the bottom left
+	cornerDI := [4]int{0, 1, 1, 0}
+	cornerDJ := [4]int{0, 0, 1, 1}
+
+	for j := 0; j < g.ny-1; j++ {
+		for i := 0; i < g.nx-1; i++ {
+			var vals [4]float64
+			mask := 0
+			for k := 0; k < 4; k++ {
+				vals[k] = float64(g.values[(j+cornerDJ[k])*g.nx+i+cornerDI[k]])
+				if vals[k] < 0 {
+					mask |= 1 << k
+				}
+			}
+			if mask == 0 || mask == 15 {
+				continue
+			}
+
+			// Find the crossings walking counter-clockwise around the cell. Leaving the
+			// inside is an exit, coming back is an entry.
+			type crossing struct {
+				edge int
+				pt   [2]float64
+				exit bool
+			}
+			var crossings []crossing
+
+			for k := 0; k < 4; k++ {
+				a, b := k, (k+1)%4
+				if (vals[a] < 0) == (vals[b] < 0) {
+					continue
+				}
+				t := vals[a] / (vals[a] - vals[b])
+				ax, ay := float64(i+cornerDI[a]), float64(j+cornerDJ[a])
+				bx, by := float64(i+cornerDI[b]), float64(j+cornerDJ[b])
+				crossings = append(crossings, crossing{
+					edge: g.edgeKey(i, j, k),
+					pt:   [2]float64{ax + t*(bx-ax), ay + t*(by-ay)},
+					exit: vals[a] < 0,
+				})
+			}
+
+			// With the inside on the left, the contour runs from each exit to an entry. In
+			// the ambiguous saddle cases, the average of the corners decides whether the
+			// inside corners are connected through the middle of the cell.
+			connected := false
+			if len(crossings) == 4 {
+				connected = (vals[0]+vals[1]+vals[2]+vals[3])/4 < 0
+			}
+			n := len(crossings)
+			for k, c := range crossings {
+				if !c.exit {
+					continue
+				}
+				var entry crossing
+				if connected {
+					entry = crossings[(k+1)%n]
+				} else {
+					entry = crossings[(k+n-1)%n]
+				}
+				segments[c.edge] = contourSegment{c.edge, entry.edge, c.pt}
+			}
+		}
+	}
+
+	// Chain the segments into rings, then sort the rings into outer boundaries and holes
+	var outers, holes [][][2]float64
+	for len(segments) > 0 {
+		var start int
+		for start = range segments {
+			break
+		}
+
+		var ring [][2]float64
+		for edge := start; ; {
+			seg, ok := segments[edge]
+			if !ok {
+				break
+			}
+			delete(segments, edge)
+			ring = append(ring, [2]float64{g.x0 + seg.from[0]*g.cell, g.y0 + seg.from[1]*g.cell})
+			edge = seg.toEdge
+		}
+		if len(ring) < 3 {
+			continue
+		}
+
+		ring = simplifyRing(ring, g.cell/8)
+		if signedArea(ring) > 0 {
+			outers = append(outers, ring)
+		} else {
+			holes = append(holes, ring)
+		}
+	}
+
+	polys := make([][][][2]float64, len(outers))
+	for i, outer := range outers {
+		polys[i] = [][][2]float64{outer}
+	}
+	for _, hole := range holes {
+		// A hole belongs to the smallest outer ring that contains it
+		best, bestArea := -1, math.Inf(1)
+		for i, outer := range outers {
+			if a := signedArea(outer); a < bestArea && pointInRing(hole[0], outer) {
+				best, bestArea = i, a
+			}
+		}
+		if best >= 0 {
+			polys[best] = append(polys[best], hole)
+		}
+	}
+
+	result := make(MultiPolygon, len(polys))
+	for i, rings := range polys {
+		result[i] = make(Polygon, len(rings))
+		for r, ring := range rings {
+			coords := make([]LatLng, len(ring))
+			for k, pt := range ring {
+				coords[k] = g.proj.toLatLng(pt[0], pt[1])
+			}
+			result[i][r] = coords
+		}
+	}
+	return result
+}
+
+// edgeKey identifies the k-th edge (counter-clockwise from the bottom) of cell (i, j) so that
+// neighboring cells agree on the key of their shared edge.
+func (g *discField) edgeKey(i, j, k int) int {
+	switch k {
+	case 0: // bottom
+		return 2 * (j*g.nx + i)
+	case 1: // right
+		return 2*(j*g.nx+i+1) + 1
+	case 2: // top
+		return 2 * ((j+1)*g.nx + i)
+	default: // left
+		return 2*(j*g.nx+i) + 1
+	}
+}
+
+// area returns the area of the union of the discs in square meters, which is the area of the
+// outer rings minus that of the holes.
+func (mp MultiPolygon) area() float64 {
+	total := 0.0
+	for _, poly := range mp {
+		for r, ring := range poly {
+			if len(ring) == 0 {
+				continue
+			}
+			proj := newLocalProjection(ring[0])
+			pts := make([][2]float64, len(ring))
+			for k, c := range ring {
+				pts[k][0], pts[k][1] = proj.toXY(c)
+			}
+			if a := math.Abs(signedArea(pts)); r == 0 {
+				total += a
+			} else {
+				total -= a
+			}
+		}
+	}
+	return total
+}
+
+// signedArea returns the area of a ring, positive if it is counter-clockwise.
+func signedArea(ring [][2]float64) float64 {
+	sum := 0.0
+	for i := range ring {
+		a, b := ring[i], ring[(i+1)%len(ring)]
+		sum += a[0]*b[1] - b[0]*a[1]
+	}
+	return sum / 2
+}
+
+// pointInRing is the usual even-odd ray casting test.
+func pointInRing(p [2]float64, ring [][2]float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
+
+// simplifyRing drops vertices that are within tolerance of the line between their neighbors
+// (Douglas-Peucker). The ring is split at its first vertex and the vertex farthest from it.
+func simplifyRing(ring [][2]float64, tolerance float64) [][2]float64 {
+	if len(ring) < 4 {
+		return ring
+	}
+
+	far, farDist := 0, -1.0
+	for i, p := range ring {
+		if d := math.Hypot(p[0]-ring[0][0], p[1]-ring[0][1]); d > farDist {
+			far, farDist = i, d
+		}
+	}
+
+	keep := make([]bool, len(ring))
+	keep[0], keep[far] = true, true
+
+	closed := append(append([][2]float64{}, ring...), ring[0])
+	simplifyRun(closed, 0, far, tolerance, keep)
+	simplifyRun(closed, far, len(ring), tolerance, keep)
+
+	out := make([][2]float64, 0, len(ring)/4)
+	for i, k := range keep {
+		if k {
+			out = append(out, ring[i])
+		}
+	}
+	if len(out) < 3 {
+		return ring
+	}
+	return out
+}
+
+func simplifyRun(pts [][2]float64, lo, hi int, tolerance float64, keep []bool) {
+	if hi-lo < 2 {
+		return
+	}
+
+	a, b := pts[lo], pts[hi]
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	length := math.Hypot(dx, dy)
+
+	worst, worstDist := -1, tolerance
+	for i := lo + 1; i < hi; i++ {
+		p := pts[i]
+		var d float64
+		if length == 0 {
+			d = math.Hypot(p[0]-a[0], p[1]-a[1])
+		} else {
+			d = math.Abs(dx*(a[1]-p[1])-dy*(a[0]-p[0])) / length
+		}
+		if d > worstDist {
+			worst, worstDist = i, d
+		}
+	}
+
+	if worst < 0 {
+		return
+	}
+	keep[worst] = true
+	simplifyRun(pts, lo, worst, tolerance, keep)
+	simplifyRun(pts, worst, hi, tolerance, keep)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// CostModelInfo holds the operating cost parameters of a project. Hourly and per-mile costs
+// apply to revenue service. CostPerVehicle is the annual cost of each vehicle needed to run
+// a route at its peak, and FixedOverhead is the project's annual overhead, which is shared
+// among routes by revenue hours.
+type CostModelInfo struct {
+	ProjectID          string  `gorm:"primaryKey" json:"project_id" msgpack:"project_id"`
+	CostPerRevenueHour float64 `gorm:"cost_per_revenue_hour" json:"cost_per_revenue_hour" msgpack:"cost_per_revenue_hour"`
+	CostPerRevenueMile float64 `gorm:"cost_per_revenue_mile" json:"cost_per_revenue_mile" msgpack:"cost_per_revenue_mile"`
+	CostPerVehicle     float64 `gorm:"cost_per_vehicle" json:"cost_per_vehicle" msgpack:"cost_per_vehicle"`
+	FixedOverhead      float64 `gorm:"fixed_overhead" json:"fixed_overhead" msgpack:"fixed_overhead"`
+}
+
+func (CostModelInfo) TableName() string {
+	return "cost_models"
+}
+
+// PeriodCost is the revenue service and cost of a route (or a whole project) over some
+// period.
+type PeriodCost struct {
+	RevenueHours float64 `msgpack:"revenue_hours"`
+	RevenueMiles float64 `msgpack:"revenue_miles"`
+	Cost         float64 `msgpack:"cost"`
+	CostPerHour  float64 `msgpack:"cost_per_hour"`
+}
+
+// RouteCost is the cost of a single route. Daily figures are for an average weekday.
+type RouteCost struct {
+	RouteID      string     `msgpack:"route_id"`
+	Name         string     `msgpack:"name"`
+	PeakVehicles int        `msgpack:"peak_vehicles"`
+	Daily        PeriodCost `msgpack:"daily"`
+	Weekly       PeriodCost `msgpack:"weekly"`
+	Annual       PeriodCost `msgpack:"annual"`
+}
+
+// CostEstimate is the reply to a 'cost:estimate' request.
+type CostEstimate struct {
+	ProjectID string        `msgpack:"project_id"`
+	Model     CostModelInfo `msgpack:"model"`
+	Routes    []RouteCost   `msgpack:"routes"`
+	Totals    RouteCost     `msgpack:"totals"`
+}
+
+// takeCostModel fetches the cost model of a project. Projects that never had one get all
+// zeroes.
+func takeCostModel(db *gorm.DB, projectID string) (CostModelInfo, error) {
+	model := CostModelInfo{ProjectID: projectID}
+	if err := db.Take(&model).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return model, err
+	}
+	return model, nil
+}
+
+func getCostModel(s *Server, u *UserConn, payload []byte) (any, error) {
+	var projectID string
+	if err := msgpack.Unmarshal(payload, &projectID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, projectID); err != nil {
+		return nil, err
+	}
+
+	return takeCostModel(s.Database, projectID)
+}
+
+func setCostModel(s *Server, u *UserConn, payload []byte) (any, error) {
+	var model CostModelInfo
+	if err := msgpack.Unmarshal(payload, &model); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, model.ProjectID); err != nil {
+		return nil, err
+	}
+	if model.CostPerRevenueHour < 0 || model.CostPerRevenueMile < 0 ||
+		model.CostPerVehicle < 0 || model.FixedOverhead < 0 {
+		// TODO
+		return nil, errors.New("costs cannot be negative")
+	}
+
+	if err := s.Database.Save(&model).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: model.ProjectID, Type: "cost_model:modified", Data: model})
+
+	return model, nil
+}
+
+// estimateCosts works out the revenue hours, miles and cost of every route in a project from
+// its schedule and service calendars.
+func estimateCosts(s *Server, u *UserConn, payload []byte) (any, error) {
+	var projectID string
+	if err := msgpack.Unmarshal(payload, &projectID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, projectID); err != nil {
+		return nil, err
+	}
+
+	return computeCostEstimate(s.Database, projectID)
+}
+
+// computeCostEstimate works out the cost of every route in a project and their totals.
+func computeCostEstimate(db *gorm.DB, projectID string) (*CostEstimate, error) {
+	model, err := takeCostModel(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceDays, err := loadServiceDays(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []RouteInfo
+	if err := db.Find(&routes, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	sort.Slice(routes, func(i, j int) bool { return routeLabel(routes[i]) < routeLabel(routes[j]) })
+
+	estimate := CostEstimate{ProjectID: projectID, Model: model, Routes: []RouteCost{}}
+
+	for _, route := range routes {
+		stats, err := computeRouteStats(db, route.ID, DefaultLayoverRatio, DefaultMinLayover)
+		if err != nil {
+			return nil, err
+		}
+
+		rc := RouteCost{RouteID: route.ID, Name: routeLabel(route), PeakVehicles: stats.PeakVehicles}
+
+		for _, ss := range stats.Services {
+			days := serviceDays[ss.ServiceID]
+			hours := float64(ss.RevenueTime) / 3600
+			miles := ss.RevenueDistance / MetersPerMile
+
+			for wd := time.Sunday; wd <= time.Saturday; wd++ {
+				if !days.Weekdays[wd] {
+					continue
+				}
+				rc.Weekly.RevenueHours += hours
+				rc.Weekly.RevenueMiles += miles
+				if wd != time.Saturday && wd != time.Sunday {
+					rc.Daily.RevenueHours += hours / 5
+					rc.Daily.RevenueMiles += miles / 5
+				}
+			}
+
+			rc.Annual.RevenueHours += hours * days.AnnualDays
+			rc.Annual.RevenueMiles += miles * days.AnnualDays
+		}
+
+		estimate.Routes = append(estimate.Routes, rc)
+		estimate.Totals.PeakVehicles += rc.PeakVehicles
+		estimate.Totals.Annual.RevenueHours += rc.Annual.RevenueHours
+	}
+
+	// Vehicle and overhead costs are annual, so each period gets a share of them proportional
+	// to its revenue hours
+	totalAnnualHours := estimate.Totals.Annual.RevenueHours
+	estimate.Totals = RouteCost{Name: "Total", PeakVehicles: estimate.Totals.PeakVehicles}
+
+	for i := range estimate.Routes {
+		rc := &estimate.Routes[i]
+
+		fixed := model.CostPerVehicle * float64(rc.PeakVehicles)
+		if totalAnnualHours > 0 {
+			fixed += model.FixedOverhead * rc.Annual.RevenueHours / totalAnnualHours
+		}
+
+		for _, pc := range []*PeriodCost{&rc.Daily, &rc.Weekly, &rc.Annual} {
+			pc.Cost = pc.RevenueHours*model.CostPerRevenueHour + pc.RevenueMiles*model.CostPerRevenueMile
+			if rc.Annual.RevenueHours > 0 {
+				pc.Cost += fixed * pc.RevenueHours / rc.Annual.RevenueHours
+			}
+			if pc.RevenueHours > 0 {
+				pc.CostPerHour = pc.Cost / pc.RevenueHours
+			}
+		}
+
+		addPeriodCost(&estimate.Totals.Daily, rc.Daily)
+		addPeriodCost(&estimate.Totals.Weekly, rc.Weekly)
+		addPeriodCost(&estimate.Totals.Annual, rc.Annual)
+	}
+
+	for _, pc := range []*PeriodCost{&estimate.Totals.Daily, &estimate.Totals.Weekly, &estimate.Totals.Annual} {
+		if pc.RevenueHours > 0 {
+			pc.CostPerHour = pc.Cost / pc.RevenueHours
+		}
+	}
+
+	return &estimate, nil
+}
+
+func addPeriodCost(total *PeriodCost, pc PeriodCost) {
+	total.RevenueHours += pc.RevenueHours
+	total.RevenueMiles += pc.RevenueMiles
+	total.Cost += pc.Cost
+}
+
+// loadServiceDays counts the service days of every service in a project.
+func loadServiceDays(db *gorm.DB, projectID string) (map[string]ServiceDays, error) {
+	var calendars []CalendarInfo
+	if err := db.Find(&calendars, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	var exceptions []CalendarDateInfo
+	if err := db.Find(&exceptions, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+
+	exceptionsByService := map[string][]CalendarDateInfo{}
+	for _, ex := range exceptions {
+		exceptionsByService[ex.ServiceID] = append(exceptionsByService[ex.ServiceID], ex)
+	}
+
+	days := make(map[string]ServiceDays, len(calendars))
+	for _, cal := range calendars {
+		days[cal.ID] = countServiceDays(cal, exceptionsByService[cal.ID])
+	}
+	return days, nil
+}
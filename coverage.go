@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// coverageSamplesPerDistance is how many sample points span the buffer distance when
+	// apportioning areas, which decides how precisely partially-covered areas are split.
+	coverageSamplesPerDistance = 10
+	// maxCoverageSamplesPerArea limits the sample points of a single (large, rural) area; such
+	// areas are sampled more coarsely instead.
+	maxCoverageSamplesPerArea = 20_000
+)
+
+// CoverageRequest is the payload of a 'demographics:coverage' request. Distance is the walk
+// buffer around each stop in meters, and defaults to a quarter mile. If Network is set, the
+// buffers are walksheds along the pedestrian street network instead of circles.
+type CoverageRequest struct {
+	StopSelection `msgpack:",inline"`
+	LayerID       string  `msgpack:"layer_id"`
+	Distance      float64 `msgpack:"distance"`
+	Network       bool    `msgpack:"network"`
+}
+
+// StopCoverage is what lies within the buffer distance of a single stop. Nearby stops share
+// people, so these do not add up to the totals.
+type StopCoverage struct {
+	StopID            string `msgpack:"stop_id"`
+	DemographicCounts `msgpack:",inline"`
+}
+
+// CoverageResult is the reply to a 'demographics:coverage' request. Areas that are only
+// partially covered by the buffers contribute in proportion to how much of their area is
+// covered, which assumes people and jobs are spread evenly within each area. Area is the
+// size of the dissolved buffers in square meters, and Areas is the number of Census areas
+// they touch. With network walksheds, Unsnapped lists the stops too far from any walkable
+// street to cover anything.
+type CoverageResult struct {
+	LayerID   string            `msgpack:"layer_id"`
+	Distance  float64           `msgpack:"distance"`
+	Network   bool              `msgpack:"network"`
+	Area      float64           `msgpack:"area"`
+	Areas     int               `msgpack:"areas"`
+	Totals    DemographicCounts `msgpack:"totals"`
+	Stops     []StopCoverage    `msgpack:"stops"`
+	Unsnapped []string          `msgpack:"unsnapped,omitempty"`
+}
+
+// coverageSample is a point within a Census area standing in for an equal share of it.
+type coverageSample struct {
+	x, y  float64
+	area  int
+	share float64
+}
+
+func demographicCoverage(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req CoverageRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if req.Distance == 0 {
+		req.Distance = DefaultBufferDistances[0]
+	}
+	if req.Distance < 0 {
+		// TODO
+		return nil, errors.New("buffer distance must be positive")
+	}
+
+	if err := requireDemographicLayer(s.Database, req.LayerID); err != nil {
+		return nil, err
+	}
+	stops, err := selectStops(s.Database, req.StopSelection)
+	if err != nil {
+		return nil, err
+	}
+
+	result := CoverageResult{
+		LayerID:  req.LayerID,
+		Distance: req.Distance,
+		Network:  req.Network,
+		Stops:    make([]StopCoverage, len(stops)),
+	}
+	for i, stop := range stops {
+		result.Stops[i].StopID = stop.ID
+	}
+
+	// Circles reach exactly the distance; walksheds reach a little further, by their buffer
+	var field *discField
+	var graph *streetGraph
+	var sources []streetPos
+	reach := req.Distance
+	if req.Network {
+		reach += DefaultWalkshedBuffer
+		graph, sources, err = loadWalkGraph(s, stops, reach)
+		if err != nil {
+			return nil, err
+		}
+
+		var snapped []streetPos
+		for i, pos := range sources {
+			if pos.Edge < 0 {
+				result.Unsnapped = append(result.Unsnapped, stops[i].ID)
+			} else {
+				snapped = append(snapped, pos)
+			}
+		}
+		field = newDiscField(graph.walkshedDiscs(snapped, req.Distance, DefaultWalkshedBuffer))
+	} else {
+		field = newDiscField(stopDiscs(stops, req.Distance))
+	}
+	if field == nil {
+		return result, nil
+	}
+	result.Area = field.polygons().area()
+
+	// Find the areas that might be covered
+	sw := field.proj.toLatLng(field.x0, field.y0)
+	ne := field.proj.toLatLng(field.x0+float64(field.nx)*field.cell, field.y0+float64(field.ny)*field.cell)
+
+	var areas []DemographicAreaInfo
+	err = s.Database.
+		Where("layer_id = ? AND geometry IS NOT NULL", req.LayerID).
+		Where("max_lat >= ? AND min_lat <= ? AND max_lng >= ? AND min_lng <= ?", sw.Lat, ne.Lat, sw.Lng, ne.Lng).
+		Find(&areas).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Scatter samples over every area, then see which of them the buffers cover
+	var samples []coverageSample
+	for i := range areas {
+		polys, err := areas[i].polygons()
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sampleArea(field.proj, polys, i, req.Distance/coverageSamplesPerDistance)...)
+	}
+
+	covered := make([]float64, len(areas))
+	for _, smp := range samples {
+		if field.containsXY(smp.x, smp.y) {
+			covered[smp.area] += smp.share
+		}
+	}
+	for i, fraction := range covered {
+		if fraction > 0 {
+			result.Areas++
+			result.Totals.add(areas[i].DemographicCounts, math.Min(fraction, 1))
+		}
+	}
+
+	// Per stop, bucket the samples so each stop only looks at the ones nearby
+	buckets := map[[2]int][]int{}
+	bucketOf := func(x, y float64) [2]int {
+		return [2]int{int(math.Floor(x / reach)), int(math.Floor(y / reach))}
+	}
+	for i, smp := range samples {
+		b := bucketOf(smp.x, smp.y)
+		buckets[b] = append(buckets[b], i)
+	}
+
+	for si, stop := range stops {
+		cx, cy := field.proj.toXY(LatLng{stop.Lat, stop.Lng})
+		covers := func(x, y float64) bool {
+			return math.Hypot(x-cx, y-cy) <= req.Distance
+		}
+		if req.Network {
+			if sources[si].Edge < 0 {
+				continue
+			}
+			walkshed := newDiscField(graph.walkshedDiscs(sources[si:si+1], req.Distance, DefaultWalkshedBuffer))
+			if walkshed == nil {
+				continue
+			}
+			covers = func(x, y float64) bool {
+				return walkshed.contains(field.proj.toLatLng(x, y))
+			}
+		}
+
+		center := bucketOf(cx, cy)
+		fractions := map[int]float64{}
+
+		for dx := -1; dx <= 1; dx++ {
+			for dy := -1; dy <= 1; dy++ {
+				for _, i := range buckets[[2]int{center[0] + dx, center[1] + dy}] {
+					smp := samples[i]
+					if covers(smp.x, smp.y) {
+						fractions[smp.area] += smp.share
+					}
+				}
+			}
+		}
+
+		for area, fraction := range fractions {
+			result.Stops[si].add(areas[area].DemographicCounts, math.Min(fraction, 1))
+		}
+	}
+
+	return result, nil
+}
+
+// sampleArea scatters sample points over a grid within an area, each standing in for an
+// equal share of it. Areas too small to catch a single grid point get one sample at the
+// middle of their first ring.
+func sampleArea(proj localProjection, polys MultiPolygon, area int, step float64) []coverageSample {
+	rings := make([][][][2]float64, len(polys))
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+
+	for p, poly := range polys {
+		rings[p] = make([][][2]float64, len(poly))
+		for r, ring := range poly {
+			pts := make([][2]float64, len(ring))
+			for k, c := range ring {
+				x, y := proj.toXY(c)
+				pts[k] = [2]float64{x, y}
+				minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+				minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+			}
+			rings[p][r] = pts
+		}
+	}
+	if math.IsInf(minX, 0) {
+		return nil
+	}
+
+	if cells := (maxX - minX) * (maxY - minY) / (step * step); cells > maxCoverageSamplesPerArea {
+		step *= math.Sqrt(cells / maxCoverageSamplesPerArea)
+	}
+
+	inside := func(x, y float64) bool {
+		for _, poly := range rings {
+			in := false
+			for _, ring := range poly {
+				if pointInRing([2]float64{x, y}, ring) {
+					in = !in
+				}
+			}
+			if in {
+				return true
+			}
+		}
+		return false
+	}
+
+	var samples []coverageSample
+	for y := minY + step/2; y < maxY; y += step {
+		for x := minX + step/2; x < maxX; x += step {
+			if inside(x, y) {
+				samples = append(samples, coverageSample{x: x, y: y, area: area})
+			}
+		}
+	}
+
+	if len(samples) == 0 {
+		sx, sy := 0.0, 0.0
+		first := rings[0][0]
+		for _, pt := range first {
+			sx, sy = sx+pt[0], sy+pt[1]
+		}
+		samples = append(samples, coverageSample{x: sx / float64(len(first)), y: sy / float64(len(first)), area: area})
+	}
+
+	for i := range samples {
+		samples[i].share = 1 / float64(len(samples))
+	}
+	return samples
+}
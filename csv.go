@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"strings"
+)
+
+// csvTable is a CSV file with a header row, read entirely into memory. Columns are looked up
+// by name so that files with extra, missing, or reordered columns can still be read.
+type csvTable struct {
+	columns map[string]int
+	rows    [][]string
+}
+
+// readCSV reads an entire CSV file. A leading UTF-8 byte order mark and whitespace around
+// column names are ignored, and rows may have differing numbers of fields.
+func readCSV(r io.Reader) (*csvTable, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.ReuseRecord = false
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return &csvTable{columns: map[string]int{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := &csvTable{columns: make(map[string]int, len(header))}
+	for i, name := range header {
+		t.columns[strings.TrimSpace(name)] = i
+	}
+
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.rows = append(t.rows, row)
+	}
+
+	return t, nil
+}
+
+// has reports whether the table has a column with the given name.
+func (t *csvTable) has(column string) bool {
+	_, ok := t.columns[column]
+	return ok
+}
+
+// get returns the trimmed value of a column in a row, or an empty string if the table has
+// no such column or the row is too short.
+func (t *csvTable) get(row []string, column string) string {
+	i, ok := t.columns[column]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// line returns the 1-based line number of the i'th row, assuming no quoted newlines.
+func (t *csvTable) line(i int) int {
+	return i + 2
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		columns map[string]int
+		rows    [][]string
+	}{
+		{
+			name:    "empty file",
+			input:   "",
+			columns: map[string]int{},
+		},
+		{
+			name:    "header only",
+			input:   "stop_id,stop_name\n",
+			columns: map[string]int{"stop_id": 0, "stop_name": 1},
+		},
+		{
+			name:    "byte order mark and padded column names",
+			input:   "\xef\xbb\xbf stop_id , stop_name\r\nS1,Main St\r\n",
+			columns: map[string]int{"stop_id": 0, "stop_name": 1},
+			rows:    [][]string{{"S1", "Main St"}},
+		},
+		{
+			name:    "rows of differing lengths",
+			input:   "a,b,c\n1\n1,2,3,4\n",
+			columns: map[string]int{"a": 0, "b": 1, "c": 2},
+			rows:    [][]string{{"1"}, {"1", "2", "3", "4"}},
+		},
+		{
+			name:    "quoted fields",
+			input:   "a,b\n\"x, y\",\"say \"\"hi\"\"\"\n",
+			columns: map[string]int{"a": 0, "b": 1},
+			rows:    [][]string{{"x, y", `say "hi"`}},
+		},
+		{
+			name:    "stray quote in an unquoted field",
+			input:   "a,b\n5\" pole,x\n",
+			columns: map[string]int{"a": 0, "b": 1},
+			rows:    [][]string{{`5" pole`, "x"}},
+		},
+		{
+			name:    "unterminated quote runs to the end of the file",
+			input:   "a,b\n\"x,y\n",
+			columns: map[string]int{"a": 0, "b": 1},
+			rows:    [][]string{{"x,y\n"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := readCSV(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(table.columns, tt.columns) {
+				t.Errorf("columns = %v, want %v", table.columns, tt.columns)
+			}
+			if !reflect.DeepEqual(table.rows, tt.rows) {
+				t.Errorf("rows = %q, want %q", table.rows, tt.rows)
+			}
+		})
+	}
+}
+
+func TestReadCSVReadError(t *testing.T) {
+	if _, err := readCSV(iotest.ErrReader(errors.New("broken"))); err == nil {
+		t.Fatal("expected the read error to be returned")
+	}
+}
+
+func TestCSVTableGet(t *testing.T) {
+	table, err := readCSV(strings.NewReader("a,b,c\n x ,y\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := table.rows[0]
+
+	tests := []struct {
+		column string
+		want   string
+	}{
+		{"a", "x"},
+		{"b", "y"},
+		{"c", ""}, // row is too short
+		{"d", ""}, // no such column
+	}
+	for _, tt := range tests {
+		if got := table.get(row, tt.column); got != tt.want {
+			t.Errorf("get(%q) = %q, want %q", tt.column, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,807 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxDemographicImportErrors caps the number of problems reported by a single demographic
+	// upload.
+	MaxDemographicImportErrors = 50
+	// demographicInsertBatchSize is the number of areas written per statement.
+	demographicInsertBatchSize = 500
+)
+
+// DemographicLayerSpec defines user-configurable fields for demographic layers.
+type DemographicLayerSpec struct {
+	Name        string `gorm:"name" msgpack:"name"`
+	Description string `gorm:"description" msgpack:"description"`
+}
+
+// DemographicLayerInfo is a set of Census areas (usually block groups) with their
+// demographics. Layers are shared by every project. Admins build them by uploading TIGER
+// shapefiles for the geometry and ACS tables (or any other CSV keyed by GEOID) for the data,
+// in either order; the two are joined by GEOID.
+type DemographicLayerInfo struct {
+	DemographicLayerSpec
+	ID string `gorm:"primaryKey" msgpack:"id"`
+	// CreatedAt is a timestamp of when the layer was created.
+	CreatedAt uint64 `gorm:"created_at" msgpack:"created_at"`
+	// CreatedBy is the ID of the user that created the layer.
+	CreatedBy string `gorm:"created_by" msgpack:"created_by"`
+}
+
+func (DemographicLayerInfo) TableName() string {
+	return "demographic_layers"
+}
+
+// DemographicCounts are the people, households and jobs in an area. They are floats because
+// analyses apportion them to parts of areas.
+type DemographicCounts struct {
+	Population        float64 `gorm:"population" msgpack:"population"`
+	Households        float64 `gorm:"households" msgpack:"households"`
+	ZeroCarHouseholds float64 `gorm:"zero_car_households" msgpack:"zero_car_households"`
+	Minority          float64 `gorm:"minority" msgpack:"minority"`
+	LowIncome         float64 `gorm:"low_income" msgpack:"low_income"`
+	Seniors           float64 `gorm:"seniors" msgpack:"seniors"`
+	Youth             float64 `gorm:"youth" msgpack:"youth"`
+	Jobs              float64 `gorm:"jobs" msgpack:"jobs"`
+}
+
+// DemographicAttributes are the names (and column names) of the fields of DemographicCounts.
+var DemographicAttributes = []string{
+	"population", "households", "zero_car_households", "minority", "low_income", "seniors",
+	"youth", "jobs",
+}
+
+// field returns a pointer to the named count, or nil if there is no such count.
+func (c *DemographicCounts) field(name string) *float64 {
+	switch name {
+	case "population":
+		return &c.Population
+	case "households":
+		return &c.Households
+	case "zero_car_households":
+		return &c.ZeroCarHouseholds
+	case "minority":
+		return &c.Minority
+	case "low_income":
+		return &c.LowIncome
+	case "seniors":
+		return &c.Seniors
+	case "youth":
+		return &c.Youth
+	case "jobs":
+		return &c.Jobs
+	}
+	return nil
+}
+
+// add adds a fraction of other to the counts.
+func (c *DemographicCounts) add(other DemographicCounts, fraction float64) {
+	for _, name := range DemographicAttributes {
+		*c.field(name) += *other.field(name) * fraction
+	}
+}
+
+// DemographicAreaInfo is a single area of a demographic layer. Geometry is a
+// MessagePack-encoded MultiPolygon, and is empty for areas that only have data so far. The
+// bounds are kept in separate columns so areas near some location can be found quickly.
+// LandArea is in square meters.
+type DemographicAreaInfo struct {
+	LayerID  string  `gorm:"primaryKey"`
+	GEOID    string  `gorm:"column:geoid;primaryKey"`
+	Name     string  `gorm:"name"`
+	LandArea float64 `gorm:"land_area"`
+	Geometry []byte  `gorm:"geometry"`
+	MinLat   float64 `gorm:"min_lat;index:demographic_area_bounds"`
+	MinLng   float64 `gorm:"min_lng;index:demographic_area_bounds"`
+	MaxLat   float64 `gorm:"max_lat;index:demographic_area_bounds"`
+	MaxLng   float64 `gorm:"max_lng;index:demographic_area_bounds"`
+	DemographicCounts
+}
+
+func (DemographicAreaInfo) TableName() string {
+	return "demographic_areas"
+}
+
+// polygons decodes the geometry of the area.
+func (a *DemographicAreaInfo) polygons() (MultiPolygon, error) {
+	if len(a.Geometry) == 0 {
+		return nil, nil
+	}
+	var mp MultiPolygon
+	if err := msgpack.Unmarshal(a.Geometry, &mp); err != nil {
+		return nil, fmt.Errorf("failed to decode geometry of area %q: %w", a.GEOID, err)
+	}
+	return mp, nil
+}
+
+// DemographicLayerSummary is a layer along with how complete it is. Areas is the number of
+// areas with any information, and Mapped is the number that have geometry.
+type DemographicLayerSummary struct {
+	DemographicLayerInfo `msgpack:",inline"`
+	Areas                int64 `msgpack:"areas"`
+	Mapped               int64 `msgpack:"mapped"`
+}
+
+// DemographicAreaQuery is the payload of a 'demographics:list_areas' request. If the bounds
+// are given, only areas overlapping the box between the southwest and northeast corners are
+// returned.
+type DemographicAreaQuery struct {
+	LayerID string  `msgpack:"layer_id"`
+	SW      *LatLng `msgpack:"sw"`
+	NE      *LatLng `msgpack:"ne"`
+}
+
+// DemographicArea is an area as sent to clients for display.
+type DemographicArea struct {
+	GEOID             string       `msgpack:"geoid"`
+	Name              string       `msgpack:"name"`
+	LandArea          float64      `msgpack:"land_area"`
+	Polygons          MultiPolygon `msgpack:"polygons"`
+	DemographicCounts `msgpack:",inline"`
+}
+
+// DemographicUploadParams are the upload ticket parameters for the "tiger" upload kind, which
+// takes a zipped shapefile of Census areas.
+type DemographicUploadParams struct {
+	LayerID string `msgpack:"layer_id"`
+}
+
+// DemographicTableParams are the upload ticket parameters for the "acs" upload kind, which
+// takes a CSV file, or a zip file of CSV files, like the ones data.census.gov produces.
+//
+// Columns maps attribute names (see DemographicAttributes) to expressions over the CSV's
+// columns, such as "B25044_003E+B25044_010E". They are merged over DefaultACSColumns; map an
+// attribute to "" to ignore it. An attribute is only updated by files that have every column
+// its expression needs, so one ACS table can be uploaded at a time.
+//
+// GEOIDs are read from GEOIDColumn (default "GEO_ID", falling back to "GEOID"), ignoring any
+// summary level prefix like "1500000US". If GEOIDLength is set, longer GEOIDs are truncated
+// and their rows summed, e.g., to roll LODES block-level jobs up into block groups.
+type DemographicTableParams struct {
+	LayerID     string            `msgpack:"layer_id"`
+	GEOIDColumn string            `msgpack:"geoid_column"`
+	GEOIDLength int               `msgpack:"geoid_length"`
+	Columns     map[string]string `msgpack:"columns"`
+}
+
+// DefaultACSColumns are the ACS 5-year estimates used for each attribute. Jobs are not part
+// of the ACS, so they have no default.
+var DefaultACSColumns = map[string]string{
+	// B01003: Total population
+	"population": "B01003_001E",
+	// B11001: Household type
+	"households": "B11001_001E",
+	// B25044: Tenure by vehicles available (owner-occupied and renter-occupied, no vehicle)
+	"zero_car_households": "B25044_003E+B25044_010E",
+	// B03002: Hispanic or Latino origin by race (everyone except non-Hispanic white alone)
+	"minority": "B03002_001E-B03002_003E",
+	// C17002: Ratio of income to poverty level (below 150% of the poverty level)
+	"low_income": "C17002_002E+C17002_003E+C17002_004E+C17002_005E",
+	// B01001: Sex by age (65 and over)
+	"seniors": "B01001_020E+B01001_021E+B01001_022E+B01001_023E+B01001_024E+B01001_025E+" +
+		"B01001_044E+B01001_045E+B01001_046E+B01001_047E+B01001_048E+B01001_049E",
+	// B01001: Sex by age (under 18)
+	"youth": "B01001_003E+B01001_004E+B01001_005E+B01001_006E+" +
+		"B01001_027E+B01001_028E+B01001_029E+B01001_030E",
+}
+
+// DemographicImportReport summarizes a demographic upload.
+type DemographicImportReport struct {
+	LayerID string `msgpack:"layer_id"`
+	// Areas is the number of areas created or updated.
+	Areas int `msgpack:"areas"`
+	// Attributes lists the attributes that were updated, for table uploads.
+	Attributes []string `msgpack:"attributes,omitempty"`
+	Skipped    int      `msgpack:"skipped"`
+	Errors     []string `msgpack:"errors"`
+}
+
+func (r *DemographicImportReport) addError(format string, args ...any) {
+	if len(r.Errors) < MaxDemographicImportErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// requireDemographicLayer returns an ErrorWithCode if there is no layer with the given ID.
+func requireDemographicLayer(db *gorm.DB, id string) error {
+	var count int64
+	if err := db.Model(&DemographicLayerInfo{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return &ErrorWithCode{
+			Code:    "demographic-layer-not-found",
+			Message: fmt.Sprintf("there is no demographic layer with ID %q", id),
+			Details: id,
+		}
+	}
+	return nil
+}
+
+func listDemographicLayers(s *Server, u *UserConn, payload []byte) (any, error) {
+	var layers []DemographicLayerInfo
+	if err := s.Database.Find(&layers).Error; err != nil {
+		return nil, err
+	}
+
+	var counts []struct {
+		LayerID string
+		Areas   int64
+		Mapped  int64
+	}
+	err := s.Database.Model(&DemographicAreaInfo{}).
+		Select("layer_id, COUNT(*) AS areas, COUNT(geometry) AS mapped").
+		Group("layer_id").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]DemographicLayerSummary, len(layers))
+	for i, layer := range layers {
+		summaries[i].DemographicLayerInfo = layer
+		for _, c := range counts {
+			if c.LayerID == layer.ID {
+				summaries[i].Areas, summaries[i].Mapped = c.Areas, c.Mapped
+			}
+		}
+	}
+	return summaries, nil
+}
+
+func createDemographicLayer(s *Server, u *UserConn, payload []byte) (any, error) {
+	// TODO: improve error
+	if u.Rank == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "rank-too-low",
+			Message: "only admins have permission to create demographic layers",
+		}
+	}
+
+	var spec DemographicLayerSpec
+	if err := msgpack.Unmarshal(payload, &spec); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	info := DemographicLayerInfo{spec, id.String(), uint64(time.Now().UnixMilli()), u.ID}
+
+	if err := s.Database.Create(info).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func modifyDemographicLayer(s *Server, u *UserConn, payload []byte) (any, error) {
+	// TODO: improve error
+	if u.Rank == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "rank-too-low",
+			Message: "only admins have permission to modify demographic layers",
+		}
+	}
+
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	changes := map[string]any{}
+
+	if name, ok := untrustedChanges["name"].(string); ok {
+		changes["name"] = name
+	}
+	if desc, ok := untrustedChanges["description"].(string); ok {
+		changes["description"] = desc
+	}
+
+	layer := DemographicLayerInfo{ID: id}
+	if len(changes) > 0 {
+		if err := s.Database.Model(&layer).Updates(changes).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	if err := s.Database.Take(&layer).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, requireDemographicLayer(s.Database, id)
+		}
+		// TODO
+		return nil, err
+	}
+
+	return layer, nil
+}
+
+// deleteDemographicLayer deletes a layer along with all of its areas.
+func deleteDemographicLayer(s *Server, u *UserConn, payload []byte) (any, error) {
+	// TODO: improve error
+	if u.Rank == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "rank-too-low",
+			Message: "only admins have permission to delete demographic layers",
+		}
+	}
+
+	var id string
+	if err := msgpack.Unmarshal(payload, &id); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&DemographicAreaInfo{}, "layer_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&DemographicLayerInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func listDemographicAreas(s *Server, u *UserConn, payload []byte) (any, error) {
+	var query DemographicAreaQuery
+	if err := msgpack.Unmarshal(payload, &query); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireDemographicLayer(s.Database, query.LayerID); err != nil {
+		return nil, err
+	}
+
+	q := s.Database.Where("layer_id = ? AND geometry IS NOT NULL", query.LayerID)
+	if query.SW != nil && query.NE != nil {
+		q = q.Where(
+			"max_lat >= ? AND min_lat <= ? AND max_lng >= ? AND min_lng <= ?",
+			query.SW.Lat, query.NE.Lat, query.SW.Lng, query.NE.Lng,
+		)
+	}
+
+	var areas []DemographicAreaInfo
+	if err := q.Order("geoid").Find(&areas).Error; err != nil {
+		return nil, err
+	}
+
+	result := make([]DemographicArea, len(areas))
+	for i, area := range areas {
+		polys, err := area.polygons()
+		if err != nil {
+			return nil, err
+		}
+		result[i] = DemographicArea{area.GEOID, area.Name, area.LandArea, polys, area.DemographicCounts}
+	}
+	return result, nil
+}
+
+// firstField returns the name of the first of the candidate fields that a shapefile has.
+func firstField(fields []dbfField, candidates ...string) string {
+	for _, c := range candidates {
+		for _, f := range fields {
+			if strings.EqualFold(f.Name, c) {
+				return f.Name
+			}
+		}
+	}
+	return ""
+}
+
+// importDemographicShapes stores the geometry of Census areas from a zipped TIGER shapefile.
+// Any data already uploaded for the areas is kept.
+func importDemographicShapes(s *Server, u *UserConn, params []byte, data []byte) (any, error) {
+	// TODO: improve error
+	if u.Rank == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "rank-too-low",
+			Message: "only admins have permission to upload demographic data",
+		}
+	}
+
+	var p DemographicUploadParams
+	if err := msgpack.Unmarshal(params, &p); err != nil {
+		// TODO
+		return nil, err
+	}
+	if err := requireDemographicLayer(s.Database, p.LayerID); err != nil {
+		return nil, err
+	}
+
+	files, err := findShapefile(data)
+	if err != nil {
+		return nil, err
+	}
+	sf, err := readShapefile(files)
+	if err != nil {
+		return nil, err
+	}
+
+	geoidField := firstField(sf.Fields, "GEOID", "GEOID20", "GEOID10")
+	if geoidField == "" {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-shapefile",
+			Message: "shapefile has no GEOID field; is it a TIGER/Line file?",
+		}
+	}
+	nameField := firstField(sf.Fields, "NAMELSAD", "NAMELSAD20", "NAMELSAD10", "NAME")
+	landField := firstField(sf.Fields, "ALAND", "ALAND20", "ALAND10")
+
+	report := DemographicImportReport{LayerID: p.LayerID, Errors: []string{}}
+	var areas []DemographicAreaInfo
+
+	for i, shape := range sf.Shapes {
+		rec := sf.Records[i]
+		geoid := rec[geoidField]
+
+		if geoid == "" {
+			report.Skipped++
+			report.addError("record %d has no GEOID", i+1)
+			continue
+		}
+		if shape == nil || shape.Type != ShapePolygon {
+			report.Skipped++
+			report.addError("area %s is not a polygon", geoid)
+			continue
+		}
+
+		polys := shape.polygons()
+		if len(polys) == 0 {
+			report.Skipped++
+			report.addError("area %s has no rings", geoid)
+			continue
+		}
+
+		geometry, err := msgpack.Marshal(polys)
+		if err != nil {
+			// TODO
+			return nil, err
+		}
+		sw, ne := polys.bounds()
+		landArea, _ := strconv.ParseFloat(rec[landField], 64)
+
+		areas = append(areas, DemographicAreaInfo{
+			LayerID:  p.LayerID,
+			GEOID:    geoid,
+			Name:     rec[nameField],
+			LandArea: landArea,
+			Geometry: geometry,
+			MinLat:   sw.Lat,
+			MinLng:   sw.Lng,
+			MaxLat:   ne.Lat,
+			MaxLng:   ne.Lng,
+		})
+	}
+
+	err = upsertDemographicAreas(s.Database, areas, []string{
+		"name", "land_area", "geometry", "min_lat", "min_lng", "max_lat", "max_lng",
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	report.Areas = len(areas)
+	return report, nil
+}
+
+// importDemographicTable stores demographics from ACS tables (or any CSV keyed by GEOID).
+// Geometry already uploaded for the areas is kept.
+func importDemographicTable(s *Server, u *UserConn, params []byte, data []byte) (any, error) {
+	// TODO: improve error
+	if u.Rank == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "rank-too-low",
+			Message: "only admins have permission to upload demographic data",
+		}
+	}
+
+	var p DemographicTableParams
+	if err := msgpack.Unmarshal(params, &p); err != nil {
+		// TODO
+		return nil, err
+	}
+	if err := requireDemographicLayer(s.Database, p.LayerID); err != nil {
+		return nil, err
+	}
+
+	// Work out which expression to use for each attribute
+	expressions := map[string][]acsTerm{}
+	for _, attr := range DemographicAttributes {
+		expr, ok := p.Columns[attr]
+		if !ok {
+			expr = DefaultACSColumns[attr]
+		}
+		if expr == "" {
+			continue
+		}
+		terms, err := parseACSExpression(expr)
+		if err != nil {
+			return nil, &ErrorWithCode{
+				Code:    "invalid-column-expression",
+				Message: fmt.Sprintf("invalid expression for %s: %v", attr, err),
+				Details: attr,
+			}
+		}
+		expressions[attr] = terms
+	}
+	for attr := range p.Columns {
+		if (&DemographicCounts{}).field(attr) == nil {
+			return nil, &ErrorWithCode{
+				Code:    "unknown-attribute",
+				Message: fmt.Sprintf("%q is not a demographic attribute", attr),
+				Details: DemographicAttributes,
+			}
+		}
+	}
+
+	tables, err := readDemographicTables(data)
+	if err != nil {
+		return nil, err
+	}
+
+	report := DemographicImportReport{LayerID: p.LayerID, Attributes: []string{}, Errors: []string{}}
+	counts := map[string]*DemographicCounts{}
+	updated := map[string]bool{}
+	keyed := 0
+
+	for _, named := range tables {
+		table := named.table
+
+		geoidColumn := p.GEOIDColumn
+		if geoidColumn == "" {
+			geoidColumn = "GEO_ID"
+			if !table.has(geoidColumn) {
+				geoidColumn = "GEOID"
+			}
+		}
+		if !table.has(geoidColumn) {
+			continue // e.g., the column metadata that comes with ACS downloads
+		}
+		keyed++
+
+		// Only the attributes whose columns are all in this table come from it
+		var attrs []string
+		for attr, terms := range expressions {
+			complete := true
+			for _, t := range terms {
+				complete = complete && table.has(t.column)
+			}
+			if complete {
+				attrs = append(attrs, attr)
+				updated[attr] = true
+			}
+		}
+		if len(attrs) == 0 {
+			continue
+		}
+
+		for i, row := range table.rows {
+			geoid := table.get(row, geoidColumn)
+			if idx := strings.Index(geoid, "US"); idx >= 0 {
+				geoid = geoid[idx+2:]
+			}
+			if p.GEOIDLength > 0 && len(geoid) > p.GEOIDLength {
+				geoid = geoid[:p.GEOIDLength]
+			}
+			if geoid == "" || strings.Trim(geoid, "0123456789") != "" {
+				// data.census.gov files have a second header row of labels
+				if i > 0 {
+					report.Skipped++
+					report.addError("%s line %d has an invalid GEOID", named.name, table.line(i))
+				}
+				continue
+			}
+
+			c := counts[geoid]
+			if c == nil {
+				c = &DemographicCounts{}
+				counts[geoid] = c
+			}
+			for _, attr := range attrs {
+				for _, t := range expressions[attr] {
+					// ACS uses placeholders like "-" and "(X)" for unavailable estimates
+					v, _ := strconv.ParseFloat(table.get(row, t.column), 64)
+					*c.field(attr) += t.sign * v
+				}
+			}
+		}
+	}
+
+	if keyed == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "missing-geoid-column",
+			Message: "none of the uploaded files have a GEOID column",
+			Details: p.GEOIDColumn,
+		}
+	}
+
+	for attr := range p.Columns {
+		if expressions[attr] != nil && !updated[attr] {
+			report.addError("no uploaded file has the columns for %s", attr)
+		}
+	}
+
+	for _, attr := range DemographicAttributes {
+		if updated[attr] {
+			report.Attributes = append(report.Attributes, attr)
+		}
+	}
+	if len(report.Attributes) == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "no-demographic-columns",
+			Message: "none of the uploaded files have the columns needed for any attribute",
+			Details: report.Errors,
+		}
+	}
+
+	geoids := make([]string, 0, len(counts))
+	for geoid := range counts {
+		geoids = append(geoids, geoid)
+	}
+	sort.Strings(geoids)
+
+	areas := make([]DemographicAreaInfo, len(geoids))
+	for i, geoid := range geoids {
+		areas[i] = DemographicAreaInfo{LayerID: p.LayerID, GEOID: geoid, DemographicCounts: *counts[geoid]}
+	}
+
+	if err := upsertDemographicAreas(s.Database, areas, report.Attributes); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	report.Areas = len(areas)
+	return report, nil
+}
+
+// upsertDemographicAreas creates areas, or updates just the given columns of areas that
+// already exist.
+func upsertDemographicAreas(db *gorm.DB, areas []DemographicAreaInfo, columns []string) error {
+	if len(areas) == 0 {
+		return nil // GORM refuses to insert empty slices
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "layer_id"}, {Name: "geoid"}},
+			DoUpdates: clause.AssignmentColumns(columns),
+		}).CreateInBatches(areas, demographicInsertBatchSize).Error
+	})
+}
+
+// acsTerm is a column of an expression like "B25044_003E+B25044_010E", with its sign.
+type acsTerm struct {
+	column string
+	sign   float64
+}
+
+func parseACSExpression(expr string) ([]acsTerm, error) {
+	var terms []acsTerm
+	sign := 1.0
+	start := 0
+
+	flush := func(end int) error {
+		column := strings.TrimSpace(expr[start:end])
+		if column == "" {
+			return errors.New("expected a column name")
+		}
+		terms = append(terms, acsTerm{column, sign})
+		return nil
+	}
+
+	for i, r := range expr {
+		if r != '+' && r != '-' {
+			continue
+		}
+		if err := flush(i); err != nil {
+			return nil, err
+		}
+		sign = 1
+		if r == '-' {
+			sign = -1
+		}
+		start = i + 1
+	}
+	if err := flush(len(expr)); err != nil {
+		return nil, err
+	}
+
+	return terms, nil
+}
+
+type namedCSVTable struct {
+	name  string
+	table *csvTable
+}
+
+// readDemographicTables reads an uploaded CSV file, or every CSV file in an uploaded zip.
+func readDemographicTables(data []byte) ([]namedCSVTable, error) {
+	if !bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		table, err := readCSV(bytes.NewReader(data))
+		if err != nil {
+			return nil, &ErrorWithCode{
+				Code:    "invalid-csv",
+				Message: fmt.Sprintf("failed to read CSV file: %v", err),
+			}
+		}
+		return []namedCSVTable{{"uploaded file", table}}, nil
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-zip",
+			Message: "failed to read zip file",
+			Details: err.Error(),
+		}
+	}
+
+	var tables []namedCSVTable
+	for _, f := range zr.File {
+		if !strings.HasSuffix(strings.ToLower(f.Name), ".csv") {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		table, err := readCSV(io.LimitReader(rc, MaxUploadBytes))
+		rc.Close()
+		if err != nil {
+			return nil, &ErrorWithCode{
+				Code:    "invalid-csv",
+				Message: fmt.Sprintf("failed to read %s: %v", f.Name, err),
+			}
+		}
+		tables = append(tables, namedCSVTable{f.Name, table})
+	}
+
+	if len(tables) == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-zip",
+			Message: "zip file does not contain any CSV files",
+		}
+	}
+	return tables, nil
+}
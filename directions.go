@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// directionsSampleStep is the spacing in meters of the points at which a shape is matched
+	// to the streets it runs along.
+	directionsSampleStep = 10
+	// directionsMatchDistance is how far (in meters) a shape may stray from a street and still
+	// be considered on it.
+	directionsMatchDistance = 25
+	// directionsHeadingTolerance is how far (in degrees) the heading of a shape may differ from
+	// that of a street for the shape to be matched to it.
+	directionsHeadingTolerance = 40
+	// minDirectionsRun is the shortest stretch of a street (in meters) that gets its own
+	// instruction. Shorter ones are usually matching glitches at intersections.
+	minDirectionsRun = 30
+	// directionsTurnWindow is how far (in meters) before and after a turn the shape's headings
+	// are measured to tell which way it turns.
+	directionsTurnWindow = 30
+)
+
+// RouteDirectionsRequest is the payload of a 'route:directions' request. Directions are given
+// for a single pattern if PatternID is set, otherwise for every pattern of the route that has
+// a shape.
+type RouteDirectionsRequest struct {
+	RouteID   string `msgpack:"route_id"`
+	PatternID string `msgpack:"pattern_id"`
+}
+
+// DirectionStep is one instruction of a run sheet. Type is one of "depart", "turn",
+// "continue" (onto a differently named street without turning), "stop" and "arrive". Turn is
+// one of "straight", "slight_left", "left", "sharp_left", "slight_right", "right",
+// "sharp_right" and "u_turn". Measure is how far along the pattern the instruction is, and
+// Distance is how far it is from there to the next instruction, both in meters.
+type DirectionStep struct {
+	Type        string  `msgpack:"type"`
+	Turn        string  `msgpack:"turn,omitempty"`
+	Heading     string  `msgpack:"heading,omitempty"`
+	Street      string  `msgpack:"street"`
+	StopID      string  `msgpack:"stop_id,omitempty"`
+	StopCode    string  `msgpack:"stop_code,omitempty"`
+	StopName    string  `msgpack:"stop_name,omitempty"`
+	Point       LatLng  `msgpack:"point"`
+	Measure     float64 `msgpack:"measure"`
+	Distance    float64 `msgpack:"distance"`
+	Instruction string  `msgpack:"instruction"`
+}
+
+// PatternDirections are the turn-by-turn directions along a pattern's shape. Matched is the
+// share of the shape that could be matched to named or unnamed streets of the imported
+// network; directions for shapes that do not follow the streets are not worth much.
+type PatternDirections struct {
+	PatternID   string          `msgpack:"pattern_id"`
+	Name        string          `msgpack:"name"`
+	DirectionID uint            `msgpack:"direction_id"`
+	Length      float64         `msgpack:"length"`
+	Matched     float64         `msgpack:"matched"`
+	Steps       []DirectionStep `msgpack:"steps"`
+}
+
+// RouteDirections is the reply to a 'route:directions' request. Download is a printable run
+// sheet with the directions for every pattern.
+type RouteDirections struct {
+	RouteID  string              `msgpack:"route_id"`
+	Patterns []PatternDirections `msgpack:"patterns"`
+	Download *DownloadInfo       `msgpack:"download"`
+}
+
+// directionsRun is a stretch of a shape along one street.
+type directionsRun struct {
+	street     string
+	start, end float64
+}
+
+func routeDirections(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req RouteDirectionsRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	var patterns []PatternInfo
+	if req.PatternID != "" {
+		pattern, err := takePattern(s.Database, req.PatternID)
+		if err != nil {
+			return nil, err
+		}
+		patterns = []PatternInfo{pattern}
+		req.RouteID = pattern.RouteID
+	}
+
+	route := RouteInfo{ID: req.RouteID}
+	if err := s.Database.Take(&route).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrorWithCode{
+				Code:    "route-not-found",
+				Message: fmt.Sprintf("there is no route with ID %q", req.RouteID),
+				Details: req.RouteID,
+			}
+		}
+		return nil, err
+	}
+
+	if req.PatternID == "" {
+		if err := s.Database.Order("direction_id, name").Find(&patterns, "route_id = ?", route.ID).Error; err != nil {
+			return nil, err
+		}
+		if err := loadPatternStops(s.Database, patterns); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only patterns with shapes can be given directions
+	shapeIDs := []string{}
+	for _, p := range patterns {
+		if p.ShapeID != "" {
+			shapeIDs = append(shapeIDs, p.ShapeID)
+		}
+	}
+	var paths []PathInfo
+	if err := s.Database.Find(&paths, "id IN ?", shapeIDs).Error; err != nil {
+		return nil, err
+	}
+	shapes := map[string][]LatLng{}
+	for _, path := range paths {
+		coords := path.Coords
+		if len(coords) >= 2 && lineLength(coords) > 0 {
+			shapes[path.ID] = coords
+		}
+	}
+
+	shaped := patterns[:0]
+	for _, p := range patterns {
+		if shapes[p.ShapeID] != nil {
+			shaped = append(shaped, p)
+		}
+	}
+	if len(shaped) == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "no-shape",
+			Message: "directions follow a pattern's shape, but there is no pattern with a shape to follow",
+		}
+	}
+	patterns = shaped
+
+	// Load the stops and the streets around the shapes
+	var stopIDs []string
+	sw, ne := shapes[patterns[0].ShapeID][0], shapes[patterns[0].ShapeID][0]
+	for _, p := range patterns {
+		stopIDs = append(stopIDs, p.StopIDs...)
+		for _, c := range shapes[p.ShapeID] {
+			sw = LatLng{math.Min(sw.Lat, c.Lat), math.Min(sw.Lng, c.Lng)}
+			ne = LatLng{math.Max(ne.Lat, c.Lat), math.Max(ne.Lng, c.Lng)}
+		}
+	}
+
+	var stops []StopInfo
+	if err := s.Database.Find(&stops, "project_id = ? AND id IN ?", route.ProjectID, stopIDs).Error; err != nil {
+		return nil, err
+	}
+	stopsByID := make(map[string]StopInfo, len(stops))
+	for _, stop := range stops {
+		stopsByID[stop.ID] = stop
+	}
+
+	proj := newLocalProjection(sw)
+	x1, y1 := proj.toXY(ne)
+	margin := 4.0 * directionsMatchDistance
+	sw, ne = proj.toLatLng(-margin, -margin), proj.toLatLng(x1+margin, y1+margin)
+
+	graph, err := loadStreetGraph(s, sw, ne, streetModeDrive, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(graph.edges) == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "no-street-network",
+			Message: "there are no streets along this route; has a street network been imported?",
+		}
+	}
+
+	result := RouteDirections{RouteID: route.ID}
+	for _, p := range patterns {
+		var patternStops []StopInfo
+		for _, id := range p.StopIDs {
+			if stop, ok := stopsByID[id]; ok {
+				patternStops = append(patternStops, stop)
+			}
+		}
+
+		pd := directionsAlong(graph, shapes[p.ShapeID], patternStops)
+		pd.PatternID, pd.Name, pd.DirectionID = p.ID, p.Name, p.DirectionID
+		result.Patterns = append(result.Patterns, pd)
+	}
+
+	title := strings.TrimSpace(route.ShortName + " " + route.LongName)
+	if title == "" {
+		title = route.ID
+	}
+	doc, err := directionsDocument(title, result.Patterns)
+	if err != nil {
+		return nil, err
+	}
+	dl, err := s.addDownload(fileNameFor(title, "directions")+".html", "text/html", doc)
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+	result.Download = dl
+
+	return result, nil
+}
+
+// directionsAlong matches a shape to the streets of a graph and turns it into instructions:
+// where to turn onto which street and where to stop.
+func directionsAlong(g *streetGraph, shape []LatLng, stops []StopInfo) PatternDirections {
+	length := lineLength(shape)
+	headingAt := func(from, to float64) float64 {
+		return bearing(pointAlong(shape, math.Max(0, from)), pointAlong(shape, math.Min(length, to)))
+	}
+
+	// Name the street under every sample point, grouping consecutive samples on the same street
+	var runs []directionsRun
+	matched := 0.0
+	samples := int(math.Ceil(length / directionsSampleStep))
+	for i := 0; i <= samples; i++ {
+		m := math.Min(length, float64(i)*directionsSampleStep)
+		p := pointAlong(shape, m)
+
+		street := ""
+		pos, ok := g.snapHeading(p, headingAt(m-directionsSampleStep/2, m+directionsSampleStep/2), directionsHeadingTolerance, directionsMatchDistance)
+		if ok {
+			street = g.edges[pos.Edge].Name
+			matched += directionsSampleStep
+		}
+
+		n := len(runs)
+		if n > 0 && runs[n-1].street == street {
+			continue
+		}
+		if n > 0 {
+			runs[n-1].end = m - directionsSampleStep/2
+		}
+		runs = append(runs, directionsRun{street, math.Max(0, m-directionsSampleStep/2), length})
+	}
+	runs[len(runs)-1].end = length
+
+	// Fold the shortest stretches into their neighbours until none are left
+	for len(runs) > 1 {
+		shortest := -1
+		for i, r := range runs {
+			if r.end-r.start < minDirectionsRun && (shortest < 0 || r.end-r.start < runs[shortest].end-runs[shortest].start) {
+				shortest = i
+			}
+		}
+		if shortest < 0 {
+			break
+		}
+
+		if shortest == 0 {
+			runs[1].start = 0
+		} else {
+			runs[shortest-1].end = runs[shortest].end
+		}
+		runs = append(runs[:shortest], runs[shortest+1:]...)
+		if shortest > 0 && shortest < len(runs) && runs[shortest-1].street == runs[shortest].street {
+			runs[shortest-1].end = runs[shortest].end
+			runs = append(runs[:shortest], runs[shortest+1:]...)
+		}
+	}
+
+	// Turns happen at vertices of the shape, so move each change of street to the closest one
+	vertices := make([]float64, len(shape))
+	for i := 1; i < len(shape); i++ {
+		vertices[i] = vertices[i-1] + distance(shape[i-1], shape[i])
+	}
+	for i := 1; i < len(runs); i++ {
+		m := runs[i].start
+		best := math.Inf(1)
+		for _, v := range vertices {
+			if d := math.Abs(v - m); d <= directionsSampleStep && d < best && v > runs[i-1].start && v < runs[i].end {
+				runs[i].start, best = v, d
+			}
+		}
+		runs[i-1].end = runs[i].start
+	}
+
+	heading := compassDirection(headingAt(0, directionsTurnWindow))
+	steps := []DirectionStep{{
+		Type:        "depart",
+		Heading:     heading,
+		Street:      runs[0].street,
+		Point:       shape[0],
+		Instruction: fmt.Sprintf("Head %s on %s", heading, streetLabel(runs[0].street)),
+	}}
+
+	var turns []DirectionStep
+	for _, r := range runs[1:] {
+		m := r.start
+		turn := turnDirection(turnAngle(headingAt(m-directionsTurnWindow, m), headingAt(m, m+directionsTurnWindow)))
+		step := DirectionStep{Type: "turn", Turn: turn, Street: r.street, Point: pointAlong(shape, m), Measure: m}
+		switch turn {
+		case "straight":
+			step.Type = "continue"
+			step.Instruction = "Continue onto " + streetLabel(r.street)
+		case "slight_left", "slight_right":
+			step.Instruction = fmt.Sprintf("Bear %s onto %s", strings.TrimPrefix(turn, "slight_"), streetLabel(r.street))
+		case "sharp_left", "sharp_right":
+			step.Instruction = fmt.Sprintf("Make a sharp %s onto %s", strings.TrimPrefix(turn, "sharp_"), streetLabel(r.street))
+		case "u_turn":
+			step.Instruction = "Make a U-turn onto " + streetLabel(r.street)
+		default:
+			step.Instruction = fmt.Sprintf("Turn %s onto %s", turn, streetLabel(r.street))
+		}
+		turns = append(turns, step)
+	}
+
+	// Announce the stops in order along the shape, before any turn at the same place
+	prev := 0.0
+	run := 0
+	for _, stop := range stops {
+		m := locateAlong(shape, LatLng{stop.Lat, stop.Lng}, prev)
+		prev = m
+		for len(turns) > 0 && turns[0].Measure < m {
+			steps, turns = append(steps, turns[0]), turns[1:]
+		}
+		for run < len(runs)-1 && runs[run].end <= m {
+			run++
+		}
+
+		label := stop.Name
+		if label == "" {
+			label = stop.ID
+		}
+		if stop.Code != "" {
+			label += " (" + stop.Code + ")"
+		}
+		steps = append(steps, DirectionStep{
+			Type:        "stop",
+			Street:      runs[run].street,
+			StopID:      stop.ID,
+			StopCode:    stop.Code,
+			StopName:    stop.Name,
+			Point:       pointAlong(shape, m),
+			Measure:     m,
+			Instruction: "Stop at " + label,
+		})
+	}
+	steps = append(steps, turns...)
+	steps = append(steps, DirectionStep{
+		Type:        "arrive",
+		Street:      runs[len(runs)-1].street,
+		Point:       shape[len(shape)-1],
+		Measure:     length,
+		Instruction: "End of route on " + streetLabel(runs[len(runs)-1].street),
+	})
+
+	for i := 0; i < len(steps)-1; i++ {
+		steps[i].Distance = steps[i+1].Measure - steps[i].Measure
+	}
+
+	return PatternDirections{
+		Length:  length,
+		Matched: math.Min(1, matched/(float64(samples+1)*directionsSampleStep)),
+		Steps:   steps,
+	}
+}
+
+// turnDirection classifies a turn by its angle in degrees, positive to the right.
+func turnDirection(angle float64) string {
+	side := "right"
+	if angle < 0 {
+		side = "left"
+	}
+	switch a := math.Abs(angle); {
+	case a < 20:
+		return "straight"
+	case a < 45:
+		return "slight_" + side
+	case a < 135:
+		return side
+	case a < 170:
+		return "sharp_" + side
+	default:
+		return "u_turn"
+	}
+}
+
+// compassDirection names the closest of the eight principal compass directions to a bearing.
+func compassDirection(bearing float64) string {
+	names := []string{"north", "northeast", "east", "southeast", "south", "southwest", "west", "northwest"}
+	return names[int(math.Mod(bearing+22.5, 360)/45)%8]
+}
+
+// streetLabel is how a street is referred to in instructions.
+func streetLabel(name string) string {
+	if name == "" {
+		return "an unnamed street"
+	}
+	return name
+}
+
+// formatDistance formats a distance in meters the way run sheets do, in miles or in feet when
+// less than a tenth of a mile.
+func formatDistance(meters float64) string {
+	if meters < 0.1*MetersPerMile {
+		return fmt.Sprintf("%.0f ft", math.Round(meters/MetersPerFoot/10)*10)
+	}
+	return fmt.Sprintf("%.1f mi", meters/MetersPerMile)
+}
+
+var directionsTemplate = template.Must(template.New("directions").Funcs(template.FuncMap{
+	"distance": formatDistance,
+	"inc":      func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} – Directions</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+section { page-break-after: always; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.num, th.num { text-align: right; white-space: nowrap; }
+tr.stop td { font-weight: bold; }
+</style>
+</head>
+<body>
+{{range .Patterns}}<section>
+<h1>{{$.Title}}</h1>
+<h2>{{if .Name}}{{.Name}}{{else}}Direction {{.DirectionID}}{{end}}</h2>
+<p>{{distance .Length}}, {{.Stops}} stops</p>
+<table>
+<thead><tr><th class="num">#</th><th>Instruction</th><th class="num">Then go</th><th class="num">Total</th></tr></thead>
+<tbody>
+{{range $i, $step := .Steps}}<tr class="{{$step.Type}}"><td class="num">{{inc $i}}</td><td>{{$step.Instruction}}</td><td class="num">{{if $step.Distance}}{{distance $step.Distance}}{{end}}</td><td class="num">{{distance $step.Measure}}</td></tr>
+{{end}}</tbody>
+</table>
+</section>
+{{end}}</body>
+</html>
+`))
+
+// directionsDocument renders directions as a printable HTML run sheet, one page per pattern.
+func directionsDocument(title string, patterns []PatternDirections) ([]byte, error) {
+	type page struct {
+		PatternDirections
+		Stops int
+	}
+	data := struct {
+		Title    string
+		Patterns []page
+	}{Title: title}
+
+	for _, pd := range patterns {
+		stops := 0
+		for _, step := range pd.Steps {
+			if step.Type == "stop" {
+				stops++
+			}
+		}
+		data.Patterns = append(data.Patterns, page{pd, stops})
+	}
+
+	var buf bytes.Buffer
+	if err := directionsTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
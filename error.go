@@ -1,6 +1,9 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // ErrorWithCode is a standard error for giving feedback to clients.
 type ErrorWithCode struct {
@@ -13,3 +16,13 @@ type ErrorWithCode struct {
 func (err *ErrorWithCode) Error() string {
 	return fmt.Sprintf("[%s] %s", err.Code, err.Message)
 }
+
+// errorMessage returns the message of an ErrorWithCode, or the text of any other error, e.g.,
+// to list it among the problems with an upload.
+func errorMessage(err error) string {
+	var e *ErrorWithCode
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	return err.Error()
+}
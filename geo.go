@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"math"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// EarthRadius is the mean radius of the Earth in meters.
+const EarthRadius = 6371008.8
+
+// MetersPerMile is used to convert distances for reports that are traditionally in miles.
+const MetersPerMile = 1609.344
+
+// MetersPerFoot is used like MetersPerMile, for short distances such as stop spacing.
+const MetersPerFoot = 0.3048
+
+// LatLng is a WGS84 coordinate in degrees. On the wire it is always a [lat, lng] pair, though
+// a {lat, lng} map is accepted too (circle centers used to be stored that way).
+type LatLng struct {
+	Lat float64 `json:"lat" msgpack:"lat"`
+	Lng float64 `json:"lng" msgpack:"lng"`
+}
+
+func (c LatLng) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if err := enc.EncodeArrayLen(2); err != nil {
+		return err
+	}
+	if err := enc.EncodeFloat64(c.Lat); err != nil {
+		return err
+	}
+	return enc.EncodeFloat64(c.Lng)
+}
+
+func (c *LatLng) DecodeMsgpack(dec *msgpack.Decoder) error {
+	code, err := dec.PeekCode()
+	if err != nil {
+		return err
+	}
+	if msgpcode.IsFixedMap(code) || code == msgpcode.Map16 || code == msgpcode.Map32 {
+		var m struct {
+			Lat *float64 `msgpack:"lat"`
+			Lng *float64 `msgpack:"lng"`
+		}
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+		if m.Lat == nil || m.Lng == nil {
+			return errors.New("coordinates must have a latitude and longitude")
+		}
+		c.Lat, c.Lng = *m.Lat, *m.Lng
+		return nil
+	}
+
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return err
+	}
+	if n < 2 {
+		return errors.New("coordinates must be [lat, lng] pairs")
+	}
+	if c.Lat, err = dec.DecodeFloat64(); err != nil {
+		return err
+	}
+	if c.Lng, err = dec.DecodeFloat64(); err != nil {
+		return err
+	}
+
+	// Tolerate extra dimensions (e.g., altitude) by ignoring them
+	for i := 2; i < n; i++ {
+		if err := dec.Skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Polygon is a list of closed rings. The first ring is the outer boundary and the rest are
+// holes. Outer rings wind counter-clockwise and holes clockwise, and rings do not repeat
+// their first coordinate at the end.
+type Polygon [][]LatLng
+
+// MultiPolygon is a list of disjoint polygons.
+type MultiPolygon []Polygon
+
+// bounds returns the southwest and northeast corners of the smallest box containing every
+// coordinate of the polygons.
+func (mp MultiPolygon) bounds() (sw, ne LatLng) {
+	sw = LatLng{math.Inf(1), math.Inf(1)}
+	ne = LatLng{math.Inf(-1), math.Inf(-1)}
+	for _, poly := range mp {
+		for _, ring := range poly {
+			for _, c := range ring {
+				sw.Lat, sw.Lng = math.Min(sw.Lat, c.Lat), math.Min(sw.Lng, c.Lng)
+				ne.Lat, ne.Lng = math.Max(ne.Lat, c.Lat), math.Max(ne.Lng, c.Lng)
+			}
+		}
+	}
+	return sw, ne
+}
+
+// contains reports whether a coordinate is inside any of the polygons (and not in a hole).
+func (mp MultiPolygon) contains(c LatLng) bool {
+	for _, poly := range mp {
+		in := false
+		for _, ring := range poly {
+			if latLngInRing(c, ring) {
+				in = !in
+			}
+		}
+		if in {
+			return true
+		}
+	}
+	return false
+}
+
+// latLngInRing is the usual even-odd ray casting test, treating degrees as planar.
+func latLngInRing(c LatLng, ring []LatLng) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > c.Lat) != (b.Lat > c.Lat) && c.Lng < (b.Lng-a.Lng)*(c.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			in = !in
+		}
+	}
+	return in
+}
+
+// distance returns the great-circle distance between two coordinates in meters.
+func distance(a, b LatLng) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// lineLength returns the length of a polyline in meters.
+func lineLength(line []LatLng) float64 {
+	total := 0.0
+	for i := 1; i < len(line); i++ {
+		total += distance(line[i-1], line[i])
+	}
+	return total
+}
+
+// locateAlong finds the point of a polyline closest to p, ignoring everything before the
+// given measure, and returns its measure: the distance in meters from the start of the line.
+// Segments are treated as straight in a local equirectangular projection, which is plenty
+// accurate at the scale of a single street segment.
+func locateAlong(line []LatLng, p LatLng, from float64) float64 {
+	if len(line) == 0 {
+		return from
+	}
+
+	best, bestDist := from, math.Inf(1)
+	measure := 0.0
+
+	for i := 1; i < len(line); i++ {
+		a, b := line[i-1], line[i]
+		segLen := distance(a, b)
+		segStart := measure
+		measure += segLen
+
+		if measure < from {
+			continue
+		}
+
+		// Project onto the segment in meters relative to a
+		kx := math.Cos(a.Lat*math.Pi/180) * EarthRadius * math.Pi / 180
+		ky := EarthRadius * math.Pi / 180
+		bx, by := (b.Lng-a.Lng)*kx, (b.Lat-a.Lat)*ky
+		px, py := (p.Lng-a.Lng)*kx, (p.Lat-a.Lat)*ky
+
+		t := 0.0
+		if lenSq := bx*bx + by*by; lenSq > 0 {
+			t = math.Max(0, math.Min(1, (px*bx+py*by)/lenSq))
+		}
+
+		m := math.Max(from, segStart+t*segLen)
+		if segLen > 0 {
+			t = (m - segStart) / segLen
+		}
+		dx, dy := px-t*bx, py-t*by
+
+		if d := math.Hypot(dx, dy); d < bestDist {
+			best, bestDist = m, d
+		}
+	}
+
+	return best
+}
+
+// pointAlong returns the point of a polyline at the given measure (distance in meters from
+// its start), clamped to the ends of the line.
+func pointAlong(line []LatLng, m float64) LatLng {
+	if len(line) == 0 {
+		return LatLng{}
+	}
+
+	measure := 0.0
+	for i := 1; i < len(line); i++ {
+		segLen := distance(line[i-1], line[i])
+		if measure+segLen >= m && segLen > 0 {
+			t := math.Max(0, (m-measure)/segLen)
+			a, b := line[i-1], line[i]
+			return LatLng{a.Lat + t*(b.Lat-a.Lat), a.Lng + t*(b.Lng-a.Lng)}
+		}
+		measure += segLen
+	}
+	return line[len(line)-1]
+}
+
+// cutLine returns the part of a polyline between two measures. If from is greater than to,
+// the part is reversed so that it still runs from one to the other.
+func cutLine(line []LatLng, from, to float64) []LatLng {
+	if from > to {
+		part := cutLine(line, to, from)
+		for i, j := 0, len(part)-1; i < j; i, j = i+1, j-1 {
+			part[i], part[j] = part[j], part[i]
+		}
+		return part
+	}
+
+	part := []LatLng{pointAlong(line, from)}
+	measure := 0.0
+	for i := 1; i < len(line); i++ {
+		measure += distance(line[i-1], line[i])
+		if measure > from && measure < to {
+			part = append(part, line[i])
+		}
+	}
+	return append(part, pointAlong(line, to))
+}
+
+// bearing returns the initial compass bearing from a to b in degrees clockwise from north,
+// in [0, 360).
+func bearing(a, b LatLng) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+// turnAngle returns how far a heading turns to reach another, in degrees in (-180, 180];
+// positive angles turn right.
+func turnAngle(from, to float64) float64 {
+	a := math.Mod(to-from+360, 360)
+	if a > 180 {
+		a -= 360
+	}
+	return a
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// GeoJSONImportParams are the upload ticket parameters for the "geojson" upload kind, which
+// takes a GeoJSON FeatureCollection (or a single Feature or geometry). Features become
+// features of the project: points become stops, or circles if they have a positive "radius"
+// property (in meters), lines become line paths and polygons become closed paths. Features
+// with several geometries become one feature per geometry.
+//
+// Every feature keeps all of its properties. The "name", "stop_code" and "description"
+// properties (or a few common alternatives) name and describe it, and paths and circles are
+// styled by the simplestyle properties ("stroke", "stroke-width", "fill" and so on).
+type GeoJSONImportParams struct {
+	ProjectID string `msgpack:"project_id"`
+}
+
+// GeoJSONExportRequest is the payload of a 'geojson:export' request. The project's stops,
+// paths and circles are exported as a FeatureCollection, with circles as points that have a
+// "radius" property.
+type GeoJSONExportRequest struct {
+	ProjectID string `msgpack:"project_id"`
+}
+
+// Properties that name, describe and style features, in order of preference.
+var (
+	geoJSONNameProperties        = []string{"name", "stop_name", "title"}
+	geoJSONCodeProperties        = []string{"stop_code", "code"}
+	geoJSONDescriptionProperties = []string{"description", "desc", "stop_desc"}
+	geoJSONStyleProperties       = []string{"stroke", "stroke-width", "stroke-opacity", "fill", "fill-opacity"}
+)
+
+// geoJSONObject is any GeoJSON object. Which fields are used depends on the Type.
+type geoJSONObject struct {
+	Type        string          `json:"type"`
+	Features    []geoJSONObject `json:"features"`
+	Geometry    *geoJSONObject  `json:"geometry"`
+	Properties  map[string]any  `json:"properties"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometries  []geoJSONObject `json:"geometries"`
+	CRS         *struct {
+		Properties struct {
+			Name string `json:"name"`
+		} `json:"properties"`
+	} `json:"crs"`
+}
+
+// geoJSONFeature is a Feature as it is exported.
+type geoJSONFeature struct {
+	Type       string          `json:"type"`
+	ID         string          `json:"id"`
+	Geometry   geoJSONGeometry `json:"geometry"`
+	Properties map[string]any  `json:"properties"`
+}
+
+// geoJSONGeometry is a geometry as it is exported, with coordinates as nested [lng, lat]
+// arrays.
+type geoJSONGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+// readGeoJSON parses a GeoJSON file into a list of features. A bare Feature is treated as a
+// collection of one, and so is a bare geometry (as a feature without properties).
+func readGeoJSON(data []byte) ([]geoJSONObject, error) {
+	dec := json.NewDecoder(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	dec.UseNumber()
+
+	var root geoJSONObject
+	if err := dec.Decode(&root); err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "bad-geojson",
+			Message: "file is not valid GeoJSON",
+			Details: err.Error(),
+		}
+	}
+
+	// RFC 7946 only allows longitude and latitude, but older files could name another system
+	if root.CRS != nil {
+		name := root.CRS.Properties.Name
+		if !strings.HasSuffix(name, "CRS84") && !strings.HasSuffix(name, ":4326") {
+			return nil, &ErrorWithCode{
+				Code:    "unsupported-projection",
+				Message: fmt.Sprintf("coordinate system %q is not supported; GeoJSON must use longitude and latitude", name),
+			}
+		}
+	}
+
+	switch root.Type {
+	case "FeatureCollection":
+		return root.Features, nil
+	case "Feature":
+		return []geoJSONObject{root}, nil
+	case "":
+		return nil, &ErrorWithCode{Code: "bad-geojson", Message: "file is not a GeoJSON object"}
+	default:
+		return []geoJSONObject{{Type: "Feature", Geometry: &root}}, nil
+	}
+}
+
+// geometries flattens a GeoJSON geometry, which may be a GeometryCollection, into a list of
+// geometries.
+func (obj *geoJSONObject) geometries() ([]Geometry, error) {
+	if obj.Type == "GeometryCollection" {
+		var all []Geometry
+		for i := range obj.Geometries {
+			gs, err := obj.Geometries[i].geometries()
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, gs...)
+		}
+		return all, nil
+	}
+
+	g := Geometry{Type: obj.Type}
+	var err error
+	switch obj.Type {
+	case GeometryPoint:
+		var pos []float64
+		if err = json.Unmarshal(obj.Coordinates, &pos); err == nil {
+			g.Point, err = latLngFromPosition(pos)
+		}
+	case GeometryLineString:
+		g.LineString, err = decodeGeoJSONPositions(obj.Coordinates)
+	case GeometryMultiPoint:
+		g.MultiPoint, err = decodeGeoJSONPositions(obj.Coordinates)
+	case GeometryPolygon:
+		g.Polygon, err = decodeGeoJSONPolygon(obj.Coordinates)
+	case GeometryMultiLineString:
+		var lines []json.RawMessage
+		if err = json.Unmarshal(obj.Coordinates, &lines); err == nil {
+			for _, raw := range lines {
+				var line []LatLng
+				if line, err = decodeGeoJSONPositions(raw); err != nil {
+					break
+				}
+				g.MultiLineString = append(g.MultiLineString, line)
+			}
+		}
+	case GeometryMultiPolygon:
+		var polys []json.RawMessage
+		if err = json.Unmarshal(obj.Coordinates, &polys); err == nil {
+			for _, raw := range polys {
+				var poly Polygon
+				if poly, err = decodeGeoJSONPolygon(raw); err != nil {
+					break
+				}
+				g.MultiPolygon = append(g.MultiPolygon, poly)
+			}
+		}
+	default:
+		return nil, invalidGeometry("unknown geometry type %q", obj.Type)
+	}
+	if err != nil {
+		return nil, invalidGeometry("%s has invalid coordinates", obj.Type)
+	}
+
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	return []Geometry{g}, nil
+}
+
+// latLngFromPosition converts a GeoJSON position, which is [lng, lat] plus an optional
+// altitude.
+func latLngFromPosition(pos []float64) (LatLng, error) {
+	if len(pos) < 2 {
+		return LatLng{}, errors.New("positions need a longitude and latitude")
+	}
+	return LatLng{pos[1], pos[0]}, nil
+}
+
+func decodeGeoJSONPositions(raw json.RawMessage) ([]LatLng, error) {
+	var positions [][]float64
+	if err := json.Unmarshal(raw, &positions); err != nil {
+		return nil, err
+	}
+	coords := make([]LatLng, len(positions))
+	for i, pos := range positions {
+		c, err := latLngFromPosition(pos)
+		if err != nil {
+			return nil, err
+		}
+		coords[i] = c
+	}
+	return coords, nil
+}
+
+// decodeGeoJSONPolygon reads the rings of a polygon, dropping the repeated last position
+// that closes each of them.
+func decodeGeoJSONPolygon(raw json.RawMessage) (Polygon, error) {
+	var rings []json.RawMessage
+	if err := json.Unmarshal(raw, &rings); err != nil {
+		return nil, err
+	}
+	poly := make(Polygon, len(rings))
+	for i, r := range rings {
+		ring, err := decodeGeoJSONPositions(r)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(ring); n > 1 && ring[0] == ring[n-1] {
+			ring = ring[:n-1]
+		}
+		poly[i] = ring
+	}
+	return poly, nil
+}
+
+// geoJSON converts a geometry to GeoJSON, closing polygon rings and rounding coordinates to
+// about a centimeter.
+func (g *Geometry) geoJSON() geoJSONGeometry {
+	pos := func(c LatLng) []float64 {
+		return []float64{math.Round(c.Lng*1e7) / 1e7, math.Round(c.Lat*1e7) / 1e7}
+	}
+	line := func(coords []LatLng) [][]float64 {
+		out := make([][]float64, len(coords))
+		for i, c := range coords {
+			out[i] = pos(c)
+		}
+		return out
+	}
+	polygon := func(poly Polygon) [][][]float64 {
+		out := make([][][]float64, len(poly))
+		for i, ring := range poly {
+			out[i] = line(ring)
+			if len(ring) > 0 && ring[0] != ring[len(ring)-1] {
+				out[i] = append(out[i], pos(ring[0]))
+			}
+		}
+		return out
+	}
+
+	out := geoJSONGeometry{Type: g.Type}
+	switch g.Type {
+	case GeometryPoint:
+		out.Coordinates = pos(g.Point)
+	case GeometryLineString:
+		out.Coordinates = line(g.LineString)
+	case GeometryMultiPoint:
+		out.Coordinates = line(g.MultiPoint)
+	case GeometryPolygon:
+		out.Coordinates = polygon(g.Polygon)
+	case GeometryMultiLineString:
+		lines := make([][][]float64, len(g.MultiLineString))
+		for i, l := range g.MultiLineString {
+			lines[i] = line(l)
+		}
+		out.Coordinates = lines
+	case GeometryMultiPolygon:
+		polys := make([][][][]float64, len(g.MultiPolygon))
+		for i, p := range g.MultiPolygon {
+			polys[i] = polygon(p)
+		}
+		out.Coordinates = polys
+	}
+	return out
+}
+
+// fromJSONValue converts a property value decoded from JSON (with json.Number for numbers)
+// into something that can be stored, keeping integers as integers.
+func fromJSONValue(v any) any {
+	switch val := v.(type) {
+	case json.Number:
+		if n, err := val.Int64(); err == nil {
+			return n
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]any:
+		for k, elem := range val {
+			val[k] = fromJSONValue(elem)
+		}
+		return val
+	case []any:
+		for i, elem := range val {
+			val[i] = fromJSONValue(elem)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+// stringProperty returns the first of the named properties that is a non-empty string.
+func stringProperty(props map[string]any, names []string) string {
+	for _, name := range names {
+		if str, ok := props[name].(string); ok && str != "" {
+			return strings.TrimSpace(str)
+		}
+	}
+	return ""
+}
+
+// setStringProperty sets whichever of the named properties a feature already has, or else
+// the first of them (unless the value is empty), so that a feature is exported with the same
+// property names it was imported with.
+func setStringProperty(props map[string]any, value string, names []string) {
+	for _, name := range names {
+		if _, ok := props[name]; ok {
+			props[name] = value
+			return
+		}
+	}
+	if value != "" {
+		props[names[0]] = value
+	}
+}
+
+// geoJSONStyles reads the simplestyle properties of a feature.
+func geoJSONStyles(props map[string]any) PathStyles {
+	var styles PathStyles
+	if color, ok := props["stroke"].(string); ok && strings.HasPrefix(color, "#") {
+		styles.Color = color
+	}
+	if width, ok := toFloat64(props["stroke-width"]); ok && width > 0 {
+		styles.Weight = width
+	}
+	if opacity, ok := toFloat64(props["stroke-opacity"]); ok {
+		styles.Opacity = &opacity
+	}
+	if color, ok := props["fill"].(string); ok && strings.HasPrefix(color, "#") {
+		fill := true
+		styles.Fill, styles.FillColor = &fill, color
+	}
+	if opacity, ok := toFloat64(props["fill-opacity"]); ok {
+		styles.FillOpacity = &opacity
+	}
+	return styles
+}
+
+// setGeoJSONStyles replaces the simplestyle properties of a feature with its styles.
+func setGeoJSONStyles(props map[string]any, styles PathStyles) {
+	for _, name := range geoJSONStyleProperties {
+		delete(props, name)
+	}
+	if styles.Color != "" {
+		props["stroke"] = styles.Color
+	}
+	if styles.Weight > 0 {
+		props["stroke-width"] = styles.Weight
+	}
+	if styles.Opacity != nil {
+		props["stroke-opacity"] = *styles.Opacity
+	}
+	if styles.FillColor != "" && (styles.Fill == nil || *styles.Fill) {
+		props["fill"] = styles.FillColor
+	}
+	if styles.FillOpacity != nil {
+		props["fill-opacity"] = *styles.FillOpacity
+	}
+}
+
+// importGeoJSON adds the features of a GeoJSON file to a project.
+func importGeoJSON(s *Server, u *UserConn, params []byte, data []byte) (any, error) {
+	var p GeoJSONImportParams
+	if err := msgpack.Unmarshal(params, &p); err != nil {
+		// TODO
+		return nil, err
+	}
+	if err := requireProject(s.Database, p.ProjectID); err != nil {
+		return nil, err
+	}
+
+	features, err := readGeoJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	report := FeatureImportReport{ProjectID: p.ProjectID, Errors: []string{}}
+	var (
+		stops   []StopInfo
+		paths   []PathInfo
+		circles []CircleInfo
+	)
+
+	for i := range features {
+		f := &features[i]
+		props := map[string]any{}
+		for k, v := range f.Properties {
+			props[k] = fromJSONValue(v)
+		}
+		name := stringProperty(props, geoJSONNameProperties)
+
+		label := fmt.Sprintf("feature %d", i+1)
+		if name != "" {
+			label = fmt.Sprintf("feature %d (%s)", i+1, name)
+		}
+		if f.Type != "Feature" || f.Geometry == nil {
+			report.Skipped++
+			report.addError("%s has no geometry", label)
+			continue
+		}
+		geometries, err := f.Geometry.geometries()
+		if err != nil {
+			report.Skipped++
+			report.addError("%s: %s", label, errorMessage(err))
+			continue
+		}
+
+		var points []LatLng
+		var lines []LineString
+		var polygons []Polygon
+		for _, g := range geometries {
+			switch g.Type {
+			case GeometryPoint:
+				points = append(points, g.Point)
+			case GeometryMultiPoint:
+				points = append(points, g.MultiPoint...)
+			case GeometryLineString:
+				lines = append(lines, g.LineString)
+			case GeometryMultiLineString:
+				lines = append(lines, g.MultiLineString...)
+			case GeometryPolygon, GeometryMultiPolygon:
+				if g.Type == GeometryPolygon {
+					polygons = append(polygons, g.Polygon)
+				} else {
+					polygons = append(polygons, g.MultiPolygon...)
+				}
+			}
+		}
+
+		styles := geoJSONStyles(props)
+		rawStyles, err := encodePathStyles(styles)
+		if err != nil {
+			// TODO
+			return nil, err
+		}
+		radius, isCircle := toFloat64(props["radius"])
+		isCircle = isCircle && radius >= 0.5
+
+		for _, pt := range points {
+			id, err := uuid.NewRandom()
+			if err != nil {
+				// TODO
+				return nil, err
+			}
+			if isCircle {
+				circles = append(circles, CircleInfo{CircleSpec{
+					ProjectID:    p.ProjectID,
+					Center:       pt,
+					RadiusMeters: uint(math.Round(radius)),
+					Name:         name,
+					Styles:       rawStyles,
+					Properties:   props,
+				}, id.String()})
+				continue
+			}
+			stops = append(stops, StopInfo{
+				ID:          id.String(),
+				ProjectID:   p.ProjectID,
+				Code:        stringProperty(props, geoJSONCodeProperties),
+				Name:        name,
+				Description: stringProperty(props, geoJSONDescriptionProperties),
+				Lat:         pt.Lat,
+				Lng:         pt.Lng,
+				Properties:  props,
+			})
+		}
+		for _, coords := range lines {
+			path, err := newPathInfo(p.ProjectID, name, true, coords, styles)
+			if err != nil {
+				// TODO
+				return nil, err
+			}
+			path.Properties = props
+			paths = append(paths, path)
+		}
+		for _, poly := range polygons {
+			path, err := newPathInfo(p.ProjectID, name, false, poly[0], styles)
+			if err != nil {
+				// TODO
+				return nil, err
+			}
+			path.Holes = holesOf(poly)
+			path.Properties = props
+			paths = append(paths, path)
+		}
+	}
+
+	if err := saveImportedFeatures(s.Database, stops, paths, circles); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	report.Stops, report.Paths, report.Circles = len(stops), len(paths), len(circles)
+	s.publish(u, ProjectEvent{ProjectID: p.ProjectID, Type: "geojson:imported", Data: report})
+
+	return report, nil
+}
+
+func exportGeoJSON(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req GeoJSONExportRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, req.ProjectID); err != nil {
+		return nil, err
+	}
+
+	var proj ProjectInfo
+	if err := s.Database.Take(&proj, "id = ?", req.ProjectID).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	var (
+		stops   []StopInfo
+		paths   []PathInfo
+		circles []CircleInfo
+	)
+	for _, records := range []any{&stops, &paths, &circles} {
+		if err := s.Database.Order("name, id").Find(records, "project_id = ?", req.ProjectID).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	// Start from the properties each feature was imported with, then bring them up to date
+	properties := func(stored FeatureProperties, name string) map[string]any {
+		props := make(map[string]any, len(stored)+1)
+		for k, v := range stored {
+			props[k] = v
+		}
+		setStringProperty(props, name, geoJSONNameProperties)
+		return props
+	}
+
+	features := []geoJSONFeature{}
+	for _, stop := range stops {
+		props := properties(stop.Properties, stop.Name)
+		setStringProperty(props, stop.Code, geoJSONCodeProperties)
+		setStringProperty(props, stop.Description, geoJSONDescriptionProperties)
+		delete(props, "radius")
+
+		g := Geometry{Type: GeometryPoint, Point: LatLng{stop.Lat, stop.Lng}}
+		features = append(features, geoJSONFeature{"Feature", stop.ID, g.geoJSON(), props})
+	}
+	for i := range paths {
+		p := &paths[i]
+		if p.PathSpec.validate() != nil {
+			continue
+		}
+
+		props := properties(p.Properties, p.Name)
+		setGeoJSONStyles(props, decodePathStyles(p.Styles))
+
+		g := p.geometry()
+		features = append(features, geoJSONFeature{"Feature", p.ID, g.geoJSON(), props})
+	}
+	for _, c := range circles {
+		if c.validate() != nil {
+			continue
+		}
+
+		props := properties(c.Properties, c.Name)
+		setGeoJSONStyles(props, decodePathStyles(c.Styles))
+		props["radius"] = c.RadiusMeters
+
+		g := Geometry{Type: GeometryPoint, Point: c.Center}
+		features = append(features, geoJSONFeature{"Feature", c.ID, g.geoJSON(), props})
+	}
+
+	data, err := json.MarshalIndent(struct {
+		Type     string           `json:"type"`
+		Features []geoJSONFeature `json:"features"`
+	}{"FeatureCollection", features}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	dl, err := s.addDownload(fileNameFor(proj.Name, "features")+".geojson", "application/geo+json", data)
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	return dl, nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Geometry types, named as in GeoJSON.
+const (
+	GeometryPoint           = "Point"
+	GeometryLineString      = "LineString"
+	GeometryPolygon         = "Polygon"
+	GeometryMultiPoint      = "MultiPoint"
+	GeometryMultiLineString = "MultiLineString"
+	GeometryMultiPolygon    = "MultiPolygon"
+)
+
+// LineString is a line through a list of coordinates. The coordinates of paths are stored as
+// LineStrings, which are MessagePack arrays of [lat, lng] pairs both on the wire and in the
+// database.
+type LineString []LatLng
+
+// Geometry is a single geometry of one of the GeoJSON types, with coordinates as LatLngs
+// instead of GeoJSON's [lng, lat] arrays. Only the field matching the Type is used. On the
+// wire it is a {type, coordinates} map, where the coordinates are nested the way GeoJSON
+// nests them but with [lat, lng] pairs.
+type Geometry struct {
+	Type            string
+	Point           LatLng
+	LineString      LineString
+	Polygon         Polygon
+	MultiPoint      []LatLng
+	MultiLineString []LineString
+	MultiPolygon    MultiPolygon
+}
+
+// coordinates returns the coordinates of the geometry for its Type, or nil if the Type is not
+// known.
+func (g *Geometry) coordinates() any {
+	switch g.Type {
+	case GeometryPoint:
+		return &g.Point
+	case GeometryLineString:
+		return &g.LineString
+	case GeometryPolygon:
+		return &g.Polygon
+	case GeometryMultiPoint:
+		return &g.MultiPoint
+	case GeometryMultiLineString:
+		return &g.MultiLineString
+	case GeometryMultiPolygon:
+		return &g.MultiPolygon
+	}
+	return nil
+}
+
+func (g Geometry) EncodeMsgpack(enc *msgpack.Encoder) error {
+	coords := g.coordinates()
+	if coords == nil {
+		return fmt.Errorf("unknown geometry type %q", g.Type)
+	}
+	return enc.Encode(map[string]any{"type": g.Type, "coordinates": coords})
+}
+
+func (g *Geometry) DecodeMsgpack(dec *msgpack.Decoder) error {
+	var wire struct {
+		Type        string             `msgpack:"type"`
+		Coordinates msgpack.RawMessage `msgpack:"coordinates"`
+	}
+	if err := dec.Decode(&wire); err != nil {
+		return err
+	}
+
+	*g = Geometry{Type: wire.Type}
+	coords := g.coordinates()
+	if coords == nil {
+		return fmt.Errorf("unknown geometry type %q", wire.Type)
+	}
+	return msgpack.Unmarshal(wire.Coordinates, coords)
+}
+
+// validate checks that the geometry is well-formed: every coordinate is a real latitude and
+// longitude, lines have at least two coordinates, and polygon rings at least three (rings do
+// not repeat their first coordinate at the end).
+func (g *Geometry) validate() error {
+	switch g.Type {
+	case GeometryPoint:
+		return validateCoords(g.Type, []LatLng{g.Point}, 1)
+	case GeometryLineString:
+		return validateCoords(g.Type, g.LineString, 2)
+	case GeometryPolygon:
+		return validatePolygon(g.Polygon)
+	case GeometryMultiPoint:
+		return validateCoords(g.Type, g.MultiPoint, 1)
+	case GeometryMultiLineString:
+		for _, line := range g.MultiLineString {
+			if err := validateCoords(GeometryLineString, line, 2); err != nil {
+				return err
+			}
+		}
+		return nil
+	case GeometryMultiPolygon:
+		for _, poly := range g.MultiPolygon {
+			if err := validatePolygon(poly); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return invalidGeometry("unknown geometry type %q", g.Type)
+	}
+}
+
+func validatePolygon(poly Polygon) error {
+	if len(poly) == 0 {
+		return invalidGeometry("a polygon must have an outer ring")
+	}
+	for _, ring := range poly {
+		if err := validateCoords("polygon ring", ring, 3); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCoords checks that there are at least min coordinates and that they are all valid.
+func validateCoords(what string, coords []LatLng, min int) error {
+	if len(coords) < min {
+		return invalidGeometry("a %s needs at least %d coordinates, not %d", what, min, len(coords))
+	}
+	for _, c := range coords {
+		if !c.valid() {
+			return invalidGeometry("[%v, %v] is not a valid latitude and longitude", c.Lat, c.Lng)
+		}
+	}
+	return nil
+}
+
+func invalidGeometry(format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	return &ErrorWithCode{Code: "invalid-geometry", Message: msg}
+}
+
+// valid reports whether a coordinate is a real latitude and longitude.
+func (c LatLng) valid() bool {
+	return !math.IsNaN(c.Lat) && !math.IsNaN(c.Lng) && math.Abs(c.Lat) <= 90 && math.Abs(c.Lng) <= 180
+}
+
+// validate checks the coordinates of a path: lines need at least two coordinates and closed
+// shapes at least three, as do their holes. Lines cannot have holes.
+func (spec *PathSpec) validate() error {
+	if spec.Line {
+		if len(spec.Holes) > 0 {
+			return invalidGeometry("a line cannot have holes")
+		}
+		return validateCoords("line", spec.Coords, 2)
+	}
+	if err := validateCoords("closed shape", spec.Coords, 3); err != nil {
+		return err
+	}
+	for _, hole := range spec.Holes {
+		if err := validateCoords("hole", hole, 3); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// geometry returns a path as a LineString, or a Polygon if it is a closed shape. Polygons wind
+// counter-clockwise and their holes clockwise, whichever way the path was drawn.
+func (p *PathInfo) geometry() Geometry {
+	if p.Line {
+		return Geometry{Type: GeometryLineString, LineString: p.Coords}
+	}
+
+	poly := Polygon{orientRing(p.Coords, true)}
+	for _, hole := range p.Holes {
+		poly = append(poly, orientRing(hole, false))
+	}
+	return Geometry{Type: GeometryPolygon, Polygon: poly}
+}
+
+// orientRing copies a ring without repeating its first coordinate at the end, winding it
+// counter-clockwise or clockwise.
+func orientRing(coords []LatLng, ccw bool) []LatLng {
+	ring := make([]LatLng, len(coords))
+	copy(ring, coords)
+	if n := len(ring); n > 1 && ring[0] == ring[n-1] {
+		ring = ring[:n-1]
+	}
+
+	xy := make([][2]float64, len(ring))
+	for i, c := range ring {
+		xy[i] = [2]float64{c.Lng, c.Lat}
+	}
+	if (signedArea(xy) < 0) == ccw {
+		for i, j := 0, len(ring)-1; i < j; i, j = i+1, j-1 {
+			ring[i], ring[j] = ring[j], ring[i]
+		}
+	}
+	return ring
+}
+
+// holesOf returns the holes of a polygon, i.e., all but its outer ring.
+func holesOf(poly Polygon) Rings {
+	var holes Rings
+	for _, ring := range poly[1:] {
+		holes = append(holes, ring)
+	}
+	return holes
+}
+
+// coords calls f with every coordinate of the geometry.
+func (g *Geometry) coords(f func(LatLng)) {
+	each := func(coords []LatLng) {
+		for _, c := range coords {
+			f(c)
+		}
+	}
+	switch g.Type {
+	case GeometryPoint:
+		f(g.Point)
+	case GeometryLineString:
+		each(g.LineString)
+	case GeometryMultiPoint:
+		each(g.MultiPoint)
+	case GeometryPolygon:
+		for _, ring := range g.Polygon {
+			each(ring)
+		}
+	case GeometryMultiLineString:
+		for _, line := range g.MultiLineString {
+			each(line)
+		}
+	case GeometryMultiPolygon:
+		for _, poly := range g.MultiPolygon {
+			for _, ring := range poly {
+				each(ring)
+			}
+		}
+	}
+}
+
+// bounds returns the southwest and northeast corners of the smallest box containing the
+// geometry.
+func (g *Geometry) bounds() (sw, ne LatLng) {
+	sw = LatLng{math.Inf(1), math.Inf(1)}
+	ne = LatLng{math.Inf(-1), math.Inf(-1)}
+	g.coords(func(c LatLng) {
+		sw.Lat, sw.Lng = math.Min(sw.Lat, c.Lat), math.Min(sw.Lng, c.Lng)
+		ne.Lat, ne.Lng = math.Max(ne.Lat, c.Lat), math.Max(ne.Lng, c.Lng)
+	})
+	return sw, ne
+}
+
+// The database stores geometry, coordinates and properties in their MessagePack encodings.
+
+func (Geometry) GormDataType() string {
+	return "bytes"
+}
+
+func (g Geometry) Value() (driver.Value, error) {
+	return msgpack.Marshal(g)
+}
+
+func (g *Geometry) Scan(src any) error {
+	*g = Geometry{}
+	return scanMsgpack(src, g)
+}
+
+func (LineString) GormDataType() string {
+	return "bytes"
+}
+
+func (ls LineString) Value() (driver.Value, error) {
+	if ls == nil {
+		return nil, nil
+	}
+	return msgpack.Marshal([]LatLng(ls))
+}
+
+func (ls *LineString) Scan(src any) error {
+	*ls = nil
+	return scanMsgpack(src, (*[]LatLng)(ls))
+}
+
+// Rings are the holes of a closed path. They are stored like LineStrings.
+type Rings []LineString
+
+func (Rings) GormDataType() string {
+	return "bytes"
+}
+
+func (r Rings) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	return msgpack.Marshal([]LineString(r))
+}
+
+func (r *Rings) Scan(src any) error {
+	*r = nil
+	return scanMsgpack(src, (*[]LineString)(r))
+}
+
+// ShapeDistances are stored like LineStrings. They are nil when unknown.
+type ShapeDistances []float64
+
+func (ShapeDistances) GormDataType() string {
+	return "bytes"
+}
+
+func (sd ShapeDistances) Value() (driver.Value, error) {
+	if sd == nil {
+		return nil, nil
+	}
+	return msgpack.Marshal([]float64(sd))
+}
+
+func (sd *ShapeDistances) Scan(src any) error {
+	*sd = nil
+	return scanMsgpack(src, (*[]float64)(sd))
+}
+
+func (LatLng) GormDataType() string {
+	return "bytes"
+}
+
+func (c LatLng) Value() (driver.Value, error) {
+	return msgpack.Marshal(c)
+}
+
+func (c *LatLng) Scan(src any) error {
+	*c = LatLng{}
+	return scanMsgpack(src, c)
+}
+
+// FeatureProperties are arbitrary properties of a map feature, such as the attributes it had in
+// a GeoJSON file it was imported from. They are kept so they can be exported again.
+type FeatureProperties map[string]any
+
+func (FeatureProperties) GormDataType() string {
+	return "bytes"
+}
+
+func (fp FeatureProperties) Value() (driver.Value, error) {
+	if len(fp) == 0 {
+		return nil, nil
+	}
+	return msgpack.Marshal(map[string]any(fp))
+}
+
+func (fp *FeatureProperties) Scan(src any) error {
+	*fp = nil
+	return scanMsgpack(src, (*map[string]any)(fp))
+}
+
+// scanMsgpack decodes a MessagePack value read from the database. NULL leaves v alone. A value
+// that cannot be decoded is treated as empty, with a warning in the log, so one corrupt row
+// cannot stop a whole project from loading.
+func scanMsgpack(src any, v any) error {
+	var err error
+	switch data := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		if len(data) == 0 {
+			return nil
+		}
+		err = msgpack.Unmarshal(data, v)
+	case string:
+		err = msgpack.Unmarshal([]byte(data), v)
+	default:
+		err = fmt.Errorf("cannot decode %T as MessagePack", src)
+	}
+	if err != nil {
+		log.Printf("Treating corrupt %T from the database as empty: %v", v, err)
+		rv := reflect.ValueOf(v).Elem()
+		rv.Set(reflect.Zero(rv.Type()))
+	}
+	return nil
+}
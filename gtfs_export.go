@@ -0,0 +1,493 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// GTFSExportResult is the reply to a 'gtfs:export' request. Warnings describe problems that
+// did not prevent the feed from being generated, e.g., trips that had to be left out.
+type GTFSExportResult struct {
+	Download *DownloadInfo `msgpack:"download"`
+	Warnings []string      `msgpack:"warnings"`
+}
+
+func exportGTFS(s *Server, u *UserConn, payload []byte) (any, error) {
+	var projectID string
+	if err := msgpack.Unmarshal(payload, &projectID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, projectID); err != nil {
+		return nil, err
+	}
+
+	var proj ProjectInfo
+	if err := s.Database.Take(&proj, "id = ?", projectID).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	data, warnings, problems, err := buildGTFSFeed(s.Database, projectID)
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-gtfs-export",
+			Message: fmt.Sprintf("project cannot be exported as GTFS until %d problem(s) are fixed", len(problems)),
+			Details: problems,
+		}
+	}
+
+	dl, err := s.addDownload(fileNameFor(proj.Name, "gtfs")+".zip", "application/zip", data)
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	return GTFSExportResult{dl, warnings}, nil
+}
+
+// buildGTFSFeed generates a zipped GTFS feed from the contents of a project. Problems are
+// violations of the GTFS specification that make the feed unusable, in which case no feed is
+// generated. Warnings are issues that were worked around by leaving records out of the feed.
+func buildGTFSFeed(db *gorm.DB, projectID string) (data []byte, warnings, problems []string, err error) {
+	var (
+		agencies      []AgencyInfo
+		stops         []StopInfo
+		routes        []RouteInfo
+		trips         []TripInfo
+		stopTimes     []StopTimeInfo
+		calendars     []CalendarInfo
+		calendarDates []CalendarDateInfo
+		frequencies   []FrequencyInfo
+	)
+	for _, records := range []any{
+		&agencies, &stops, &routes, &trips, &calendars, &calendarDates, &frequencies,
+	} {
+		if err = db.Find(records, "project_id = ?", projectID).Error; err != nil {
+			return
+		}
+	}
+	if err = db.Order("trip_id, stop_sequence").Find(&stopTimes, "project_id = ?", projectID).Error; err != nil {
+		return
+	}
+
+	warnings, problems = []string{}, []string{}
+	warn := func(format string, args ...any) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+	problem := func(format string, args ...any) { problems = append(problems, fmt.Sprintf(format, args...)) }
+
+	// Agencies
+
+	agencyIDs := map[string]bool{}
+	if len(agencies) == 0 {
+		problem("project has no agency")
+	}
+	for _, a := range agencies {
+		agencyIDs[a.ID] = true
+		if a.URL == "" || a.Timezone == "" {
+			problem("agency %q must have a URL and timezone", a.Name)
+		}
+	}
+
+	// Services
+
+	serviceIDs := map[string]bool{}
+	for _, c := range calendars {
+		serviceIDs[c.ID] = true
+	}
+	datedServices := map[string]bool{}
+	for _, cd := range calendarDates {
+		if !serviceIDs[cd.ServiceID] {
+			warn("calendar exception on %s refers to a missing service and was left out", cd.Date)
+			continue
+		}
+		datedServices[cd.ServiceID] = true
+	}
+
+	// Services without a date range only go in calendar_dates.txt, so they need some dates
+	var regularCalendars []CalendarInfo
+	for _, c := range calendars {
+		if c.StartDate != "" && c.EndDate != "" {
+			regularCalendars = append(regularCalendars, c)
+			continue
+		}
+		name := c.Name
+		if name == "" {
+			name = c.ID
+		}
+		if !datedServices[c.ID] {
+			problem("service %q must have a start and end date or calendar dates", name)
+		} else if c.Monday || c.Tuesday || c.Wednesday || c.Thursday || c.Friday || c.Saturday || c.Sunday {
+			warn("service %q has no start and end date, so only its calendar dates were exported", name)
+		}
+	}
+
+	// Routes
+
+	routeIDs := map[string]bool{}
+	for _, r := range routes {
+		routeIDs[r.ID] = true
+		if r.ShortName == "" && r.LongName == "" {
+			problem("route %q must have a short name or a long name", r.ID)
+		}
+		if !agencyIDs[r.AgencyID] && len(agencies) != 1 {
+			problem("route %q does not refer to one of the project's agencies", routeLabel(r))
+		}
+	}
+
+	// Stops
+
+	stopIDs := map[string]bool{}
+	for _, st := range stops {
+		stopIDs[st.ID] = true
+	}
+	for _, st := range stops {
+		if st.Name == "" && st.Type <= 2 {
+			problem("stop %q must have a name", st.ID)
+		}
+		if st.ParentStation != "" && !stopIDs[st.ParentStation] {
+			warn("stop %q refers to a missing parent station, which was left out", st.Name)
+		}
+	}
+
+	// Stop times, grouped by trip (they are already sorted by trip and sequence)
+
+	tripStopTimes := map[string][]StopTimeInfo{}
+	for _, st := range stopTimes {
+		if !stopIDs[st.StopID] {
+			problem("a stop time of trip %q refers to missing stop %q", st.TripID, st.StopID)
+			continue
+		}
+		tripStopTimes[st.TripID] = append(tripStopTimes[st.TripID], st)
+	}
+
+	// Trips
+
+	shapeIDs := map[string]bool{}
+	exportedTrips := make([]TripInfo, 0, len(trips))
+	for _, t := range trips {
+		if !routeIDs[t.RouteID] {
+			problem("trip %q refers to missing route %q", t.ID, t.RouteID)
+			continue
+		}
+		if !serviceIDs[t.ServiceID] {
+			problem("trip %q refers to missing service %q", t.ID, t.ServiceID)
+			continue
+		}
+
+		sts := tripStopTimes[t.ID]
+		if len(sts) < 2 {
+			warn("trip %q has fewer than 2 stop times and was left out", t.ID)
+			delete(tripStopTimes, t.ID)
+			continue
+		}
+		if sts[0].ArrivalTime == nil || sts[len(sts)-1].ArrivalTime == nil {
+			problem("the first and last stops of trip %q must have arrival and departure times", t.ID)
+			continue
+		}
+
+		if t.ShapeID != "" {
+			shapeIDs[t.ShapeID] = true
+		}
+		exportedTrips = append(exportedTrips, t)
+	}
+	if len(exportedTrips) == 0 {
+		problem("project has no complete trips")
+	}
+
+	exportedTripIDs := map[string]bool{}
+	for _, t := range exportedTrips {
+		exportedTripIDs[t.ID] = true
+	}
+
+	// Shapes come from the paths referenced by trips
+
+	var shapes []PathInfo
+	if len(shapeIDs) > 0 {
+		ids := make([]string, 0, len(shapeIDs))
+		for id := range shapeIDs {
+			ids = append(ids, id)
+		}
+		if err = db.Find(&shapes, "project_id = ? AND id IN ?", projectID, ids).Error; err != nil {
+			return
+		}
+	}
+	shapeCoords := map[string][]LatLng{}
+	shapeDists := map[string]ShapeDistances{}
+	for _, sh := range shapes {
+		if len(sh.Coords) < 2 {
+			continue
+		}
+		shapeCoords[sh.ID] = sh.Coords
+		if len(sh.ShapeDistTraveled) == len(sh.Coords) {
+			shapeDists[sh.ID] = sh.ShapeDistTraveled
+		}
+	}
+	for i, t := range exportedTrips {
+		if t.ShapeID != "" && shapeCoords[t.ShapeID] == nil {
+			warn("trip %q refers to a missing or empty shape, so its shape was left out", t.ID)
+			exportedTrips[i].ShapeID = ""
+		}
+	}
+
+	// Distances traveled along a shape must be in the same units as the shape's own, so they
+	// are only kept for trips whose shape still has the distances it was imported with
+	for _, t := range exportedTrips {
+		if shapeDists[t.ShapeID] != nil {
+			continue
+		}
+		dropped := false
+		sts := tripStopTimes[t.ID]
+		for i := range sts {
+			if sts[i].ShapeDistTraveled != nil {
+				sts[i].ShapeDistTraveled = nil
+				dropped = true
+			}
+		}
+		if dropped {
+			warn("trip %q has no shape distances to match, so its shape_dist_traveled was left out", t.ID)
+		}
+	}
+
+	if len(problems) > 0 {
+		return
+	}
+
+	// Everything checks out, so write the files
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw := gtfsFeedWriter{zw: zw}
+
+	fw.write("agency.txt", []string{
+		"agency_id", "agency_name", "agency_url", "agency_timezone",
+		"agency_lang", "agency_phone", "agency_fare_url", "agency_email",
+	}, len(agencies), func(i int) []string {
+		a := agencies[i]
+		return []string{a.ID, a.Name, a.URL, a.Timezone, a.Lang, a.Phone, a.FareURL, a.Email}
+	})
+
+	fw.write("stops.txt", []string{
+		"stop_id", "stop_code", "stop_name", "tts_stop_name", "stop_desc", "stop_lat", "stop_lon",
+		"zone_id", "stop_url", "location_type", "parent_station", "stop_timezone",
+		"wheelchair_boarding", "level_id", "platform_code",
+	}, len(stops), func(i int) []string {
+		st := stops[i]
+		parent := st.ParentStation
+		if !stopIDs[parent] {
+			parent = ""
+		}
+		return []string{
+			st.ID, st.Code, st.Name, st.NameTTS, st.Description, formatFloat(st.Lat), formatFloat(st.Lng),
+			st.ZoneID, st.URL, formatUint(st.Type), parent, st.Timezone,
+			formatUint(st.WheelchairBoarding), st.LevelID, st.PlatformCode,
+		}
+	})
+
+	fw.write("routes.txt", []string{
+		"route_id", "agency_id", "route_short_name", "route_long_name", "route_desc", "route_type",
+		"route_url", "route_color", "route_text_color", "route_sort_order",
+	}, len(routes), func(i int) []string {
+		r := routes[i]
+		agencyID := r.AgencyID
+		if !agencyIDs[agencyID] {
+			agencyID = agencies[0].ID // only allowed when there is exactly one agency
+		}
+		return []string{
+			r.ID, agencyID, r.ShortName, r.LongName, r.Description, formatUint(r.Type),
+			r.URL, r.Color, r.TextColor, formatUint(r.SortOrder),
+		}
+	})
+
+	fw.write("trips.txt", []string{
+		"route_id", "service_id", "trip_id", "trip_headsign", "trip_short_name", "direction_id",
+		"block_id", "shape_id", "wheelchair_accessible", "bikes_allowed",
+	}, len(exportedTrips), func(i int) []string {
+		t := exportedTrips[i]
+		return []string{
+			t.RouteID, t.ServiceID, t.ID, t.Headsign, t.ShortName, formatUint(t.DirectionID),
+			t.BlockID, t.ShapeID, formatUint(t.WheelchairAccessible), formatUint(t.BikesAllowed),
+		}
+	})
+
+	var exportedStopTimes []StopTimeInfo
+	for _, t := range exportedTrips {
+		exportedStopTimes = append(exportedStopTimes, tripStopTimes[t.ID]...)
+	}
+	fw.write("stop_times.txt", []string{
+		"trip_id", "arrival_time", "departure_time", "stop_id", "stop_sequence",
+		"stop_headsign", "pickup_type", "drop_off_type", "shape_dist_traveled", "timepoint",
+	}, len(exportedStopTimes), func(i int) []string {
+		st := exportedStopTimes[i]
+		return []string{
+			st.TripID, formatOptionalGTFSTime(st.ArrivalTime), formatOptionalGTFSTime(st.DepartureTime),
+			st.StopID, formatUint(st.StopSequence), st.StopHeadsign,
+			formatUint(st.PickupType), formatUint(st.DropOffType), formatOptionalFloat(st.ShapeDistTraveled),
+			formatUint(st.Timepoint),
+		}
+	})
+
+	if len(regularCalendars) > 0 {
+		fw.write("calendar.txt", []string{
+			"service_id", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday",
+			"start_date", "end_date",
+		}, len(regularCalendars), func(i int) []string {
+			c := regularCalendars[i]
+			return []string{
+				c.ID, formatBool(c.Monday), formatBool(c.Tuesday), formatBool(c.Wednesday),
+				formatBool(c.Thursday), formatBool(c.Friday), formatBool(c.Saturday), formatBool(c.Sunday),
+				c.StartDate, c.EndDate,
+			}
+		})
+	}
+
+	var exportedDates []CalendarDateInfo
+	for _, cd := range calendarDates {
+		if serviceIDs[cd.ServiceID] {
+			exportedDates = append(exportedDates, cd)
+		}
+	}
+	if len(exportedDates) > 0 {
+		fw.write("calendar_dates.txt", []string{
+			"service_id", "date", "exception_type",
+		}, len(exportedDates), func(i int) []string {
+			cd := exportedDates[i]
+			return []string{cd.ServiceID, cd.Date, formatUint(cd.ExceptionType)}
+		})
+	}
+
+	if len(shapeCoords) > 0 {
+		var rows [][]string
+		shapeIDs := make([]string, 0, len(shapeCoords))
+		for id := range shapeCoords {
+			shapeIDs = append(shapeIDs, id)
+		}
+		sort.Strings(shapeIDs)
+		for _, id := range shapeIDs {
+			dists := shapeDists[id]
+			for seq, c := range shapeCoords[id] {
+				dist := ""
+				if dists != nil {
+					dist = formatFloat(dists[seq])
+				}
+				rows = append(rows, []string{id, formatFloat(c.Lat), formatFloat(c.Lng), strconv.Itoa(seq + 1), dist})
+			}
+		}
+		fw.write("shapes.txt", []string{
+			"shape_id", "shape_pt_lat", "shape_pt_lon", "shape_pt_sequence", "shape_dist_traveled",
+		}, len(rows), func(i int) []string { return rows[i] })
+	}
+
+	var exportedFrequencies []FrequencyInfo
+	for _, f := range frequencies {
+		if exportedTripIDs[f.TripID] {
+			exportedFrequencies = append(exportedFrequencies, f)
+		}
+	}
+	if len(exportedFrequencies) > 0 {
+		fw.write("frequencies.txt", []string{
+			"trip_id", "start_time", "end_time", "headway_secs", "exact_times",
+		}, len(exportedFrequencies), func(i int) []string {
+			f := exportedFrequencies[i]
+			return []string{
+				f.TripID, formatGTFSTime(f.StartTime), formatGTFSTime(f.EndTime),
+				formatUint(f.HeadwaySecs), formatUint(f.ExactTimes),
+			}
+		})
+	}
+
+	if fw.err != nil {
+		err = fw.err
+		return
+	}
+	if err = zw.Close(); err != nil {
+		return
+	}
+
+	data = buf.Bytes()
+	return
+}
+
+// gtfsFeedWriter writes CSV files into a zip archive, remembering the first error.
+type gtfsFeedWriter struct {
+	zw  *zip.Writer
+	err error
+}
+
+func (fw *gtfsFeedWriter) write(name string, header []string, n int, row func(int) []string) {
+	if fw.err != nil {
+		return
+	}
+
+	f, err := fw.zw.Create(name)
+	if err != nil {
+		fw.err = err
+		return
+	}
+
+	cw := csv.NewWriter(f)
+	cw.Write(header)
+	for i := 0; i < n; i++ {
+		cw.Write(row(i))
+	}
+	cw.Flush()
+	fw.err = cw.Error()
+}
+
+// routeLabel returns the most human-friendly name of a route for messages.
+func routeLabel(r RouteInfo) string {
+	if r.ShortName != "" {
+		return r.ShortName
+	}
+	if r.LongName != "" {
+		return r.LongName
+	}
+	return r.ID
+}
+
+// formatGTFSTime is the inverse of parseGTFSTime.
+func formatGTFSTime(secs int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs%3600/60, secs%60)
+}
+
+// formatOptionalGTFSTime is like formatGTFSTime, but formats nil as an empty string.
+func formatOptionalGTFSTime(secs *int) string {
+	if secs == nil {
+		return ""
+	}
+	return formatGTFSTime(*secs)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// formatOptionalFloat is like formatFloat, but formats nil as an empty string.
+func formatOptionalFloat(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return formatFloat(*f)
+}
+
+func formatUint(n uint) string {
+	return strconv.FormatUint(uint64(n), 10)
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxGTFSErrorsPerFile caps the number of errors reported for a single file of a feed so
+	// that a badly broken file does not produce an enormous reply. Rows with errors beyond
+	// this limit are still counted as skipped.
+	MaxGTFSErrorsPerFile = 50
+	// gtfsInsertBatchSize is the number of rows inserted per statement during an import.
+	gtfsInsertBatchSize = 500
+)
+
+// GTFSImportRequest is the payload of a 'gtfs:import' request. Data is the raw zip file.
+type GTFSImportRequest struct {
+	ProjectID string `msgpack:"project_id"`
+	Data      []byte `msgpack:"data"`
+}
+
+// GTFSImportParams are the upload ticket parameters for the "gtfs" upload kind.
+type GTFSImportParams struct {
+	ProjectID string `msgpack:"project_id"`
+}
+
+// GTFSImportError describes a problem with a single row (or a whole file, if Line is 0) of
+// an imported feed.
+type GTFSImportError struct {
+	File    string `msgpack:"file"`
+	Line    int    `msgpack:"line"`
+	Message string `msgpack:"message"`
+}
+
+// GTFSImportReport summarizes a GTFS import. Counts and Skipped are keyed by file name, e.g.,
+// "stops.txt".
+type GTFSImportReport struct {
+	ProjectID string            `msgpack:"project_id"`
+	Counts    map[string]int    `msgpack:"counts"`
+	Skipped   map[string]int    `msgpack:"skipped"`
+	Errors    []GTFSImportError `msgpack:"errors"`
+}
+
+func importGTFSRequest(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req GTFSImportRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	return importGTFS(s, u, req.ProjectID, req.Data)
+}
+
+func importGTFSUpload(s *Server, u *UserConn, params []byte, data []byte) (any, error) {
+	var p GTFSImportParams
+	if err := msgpack.Unmarshal(params, &p); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	return importGTFS(s, u, p.ProjectID, data)
+}
+
+// importGTFS adds the contents of a zipped GTFS feed to a project. Every record is given a
+// new UUID (so the same feed can be imported into multiple projects) and references between
+// files are translated accordingly. Shapes become line paths named after their shape ID.
+// Rows that cannot be imported are skipped and reported, but the rest of the feed is still
+// imported.
+func importGTFS(s *Server, u *UserConn, projectID string, data []byte) (*GTFSImportReport, error) {
+	if err := requireProject(s.Database, projectID); err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "bad-gtfs-zip",
+			Message: fmt.Sprintf("GTFS feed is not a valid zip file: %v", err),
+		}
+	}
+
+	im := gtfsImporter{
+		projectID: projectID,
+		files:     map[string]*zip.File{},
+		report: GTFSImportReport{
+			ProjectID: projectID,
+			Counts:    map[string]int{},
+			Skipped:   map[string]int{},
+			Errors:    []GTFSImportError{},
+		},
+		agencyIDs:  map[string]string{},
+		stopIDs:    map[string]string{},
+		serviceIDs: map[string]string{},
+		shapeIDs:   map[string]string{},
+		routeIDs:   map[string]string{},
+		tripIDs:    map[string]string{},
+	}
+
+	// Some feeds are zipped up with an enclosing folder, so only look at base names
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() {
+			im.files[path.Base(f.Name)] = f
+		}
+	}
+
+	// The order matters because later files refer to records from earlier ones
+	im.readAgencies()
+	im.readStops()
+	im.readCalendars()
+	im.readCalendarDates()
+	im.readShapes()
+	im.readRoutes()
+	im.readTrips()
+	im.readStopTimes()
+	im.readFrequencies()
+
+	if im.err != nil {
+		return nil, im.err
+	}
+
+	err = s.Database.Transaction(func(tx *gorm.DB) error {
+		for _, records := range []any{
+			im.agencies, im.stops, im.calendars, im.calendarDates, im.shapes,
+			im.routes, im.trips, im.stopTimes, im.frequencies,
+		} {
+			if reflect.ValueOf(records).Len() == 0 {
+				continue // GORM refuses to insert empty slices
+			}
+			if err := tx.CreateInBatches(records, gtfsInsertBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: projectID, Type: "gtfs:imported", Data: im.report})
+
+	return &im.report, nil
+}
+
+// gtfsImporter holds the state of a single GTFS import. The ID maps translate IDs from the
+// feed to the UUIDs of the newly-created records.
+type gtfsImporter struct {
+	projectID string
+	files     map[string]*zip.File
+	report    GTFSImportReport
+	err       error
+
+	agencyIDs  map[string]string
+	stopIDs    map[string]string
+	serviceIDs map[string]string
+	shapeIDs   map[string]string
+	routeIDs   map[string]string
+	tripIDs    map[string]string
+
+	agencies      []AgencyInfo
+	stops         []StopInfo
+	calendars     []CalendarInfo
+	calendarDates []CalendarDateInfo
+	shapes        []PathInfo
+	routes        []RouteInfo
+	trips         []TripInfo
+	stopTimes     []StopTimeInfo
+	frequencies   []FrequencyInfo
+}
+
+// newID generates a UUID for a new record. If generation fails, the error is remembered and
+// the import is aborted before anything is written to the database.
+func (im *gtfsImporter) newID() string {
+	id, err := uuid.NewRandom()
+	if err != nil && im.err == nil {
+		im.err = err
+	}
+	return id.String()
+}
+
+// rowError reports a problem with a row and counts it as skipped.
+func (im *gtfsImporter) rowError(file string, line int, format string, args ...any) {
+	im.report.Skipped[file]++
+	im.fileError(file, line, format, args...)
+}
+
+// fileError reports a problem without counting a skipped row.
+func (im *gtfsImporter) fileError(file string, line int, format string, args ...any) {
+	reported := 0
+	for _, e := range im.report.Errors {
+		if e.File == file {
+			reported++
+		}
+	}
+	if reported < MaxGTFSErrorsPerFile {
+		im.report.Errors = append(im.report.Errors, GTFSImportError{file, line, fmt.Sprintf(format, args...)})
+	}
+}
+
+// open reads one of the files in the feed. It returns nil if the file is absent (reporting an
+// error if the file is required) or cannot be parsed.
+func (im *gtfsImporter) open(name string, required bool) *csvTable {
+	f, ok := im.files[name]
+	if !ok {
+		if required {
+			im.fileError(name, 0, "required file is missing from the feed")
+		}
+		return nil
+	}
+
+	data, err := readZipFile(f, MaxUploadBytes)
+	if err != nil {
+		im.fileError(name, 0, "failed to decompress file: %v", err)
+		return nil
+	}
+
+	t, err := readCSV(bytes.NewReader(data))
+	if err != nil {
+		im.fileError(name, 0, "failed to parse file as CSV: %v", err)
+		return nil
+	}
+	return t
+}
+
+func (im *gtfsImporter) readAgencies() {
+	const file = "agency.txt"
+	t := im.open(file, true)
+	if t == nil {
+		return
+	}
+
+	for i, row := range t.rows {
+		name := t.get(row, "agency_name")
+		if name == "" {
+			im.rowError(file, t.line(i), "agency_name is required")
+			continue
+		}
+
+		info := AgencyInfo{
+			ID:        im.newID(),
+			ProjectID: im.projectID,
+			Name:      name,
+			URL:       t.get(row, "agency_url"),
+			Timezone:  t.get(row, "agency_timezone"),
+			Lang:      t.get(row, "agency_lang"),
+			Phone:     t.get(row, "agency_phone"),
+			FareURL:   t.get(row, "agency_fare_url"),
+			Email:     t.get(row, "agency_email"),
+		}
+		im.agencyIDs[t.get(row, "agency_id")] = info.ID
+		im.agencies = append(im.agencies, info)
+	}
+	im.report.Counts[file] = len(im.agencies)
+}
+
+func (im *gtfsImporter) readStops() {
+	const file = "stops.txt"
+	t := im.open(file, true)
+	if t == nil {
+		return
+	}
+
+	parents := map[int]string{} // index into im.stops -> feed ID of parent station
+
+	for i, row := range t.rows {
+		feedID := t.get(row, "stop_id")
+		if feedID == "" {
+			im.rowError(file, t.line(i), "stop_id is required")
+			continue
+		}
+		if _, dup := im.stopIDs[feedID]; dup {
+			im.rowError(file, t.line(i), "duplicate stop_id %q", feedID)
+			continue
+		}
+
+		locType, err := parseGTFSUint(t.get(row, "location_type"))
+		if err != nil {
+			im.rowError(file, t.line(i), "invalid location_type: %v", err)
+			continue
+		}
+		lat, latErr := strconv.ParseFloat(t.get(row, "stop_lat"), 64)
+		lng, lngErr := strconv.ParseFloat(t.get(row, "stop_lon"), 64)
+		if (latErr != nil || lngErr != nil) && locType <= 2 {
+			im.rowError(file, t.line(i), "stop %q has an invalid or missing stop_lat/stop_lon", feedID)
+			continue
+		}
+		wheelchair, err := parseGTFSUint(t.get(row, "wheelchair_boarding"))
+		if err != nil {
+			im.rowError(file, t.line(i), "invalid wheelchair_boarding: %v", err)
+			continue
+		}
+
+		info := StopInfo{
+			ID:                 im.newID(),
+			ProjectID:          im.projectID,
+			Code:               t.get(row, "stop_code"),
+			Name:               t.get(row, "stop_name"),
+			NameTTS:            t.get(row, "tts_stop_name"),
+			Description:        t.get(row, "stop_desc"),
+			Lat:                lat,
+			Lng:                lng,
+			ZoneID:             t.get(row, "zone_id"),
+			URL:                t.get(row, "stop_url"),
+			Type:               locType,
+			Timezone:           t.get(row, "stop_timezone"),
+			WheelchairBoarding: wheelchair,
+			LevelID:            t.get(row, "level_id"),
+			PlatformCode:       t.get(row, "platform_code"),
+		}
+		if parent := t.get(row, "parent_station"); parent != "" {
+			parents[len(im.stops)] = parent
+		}
+		im.stopIDs[feedID] = info.ID
+		im.stops = append(im.stops, info)
+	}
+
+	// Parent stations may appear after their children, so they are linked up afterwards
+	for i, parent := range parents {
+		if id, ok := im.stopIDs[parent]; ok {
+			im.stops[i].ParentStation = id
+		} else {
+			im.fileError(file, 0, "stop %q refers to unknown parent_station %q", im.stops[i].Name, parent)
+		}
+	}
+
+	im.report.Counts[file] = len(im.stops)
+}
+
+func (im *gtfsImporter) readCalendars() {
+	const file = "calendar.txt"
+	t := im.open(file, false)
+	if t == nil {
+		if _, ok := im.files["calendar_dates.txt"]; !ok {
+			im.fileError(file, 0, "feed must contain calendar.txt, calendar_dates.txt, or both")
+		}
+		return
+	}
+
+	for i, row := range t.rows {
+		feedID := t.get(row, "service_id")
+		if feedID == "" {
+			im.rowError(file, t.line(i), "service_id is required")
+			continue
+		}
+		if _, dup := im.serviceIDs[feedID]; dup {
+			im.rowError(file, t.line(i), "duplicate service_id %q", feedID)
+			continue
+		}
+
+		start, end := t.get(row, "start_date"), t.get(row, "end_date")
+		if !isGTFSDate(start) || !isGTFSDate(end) {
+			im.rowError(file, t.line(i), "service %q has an invalid start_date/end_date", feedID)
+			continue
+		}
+
+		info := CalendarInfo{
+			ID:        im.newID(),
+			ProjectID: im.projectID,
+			Name:      feedID,
+			Monday:    t.get(row, "monday") == "1",
+			Tuesday:   t.get(row, "tuesday") == "1",
+			Wednesday: t.get(row, "wednesday") == "1",
+			Thursday:  t.get(row, "thursday") == "1",
+			Friday:    t.get(row, "friday") == "1",
+			Saturday:  t.get(row, "saturday") == "1",
+			Sunday:    t.get(row, "sunday") == "1",
+			StartDate: start,
+			EndDate:   end,
+		}
+		im.serviceIDs[feedID] = info.ID
+		im.calendars = append(im.calendars, info)
+	}
+	im.report.Counts[file] = len(im.calendars)
+}
+
+func (im *gtfsImporter) readCalendarDates() {
+	const file = "calendar_dates.txt"
+	t := im.open(file, false)
+	if t == nil {
+		return
+	}
+
+	seen := map[[2]string]bool{}
+
+	for i, row := range t.rows {
+		feedID, date := t.get(row, "service_id"), t.get(row, "date")
+		if feedID == "" || !isGTFSDate(date) {
+			im.rowError(file, t.line(i), "service_id and a valid date are required")
+			continue
+		}
+		exception, err := parseGTFSUint(t.get(row, "exception_type"))
+		if err != nil || (exception != 1 && exception != 2) {
+			im.rowError(file, t.line(i), "exception_type must be 1 or 2")
+			continue
+		}
+		if seen[[2]string{feedID, date}] {
+			im.rowError(file, t.line(i), "duplicate exception for service %q on %s", feedID, date)
+			continue
+		}
+		seen[[2]string{feedID, date}] = true
+
+		// Services may be defined entirely by their exceptions
+		serviceID, ok := im.serviceIDs[feedID]
+		if !ok {
+			serviceID = im.newID()
+			im.serviceIDs[feedID] = serviceID
+			im.calendars = append(im.calendars, CalendarInfo{ID: serviceID, ProjectID: im.projectID, Name: feedID})
+		}
+
+		im.calendarDates = append(im.calendarDates, CalendarDateInfo{serviceID, date, im.projectID, exception})
+	}
+	im.report.Counts[file] = len(im.calendarDates)
+}
+
+func (im *gtfsImporter) readShapes() {
+	const file = "shapes.txt"
+	t := im.open(file, false)
+	if t == nil {
+		return
+	}
+
+	type shapePoint struct {
+		seq    uint64
+		coords LatLng
+		dist   *float64
+	}
+	points := map[string][]shapePoint{}
+	var order []string
+
+	for i, row := range t.rows {
+		feedID := t.get(row, "shape_id")
+		lat, latErr := strconv.ParseFloat(t.get(row, "shape_pt_lat"), 64)
+		lng, lngErr := strconv.ParseFloat(t.get(row, "shape_pt_lon"), 64)
+		seq, seqErr := strconv.ParseUint(t.get(row, "shape_pt_sequence"), 10, 32)
+		if feedID == "" || latErr != nil || lngErr != nil || seqErr != nil {
+			im.rowError(file, t.line(i), "shape_id, shape_pt_lat, shape_pt_lon, and shape_pt_sequence are required")
+			continue
+		}
+
+		var distTraveled *float64
+		if str := t.get(row, "shape_dist_traveled"); str != "" {
+			dist, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				im.rowError(file, t.line(i), "invalid shape_dist_traveled: %v", err)
+				continue
+			}
+			distTraveled = &dist
+		}
+
+		if _, ok := points[feedID]; !ok {
+			order = append(order, feedID)
+		}
+		points[feedID] = append(points[feedID], shapePoint{seq, LatLng{lat, lng}, distTraveled})
+	}
+
+	for _, feedID := range order {
+		pts := points[feedID]
+		sort.SliceStable(pts, func(i, j int) bool { return pts[i].seq < pts[j].seq })
+
+		// Distances are only kept if every point has one
+		coords := make([]LatLng, len(pts))
+		dists := make(ShapeDistances, len(pts))
+		for i, pt := range pts {
+			coords[i] = pt.coords
+			if pt.dist == nil {
+				dists = nil
+			} else if dists != nil {
+				dists[i] = *pt.dist
+			}
+		}
+
+		info := PathInfo{
+			PathSpec:          PathSpec{ProjectID: im.projectID, Line: true, Coords: coords, Name: feedID},
+			ID:                im.newID(),
+			ShapeDistTraveled: dists,
+		}
+		im.shapeIDs[feedID] = info.ID
+		im.shapes = append(im.shapes, info)
+	}
+	im.report.Counts[file] = len(t.rows) - im.report.Skipped[file]
+}
+
+func (im *gtfsImporter) readRoutes() {
+	const file = "routes.txt"
+	t := im.open(file, true)
+	if t == nil {
+		return
+	}
+
+	for i, row := range t.rows {
+		feedID := t.get(row, "route_id")
+		if feedID == "" {
+			im.rowError(file, t.line(i), "route_id is required")
+			continue
+		}
+		if _, dup := im.routeIDs[feedID]; dup {
+			im.rowError(file, t.line(i), "duplicate route_id %q", feedID)
+			continue
+		}
+		routeType, err := parseGTFSUint(t.get(row, "route_type"))
+		if err != nil || t.get(row, "route_type") == "" {
+			im.rowError(file, t.line(i), "route %q has an invalid or missing route_type", feedID)
+			continue
+		}
+		sortOrder, err := parseGTFSUint(t.get(row, "route_sort_order"))
+		if err != nil {
+			im.rowError(file, t.line(i), "invalid route_sort_order: %v", err)
+			continue
+		}
+
+		// agency_id may be omitted when the feed only has one agency
+		agencyID, ok := im.agencyIDs[t.get(row, "agency_id")]
+		if !ok && len(im.agencies) == 1 {
+			agencyID, ok = im.agencies[0].ID, true
+		}
+		if !ok {
+			im.fileError(file, t.line(i), "route %q refers to unknown agency_id %q", feedID, t.get(row, "agency_id"))
+		}
+
+		info := RouteInfo{
+			ID:          im.newID(),
+			ProjectID:   im.projectID,
+			AgencyID:    agencyID,
+			ShortName:   t.get(row, "route_short_name"),
+			LongName:    t.get(row, "route_long_name"),
+			Description: t.get(row, "route_desc"),
+			Type:        routeType,
+			URL:         t.get(row, "route_url"),
+			Color:       t.get(row, "route_color"),
+			TextColor:   t.get(row, "route_text_color"),
+			SortOrder:   sortOrder,
+		}
+		im.routeIDs[feedID] = info.ID
+		im.routes = append(im.routes, info)
+	}
+	im.report.Counts[file] = len(im.routes)
+}
+
+func (im *gtfsImporter) readTrips() {
+	const file = "trips.txt"
+	t := im.open(file, true)
+	if t == nil {
+		return
+	}
+
+	for i, row := range t.rows {
+		feedID := t.get(row, "trip_id")
+		if feedID == "" {
+			im.rowError(file, t.line(i), "trip_id is required")
+			continue
+		}
+		if _, dup := im.tripIDs[feedID]; dup {
+			im.rowError(file, t.line(i), "duplicate trip_id %q", feedID)
+			continue
+		}
+		routeID, ok := im.routeIDs[t.get(row, "route_id")]
+		if !ok {
+			im.rowError(file, t.line(i), "trip %q refers to unknown route_id %q", feedID, t.get(row, "route_id"))
+			continue
+		}
+		serviceID, ok := im.serviceIDs[t.get(row, "service_id")]
+		if !ok {
+			im.rowError(file, t.line(i), "trip %q refers to unknown service_id %q", feedID, t.get(row, "service_id"))
+			continue
+		}
+
+		var shapeID string
+		if feedShapeID := t.get(row, "shape_id"); feedShapeID != "" {
+			if shapeID, ok = im.shapeIDs[feedShapeID]; !ok {
+				im.fileError(file, t.line(i), "trip %q refers to unknown shape_id %q", feedID, feedShapeID)
+			}
+		}
+
+		direction, dirErr := parseGTFSUint(t.get(row, "direction_id"))
+		wheelchair, wcErr := parseGTFSUint(t.get(row, "wheelchair_accessible"))
+		bikes, bikeErr := parseGTFSUint(t.get(row, "bikes_allowed"))
+		if dirErr != nil || wcErr != nil || bikeErr != nil {
+			im.rowError(file, t.line(i), "trip %q has an invalid direction_id, wheelchair_accessible, or bikes_allowed", feedID)
+			continue
+		}
+
+		info := TripInfo{
+			ID:                   im.newID(),
+			ProjectID:            im.projectID,
+			RouteID:              routeID,
+			ServiceID:            serviceID,
+			Headsign:             t.get(row, "trip_headsign"),
+			ShortName:            t.get(row, "trip_short_name"),
+			DirectionID:          direction,
+			BlockID:              t.get(row, "block_id"),
+			ShapeID:              shapeID,
+			WheelchairAccessible: wheelchair,
+			BikesAllowed:         bikes,
+		}
+		im.tripIDs[feedID] = info.ID
+		im.trips = append(im.trips, info)
+	}
+	im.report.Counts[file] = len(im.trips)
+}
+
+func (im *gtfsImporter) readStopTimes() {
+	const file = "stop_times.txt"
+	t := im.open(file, true)
+	if t == nil {
+		return
+	}
+
+	seen := map[string]map[uint]bool{}
+
+	for i, row := range t.rows {
+		tripID, ok := im.tripIDs[t.get(row, "trip_id")]
+		if !ok {
+			im.rowError(file, t.line(i), "unknown trip_id %q", t.get(row, "trip_id"))
+			continue
+		}
+		stopID, ok := im.stopIDs[t.get(row, "stop_id")]
+		if !ok {
+			im.rowError(file, t.line(i), "unknown stop_id %q", t.get(row, "stop_id"))
+			continue
+		}
+		seq, err := parseGTFSUint(t.get(row, "stop_sequence"))
+		if err != nil || t.get(row, "stop_sequence") == "" {
+			im.rowError(file, t.line(i), "invalid or missing stop_sequence")
+			continue
+		}
+		if seen[tripID] == nil {
+			seen[tripID] = map[uint]bool{}
+		}
+		if seen[tripID][seq] {
+			im.rowError(file, t.line(i), "duplicate stop_sequence %d for trip %q", seq, t.get(row, "trip_id"))
+			continue
+		}
+		seen[tripID][seq] = true
+
+		arrival, arrErr := parseOptionalGTFSTime(t.get(row, "arrival_time"))
+		departure, depErr := parseOptionalGTFSTime(t.get(row, "departure_time"))
+		if arrErr != nil || depErr != nil {
+			im.rowError(file, t.line(i), "invalid arrival_time or departure_time")
+			continue
+		}
+		// Feeds commonly only specify one of the two for timepoints
+		if arrival == nil {
+			arrival = departure
+		} else if departure == nil {
+			departure = arrival
+		}
+
+		pickup, puErr := parseGTFSUint(t.get(row, "pickup_type"))
+		dropOff, doErr := parseGTFSUint(t.get(row, "drop_off_type"))
+		if puErr != nil || doErr != nil {
+			im.rowError(file, t.line(i), "invalid pickup_type or drop_off_type")
+			continue
+		}
+
+		var distTraveled *float64
+		if str := t.get(row, "shape_dist_traveled"); str != "" {
+			dist, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				im.rowError(file, t.line(i), "invalid shape_dist_traveled: %v", err)
+				continue
+			}
+			distTraveled = &dist
+		}
+
+		timepoint := uint(1)
+		if str := t.get(row, "timepoint"); str != "" {
+			timepoint, err = parseGTFSUint(str)
+		} else if arrival == nil {
+			timepoint = 0
+		}
+		if err != nil {
+			im.rowError(file, t.line(i), "invalid timepoint: %v", err)
+			continue
+		}
+
+		im.stopTimes = append(im.stopTimes, StopTimeInfo{
+			TripID:            tripID,
+			StopSequence:      seq,
+			ProjectID:         im.projectID,
+			StopID:            stopID,
+			ArrivalTime:       arrival,
+			DepartureTime:     departure,
+			StopHeadsign:      t.get(row, "stop_headsign"),
+			PickupType:        pickup,
+			DropOffType:       dropOff,
+			ShapeDistTraveled: distTraveled,
+			Timepoint:         timepoint,
+		})
+	}
+	im.report.Counts[file] = len(im.stopTimes)
+}
+
+func (im *gtfsImporter) readFrequencies() {
+	const file = "frequencies.txt"
+	t := im.open(file, false)
+	if t == nil {
+		return
+	}
+
+	seen := map[[2]string]bool{}
+
+	for i, row := range t.rows {
+		tripID, ok := im.tripIDs[t.get(row, "trip_id")]
+		if !ok {
+			im.rowError(file, t.line(i), "unknown trip_id %q", t.get(row, "trip_id"))
+			continue
+		}
+		start, startErr := parseGTFSTime(t.get(row, "start_time"))
+		end, endErr := parseGTFSTime(t.get(row, "end_time"))
+		headway, hwErr := parseGTFSUint(t.get(row, "headway_secs"))
+		exact, exErr := parseGTFSUint(t.get(row, "exact_times"))
+		if startErr != nil || endErr != nil || hwErr != nil || exErr != nil || headway == 0 {
+			im.rowError(file, t.line(i), "invalid start_time, end_time, headway_secs, or exact_times")
+			continue
+		}
+		// Keyed by the parsed time so 8:00:00 and 08:00:00 are the same start
+		key := [2]string{tripID, formatGTFSTime(start)}
+		if seen[key] {
+			im.rowError(file, t.line(i), "duplicate start_time %s for trip %q", formatGTFSTime(start), t.get(row, "trip_id"))
+			continue
+		}
+		seen[key] = true
+
+		im.frequencies = append(im.frequencies, FrequencyInfo{tripID, start, im.projectID, end, headway, exact})
+	}
+	im.report.Counts[file] = len(im.frequencies)
+}
+
+// parseGTFSUint parses an optional non-negative integer field, treating empty as 0.
+func parseGTFSUint(str string) (uint, error) {
+	if str == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(str, 10, 32)
+	return uint(n), err
+}
+
+// parseGTFSTime parses a GTFS time (H:MM:SS, where H may exceed 23) into seconds since
+// midnight of the service day.
+func parseGTFSTime(str string) (int, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("time %q is not formatted as HH:MM:SS", str)
+	}
+
+	var hms [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (i > 0 && n > 59) {
+			return 0, fmt.Errorf("time %q is not formatted as HH:MM:SS", str)
+		}
+		hms[i] = n
+	}
+
+	return hms[0]*3600 + hms[1]*60 + hms[2], nil
+}
+
+// parseOptionalGTFSTime is like parseGTFSTime, but returns nil for an empty string.
+func parseOptionalGTFSTime(str string) (*int, error) {
+	if str == "" {
+		return nil, nil
+	}
+	secs, err := parseGTFSTime(str)
+	if err != nil {
+		return nil, err
+	}
+	return &secs, nil
+}
+
+// isGTFSDate reports whether a string is a date formatted as YYYYMMDD.
+func isGTFSDate(str string) bool {
+	if len(str) != 8 {
+		return false
+	}
+	_, err := strconv.ParseUint(str, 10, 32)
+	return err == nil
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultWalkSpeed is the walking speed in m/s when a request does not specify one
+	// (about 3 mph).
+	DefaultWalkSpeed = 1.3
+	// DefaultMaxAccessWalk is the farthest (in meters) an isochrone walks to its first stop or
+	// from its last stop when the request does not specify a limit.
+	DefaultMaxAccessWalk = 800
+	// DefaultMaxTransferWalk is the farthest (in meters) an isochrone walks between two stops
+	// to transfer when the request does not specify a limit.
+	DefaultMaxTransferWalk = 400
+	// DefaultIsochroneBand is the width of each time band in seconds when an
+	// 'isochrone:compute' request does not list its bands.
+	DefaultIsochroneBand = 15 * 60
+	// MaxIsochroneTime limits the maximum travel time of an isochrone, in seconds.
+	MaxIsochroneTime = 3 * 60 * 60
+	// MaxIsochroneDepartures limits how many departure times across the departure window are
+	// routed; long windows space the departures further apart instead.
+	MaxIsochroneDepartures = 120
+	// isochroneDepartureStep is the spacing in seconds between the departure times routed
+	// across a departure window, unless the window is too long for that.
+	isochroneDepartureStep = 60
+	// minIsochroneRadius is the smallest walk (in meters) around a stop that is drawn; shorter
+	// ones are invisible at any useful scale and would only make the grid needlessly fine.
+	minIsochroneRadius = 25
+)
+
+// IsochroneRequest is the payload of an 'isochrone:compute' request. Travel starts at Origin
+// some time between StartTime and EndTime (seconds since midnight) on Date (YYYYMMDD), and the
+// result is the area reachable within each of the Bands (seconds, ascending) by walking and
+// riding the project's scheduled trips.
+//
+// Travel times vary with the exact departure time, so every minute of the window is routed and
+// Percentile (1-100, default 50) picks which travel time stands for the window: 50 is the
+// median, lower values are more optimistic. Bands default to every 15 minutes up to MaxTime,
+// which in turn defaults to the largest band, or an hour. The walk settings fall back to
+// DefaultWalkSpeed, DefaultMaxAccessWalk and DefaultMaxTransferWalk. If Shapefile is set, the
+// bands are also made available for download as a zipped shapefile.
+type IsochroneRequest struct {
+	ProjectID       string  `msgpack:"project_id"`
+	Origin          LatLng  `msgpack:"origin"`
+	Date            string  `msgpack:"date"`
+	StartTime       int     `msgpack:"start_time"`
+	EndTime         int     `msgpack:"end_time"`
+	MaxTime         int     `msgpack:"max_time"`
+	Bands           []int   `msgpack:"bands"`
+	Percentile      int     `msgpack:"percentile"`
+	WalkSpeed       float64 `msgpack:"walk_speed"`
+	MaxAccessWalk   float64 `msgpack:"max_access_walk"`
+	MaxTransferWalk float64 `msgpack:"max_transfer_walk"`
+	Shapefile       bool    `msgpack:"shapefile"`
+}
+
+// IsochroneBand is the area reachable within Time seconds. Bands are cumulative: each one
+// contains all the smaller ones. Area is in square meters.
+type IsochroneBand struct {
+	Time     int          `msgpack:"time"`
+	Area     float64      `msgpack:"area"`
+	Polygons MultiPolygon `msgpack:"polygons"`
+}
+
+// StopTravelTime is the travel time in seconds from the origin to a stop.
+type StopTravelTime struct {
+	StopID string `msgpack:"stop_id"`
+	Time   int    `msgpack:"time"`
+}
+
+// Isochrone is the reply to an 'isochrone:compute' request. Stops lists every stop reached
+// within the maximum travel time, fastest first.
+type Isochrone struct {
+	Origin     LatLng           `msgpack:"origin"`
+	Date       string           `msgpack:"date"`
+	Departures int              `msgpack:"departures"`
+	Bands      []IsochroneBand  `msgpack:"bands"`
+	Stops      []StopTravelTime `msgpack:"stops"`
+	Download   *DownloadInfo    `msgpack:"download,omitempty"`
+}
+
+// connection is a vehicle going directly from one stop to the next. Stops and runs are
+// indexes into the network. Board and Alight say whether passengers may get on at the
+// departure stop and off at the arrival stop.
+type connection struct {
+	dep, arr      int
+	from, to, run int32
+	board, alight bool
+}
+
+// footpath is a walk from one stop to another, in seconds.
+type footpath struct {
+	to   int32
+	time int
+}
+
+// transitNetwork is a project's scheduled service on one day, ready for routing.
+// Connections are sorted by departure time.
+type transitNetwork struct {
+	stops       []StopInfo
+	xy          [][2]float64
+	connections []connection
+	runs        int
+	footpaths   [][]footpath
+}
+
+func isochrone(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req IsochroneRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if req.MaxTime == 0 {
+		req.MaxTime = 60 * 60
+		if len(req.Bands) > 0 {
+			req.MaxTime = req.Bands[len(req.Bands)-1]
+		}
+	}
+	if len(req.Bands) == 0 {
+		for band := DefaultIsochroneBand; band < req.MaxTime; band += DefaultIsochroneBand {
+			req.Bands = append(req.Bands, band)
+		}
+		req.Bands = append(req.Bands, req.MaxTime)
+	}
+	if req.EndTime == 0 {
+		req.EndTime = req.StartTime
+	}
+	if req.Percentile == 0 {
+		req.Percentile = 50
+	}
+	if req.WalkSpeed == 0 {
+		req.WalkSpeed = DefaultWalkSpeed
+	}
+	if req.MaxAccessWalk == 0 {
+		req.MaxAccessWalk = DefaultMaxAccessWalk
+	}
+	if req.MaxTransferWalk == 0 {
+		req.MaxTransferWalk = DefaultMaxTransferWalk
+	}
+
+	if !isGTFSDate(req.Date) {
+		// TODO
+		return nil, fmt.Errorf("date must be formatted as YYYYMMDD, not %q", req.Date)
+	}
+	if req.StartTime < 0 || req.EndTime < req.StartTime {
+		// TODO
+		return nil, errors.New("departure window must not end before it starts")
+	}
+	if req.MaxTime <= 0 || req.MaxTime > MaxIsochroneTime {
+		// TODO
+		return nil, fmt.Errorf("maximum travel time must be between 0 and %d seconds", MaxIsochroneTime)
+	}
+	for i, band := range req.Bands {
+		if band <= 0 || band > req.MaxTime || (i > 0 && band <= req.Bands[i-1]) {
+			// TODO
+			return nil, errors.New("time bands must be ascending and within the maximum travel time")
+		}
+	}
+	if req.Percentile < 1 || req.Percentile > 100 {
+		// TODO
+		return nil, errors.New("percentile must be between 1 and 100")
+	}
+	if req.WalkSpeed < 0 || req.MaxAccessWalk < 0 || req.MaxTransferWalk < 0 {
+		// TODO
+		return nil, errors.New("walk speed and distances cannot be negative")
+	}
+
+	if err := requireProject(s.Database, req.ProjectID); err != nil {
+		return nil, err
+	}
+
+	proj := newLocalProjection(req.Origin)
+	net, err := loadTransitNetwork(s.Database, proj, req.ProjectID, req.Date,
+		req.StartTime, req.EndTime+req.MaxTime, req.MaxTransferWalk, req.WalkSpeed)
+	if err != nil {
+		return nil, err
+	}
+
+	// Route every departure time across the window
+	step := isochroneDepartureStep
+	if window := req.EndTime - req.StartTime; window/step+1 > MaxIsochroneDepartures {
+		step = (window + MaxIsochroneDepartures - 2) / (MaxIsochroneDepartures - 1)
+	}
+	var departures []int
+	for t := req.StartTime; t <= req.EndTime; t += step {
+		departures = append(departures, t)
+	}
+
+	access := net.access(req.Origin, req.MaxAccessWalk, req.WalkSpeed)
+	times := make([][]int, len(net.stops))
+	for _, dep := range departures {
+		arrivals := net.route(access, dep, dep+req.MaxTime)
+		for i, arr := range arrivals {
+			if arr <= dep+req.MaxTime {
+				times[i] = append(times[i], arr-dep)
+			}
+		}
+	}
+
+	// Pick each stop's travel time for the window; stops not reached often enough are out
+	result := Isochrone{Origin: req.Origin, Date: req.Date, Departures: len(departures)}
+	rank := int(math.Ceil(float64(req.Percentile)/100*float64(len(departures)))) - 1
+	travel := make([]int, len(net.stops))
+	for i, tt := range times {
+		travel[i] = -1
+		if len(tt) > rank {
+			sort.Ints(tt)
+			travel[i] = tt[rank]
+			result.Stops = append(result.Stops, StopTravelTime{net.stops[i].ID, tt[rank]})
+		}
+	}
+	sort.Slice(result.Stops, func(i, j int) bool {
+		return result.Stops[i].Time < result.Stops[j].Time
+	})
+
+	// Each band is the walk from the origin plus the walks from every stop reached in time
+	for _, band := range req.Bands {
+		discs := []disc{{req.Origin, req.WalkSpeed * float64(band)}}
+		for i, tt := range travel {
+			if tt < 0 || tt >= band {
+				continue
+			}
+			if r := math.Min(req.WalkSpeed*float64(band-tt), req.MaxAccessWalk); r >= minIsochroneRadius {
+				discs = append(discs, disc{LatLng{net.stops[i].Lat, net.stops[i].Lng}, r})
+			}
+		}
+
+		ib := IsochroneBand{Time: band, Polygons: MultiPolygon{}}
+		if field := newDiscField(discs); field != nil {
+			ib.Polygons = field.polygons()
+			ib.Area = ib.Polygons.area()
+		}
+		result.Bands = append(result.Bands, ib)
+	}
+
+	if req.Shapefile {
+		fields := []dbfField{
+			{Name: "TIME", Type: 'N'},
+			{Name: "MINUTES", Type: 'N', Decimals: 1},
+			{Name: "AREA_M2", Type: 'N'},
+		}
+		polygons := make([]MultiPolygon, len(result.Bands))
+		records := make([]map[string]string, len(result.Bands))
+		for i, band := range result.Bands {
+			polygons[i] = band.Polygons
+			records[i] = map[string]string{
+				"TIME":    strconv.Itoa(band.Time),
+				"MINUTES": strconv.FormatFloat(float64(band.Time)/60, 'f', 1, 64),
+				"AREA_M2": strconv.FormatFloat(band.Area, 'f', 0, 64),
+			}
+		}
+		if result.Download, err = s.addPolygonDownload("isochrone", fields, polygons, records); err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// loadTransitNetwork loads the trips of a project that run on a date and depart between two
+// times (seconds since midnight), along with footpaths between stops no more than
+// maxTransfer meters apart. Trips running past midnight from the previous day are not
+// included. Stop times without a time are skipped, so riders can neither board nor alight
+// there.
+func loadTransitNetwork(db *gorm.DB, proj localProjection, projectID, date string, earliest, latest int, maxTransfer, walkSpeed float64) (*transitNetwork, error) {
+	services, err := servicesOn(db, projectID, date)
+	if err != nil {
+		return nil, err
+	}
+	serviceIDs := make([]string, 0, len(services))
+	for id := range services {
+		serviceIDs = append(serviceIDs, id)
+	}
+
+	net := &transitNetwork{}
+	if err := db.Order("id").Find(&net.stops, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	stopIndex := make(map[string]int32, len(net.stops))
+	net.xy = make([][2]float64, len(net.stops))
+	for i, stop := range net.stops {
+		stopIndex[stop.ID] = int32(i)
+		x, y := proj.toXY(LatLng{stop.Lat, stop.Lng})
+		net.xy[i] = [2]float64{x, y}
+	}
+
+	activeTrips := db.Model(&TripInfo{}).Select("id").
+		Where("project_id = ? AND service_id IN ?", projectID, serviceIDs)
+
+	var frequencies []FrequencyInfo
+	if err := db.Find(&frequencies, "trip_id IN (?)", activeTrips).Error; err != nil {
+		return nil, err
+	}
+	frequenciesByTrip := map[string][]FrequencyInfo{}
+	for _, f := range frequencies {
+		frequenciesByTrip[f.TripID] = append(frequenciesByTrip[f.TripID], f)
+	}
+
+	var stopTimes []StopTimeInfo
+	err = db.Where("trip_id IN (?)", activeTrips).
+		Where("arrival_time IS NOT NULL OR departure_time IS NOT NULL").
+		Order("trip_id, stop_sequence").
+		Find(&stopTimes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Turn each trip (or each dispatch of a trip with frequencies) into connections
+	addRun := func(sts []StopTimeInfo, offset int) {
+		run := int32(net.runs)
+		net.runs++
+		for i := 0; i+1 < len(sts); i++ {
+			a, b := sts[i], sts[i+1]
+			from, okFrom := stopIndex[a.StopID]
+			to, okTo := stopIndex[b.StopID]
+			if !okFrom || !okTo {
+				continue
+			}
+			c := connection{
+				dep:    stopTimeDeparture(a) + offset,
+				arr:    stopTimeArrival(b) + offset,
+				from:   from,
+				to:     to,
+				run:    run,
+				board:  a.PickupType != 1,
+				alight: b.DropOffType != 1,
+			}
+			if c.dep >= earliest && c.dep <= latest && c.arr >= c.dep {
+				net.connections = append(net.connections, c)
+			}
+		}
+	}
+
+	for start := 0; start < len(stopTimes); {
+		end := start + 1
+		for end < len(stopTimes) && stopTimes[end].TripID == stopTimes[start].TripID {
+			end++
+		}
+		sts := stopTimes[start:end]
+		start = end
+
+		freqs := frequenciesByTrip[sts[0].TripID]
+		if len(freqs) == 0 {
+			addRun(sts, 0)
+			continue
+		}
+		first := stopTimeDeparture(sts[0])
+		for _, f := range freqs {
+			if f.HeadwaySecs == 0 {
+				continue
+			}
+			for dep := f.StartTime; dep < f.EndTime; dep += int(f.HeadwaySecs) {
+				addRun(sts, dep-first)
+			}
+		}
+	}
+
+	sort.SliceStable(net.connections, func(i, j int) bool {
+		return net.connections[i].dep < net.connections[j].dep
+	})
+
+	// Footpaths, using buckets as wide as the longest walk so only neighbors are compared
+	net.footpaths = make([][]footpath, len(net.stops))
+	if maxDist := maxTransfer; maxDist > 0 {
+		buckets := map[[2]int][]int32{}
+		bucketOf := func(p [2]float64) [2]int {
+			return [2]int{int(math.Floor(p[0] / maxDist)), int(math.Floor(p[1] / maxDist))}
+		}
+		for i, p := range net.xy {
+			b := bucketOf(p)
+			buckets[b] = append(buckets[b], int32(i))
+		}
+		for i, p := range net.xy {
+			b := bucketOf(p)
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					for _, j := range buckets[[2]int{b[0] + dx, b[1] + dy}] {
+						if int(j) == i {
+							continue
+						}
+						q := net.xy[j]
+						if d := math.Hypot(q[0]-p[0], q[1]-p[1]); d <= maxDist {
+							net.footpaths[i] = append(net.footpaths[i], footpath{j, int(math.Ceil(d / walkSpeed))})
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return net, nil
+}
+
+// stopTimeArrival returns when a vehicle arrives at a stop, falling back to its departure.
+func stopTimeArrival(st StopTimeInfo) int {
+	if st.ArrivalTime != nil {
+		return *st.ArrivalTime
+	}
+	return *st.DepartureTime
+}
+
+// stopTimeDeparture returns when a vehicle leaves a stop, falling back to its arrival.
+func stopTimeDeparture(st StopTimeInfo) int {
+	if st.DepartureTime != nil {
+		return *st.DepartureTime
+	}
+	return *st.ArrivalTime
+}
+
+// access returns the walking time in seconds from a point to every stop within a distance,
+// keyed by stop index.
+func (net *transitNetwork) access(origin LatLng, maxDist, walkSpeed float64) map[int32]int {
+	access := map[int32]int{}
+	if walkSpeed <= 0 {
+		return access
+	}
+	for i, stop := range net.stops {
+		if d := distance(origin, LatLng{stop.Lat, stop.Lng}); d <= maxDist {
+			access[int32(i)] = int(math.Ceil(d / walkSpeed))
+		}
+	}
+	return access
+}
+
+// route finds the earliest arrival at every stop when leaving the origin at a given time,
+// scanning connections in order of departure until the deadline (the connection scan
+// algorithm). Unreachable stops arrive at math.MaxInt.
+func (net *transitNetwork) route(access map[int32]int, depart, deadline int) []int {
+	arrivals := make([]int, len(net.stops))
+	for i := range arrivals {
+		arrivals[i] = math.MaxInt
+	}
+	for stop, walk := range access {
+		arrivals[stop] = depart + walk
+	}
+	onboard := make([]bool, net.runs)
+
+	first := sort.Search(len(net.connections), func(i int) bool {
+		return net.connections[i].dep >= depart
+	})
+	for _, c := range net.connections[first:] {
+		if c.dep > deadline {
+			break
+		}
+		if !onboard[c.run] {
+			if !c.board || arrivals[c.from] > c.dep {
+				continue
+			}
+			onboard[c.run] = true
+		}
+		if !c.alight || c.arr >= arrivals[c.to] {
+			continue
+		}
+
+		arrivals[c.to] = c.arr
+		for _, fp := range net.footpaths[c.to] {
+			if t := c.arr + fp.time; t < arrivals[fp.to] {
+				arrivals[fp.to] = t
+			}
+		}
+	}
+
+	return arrivals
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// kmlCircleSegments is how many sides the polygons standing in for circles have in KML.
+	kmlCircleSegments = 72
+)
+
+// KMLImportParams are the upload ticket parameters for the "kml" upload kind, which takes a
+// KML file or a zipped KMZ file. Placemarks become features of the project: points become
+// stops, line strings become line paths and polygons become closed paths. Placemarks with
+// several geometries become one feature per geometry.
+type KMLImportParams struct {
+	ProjectID string `msgpack:"project_id"`
+}
+
+// KMLExportRequest is the payload of a 'kml:export' request. The project's stops, paths and
+// circles are exported as a KMZ file if KMZ is set, otherwise as a plain KML file.
+type KMLExportRequest struct {
+	ProjectID string `msgpack:"project_id"`
+	KMZ       bool   `msgpack:"kmz"`
+}
+
+// kmlContainer is a KML Document or Folder, or the root kml element itself. Only the parts
+// of KML that map onto project features are read or written.
+type kmlContainer struct {
+	Name       string         `xml:"name,omitempty"`
+	Styles     []kmlStyle     `xml:"Style,omitempty"`
+	StyleMaps  []kmlStyleMap  `xml:"StyleMap,omitempty"`
+	Documents  []kmlContainer `xml:"Document,omitempty"`
+	Folders    []kmlContainer `xml:"Folder,omitempty"`
+	Placemarks []kmlPlacemark `xml:"Placemark,omitempty"`
+}
+
+// kmlStyle is a shared or inline Style. Colors are in KML's aabbggrr format.
+type kmlStyle struct {
+	ID   string        `xml:"id,attr,omitempty"`
+	Line *kmlLineStyle `xml:"LineStyle,omitempty"`
+	Poly *kmlPolyStyle `xml:"PolyStyle,omitempty"`
+}
+
+type kmlLineStyle struct {
+	Color string `xml:"color,omitempty"`
+	Width string `xml:"width,omitempty"`
+}
+
+type kmlPolyStyle struct {
+	Color string `xml:"color,omitempty"`
+	Fill  string `xml:"fill,omitempty"`
+}
+
+type kmlStyleMap struct {
+	ID    string `xml:"id,attr"`
+	Pairs []struct {
+		Key      string `xml:"key"`
+		StyleURL string `xml:"styleUrl"`
+	} `xml:"Pair"`
+}
+
+type kmlPlacemark struct {
+	Name        string           `xml:"name,omitempty"`
+	Description string           `xml:"description,omitempty"`
+	StyleURL    string           `xml:"styleUrl,omitempty"`
+	Style       *kmlStyle        `xml:"Style,omitempty"`
+	Data        *kmlExtendedData `xml:"ExtendedData,omitempty"`
+	kmlGeometry
+}
+
+type kmlExtendedData struct {
+	Data       []kmlData `xml:"Data,omitempty"`
+	SchemaData []struct {
+		SimpleData []kmlSimpleData `xml:"SimpleData"`
+	} `xml:"SchemaData,omitempty"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlSimpleData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// kmlGeometry holds the geometries of a placemark or MultiGeometry. Coordinates are lists of
+// "lng,lat[,alt]" tuples separated by whitespace.
+type kmlGeometry struct {
+	Points      []kmlCoordinates `xml:"Point,omitempty"`
+	LineStrings []kmlCoordinates `xml:"LineString,omitempty"`
+	Polygons    []kmlPolygon     `xml:"Polygon,omitempty"`
+	Multi       []kmlGeometry    `xml:"MultiGeometry,omitempty"`
+}
+
+type kmlCoordinates struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlPolygon struct {
+	Outer string    `xml:"outerBoundaryIs>LinearRing>coordinates"`
+	Inner []kmlRing `xml:"innerBoundaryIs,omitempty"`
+}
+
+type kmlRing struct {
+	Coordinates string `xml:"LinearRing>coordinates"`
+}
+
+// importKML adds the placemarks of a KML or KMZ file to a project.
+func importKML(s *Server, u *UserConn, params []byte, data []byte) (any, error) {
+	var p KMLImportParams
+	if err := msgpack.Unmarshal(params, &p); err != nil {
+		// TODO
+		return nil, err
+	}
+	if err := requireProject(s.Database, p.ProjectID); err != nil {
+		return nil, err
+	}
+
+	doc, err := readKML(data)
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "bad-kml",
+			Message: fmt.Sprintf("file is not valid KML or KMZ: %v", err),
+		}
+	}
+
+	// Shared styles may be defined anywhere in the file
+	styles := map[string]kmlStyle{}
+	styleMaps := map[string]string{}
+	var collect func(c *kmlContainer)
+	collect = func(c *kmlContainer) {
+		for _, st := range c.Styles {
+			styles[st.ID] = st
+		}
+		for _, sm := range c.StyleMaps {
+			for _, pair := range sm.Pairs {
+				if pair.Key == "normal" {
+					styleMaps[sm.ID] = strings.TrimPrefix(pair.StyleURL, "#")
+				}
+			}
+		}
+		for i := range c.Documents {
+			collect(&c.Documents[i])
+		}
+		for i := range c.Folders {
+			collect(&c.Folders[i])
+		}
+	}
+	collect(doc)
+
+	report := FeatureImportReport{ProjectID: p.ProjectID, Errors: []string{}}
+	var stops []StopInfo
+	var paths []PathInfo
+
+	var visit func(c *kmlContainer) error
+	visit = func(c *kmlContainer) error {
+		for _, pm := range c.Placemarks {
+			style := pm.Style
+			if style == nil {
+				id := strings.TrimPrefix(pm.StyleURL, "#")
+				if mapped, ok := styleMaps[id]; ok {
+					id = mapped
+				}
+				if st, ok := styles[id]; ok {
+					style = &st
+				}
+			}
+
+			label := pm.Name
+			if label == "" {
+				label = "unnamed placemark"
+			}
+
+			var geometries []kmlGeometry
+			var flatten func(g kmlGeometry)
+			flatten = func(g kmlGeometry) {
+				geometries = append(geometries, g)
+				for _, m := range g.Multi {
+					flatten(m)
+				}
+			}
+			flatten(pm.kmlGeometry)
+
+			found := false
+			for _, g := range geometries {
+				for _, pt := range g.Points {
+					found = true
+					coords, err := parseKMLCoordinates(pt.Coordinates)
+					if err != nil || len(coords) != 1 {
+						report.Skipped++
+						report.addError("%s has an invalid point", label)
+						continue
+					}
+					id, err := uuid.NewRandom()
+					if err != nil {
+						return err
+					}
+					stops = append(stops, StopInfo{
+						ID:          id.String(),
+						ProjectID:   p.ProjectID,
+						Code:        pm.data("stop_code", "code"),
+						Name:        pm.Name,
+						Description: strings.TrimSpace(pm.Description),
+						Lat:         coords[0].Lat,
+						Lng:         coords[0].Lng,
+					})
+				}
+
+				for _, ls := range g.LineStrings {
+					found = true
+					coords, err := parseKMLCoordinates(ls.Coordinates)
+					if err != nil || len(coords) < 2 {
+						report.Skipped++
+						report.addError("%s has an invalid line", label)
+						continue
+					}
+					path, err := newKMLPath(p.ProjectID, pm.Name, true, coords, style)
+					if err != nil {
+						return err
+					}
+					paths = append(paths, path)
+				}
+
+				for _, poly := range g.Polygons {
+					found = true
+					coords, err := parseKMLCoordinates(poly.Outer)
+					if n := len(coords); err == nil && n > 1 && coords[0] == coords[n-1] {
+						coords = coords[:n-1]
+					}
+					if err != nil || len(coords) < 3 {
+						report.Skipped++
+						report.addError("%s has an invalid polygon", label)
+						continue
+					}
+					path, err := newKMLPath(p.ProjectID, pm.Name, false, coords, style)
+					if err != nil {
+						return err
+					}
+					for _, inner := range poly.Inner {
+						hole, err := parseKMLCoordinates(inner.Coordinates)
+						if n := len(hole); err == nil && n > 1 && hole[0] == hole[n-1] {
+							hole = hole[:n-1]
+						}
+						if err != nil || len(hole) < 3 {
+							report.addError("%s has an invalid hole, which was left out", label)
+							continue
+						}
+						path.Holes = append(path.Holes, hole)
+					}
+					paths = append(paths, path)
+				}
+			}
+			if !found {
+				report.Skipped++
+				report.addError("%s has no point, line or polygon", label)
+			}
+		}
+
+		for i := range c.Documents {
+			if err := visit(&c.Documents[i]); err != nil {
+				return err
+			}
+		}
+		for i := range c.Folders {
+			if err := visit(&c.Folders[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(doc); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := saveImportedFeatures(s.Database, stops, paths, nil); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	report.Stops, report.Paths = len(stops), len(paths)
+	s.publish(u, ProjectEvent{ProjectID: p.ProjectID, Type: "kml:imported", Data: report})
+
+	return report, nil
+}
+
+// readKML parses a KML file, unzipping it first if it is a KMZ file. The main KML file of a
+// KMZ is doc.kml, or else the first .kml file in it.
+func readKML(data []byte) (*kmlContainer, error) {
+	if bytes.HasPrefix(data, []byte("PK")) {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+
+		var main *zip.File
+		for _, f := range zr.File {
+			if !strings.EqualFold(path.Ext(f.Name), ".kml") {
+				continue
+			}
+			if main == nil || f.Name == "doc.kml" {
+				main = f
+			}
+		}
+		if main == nil {
+			return nil, fmt.Errorf("KMZ file has no .kml file in it")
+		}
+
+		if data, err = readZipFile(main, MaxUploadBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	var doc kmlContainer
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// data returns the first value of a placemark's extended data under any of the given names,
+// ignoring case.
+func (pm *kmlPlacemark) data(names ...string) string {
+	if pm.Data == nil {
+		return ""
+	}
+	for _, name := range names {
+		for _, d := range pm.Data.Data {
+			if strings.EqualFold(d.Name, name) {
+				return strings.TrimSpace(d.Value)
+			}
+		}
+		for _, sd := range pm.Data.SchemaData {
+			for _, d := range sd.SimpleData {
+				if strings.EqualFold(d.Name, name) {
+					return strings.TrimSpace(d.Value)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// properties returns the extended data of a placemark, along with its description, as
+// feature properties.
+func (pm *kmlPlacemark) properties() map[string]any {
+	props := map[string]any{}
+	if desc := strings.TrimSpace(pm.Description); desc != "" {
+		props["description"] = desc
+	}
+	if pm.Data != nil {
+		for _, d := range pm.Data.Data {
+			props[d.Name] = strings.TrimSpace(d.Value)
+		}
+		for _, sd := range pm.Data.SchemaData {
+			for _, d := range sd.SimpleData {
+				props[d.Name] = strings.TrimSpace(d.Value)
+			}
+		}
+	}
+	return props
+}
+
+// geometries converts the geometries of a placemark or MultiGeometry, keeping the holes of
+// polygons. The geometries are not validated.
+func (g *kmlGeometry) geometries() ([]Geometry, error) {
+	var out []Geometry
+	for _, pt := range g.Points {
+		coords, err := parseKMLCoordinates(pt.Coordinates)
+		if err != nil {
+			return nil, err
+		}
+		if len(coords) != 1 {
+			return nil, fmt.Errorf("a point has %d coordinates", len(coords))
+		}
+		out = append(out, Geometry{Type: GeometryPoint, Point: coords[0]})
+	}
+	for _, ls := range g.LineStrings {
+		coords, err := parseKMLCoordinates(ls.Coordinates)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Geometry{Type: GeometryLineString, LineString: coords})
+	}
+	for _, poly := range g.Polygons {
+		rings := []string{poly.Outer}
+		for _, inner := range poly.Inner {
+			rings = append(rings, inner.Coordinates)
+		}
+
+		var p Polygon
+		for _, r := range rings {
+			ring, err := parseKMLCoordinates(r)
+			if err != nil {
+				return nil, err
+			}
+			if n := len(ring); n > 1 && ring[0] == ring[n-1] {
+				ring = ring[:n-1]
+			}
+			p = append(p, ring)
+		}
+		out = append(out, Geometry{Type: GeometryPolygon, Polygon: p})
+	}
+	for i := range g.Multi {
+		multi, err := g.Multi[i].geometries()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, multi...)
+	}
+	return out, nil
+}
+
+// newKMLPath makes a path out of a line string or polygon.
+func newKMLPath(projectID, name string, line bool, coords []LatLng, style *kmlStyle) (PathInfo, error) {
+	var styles PathStyles
+	if style != nil {
+		styles = style.pathStyles()
+	}
+	return newPathInfo(projectID, name, line, coords, styles)
+}
+
+// parseKMLCoordinates parses the contents of a coordinates element.
+func parseKMLCoordinates(str string) ([]LatLng, error) {
+	// Some writers put spaces after the commas within tuples
+	str = strings.ReplaceAll(str, ", ", ",")
+
+	var coords []LatLng
+	for _, tuple := range strings.Fields(str) {
+		parts := strings.Split(tuple, ",")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("coordinate %q has no latitude", tuple)
+		}
+		lng, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		lat, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(lat) || math.IsNaN(lng) || math.Abs(lat) > 90 || math.Abs(lng) > 180 {
+			return nil, fmt.Errorf("coordinate %q is out of range", tuple)
+		}
+		coords = append(coords, LatLng{lat, lng})
+	}
+	return coords, nil
+}
+
+// formatKMLCoordinates is the inverse of parseKMLCoordinates. Coordinates are rounded to
+// seven decimal places, about a centimeter.
+func formatKMLCoordinates(coords []LatLng) string {
+	format := func(v float64) string {
+		return strconv.FormatFloat(math.Round(v*1e7)/1e7, 'f', -1, 64)
+	}
+
+	tuples := make([]string, len(coords))
+	for i, c := range coords {
+		tuples[i] = format(c.Lng) + "," + format(c.Lat)
+	}
+	return strings.Join(tuples, " ")
+}
+
+// pathStyles converts a KML style to the styles of a path.
+func (st *kmlStyle) pathStyles() PathStyles {
+	var styles PathStyles
+	if st.Line != nil {
+		if color, opacity, ok := parseKMLColor(st.Line.Color); ok {
+			styles.Color, styles.Opacity = color, &opacity
+		}
+		if width, err := strconv.ParseFloat(strings.TrimSpace(st.Line.Width), 64); err == nil && width > 0 {
+			styles.Weight = width
+		}
+	}
+	if st.Poly != nil {
+		if color, opacity, ok := parseKMLColor(st.Poly.Color); ok {
+			styles.FillColor, styles.FillOpacity = color, &opacity
+		}
+		if strings.TrimSpace(st.Poly.Fill) == "0" {
+			fill := false
+			styles.Fill = &fill
+		}
+	}
+	return styles
+}
+
+// kmlStyleFor is the inverse of pathStyles. It returns nil if none of the styles carry over.
+func kmlStyleFor(styles PathStyles) *kmlStyle {
+	st := &kmlStyle{}
+
+	lineColor := formatKMLColor(styles.Color, styles.Opacity)
+	if lineColor != "" || styles.Weight > 0 {
+		st.Line = &kmlLineStyle{Color: lineColor}
+		if styles.Weight > 0 {
+			st.Line.Width = strconv.FormatFloat(styles.Weight, 'f', -1, 64)
+		}
+	}
+
+	fillColor := formatKMLColor(styles.FillColor, styles.FillOpacity)
+	if fillColor != "" || (styles.Fill != nil && !*styles.Fill) {
+		st.Poly = &kmlPolyStyle{Color: fillColor}
+		if styles.Fill != nil && !*styles.Fill {
+			st.Poly.Fill = "0"
+		}
+	}
+
+	if st.Line == nil && st.Poly == nil {
+		return nil
+	}
+	return st
+}
+
+// parseKMLColor converts a KML color (aabbggrr in hex) to a "#rrggbb" color and an opacity.
+func parseKMLColor(str string) (color string, opacity float64, ok bool) {
+	str = strings.TrimPrefix(strings.TrimSpace(str), "#")
+	if len(str) != 8 {
+		return "", 0, false
+	}
+	if _, err := strconv.ParseUint(str, 16, 32); err != nil {
+		return "", 0, false
+	}
+	alpha, _ := strconv.ParseUint(str[0:2], 16, 8)
+	return "#" + strings.ToLower(str[6:8]+str[4:6]+str[2:4]), float64(alpha) / 255, true
+}
+
+// formatKMLColor is the inverse of parseKMLColor. Colors that are not "#rrggbb" (or "#rgb")
+// come out empty, and a nil opacity is fully opaque.
+func formatKMLColor(color string, opacity *float64) string {
+	color = strings.TrimPrefix(color, "#")
+	if len(color) == 3 {
+		color = string([]byte{color[0], color[0], color[1], color[1], color[2], color[2]})
+	}
+	if len(color) != 6 {
+		return ""
+	}
+	if _, err := strconv.ParseUint(color, 16, 32); err != nil {
+		return ""
+	}
+
+	alpha := 255
+	if opacity != nil {
+		alpha = int(math.Round(math.Max(0, math.Min(1, *opacity)) * 255))
+	}
+	return strings.ToLower(fmt.Sprintf("%02x%s%s%s", alpha, color[4:6], color[2:4], color[0:2]))
+}
+
+func exportKML(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req KMLExportRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, req.ProjectID); err != nil {
+		return nil, err
+	}
+
+	var proj ProjectInfo
+	if err := s.Database.Take(&proj, "id = ?", req.ProjectID).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	var (
+		stops   []StopInfo
+		paths   []PathInfo
+		circles []CircleInfo
+	)
+	for _, records := range []any{&stops, &paths, &circles} {
+		if err := s.Database.Order("name, id").Find(records, "project_id = ?", req.ProjectID).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	stopFolder := kmlContainer{Name: "Stops"}
+	for _, stop := range stops {
+		pm := kmlPlacemark{Name: stop.Name, Description: stop.Description, Data: &kmlExtendedData{Data: []kmlData{{"stop_id", stop.ID}}}}
+		if stop.Code != "" {
+			pm.Data.Data = append(pm.Data.Data, kmlData{"stop_code", stop.Code})
+		}
+		pm.Points = []kmlCoordinates{{formatKMLCoordinates([]LatLng{{stop.Lat, stop.Lng}})}}
+		stopFolder.Placemarks = append(stopFolder.Placemarks, pm)
+	}
+
+	pathFolder := kmlContainer{Name: "Paths"}
+	for _, p := range paths {
+		coords := p.Coords
+		if len(coords) < 2 {
+			continue
+		}
+
+		pm := kmlPlacemark{Name: p.Name, Style: kmlStyleFor(decodePathStyles(p.Styles))}
+		if p.Line {
+			pm.LineStrings = []kmlCoordinates{{formatKMLCoordinates(coords)}}
+		} else {
+			poly := kmlPolygon{Outer: formatKMLCoordinates(append(coords, coords[0]))}
+			for _, hole := range p.Holes {
+				if len(hole) > 0 {
+					poly.Inner = append(poly.Inner, kmlRing{formatKMLCoordinates(append(hole, hole[0]))})
+				}
+			}
+			pm.Polygons = []kmlPolygon{poly}
+		}
+		pathFolder.Placemarks = append(pathFolder.Placemarks, pm)
+	}
+
+	circleFolder := kmlContainer{Name: "Circles"}
+	for _, c := range circles {
+		if c.RadiusMeters == 0 {
+			continue
+		}
+		proj := newLocalProjection(c.Center)
+		ring := make([]LatLng, kmlCircleSegments+1)
+		for i := range ring {
+			angle := 2 * math.Pi * float64(i) / kmlCircleSegments
+			r := float64(c.RadiusMeters)
+			ring[i] = proj.toLatLng(r*math.Cos(angle), r*math.Sin(angle))
+		}
+
+		circleFolder.Placemarks = append(circleFolder.Placemarks, kmlPlacemark{
+			Name:        c.Name,
+			Style:       kmlStyleFor(decodePathStyles(c.Styles)),
+			kmlGeometry: kmlGeometry{Polygons: []kmlPolygon{{Outer: formatKMLCoordinates(ring)}}},
+		})
+	}
+
+	doc := struct {
+		XMLName  xml.Name     `xml:"kml"`
+		Xmlns    string       `xml:"xmlns,attr"`
+		Document kmlContainer `xml:"Document"`
+	}{
+		Xmlns:    "http://www.opengis.net/kml/2.2",
+		Document: kmlContainer{Name: proj.Name, Folders: []kmlContainer{stopFolder, pathFolder, circleFolder}},
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+
+	data, filename, contentType := buf.Bytes(), fileNameFor(proj.Name, "features")+".kml", "application/vnd.google-earth.kml+xml"
+	if req.KMZ {
+		var zbuf bytes.Buffer
+		zw := zip.NewWriter(&zbuf)
+		w, err := zw.Create("doc.kml")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		data, filename, contentType = zbuf.Bytes(), fileNameFor(proj.Name, "features")+".kmz", "application/vnd.google-earth.kmz"
+	}
+
+	dl, err := s.addDownload(filename, contentType, data)
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	return dl, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func testKMZ(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func kmlWithPlacemark(name string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document><Folder>
+<Placemark><name>` + name + `</name><Point><coordinates>-75,40</coordinates></Point></Placemark>
+</Folder></Document></kml>`
+}
+
+func TestReadKML(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		placemark string
+		wantErr   bool
+	}{
+		{
+			name:      "KML",
+			data:      []byte(kmlWithPlacemark("Main St")),
+			placemark: "Main St",
+		},
+		{
+			name: "KMZ prefers doc.kml",
+			data: testKMZ(t, map[string]string{
+				"a.kml":      kmlWithPlacemark("Other"),
+				"doc.kml":    kmlWithPlacemark("Main St"),
+				"images/a.p": "not KML",
+			}),
+			placemark: "Main St",
+		},
+		{
+			name:      "KMZ without doc.kml",
+			data:      testKMZ(t, map[string]string{"files/Layer.KML": kmlWithPlacemark("Main St")}),
+			placemark: "Main St",
+		},
+		{
+			name:    "KMZ without KML",
+			data:    testKMZ(t, map[string]string{"readme.txt": "hi"}),
+			wantErr: true,
+		},
+		{
+			name:    "corrupt KMZ",
+			data:    []byte("PK\x03\x04 this is not a zip file"),
+			wantErr: true,
+		},
+		{
+			name:    "not XML",
+			data:    []byte("stop_id,stop_name\n"),
+			wantErr: true,
+		},
+		{
+			name:    "unclosed element",
+			data:    []byte(`<kml><Document><Placemark><name>Main St</name>`),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := readKML(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var names []string
+			var walk func(c kmlContainer)
+			walk = func(c kmlContainer) {
+				for _, pm := range c.Placemarks {
+					names = append(names, pm.Name)
+				}
+				for _, d := range append(c.Documents, c.Folders...) {
+					walk(d)
+				}
+			}
+			walk(*doc)
+			if !reflect.DeepEqual(names, []string{tt.placemark}) {
+				t.Errorf("placemarks = %q, want %q", names, tt.placemark)
+			}
+		})
+	}
+}
+
+func TestParseKMLCoordinates(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []LatLng
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: nil},
+		{name: "pairs", input: "-75,40 -75.1,40.1", want: []LatLng{{40, -75}, {40.1, -75.1}}},
+		{name: "altitudes and newlines", input: "\n\t-75,40,10\n\t-75.1,40.1,0\n", want: []LatLng{{40, -75}, {40.1, -75.1}}},
+		{name: "spaces after commas", input: "-75, 40 -75.1, 40.1", want: []LatLng{{40, -75}, {40.1, -75.1}}},
+		{name: "missing latitude", input: "-75", wantErr: true},
+		{name: "not a number", input: "-75,north", wantErr: true},
+		{name: "latitude out of range", input: "-75,91", wantErr: true},
+		{name: "longitude out of range", input: "181,40", wantErr: true},
+		{name: "not finite", input: "NaN,40", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseKMLCoordinates(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// osmNode is an OpenStreetMap node. Tags are not read since street networks do not need them.
+type osmNode struct {
+	ID  int64
+	Lat float64
+	Lng float64
+}
+
+// osmWay is an OpenStreetMap way: an ordered list of node IDs plus tags.
+type osmWay struct {
+	ID    int64
+	Nodes []int64
+	Tags  map[string]string
+}
+
+// osmMember is a member of an OpenStreetMap relation. Type is "node", "way" or "relation".
+type osmMember struct {
+	Type string
+	Ref  int64
+	Role string
+}
+
+// osmRelation is an OpenStreetMap relation.
+type osmRelation struct {
+	ID      int64
+	Members []osmMember
+	Tags    map[string]string
+}
+
+// osmHandlers receive the elements of an OpenStreetMap file as it is read. Nil handlers are
+// skipped, and so is the work of decoding their elements.
+type osmHandlers struct {
+	Node     func(osmNode)
+	Way      func(*osmWay)
+	Relation func(*osmRelation)
+}
+
+// readOSM reads an OpenStreetMap extract in either PBF or XML format. XML may be compressed
+// with gzip or bzip2.
+func readOSM(data []byte, h osmHandlers) error {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		return readOSMXML(zr, h)
+	case bytes.HasPrefix(data, []byte("BZh")):
+		return readOSMXML(bzip2.NewReader(bytes.NewReader(data)), h)
+	case bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n\xef\xbb\xbf"), []byte("<")):
+		return readOSMXML(bytes.NewReader(data), h)
+	default:
+		return readOSMPBF(data, h)
+	}
+}
+
+// readOSMXML reads the OpenStreetMap XML format.
+func readOSMXML(r io.Reader, h osmHandlers) error {
+	dec := xml.NewDecoder(r)
+	attr := func(el xml.StartElement, name string) string {
+		for _, a := range el.Attr {
+			if a.Name.Local == name {
+				return a.Value
+			}
+		}
+		return ""
+	}
+	id := func(el xml.StartElement, name string) int64 {
+		v, _ := strconv.ParseInt(attr(el, name), 10, 64)
+		return v
+	}
+
+	var way *osmWay
+	var rel *osmRelation
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "node":
+				if h.Node != nil {
+					lat, errLat := strconv.ParseFloat(attr(el, "lat"), 64)
+					lng, errLng := strconv.ParseFloat(attr(el, "lon"), 64)
+					if errLat == nil && errLng == nil {
+						h.Node(osmNode{id(el, "id"), lat, lng})
+					}
+				}
+			case "way":
+				if h.Way != nil {
+					way = &osmWay{ID: id(el, "id"), Tags: map[string]string{}}
+				}
+			case "relation":
+				if h.Relation != nil {
+					rel = &osmRelation{ID: id(el, "id"), Tags: map[string]string{}}
+				}
+			case "nd":
+				if way != nil {
+					way.Nodes = append(way.Nodes, id(el, "ref"))
+				}
+			case "member":
+				if rel != nil {
+					rel.Members = append(rel.Members, osmMember{attr(el, "type"), id(el, "ref"), attr(el, "role")})
+				}
+			case "tag":
+				switch {
+				case way != nil:
+					way.Tags[attr(el, "k")] = attr(el, "v")
+				case rel != nil:
+					rel.Tags[attr(el, "k")] = attr(el, "v")
+				}
+			}
+
+		case xml.EndElement:
+			switch el.Name.Local {
+			case "way":
+				if way != nil {
+					h.Way(way)
+					way = nil
+				}
+			case "relation":
+				if rel != nil {
+					h.Relation(rel)
+					rel = nil
+				}
+			}
+		}
+	}
+}
+
+// readOSMPBF reads the OpenStreetMap PBF format: a sequence of length-prefixed blob headers,
+// each followed by a (usually zlib-compressed) blob holding a block of elements.
+func readOSMPBF(data []byte, h osmHandlers) error {
+	for off := 0; off < len(data); {
+		if off+4 > len(data) {
+			return errors.New("file is truncated")
+		}
+		headerLen := int(binary.BigEndian.Uint32(data[off:]))
+		off += 4
+		if headerLen > 64*1024 || off+headerLen > len(data) {
+			return errors.New("blob header is corrupt")
+		}
+
+		var blobType string
+		var blobLen uint64
+		hdr := pbMessage(data[off : off+headerLen])
+		for hdr.next() {
+			switch hdr.field {
+			case 1:
+				blobType = string(hdr.bytes)
+			case 3:
+				blobLen = hdr.varint
+			}
+		}
+		if hdr.err != nil {
+			return hdr.err
+		}
+		off += headerLen
+		// Checked before converting so a huge length cannot wrap around to a small one
+		if blobLen > uint64(len(data)-off) {
+			return errors.New("blob is truncated")
+		}
+
+		blob := data[off : off+int(blobLen)]
+		off += int(blobLen)
+		if blobType != "OSMData" {
+			continue
+		}
+
+		block, err := readPBFBlob(blob)
+		if err != nil {
+			return err
+		}
+		if err := readPBFBlock(block, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxPBFBlobSize is the largest uncompressed blob allowed by the PBF format.
+const maxPBFBlobSize = 32 * 1024 * 1024
+
+// readPBFBlob returns the uncompressed contents of a blob, which may not be larger than the
+// size it states.
+func readPBFBlob(blob []byte) ([]byte, error) {
+	msg := pbMessage(blob)
+	var rawSize int
+	var raw, zdata []byte
+	var compressed bool
+
+	for msg.next() {
+		switch msg.field {
+		case 1:
+			raw = msg.bytes
+		case 2:
+			// Checked before converting so a huge size cannot wrap around to a small one
+			if msg.varint > maxPBFBlobSize {
+				return nil, errors.New("blob is too large")
+			}
+			rawSize = int(msg.varint)
+		case 3:
+			zdata = msg.bytes
+		case 4, 5, 6, 7:
+			compressed = true
+		}
+	}
+	if msg.err != nil {
+		return nil, msg.err
+	}
+
+	switch {
+	case raw != nil:
+		return raw, nil
+	case zdata != nil:
+		if rawSize < 0 {
+			return nil, errors.New("blob size is corrupt")
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(zdata))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		// Reading one byte past the stated size is enough to tell the blob is larger than that
+		buf := bytes.NewBuffer(make([]byte, 0, rawSize))
+		if _, err := io.Copy(buf, io.LimitReader(zr, int64(rawSize)+1)); err != nil {
+			return nil, err
+		}
+		if buf.Len() > rawSize {
+			return nil, errors.New("blob is larger than its stated size")
+		}
+		return buf.Bytes(), nil
+	case compressed:
+		return nil, errors.New("only zlib-compressed PBF files are supported")
+	default:
+		return nil, nil
+	}
+}
+
+// readPBFBlock reads a PrimitiveBlock: a string table plus groups of elements whose
+// coordinates are scaled by the block's granularity.
+func readPBFBlock(block []byte, h osmHandlers) error {
+	var strs [][]byte
+	var groups [][]byte
+	granularity, latOffset, lonOffset := int64(100), int64(0), int64(0)
+
+	msg := pbMessage(block)
+	for msg.next() {
+		switch msg.field {
+		case 1:
+			st := pbMessage(msg.bytes)
+			for st.next() {
+				if st.field == 1 {
+					strs = append(strs, st.bytes)
+				}
+			}
+			if st.err != nil {
+				return st.err
+			}
+		case 2:
+			groups = append(groups, msg.bytes)
+		case 17:
+			granularity = int64(msg.varint)
+		case 19:
+			latOffset = int64(msg.varint)
+		case 20:
+			lonOffset = int64(msg.varint)
+		}
+	}
+	if msg.err != nil {
+		return msg.err
+	}
+
+	str := func(i uint64) string {
+		if i < uint64(len(strs)) {
+			return string(strs[i])
+		}
+		return ""
+	}
+	coord := func(v, offset int64) float64 {
+		return 1e-9 * float64(offset+granularity*v)
+	}
+	tags := func(keys, vals []uint64) map[string]string {
+		m := make(map[string]string, len(keys))
+		for i := 0; i < len(keys) && i < len(vals); i++ {
+			m[str(keys[i])] = str(vals[i])
+		}
+		return m
+	}
+
+	for _, group := range groups {
+		g := pbMessage(group)
+		for g.next() {
+			switch {
+			case g.field == 1 && h.Node != nil:
+				var n osmNode
+				var lat, lon int64
+				m := pbMessage(g.bytes)
+				for m.next() {
+					switch m.field {
+					case 1:
+						n.ID = zigzag(m.varint)
+					case 8:
+						lat = zigzag(m.varint)
+					case 9:
+						lon = zigzag(m.varint)
+					}
+				}
+				if m.err != nil {
+					return m.err
+				}
+				n.Lat, n.Lng = coord(lat, latOffset), coord(lon, lonOffset)
+				h.Node(n)
+
+			case g.field == 2 && h.Node != nil:
+				var ids, lats, lons []uint64
+				m := pbMessage(g.bytes)
+				for m.next() {
+					switch m.field {
+					case 1:
+						ids = m.appendVarints(ids)
+					case 8:
+						lats = m.appendVarints(lats)
+					case 9:
+						lons = m.appendVarints(lons)
+					}
+				}
+				if m.err != nil {
+					return m.err
+				}
+				if len(lats) != len(ids) || len(lons) != len(ids) {
+					return errors.New("dense nodes are corrupt")
+				}
+				var id, lat, lon int64
+				for i := range ids {
+					id += zigzag(ids[i])
+					lat += zigzag(lats[i])
+					lon += zigzag(lons[i])
+					h.Node(osmNode{id, coord(lat, latOffset), coord(lon, lonOffset)})
+				}
+
+			case g.field == 3 && h.Way != nil:
+				var keys, vals, refs []uint64
+				way := &osmWay{}
+				m := pbMessage(g.bytes)
+				for m.next() {
+					switch m.field {
+					case 1:
+						way.ID = int64(m.varint)
+					case 2:
+						keys = m.appendVarints(keys)
+					case 3:
+						vals = m.appendVarints(vals)
+					case 8:
+						refs = m.appendVarints(refs)
+					}
+				}
+				if m.err != nil {
+					return m.err
+				}
+				way.Tags = tags(keys, vals)
+				way.Nodes = make([]int64, len(refs))
+				var ref int64
+				for i, delta := range refs {
+					ref += zigzag(delta)
+					way.Nodes[i] = ref
+				}
+				h.Way(way)
+
+			case g.field == 4 && h.Relation != nil:
+				var keys, vals, roles, memids, types []uint64
+				rel := &osmRelation{}
+				m := pbMessage(g.bytes)
+				for m.next() {
+					switch m.field {
+					case 1:
+						rel.ID = int64(m.varint)
+					case 2:
+						keys = m.appendVarints(keys)
+					case 3:
+						vals = m.appendVarints(vals)
+					case 8:
+						roles = m.appendVarints(roles)
+					case 9:
+						memids = m.appendVarints(memids)
+					case 10:
+						types = m.appendVarints(types)
+					}
+				}
+				if m.err != nil {
+					return m.err
+				}
+				rel.Tags = tags(keys, vals)
+				var ref int64
+				for i := 0; i < len(memids) && i < len(roles) && i < len(types); i++ {
+					ref += zigzag(memids[i])
+					kind := "node"
+					switch types[i] {
+					case 1:
+						kind = "way"
+					case 2:
+						kind = "relation"
+					}
+					rel.Members = append(rel.Members, osmMember{kind, ref, str(roles[i])})
+				}
+				h.Relation(rel)
+			}
+		}
+		if g.err != nil {
+			return g.err
+		}
+	}
+	return nil
+}
+
+// pbReader steps through the fields of an encoded protocol buffer message. After each call
+// to next, field holds the field number and either varint (for varint and fixed-width fields)
+// or bytes (for length-delimited fields) holds its value.
+type pbReader struct {
+	data   []byte
+	field  int
+	wire   int
+	varint uint64
+	bytes  []byte
+	err    error
+}
+
+func pbMessage(data []byte) *pbReader {
+	return &pbReader{data: data}
+}
+
+func (r *pbReader) next() bool {
+	if r.err != nil || len(r.data) == 0 {
+		return false
+	}
+
+	key, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errors.New("protocol buffer is corrupt")
+		return false
+	}
+	r.data = r.data[n:]
+	r.field, r.wire = int(key>>3), int(key&7)
+
+	switch r.wire {
+	case 0:
+		r.varint, n = binary.Uvarint(r.data)
+		if n <= 0 {
+			r.err = errors.New("protocol buffer is corrupt")
+			return false
+		}
+		r.data = r.data[n:]
+	case 1:
+		if len(r.data) < 8 {
+			r.err = errors.New("protocol buffer is truncated")
+			return false
+		}
+		r.varint = binary.LittleEndian.Uint64(r.data)
+		r.data = r.data[8:]
+	case 2:
+		size, n := binary.Uvarint(r.data)
+		if n <= 0 || size > uint64(len(r.data)-n) {
+			r.err = errors.New("protocol buffer is truncated")
+			return false
+		}
+		r.bytes = r.data[n : n+int(size)]
+		r.data = r.data[n+int(size):]
+	case 5:
+		if len(r.data) < 4 {
+			r.err = errors.New("protocol buffer is truncated")
+			return false
+		}
+		r.varint = uint64(binary.LittleEndian.Uint32(r.data))
+		r.data = r.data[4:]
+	default:
+		r.err = fmt.Errorf("protocol buffer has unsupported wire type %d", r.wire)
+		return false
+	}
+	return true
+}
+
+// appendVarints appends the value of the current field, which is either a single varint or
+// a packed run of them.
+func (r *pbReader) appendVarints(dst []uint64) []uint64 {
+	if r.wire != 2 {
+		return append(dst, r.varint)
+	}
+	for b := r.bytes; len(b) > 0; {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			r.err = errors.New("protocol buffer is corrupt")
+			return dst
+		}
+		dst = append(dst, v)
+		b = b[n:]
+	}
+	return dst
+}
+
+// zigzag decodes a signed (sint64) varint.
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
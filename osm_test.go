@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Protocol buffer encoding, just enough to build small PBF files.
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func bigEndian32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func pbVarint(field int, v uint64) []byte {
+	b := appendUvarint(nil, uint64(field)<<3)
+	return appendUvarint(b, v)
+}
+
+func pbBytes(field int, data []byte) []byte {
+	b := appendUvarint(nil, uint64(field)<<3|2)
+	b = appendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func pbPacked(field int, values ...uint64) []byte {
+	var b []byte
+	for _, v := range values {
+		b = appendUvarint(b, v)
+	}
+	return pbBytes(field, b)
+}
+
+func pbZigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func zlibCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// pbfFileBlock frames a blob with its header, stating dataSize as the length of the blob.
+func pbfFileBlock(blobType string, blob []byte, dataSize uint64) []byte {
+	header := append(pbBytes(1, []byte(blobType)), pbVarint(3, dataSize)...)
+	return append(append(bigEndian32(uint32(len(header))), header...), blob...)
+}
+
+// testPBFBlock is a PrimitiveBlock with two dense nodes and a way between them.
+func testPBFBlock() []byte {
+	strs := bytes.Join([][]byte{pbBytes(1, nil), pbBytes(1, []byte("highway")), pbBytes(1, []byte("residential"))}, nil)
+	dense := bytes.Join([][]byte{
+		pbPacked(1, pbZigzag(1), pbZigzag(1)),
+		pbPacked(8, pbZigzag(400000000), pbZigzag(1000000)),
+		pbPacked(9, pbZigzag(-750000000), pbZigzag(-1000000)),
+	}, nil)
+	way := bytes.Join([][]byte{
+		pbVarint(1, 10),
+		pbPacked(2, 1),
+		pbPacked(3, 2),
+		pbPacked(8, pbZigzag(1), pbZigzag(1)),
+	}, nil)
+	group := append(pbBytes(2, dense), pbBytes(3, way)...)
+	return append(pbBytes(1, strs), pbBytes(2, group)...)
+}
+
+func TestReadOSMPBF(t *testing.T) {
+	block := testPBFBlock()
+	rawBlob := pbBytes(1, block)
+	zlibBlob := append(pbVarint(2, uint64(len(block))), pbBytes(3, zlibCompress(block))...)
+	header := pbfFileBlock("OSMHeader", pbBytes(1, []byte("ignored")), uint64(len(pbBytes(1, []byte("ignored")))))
+	valid := append(header, pbfFileBlock("OSMData", zlibBlob, uint64(len(zlibBlob)))...)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "raw blob", data: pbfFileBlock("OSMData", rawBlob, uint64(len(rawBlob)))},
+		{name: "zlib blob after a header blob", data: valid},
+		{name: "empty file", data: nil},
+		{name: "truncated header length", data: []byte{0, 0, 1}, wantErr: true},
+		{name: "header past the end", data: []byte{0, 0, 1, 0, 1, 2}, wantErr: true},
+		{name: "huge header", data: bigEndian32(1 << 20), wantErr: true},
+		{name: "corrupt header", data: []byte{0, 0, 0, 1, 0xFF}, wantErr: true},
+		{name: "blob past the end", data: valid[:len(valid)-1], wantErr: true},
+		{
+			// Converting this length to int used to wrap the bounds check around and panic
+			name:    "blob length overflows int",
+			data:    pbfFileBlock("OSMData", rawBlob, math.MaxInt64),
+			wantErr: true,
+		},
+		{name: "blob length above int64", data: pbfFileBlock("OSMData", rawBlob, math.MaxUint64), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nodes []osmNode
+			var ways []osmWay
+			err := readOSMPBF(tt.data, osmHandlers{
+				Node: func(n osmNode) { nodes = append(nodes, n) },
+				Way:  func(w *osmWay) { ways = append(ways, *w) },
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.data == nil {
+				return
+			}
+
+			if len(nodes) != 2 || nodes[0].ID != 1 || nodes[1].ID != 2 {
+				t.Fatalf("nodes = %v, want IDs 1 and 2", nodes)
+			}
+			if math.Abs(nodes[0].Lat-40) > 1e-9 || math.Abs(nodes[0].Lng+75) > 1e-9 ||
+				math.Abs(nodes[1].Lat-40.1) > 1e-9 || math.Abs(nodes[1].Lng+75.1) > 1e-9 {
+				t.Errorf("nodes = %v, want (40, -75) and (40.1, -75.1)", nodes)
+			}
+			want := []osmWay{{ID: 10, Nodes: []int64{1, 2}, Tags: map[string]string{"highway": "residential"}}}
+			if !reflect.DeepEqual(ways, want) {
+				t.Errorf("ways = %v, want %v", ways, want)
+			}
+		})
+	}
+}
+
+func TestReadPBFBlob(t *testing.T) {
+	data := bytes.Repeat([]byte("hiveway"), 100)
+	zdata := zlibCompress(data)
+	zlibBlob := func(rawSize uint64) []byte {
+		return append(pbVarint(2, rawSize), pbBytes(3, zdata)...)
+	}
+
+	tests := []struct {
+		name    string
+		blob    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "raw", blob: pbBytes(1, data), want: data},
+		{name: "zlib", blob: zlibBlob(uint64(len(data))), want: data},
+		{name: "empty", blob: nil, want: nil},
+		{name: "larger than its stated size", blob: zlibBlob(uint64(len(data) - 1)), wantErr: true},
+		{name: "missing size", blob: pbBytes(3, zdata), wantErr: true},
+		{name: "size above the format's limit", blob: zlibBlob(maxPBFBlobSize + 1), wantErr: true},
+		{name: "size that wraps around to negative", blob: zlibBlob(math.MaxUint64), wantErr: true},
+		{name: "corrupt zlib data", blob: append(pbVarint(2, 10), pbBytes(3, []byte("not zlib"))...), wantErr: true},
+		{name: "unsupported compression", blob: append(pbVarint(2, 10), pbBytes(4, []byte("lzma"))...), wantErr: true},
+		{name: "corrupt protocol buffer", blob: []byte{0x0A, 0xFF}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readPBFBlob(tt.blob)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d bytes", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,51 +2,218 @@ package main
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/google/uuid"
 	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
 )
 
+// PathSpec defines user-configurable fields for paths, which are lines or closed shapes
+// drawn on the map. Closed shapes do not need to repeat their first coordinate at the end,
+// and may have holes, e.g., a lake in a park, which are not part of the shape. Properties are
+// kept from imported files so they can be exported again.
 type PathSpec struct {
-	Line   bool                `gorm:"line" json:"line" msgpack:"line"`
-	Coords *msgpack.RawMessage `gorm:"coords" json:"coords" msgpack:"coords"`
-	Name   string              `gorm:"name" json:"name" msgpack:"name"`
-	Styles *msgpack.RawMessage `gorm:"styles" json:"styles" msgpack:"styles"`
+	ProjectID  string              `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	Line       bool                `gorm:"line" json:"line" msgpack:"line"`
+	Coords     LineString          `gorm:"coords" json:"coords" msgpack:"coords"`
+	Holes      Rings               `gorm:"holes" json:"holes,omitempty" msgpack:"holes,omitempty"`
+	Name       string              `gorm:"name" json:"name" msgpack:"name"`
+	Styles     *msgpack.RawMessage `gorm:"styles" json:"styles" msgpack:"styles"`
+	Properties FeatureProperties   `gorm:"properties" json:"properties,omitempty" msgpack:"properties,omitempty"`
 }
 
 type PathInfo struct {
 	PathSpec
 	ID string `gorm:"primaryKey" json:"id" msgpack:"id"`
+	// ShapeDistTraveled is the distance along the path at each of its coordinates, in whatever
+	// units the shapes.txt of an imported GTFS feed used, so it can be exported again. It is
+	// dropped whenever the coordinates change.
+	ShapeDistTraveled ShapeDistances `gorm:"shape_dist_traveled" json:"-" msgpack:"-"`
 }
 
 func (PathInfo) TableName() string {
 	return "paths"
 }
 
-func createPath(s *Server, u *UserInfo, payload []byte) (any, error) {
+// PathStyles are the styles of a path (and of a circle) that are understood when converting
+// to and from other formats. They follow the path options of the web map: colors are
+// "#rrggbb", opacities range from 0 to 1, and Weight is the line width in pixels. Styles are
+// otherwise stored exactly as clients send them.
+type PathStyles struct {
+	Color       string   `msgpack:"color,omitempty"`
+	Weight      float64  `msgpack:"weight,omitempty"`
+	Opacity     *float64 `msgpack:"opacity,omitempty"`
+	Fill        *bool    `msgpack:"fill,omitempty"`
+	FillColor   string   `msgpack:"fillColor,omitempty"`
+	FillOpacity *float64 `msgpack:"fillOpacity,omitempty"`
+}
+
+// decodePathStyles reads the styles of a path or circle, ignoring any it does not understand.
+// Missing or malformed styles yield the zero PathStyles.
+func decodePathStyles(raw *msgpack.RawMessage) PathStyles {
+	var styles PathStyles
+	if raw == nil || len(*raw) == 0 {
+		return styles
+	}
+	if err := msgpack.Unmarshal(*raw, &styles); err != nil {
+		return PathStyles{}
+	}
+	return styles
+}
+
+// encodePathStyles is the inverse of decodePathStyles. The zero PathStyles encodes as nil.
+func encodePathStyles(styles PathStyles) (*msgpack.RawMessage, error) {
+	if styles == (PathStyles{}) {
+		return nil, nil
+	}
+	raw, err := msgpack.Marshal(styles)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := msgpack.RawMessage(raw)
+	return &msg, nil
+}
+
+// newPathInfo makes a new path with a fresh ID, e.g., for a line or shape being imported.
+func newPathInfo(projectID, name string, line bool, coords []LatLng, styles PathStyles) (PathInfo, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return PathInfo{}, err
+	}
+	rawStyles, err := encodePathStyles(styles)
+	if err != nil {
+		return PathInfo{}, err
+	}
+
+	spec := PathSpec{ProjectID: projectID, Line: line, Coords: coords, Name: name, Styles: rawStyles}
+	return PathInfo{PathSpec: spec, ID: id.String()}, nil
+}
+
+func createPath(s *Server, u *UserConn, payload []byte) (any, error) {
 	var spec PathSpec
 	if err := msgpack.Unmarshal(payload, &spec); err != nil {
 		// TODO
 		return nil, err
 	}
 
+	if err := requireProject(s.Database, spec.ProjectID); err != nil {
+		return nil, err
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
 	id, err := uuid.NewRandom()
 	if err != nil {
 		// TODO
 		return nil, err
 	}
 
-	info := PathInfo{spec, id.String()}
+	info := PathInfo{PathSpec: spec, ID: id.String()}
 
 	if err := s.Database.Create(info).Error; err != nil {
 		// TODO
 		return nil, err
 	}
 
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "path:created", Data: info})
+
 	return info, nil
 }
 
-func deletePath(s *Server, u *UserInfo, payload []byte) (any, error) {
+func modifyPath(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to modify the ID or project of the path, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	path := PathInfo{ID: id}
+	if err := s.Database.Take(&path).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrorWithCode{
+				Code:    "path-not-found",
+				Message: fmt.Sprintf("there is no path with ID %q", id),
+				Details: id,
+			}
+		}
+		// TODO
+		return nil, err
+	}
+
+	changes := map[string]any{}
+
+	if line, ok := untrustedChanges["line"].(bool); ok {
+		changes["line"] = line
+		path.Line = line
+	}
+	if name, ok := untrustedChanges["name"].(string); ok {
+		changes["name"] = name
+		path.Name = name
+	}
+	if val, present := untrustedChanges["coords"]; present {
+		var coords LineString
+		if err := convertValue(val, &coords); err != nil {
+			return nil, invalidGeometry("coords must be a list of [lat, lng] pairs")
+		}
+		changes["coords"] = coords
+		changes["shape_dist_traveled"] = ShapeDistances(nil)
+		path.Coords = coords
+		path.ShapeDistTraveled = nil
+	}
+	if val, present := untrustedChanges["holes"]; present {
+		var holes Rings
+		if err := convertValue(val, &holes); err != nil {
+			return nil, invalidGeometry("holes must be a list of lists of [lat, lng] pairs")
+		}
+		changes["holes"] = holes
+		path.Holes = holes
+	}
+	if val, present := untrustedChanges["styles"]; present {
+		raw, err := toRawMessage(val)
+		if err != nil {
+			// TODO
+			return nil, err
+		}
+		changes["styles"] = raw
+		path.Styles = raw
+	}
+	if val, present := untrustedChanges["properties"]; present {
+		var props FeatureProperties
+		if err := convertValue(val, &props); err != nil {
+			return nil, &ErrorWithCode{Code: "invalid-properties", Message: "properties must be a map"}
+		}
+		changes["properties"] = props
+		path.Properties = props
+	}
+
+	// Changing whether the path is a line can make its existing coordinates invalid too
+	if err := path.PathSpec.validate(); err != nil {
+		return nil, err
+	}
+
+	if len(changes) > 0 {
+		if err := s.Database.Model(&path).Updates(changes).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: path.ProjectID, Type: "path:modified", Data: path})
+
+	return path, nil
+}
+
+func deletePath(s *Server, u *UserConn, payload []byte) (any, error) {
 	var id string
 	if err := msgpack.Unmarshal(payload, &id); err != nil {
 		// TODO
@@ -58,10 +225,32 @@ func deletePath(s *Server, u *UserInfo, payload []byte) (any, error) {
 		return nil, errors.New("a non-empty string ID must be supplied")
 	}
 
-	if err := s.Database.Delete(&PathInfo{}, "id = ?", id).Error; err != nil {
+	// Look up the project first so we know who to notify
+	var path PathInfo
+	if err := s.Database.Select("project_id").Take(&path, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
 		// TODO
 		return nil, err
 	}
 
+	// Patterns and trips that used the path as their shape are left without one
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&PatternInfo{}).Where("shape_id = ?", id).Update("shape_id", "").Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&TripInfo{}).Where("shape_id = ?", id).Update("shape_id", "").Error; err != nil {
+			return err
+		}
+		return tx.Delete(&PathInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: path.ProjectID, Type: "path:deleted", Data: id})
+
 	return nil, nil
 }
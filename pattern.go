@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// PatternInfo is one way of running a route: an ordered sequence of stops, plus the path
+// (shape) that vehicles follow between them. A route usually has at least one pattern per
+// direction. Trips may refer to the pattern they follow.
+type PatternInfo struct {
+	ID          string `gorm:"primaryKey" json:"id" msgpack:"id"`
+	ProjectID   string `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	RouteID     string `gorm:"route_id;index" json:"route_id" msgpack:"route_id"`
+	Name        string `gorm:"name" json:"name" msgpack:"name"`
+	DirectionID uint   `gorm:"direction_id" json:"direction_id" msgpack:"direction_id"`
+	// ShapeID is the ID of a PathInfo, or empty if the pattern has no shape yet.
+	ShapeID string `gorm:"shape_id" json:"shape_id" msgpack:"shape_id"`
+	// StopIDs are the stops of the pattern in order. They are stored in a separate table.
+	StopIDs []string `gorm:"-" json:"stop_ids" msgpack:"stop_ids"`
+}
+
+func (PatternInfo) TableName() string {
+	return "patterns"
+}
+
+// PatternStopInfo is a single stop of a pattern.
+type PatternStopInfo struct {
+	PatternID string `gorm:"primaryKey"`
+	Sequence  uint   `gorm:"primaryKey"`
+	ProjectID string `gorm:"project_id;index"`
+	StopID    string `gorm:"stop_id"`
+}
+
+func (PatternStopInfo) TableName() string {
+	return "pattern_stops"
+}
+
+// loadPatternStops fills in the StopIDs of the given patterns.
+func loadPatternStops(db *gorm.DB, patterns []PatternInfo) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(patterns))
+	byID := make(map[string]*PatternInfo, len(patterns))
+	for i := range patterns {
+		ids[i] = patterns[i].ID
+		byID[patterns[i].ID] = &patterns[i]
+		patterns[i].StopIDs = []string{}
+	}
+
+	var stops []PatternStopInfo
+	if err := db.Order("pattern_id, sequence").Find(&stops, "pattern_id IN ?", ids).Error; err != nil {
+		return err
+	}
+	for _, ps := range stops {
+		p := byID[ps.PatternID]
+		p.StopIDs = append(p.StopIDs, ps.StopID)
+	}
+
+	return nil
+}
+
+// takePattern fetches a single pattern, including its stops.
+func takePattern(db *gorm.DB, id string) (PatternInfo, error) {
+	pattern := PatternInfo{ID: id}
+	if err := db.Take(&pattern).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return pattern, &ErrorWithCode{
+				Code:    "pattern-not-found",
+				Message: fmt.Sprintf("there is no pattern with ID %q", id),
+				Details: id,
+			}
+		}
+		return pattern, err
+	}
+
+	patterns := []PatternInfo{pattern}
+	if err := loadPatternStops(db, patterns); err != nil {
+		return pattern, err
+	}
+	return patterns[0], nil
+}
+
+// setPatternStops replaces the stops of a pattern, making sure they all belong to the project.
+func setPatternStops(tx *gorm.DB, pattern PatternInfo) error {
+	for _, stopID := range pattern.StopIDs {
+		if err := requireInProject(tx, &StopInfo{}, "stop", stopID, pattern.ProjectID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Delete(&PatternStopInfo{}, "pattern_id = ?", pattern.ID).Error; err != nil {
+		return err
+	}
+	if len(pattern.StopIDs) == 0 {
+		return nil
+	}
+
+	stops := make([]PatternStopInfo, len(pattern.StopIDs))
+	for i, stopID := range pattern.StopIDs {
+		stops[i] = PatternStopInfo{pattern.ID, uint(i), pattern.ProjectID, stopID}
+	}
+	return tx.Create(stops).Error
+}
+
+func listPatterns(s *Server, u *UserConn, payload []byte) (any, error) {
+	var projectID string
+	if err := msgpack.Unmarshal(payload, &projectID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, projectID); err != nil {
+		return nil, err
+	}
+
+	var patterns []PatternInfo
+	if err := s.Database.Find(&patterns, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	if err := loadPatternStops(s.Database, patterns); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+func createPattern(s *Server, u *UserConn, payload []byte) (any, error) {
+	var info PatternInfo
+	if err := msgpack.Unmarshal(payload, &info); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, info.ProjectID); err != nil {
+		return nil, err
+	}
+	if err := requireInProject(s.Database, &RouteInfo{}, "route", info.RouteID, info.ProjectID); err != nil {
+		return nil, err
+	}
+	if info.ShapeID != "" {
+		if err := requireInProject(s.Database, &PathInfo{}, "path", info.ShapeID, info.ProjectID); err != nil {
+			return nil, err
+		}
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+	info.ID = id.String()
+	if info.StopIDs == nil {
+		info.StopIDs = []string{}
+	}
+
+	err = s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&info).Error; err != nil {
+			return err
+		}
+		return setPatternStops(tx, info)
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "pattern:created", Data: info})
+
+	return info, nil
+}
+
+func modifyPattern(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to modify the ID, project, or route of the pattern, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	pattern, err := takePattern(s.Database, id)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]any{}
+
+	if name, ok := untrustedChanges["name"].(string); ok {
+		changes["name"] = name
+	}
+	if dir, ok := toUint(untrustedChanges["direction_id"]); ok {
+		changes["direction_id"] = dir
+	}
+	if shapeID, ok := untrustedChanges["shape_id"].(string); ok {
+		if shapeID != "" {
+			if err := requireInProject(s.Database, &PathInfo{}, "path", shapeID, pattern.ProjectID); err != nil {
+				return nil, err
+			}
+		}
+		changes["shape_id"] = shapeID
+	}
+
+	var newStopIDs []string
+	if rawStops, ok := untrustedChanges["stop_ids"].([]any); ok {
+		newStopIDs = make([]string, len(rawStops))
+		for i, raw := range rawStops {
+			if newStopIDs[i], ok = raw.(string); !ok {
+				return nil, errors.New("stop_ids must be an array of strings")
+			}
+		}
+	}
+
+	err = s.Database.Transaction(func(tx *gorm.DB) error {
+		if len(changes) > 0 {
+			if err := tx.Model(&PatternInfo{ID: id}).Updates(changes).Error; err != nil {
+				return err
+			}
+		}
+		if newStopIDs != nil {
+			pattern.StopIDs = newStopIDs
+			return setPatternStops(tx, pattern)
+		}
+		return nil
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if pattern, err = takePattern(s.Database, id); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: pattern.ProjectID, Type: "pattern:modified", Data: pattern})
+
+	return pattern, nil
+}
+
+// deletePattern deletes a pattern. Trips that followed the pattern are kept, but no longer
+// refer to it.
+func deletePattern(s *Server, u *UserConn, payload []byte) (any, error) {
+	var id string
+	if err := msgpack.Unmarshal(payload, &id); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	// Look up the project first so we know who to notify
+	var pattern PatternInfo
+	if err := s.Database.Select("project_id").Take(&pattern, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
+		// TODO
+		return nil, err
+	}
+
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&TripInfo{}).Where("pattern_id = ?", id).Update("pattern_id", "").Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&PatternStopInfo{}, "pattern_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&PatternInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: pattern.ProjectID, Type: "pattern:deleted", Data: id})
+
+	return nil, nil
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
 
@@ -27,13 +29,78 @@ type ProjectInfo struct {
 	CreatedBy string `gorm:"created_by" msgpack:"created_by"`
 }
 
+// projectScopedModels lists every table with a 'project_id' column. Deleting a project
+// deletes all of its rows from each of these tables.
+var projectScopedModels = []any{
+	&StopInfo{},
+	&PathInfo{},
+	&CircleInfo{},
+	&AgencyInfo{},
+	&RouteInfo{},
+	&TripInfo{},
+	&StopTimeInfo{},
+	&FrequencyInfo{},
+	&CalendarInfo{},
+	&CalendarDateInfo{},
+	&PatternInfo{},
+	&PatternStopInfo{},
+	&CostModelInfo{},
+	&RidershipInfo{},
+	&ReferenceLayerInfo{},
+	&ReferenceFeatureInfo{},
+	&ReferenceVisibilityInfo{},
+}
+
 type ProjectFeatures struct {
 	Stops   []StopInfo   `json:"stops" msgpack:"stops"`
 	Paths   []PathInfo   `json:"paths" msgpack:"paths"`
 	Circles []CircleInfo `json:"circles" msgpack:"circles"`
 }
 
-func listProjects(s *Server, u *UserInfo, payload []byte) (any, error) {
+// MaxFeatureImportErrors caps the number of problems reported by a single upload of map
+// features.
+const MaxFeatureImportErrors = 50
+
+// FeatureImportReport summarizes an upload of map features (from KML, a shapefile or GeoJSON)
+// into a project.
+type FeatureImportReport struct {
+	ProjectID string   `msgpack:"project_id"`
+	Stops     int      `msgpack:"stops"`
+	Paths     int      `msgpack:"paths"`
+	Circles   int      `msgpack:"circles"`
+	Skipped   int      `msgpack:"skipped"`
+	Errors    []string `msgpack:"errors"`
+}
+
+func (r *FeatureImportReport) addError(format string, args ...any) {
+	if len(r.Errors) < MaxFeatureImportErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// saveImportedFeatures creates imported stops, paths and circles all at once.
+func saveImportedFeatures(db *gorm.DB, stops []StopInfo, paths []PathInfo, circles []CircleInfo) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if len(stops) > 0 {
+			if err := tx.CreateInBatches(stops, gtfsInsertBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		if len(paths) > 0 {
+			if err := tx.CreateInBatches(paths, gtfsInsertBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		if len(circles) > 0 {
+			if err := tx.CreateInBatches(circles, gtfsInsertBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func listProjects(s *Server, u *UserConn, payload []byte) (any, error) {
 	var projects []ProjectInfo
 	if err := s.Database.Find(&projects).Error; err != nil {
 		return nil, err
@@ -41,7 +108,7 @@ func listProjects(s *Server, u *UserInfo, payload []byte) (any, error) {
 	return projects, nil
 }
 
-func createProject(s *Server, u *UserInfo, payload []byte) (any, error) {
+func createProject(s *Server, u *UserConn, payload []byte) (any, error) {
 	var spec ProjectSpec
 	if err := msgpack.Unmarshal(payload, &spec); err != nil {
 		// TODO
@@ -64,7 +131,7 @@ func createProject(s *Server, u *UserInfo, payload []byte) (any, error) {
 	return info, nil
 }
 
-func modifyProjectMetadata(s *Server, u *UserInfo, payload []byte) (any, error) {
+func modifyProjectMetadata(s *Server, u *UserConn, payload []byte) (any, error) {
 	// They might try to modified 'created_at' and other fields they are not allowed
 	// to modify
 	var untrustedChanges map[string]any
@@ -94,10 +161,18 @@ func modifyProjectMetadata(s *Server, u *UserInfo, payload []byte) (any, error)
 		return nil, err
 	}
 
+	// SQLite ignores the RETURNING clause, so fetch the full record before pushing it out
+	if err := s.Database.Take(&proj).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: proj.ID, Type: "project:modified", Data: proj})
+
 	return proj, nil
 }
 
-func deleteProject(s *Server, u *UserInfo, payload []byte) (any, error) {
+func deleteProject(s *Server, u *UserConn, payload []byte) (any, error) {
 	var id string
 	if err := msgpack.Unmarshal(payload, &id); err != nil {
 		// TODO
@@ -109,26 +184,91 @@ func deleteProject(s *Server, u *UserInfo, payload []byte) (any, error) {
 		return nil, errors.New("a non-empty string ID must be supplied")
 	}
 
-	if err := s.Database.Delete(&ProjectInfo{}, "id = ?", id).Error; err != nil {
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		for _, model := range projectScopedModels {
+			if err := tx.Delete(model, "project_id = ?", id).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&ProjectInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
 		// TODO
 		return nil, err
 	}
 
+	s.publish(u, ProjectEvent{ProjectID: id, Type: "project:deleted", Data: id})
+	s.dropSubscribers(id)
+
 	return nil, nil
 }
 
-func listProjectFeatures(s *Server, u *UserInfo, payload []byte) (any, error) {
+func listProjectFeatures(s *Server, u *UserConn, payload []byte) (any, error) {
+	var id string
+	if err := msgpack.Unmarshal(payload, &id); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, id); err != nil {
+		return nil, err
+	}
+
 	var features ProjectFeatures
 
-	if err := s.Database.Find(&features.Stops).Error; err != nil {
+	if err := s.Database.Find(&features.Stops, "project_id = ?", id).Error; err != nil {
 		return nil, err // TODO
 	}
-	if err := s.Database.Find(&features.Paths).Error; err != nil {
+	if err := s.Database.Find(&features.Paths, "project_id = ?", id).Error; err != nil {
 		return nil, err // TODO
 	}
-	if err := s.Database.Find(&features.Circles).Error; err != nil {
+	if err := s.Database.Find(&features.Circles, "project_id = ?", id).Error; err != nil {
 		return nil, err // TODO
 	}
 
 	return features, nil
 }
+
+// requireProject returns an error if the given ID is empty or does not belong to an
+// existing project. Handlers use it to validate the project ID of anything that is
+// being added to a project.
+func requireProject(db *gorm.DB, id string) error {
+	if id == "" {
+		return errors.New("a non-empty project ID must be supplied")
+	}
+
+	var count int64
+	if err := db.Model(&ProjectInfo{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return &ErrorWithCode{
+			Code:    "project-not-found",
+			Message: fmt.Sprintf("there is no project with ID %q", id),
+			Details: id,
+		}
+	}
+
+	return nil
+}
+
+// requireInProject returns an error if there is no record of the given model with the given
+// ID in the given project. The kind is used to construct the error code, e.g., "route" gives
+// "route-not-found".
+func requireInProject(db *gorm.DB, model any, kind, id, projectID string) error {
+	var count int64
+	if err := db.Model(model).Where("id = ? AND project_id = ?", id, projectID).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return &ErrorWithCode{
+			Code:    kind + "-not-found",
+			Message: fmt.Sprintf("there is no %s with ID %q in this project", kind, id),
+			Details: id,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// coordSystem converts the coordinates of a shapefile to longitude and latitude. It is built
+// from the well-known text (WKT) in a .prj file, which is either a geographic system (GEOGCS)
+// or a projected one (PROJCS) using one of the projections US agencies commonly publish in:
+// Transverse Mercator (UTM and many State Plane zones), Lambert Conformal Conic (the other
+// State Plane zones), Albers Equal Area and Mercator (including web mercator).
+//
+// Datum shifts are not applied. NAD83 and WGS84 differ by about a meter, which does not
+// matter at the scale of a bus network, but older NAD27 data will be noticeably off.
+type coordSystem struct {
+	// Geographic systems: the size of their angular unit in degrees, and the longitude of
+	// their prime meridian
+	degreesPerUnit float64
+	primeMeridian  float64
+
+	// Projected systems: the size of their linear unit in meters, the false origin in
+	// meters, the central meridian in radians, and the inverse projection of the ellipsoid,
+	// which takes meters from the natural origin and returns radians
+	projected                   bool
+	metersPerUnit               float64
+	falseEasting, falseNorthing float64
+	lon0                        float64
+	inverse                     func(x, y float64) (phi, lam float64)
+}
+
+// wgs84PRJ is the .prj file written alongside exported shapefiles.
+const wgs84PRJ = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+
+// geographicCoords is the coordinate system of shapefiles without a .prj file, which are
+// assumed to be in longitude and latitude.
+var geographicCoords = &coordSystem{degreesPerUnit: 1}
+
+// toLatLng converts a point of the coordinate system to longitude and latitude.
+func (cs *coordSystem) toLatLng(x, y float64) LatLng {
+	if !cs.projected {
+		return LatLng{y * cs.degreesPerUnit, x*cs.degreesPerUnit + cs.primeMeridian}
+	}
+
+	x = x*cs.metersPerUnit - cs.falseEasting
+	y = y*cs.metersPerUnit - cs.falseNorthing
+	phi, lam := cs.inverse(x, y)
+
+	lng := math.Mod((lam+cs.lon0)*180/math.Pi+540, 360) - 180
+	return LatLng{phi * 180 / math.Pi, lng}
+}
+
+// wktNode is an element of well-known text, such as PARAMETER["False_Easting",500000.0].
+// Values holds its quoted strings, numbers and bare words in order.
+type wktNode struct {
+	Keyword  string
+	Values   []string
+	Children []*wktNode
+}
+
+// child returns the first child with the given keyword, or nil.
+func (n *wktNode) child(keyword string) *wktNode {
+	for _, c := range n.Children {
+		if strings.EqualFold(c.Keyword, keyword) {
+			return c
+		}
+	}
+	return nil
+}
+
+// number returns the i-th value of a node as a number.
+func (n *wktNode) number(i int) (float64, bool) {
+	if n == nil || i >= len(n.Values) {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(n.Values[i], 64)
+	return v, err == nil
+}
+
+// parseWKT parses well-known text. Both square brackets and parentheses are accepted.
+func parseWKT(text string) (*wktNode, error) {
+	p := wktParser{text: text}
+	node, err := p.node()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.text) {
+		return nil, fmt.Errorf("unexpected %q after the end of the WKT", p.text[p.pos:])
+	}
+	return node, nil
+}
+
+type wktParser struct {
+	text string
+	pos  int
+}
+
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *wktParser) word() string {
+	start := p.pos
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		if c == '[' || c == ']' || c == '(' || c == ')' || c == ',' || c == '"' || unicode.IsSpace(rune(c)) {
+			break
+		}
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+// node parses a keyword and its bracketed list of values and child nodes.
+func (p *wktParser) node() (*wktNode, error) {
+	p.skipSpace()
+	n := &wktNode{Keyword: p.word()}
+	if n.Keyword == "" {
+		return nil, fmt.Errorf("expected a keyword at offset %d", p.pos)
+	}
+
+	p.skipSpace()
+	if p.pos >= len(p.text) || (p.text[p.pos] != '[' && p.text[p.pos] != '(') {
+		return nil, fmt.Errorf("expected '[' after %s", n.Keyword)
+	}
+	p.pos++
+
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.text) {
+			return nil, fmt.Errorf("%s is not closed", n.Keyword)
+		}
+
+		switch c := p.text[p.pos]; {
+		case c == '"':
+			end := strings.IndexByte(p.text[p.pos+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			n.Values = append(n.Values, p.text[p.pos+1:p.pos+1+end])
+			p.pos += end + 2
+
+		default:
+			start := p.pos
+			word := p.word()
+			if word == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, p.pos)
+			}
+			p.skipSpace()
+			if p.pos < len(p.text) && (p.text[p.pos] == '[' || p.text[p.pos] == '(') {
+				p.pos = start
+				child, err := p.node()
+				if err != nil {
+					return nil, err
+				}
+				n.Children = append(n.Children, child)
+			} else {
+				n.Values = append(n.Values, word)
+			}
+		}
+
+		p.skipSpace()
+		if p.pos >= len(p.text) {
+			return nil, fmt.Errorf("%s is not closed", n.Keyword)
+		}
+		switch p.text[p.pos] {
+		case ',':
+			p.pos++
+		case ']', ')':
+			p.pos++
+			return n, nil
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", p.text[p.pos], p.pos)
+		}
+	}
+}
+
+// parsePRJ reads the coordinate system in a .prj file. An empty file means longitude and
+// latitude.
+func parsePRJ(prj []byte) (*coordSystem, error) {
+	text := strings.TrimSpace(strings.TrimPrefix(string(prj), "\ufeff"))
+	if text == "" {
+		return geographicCoords, nil
+	}
+
+	root, err := parseWKT(text)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToUpper(root.Keyword) {
+	case "GEOGCS":
+		cs := &coordSystem{degreesPerUnit: 1}
+		if radians, ok := root.child("UNIT").number(1); ok && radians > 0 {
+			cs.degreesPerUnit = radians * 180 / math.Pi
+		}
+		if pm, ok := root.child("PRIMEM").number(1); ok {
+			cs.primeMeridian = pm * cs.degreesPerUnit
+		}
+		return cs, nil
+
+	case "PROJCS":
+		return parseProjCS(root)
+
+	default:
+		return nil, fmt.Errorf("unsupported coordinate system type %s", root.Keyword)
+	}
+}
+
+func parseProjCS(root *wktNode) (*coordSystem, error) {
+	// The ellipsoid
+	spheroid := root.child("GEOGCS").childPath("DATUM", "SPHEROID")
+	a, okA := spheroid.number(1)
+	invF, okF := spheroid.number(2)
+	if !okA || a <= 0 || !okF {
+		return nil, errors.New("projection has no ellipsoid")
+	}
+	e2 := 0.0
+	if invF != 0 {
+		f := 1 / invF
+		e2 = f * (2 - f)
+	}
+
+	// The parameters, in degrees or linear units
+	cs := &coordSystem{projected: true, metersPerUnit: 1}
+	if meters, ok := root.child("UNIT").number(1); ok && meters > 0 {
+		cs.metersPerUnit = meters
+	}
+	params := map[string]float64{}
+	for _, c := range root.Children {
+		if v, ok := c.number(1); ok && strings.EqualFold(c.Keyword, "PARAMETER") {
+			params[strings.ToLower(c.Values[0])] = v
+		}
+	}
+	param := func(def float64, names ...string) float64 {
+		for _, name := range names {
+			if v, ok := params[name]; ok {
+				return v
+			}
+		}
+		return def
+	}
+	radians := func(names ...string) float64 {
+		return param(0, names...) * math.Pi / 180
+	}
+
+	cs.falseEasting = param(0, "false_easting") * cs.metersPerUnit
+	cs.falseNorthing = param(0, "false_northing") * cs.metersPerUnit
+	cs.lon0 = radians("central_meridian", "longitude_of_center", "longitude_of_origin")
+	lat0 := radians("latitude_of_origin", "latitude_of_center")
+	phi1 := radians("standard_parallel_1")
+	phi2 := radians("standard_parallel_2")
+	k0 := param(1, "scale_factor")
+
+	projection := ""
+	if n := root.child("PROJECTION"); n != nil && len(n.Values) > 0 {
+		projection = strings.ToLower(n.Values[0])
+	}
+	switch projection {
+	case "transverse_mercator", "gauss_kruger":
+		cs.inverse = inverseTransverseMercator(a, e2, k0, lat0)
+
+	case "lambert_conformal_conic", "lambert_conformal_conic_1sp", "lambert_conformal_conic_2sp":
+		if _, ok := params["standard_parallel_1"]; !ok {
+			phi1 = lat0
+		}
+		if _, ok := params["standard_parallel_2"]; !ok {
+			phi2 = phi1
+		}
+		cs.inverse = inverseLambertConformalConic(a, e2, k0, lat0, phi1, phi2)
+
+	case "albers", "albers_conic_equal_area":
+		if _, ok := params["standard_parallel_2"]; !ok {
+			phi2 = phi1
+		}
+		cs.inverse = inverseAlbers(a, e2, lat0, phi1, phi2)
+
+	case "mercator", "mercator_1sp", "mercator_2sp":
+		if _, ok := params["standard_parallel_1"]; ok {
+			k0 = math.Cos(phi1) / math.Sqrt(1-e2*math.Sin(phi1)*math.Sin(phi1))
+		}
+		cs.inverse = inverseMercator(a, e2, k0)
+
+	case "mercator_auxiliary_sphere", "popular_visualisation_pseudo_mercator":
+		// Web mercator projects the ellipsoid's coordinates as if they were on a sphere
+		cs.inverse = inverseMercator(a, 0, k0)
+
+	default:
+		return nil, fmt.Errorf("unsupported projection %q", projection)
+	}
+	return cs, nil
+}
+
+// childPath follows a path of keywords down from a node, returning nil if any are missing.
+func (n *wktNode) childPath(keywords ...string) *wktNode {
+	for _, k := range keywords {
+		if n == nil {
+			return nil
+		}
+		n = n.child(k)
+	}
+	return n
+}
+
+// The inverse projections follow J. P. Snyder, "Map Projections: A Working Manual" (USGS
+// Professional Paper 1395). Each takes the semi-major axis a and squared eccentricity e2 of
+// the ellipsoid, and angles in radians.
+
+// conformalLatitude inverts t = tan(pi/4 - phi/2) / ((1 - e sin phi) / (1 + e sin phi))^(e/2),
+// which the conformal projections share.
+func conformalLatitude(t, e float64) float64 {
+	phi := math.Pi/2 - 2*math.Atan(t)
+	for i := 0; i < 15; i++ {
+		es := e * math.Sin(phi)
+		next := math.Pi/2 - 2*math.Atan(t*math.Pow((1-es)/(1+es), e/2))
+		if math.Abs(next-phi) < 1e-12 {
+			return next
+		}
+		phi = next
+	}
+	return phi
+}
+
+func conformalT(phi, e float64) float64 {
+	es := e * math.Sin(phi)
+	return math.Tan(math.Pi/4-phi/2) / math.Pow((1-es)/(1+es), e/2)
+}
+
+func conicM(phi, e2 float64) float64 {
+	s := math.Sin(phi)
+	return math.Cos(phi) / math.Sqrt(1-e2*s*s)
+}
+
+func inverseTransverseMercator(a, e2, k0, lat0 float64) func(x, y float64) (float64, float64) {
+	e4, e6 := e2*e2, e2*e2*e2
+	meridian := func(phi float64) float64 {
+		return a * ((1-e2/4-3*e4/64-5*e6/256)*phi -
+			(3*e2/8+3*e4/32+45*e6/1024)*math.Sin(2*phi) +
+			(15*e4/256+45*e6/1024)*math.Sin(4*phi) -
+			(35*e6/3072)*math.Sin(6*phi))
+	}
+	m0 := meridian(lat0)
+	ep2 := e2 / (1 - e2)
+	e1 := (1 - math.Sqrt(1-e2)) / (1 + math.Sqrt(1-e2))
+
+	return func(x, y float64) (float64, float64) {
+		// The footpoint latitude
+		mu := (m0 + y/k0) / (a * (1 - e2/4 - 3*e4/64 - 5*e6/256))
+		phi1 := mu + (3*e1/2-27*math.Pow(e1, 3)/32)*math.Sin(2*mu) +
+			(21*e1*e1/16-55*math.Pow(e1, 4)/32)*math.Sin(4*mu) +
+			(151*math.Pow(e1, 3)/96)*math.Sin(6*mu) +
+			(1097*math.Pow(e1, 4)/512)*math.Sin(8*mu)
+
+		sin, cos, tan := math.Sin(phi1), math.Cos(phi1), math.Tan(phi1)
+		c1 := ep2 * cos * cos
+		t1 := tan * tan
+		n1 := a / math.Sqrt(1-e2*sin*sin)
+		r1 := a * (1 - e2) / math.Pow(1-e2*sin*sin, 1.5)
+		d := x / (n1 * k0)
+
+		phi := phi1 - (n1*tan/r1)*(d*d/2-
+			(5+3*t1+10*c1-4*c1*c1-9*ep2)*math.Pow(d, 4)/24+
+			(61+90*t1+298*c1+45*t1*t1-252*ep2-3*c1*c1)*math.Pow(d, 6)/720)
+		lam := (d - (1+2*t1+c1)*math.Pow(d, 3)/6 +
+			(5-2*c1+28*t1-3*c1*c1+8*ep2+24*t1*t1)*math.Pow(d, 5)/120) / cos
+		return phi, lam
+	}
+}
+
+func inverseLambertConformalConic(a, e2, k0, lat0, phi1, phi2 float64) func(x, y float64) (float64, float64) {
+	e := math.Sqrt(e2)
+	m1, m2 := conicM(phi1, e2), conicM(phi2, e2)
+	t0, t1, t2 := conformalT(lat0, e), conformalT(phi1, e), conformalT(phi2, e)
+
+	n := math.Sin(phi1)
+	if math.Abs(phi1-phi2) > 1e-10 {
+		n = (math.Log(m1) - math.Log(m2)) / (math.Log(t1) - math.Log(t2))
+	}
+	f := m1 / (n * math.Pow(t1, n))
+	rho0 := a * k0 * f * math.Pow(t0, n)
+	sign := math.Copysign(1, n)
+
+	return func(x, y float64) (float64, float64) {
+		rho := sign * math.Hypot(x, rho0-y)
+		theta := math.Atan2(sign*x, sign*(rho0-y))
+		if rho == 0 {
+			return sign * math.Pi / 2, 0
+		}
+		t := math.Pow(rho/(a*k0*f), 1/n)
+		return conformalLatitude(t, e), theta / n
+	}
+}
+
+func inverseAlbers(a, e2, lat0, phi1, phi2 float64) func(x, y float64) (float64, float64) {
+	e := math.Sqrt(e2)
+	q := func(phi float64) float64 {
+		s := math.Sin(phi)
+		if e == 0 {
+			return 2 * s
+		}
+		return (1 - e2) * (s/(1-e2*s*s) - math.Log((1-e*s)/(1+e*s))/(2*e))
+	}
+	m1, m2 := conicM(phi1, e2), conicM(phi2, e2)
+	q0, q1, q2 := q(lat0), q(phi1), q(phi2)
+
+	n := math.Sin(phi1)
+	if math.Abs(phi1-phi2) > 1e-10 {
+		n = (m1*m1 - m2*m2) / (q2 - q1)
+	}
+	c := m1*m1 + n*q1
+	rho0 := a * math.Sqrt(c-n*q0) / n
+	sign := math.Copysign(1, n)
+
+	return func(x, y float64) (float64, float64) {
+		rho := math.Hypot(x, rho0-y)
+		theta := math.Atan2(sign*x, sign*(rho0-y))
+		qq := (c - rho*rho*n*n/(a*a)) / n
+
+		phi := math.Asin(math.Max(-1, math.Min(1, qq/2)))
+		if e > 0 {
+			for i := 0; i < 15; i++ {
+				s, cos := math.Sin(phi), math.Cos(phi)
+				delta := math.Pow(1-e2*s*s, 2) / (2 * cos) *
+					(qq/(1-e2) - s/(1-e2*s*s) + math.Log((1-e*s)/(1+e*s))/(2*e))
+				phi += delta
+				if math.Abs(delta) < 1e-12 {
+					break
+				}
+			}
+		}
+		return phi, theta / n
+	}
+}
+
+func inverseMercator(a, e2, k0 float64) func(x, y float64) (float64, float64) {
+	e := math.Sqrt(e2)
+	return func(x, y float64) (float64, float64) {
+		t := math.Exp(-y / (a * k0))
+		return conformalLatitude(t, e), x / (a * k0)
+	}
+}
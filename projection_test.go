@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+const (
+	nad83GeogCS  = `GEOGCS["GCS_North_American_1983",DATUM["D_North_American_1983",SPHEROID["GRS_1980",6378137.0,298.257222101]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+	nad27GeogCS  = `GEOGCS["GCS_North_American_1927",DATUM["D_North_American_1927",SPHEROID["Clarke_1866",6378206.4,294.9786982]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+	besselGeogCS = `GEOGCS["GCS_Batavia",DATUM["D_Batavia",SPHEROID["Bessel_1841",6377397.155,299.1528128]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+
+	conusAlbers = `PROJCS["NAD_1983_Contiguous_USA_Albers",` + nad83GeogCS + `,PROJECTION["Albers"],` +
+		`PARAMETER["False_Easting",0.0],PARAMETER["False_Northing",0.0],PARAMETER["Central_Meridian",-96.0],` +
+		`PARAMETER["Standard_Parallel_1",29.5],PARAMETER["Standard_Parallel_2",45.5],` +
+		`PARAMETER["Latitude_Of_Origin",23.0],UNIT["Meter",1.0]]`
+)
+
+func TestParsePRJ(t *testing.T) {
+	tests := []struct {
+		name     string
+		prj      string
+		x, y     float64
+		lat, lng float64
+	}{
+		{
+			name: "no .prj file",
+			prj:  "",
+			x:    -75, y: 40,
+			lat: 40, lng: -75,
+		},
+		{
+			name: "geographic with a byte order mark",
+			prj:  "\ufeff" + wgs84PRJ,
+			x:    -75, y: 40,
+			lat: 40, lng: -75,
+		},
+		{
+			name: "geographic with another prime meridian",
+			prj:  `GEOGCS["Test",DATUM["D",SPHEROID["S",6378137.0,298.257223563]],PRIMEM["Test",10.0],UNIT["Degree",0.0174532925199433]]`,
+			x:    5, y: 40,
+			lat: 40, lng: 15,
+		},
+		{
+			name: "UTM zone 18N",
+			prj: `PROJCS["NAD_1983_UTM_Zone_18N",` + nad83GeogCS + `,PROJECTION["Transverse_Mercator"],` +
+				`PARAMETER["False_Easting",500000.0],PARAMETER["False_Northing",0.0],PARAMETER["Central_Meridian",-75.0],` +
+				`PARAMETER["Scale_Factor",0.9996],PARAMETER["Latitude_Of_Origin",0.0],UNIT["Meter",1.0]]`,
+			x: 500000, y: 4427757.218765,
+			lat: 40, lng: -75,
+		},
+		{
+			// The worked example in EPSG Guidance Note 7-2, in US survey feet
+			name: "Lambert Conformal Conic",
+			prj: `PROJCS["NAD_1927_StatePlane_Texas_South_Central_FIPS_4204",` + nad27GeogCS + `,PROJECTION["Lambert_Conformal_Conic"],` +
+				`PARAMETER["False_Easting",2000000.0],PARAMETER["False_Northing",0.0],PARAMETER["Central_Meridian",-99.0],` +
+				`PARAMETER["Standard_Parallel_1",28.38333333333333],PARAMETER["Standard_Parallel_2",30.28333333333333],` +
+				`PARAMETER["Latitude_Of_Origin",27.83333333333333],UNIT["Foot_US",0.3048006096012192]]`,
+			x: 2963503.91, y: 254759.80,
+			lat: 28.5, lng: -96,
+		},
+		{
+			// The false origin is the point at the latitude of origin and central meridian
+			name: "Albers origin",
+			prj:  conusAlbers,
+			x:    0, y: 0,
+			lat: 23, lng: -96,
+		},
+		{
+			// Projected with the forward formulas in Snyder's Map Projections: A Working Manual
+			name: "Albers",
+			prj:  conusAlbers,
+			x:    1762648.053477, y: 2082524.864696,
+			lat: 40, lng: -75,
+		},
+		{
+			// The worked example in EPSG Guidance Note 7-2
+			name: "Mercator",
+			prj: `PROJCS["Batavia_NEIEZ",` + besselGeogCS + `,PROJECTION["Mercator"],` +
+				`PARAMETER["False_Easting",3900000.0],PARAMETER["False_Northing",900000.0],` +
+				`PARAMETER["Central_Meridian",110.0],PARAMETER["Scale_Factor",0.997],UNIT["Meter",1.0]]`,
+			x: 5009726.58, y: 569150.82,
+			lat: -3, lng: 120,
+		},
+		{
+			name: "web mercator",
+			prj: `PROJCS["WGS_1984_Web_Mercator_Auxiliary_Sphere",GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],` +
+				`PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]],PROJECTION["Mercator_Auxiliary_Sphere"],` +
+				`PARAMETER["False_Easting",0.0],PARAMETER["False_Northing",0.0],PARAMETER["Central_Meridian",0.0],` +
+				`PARAMETER["Standard_Parallel_1",0.0],PARAMETER["Auxiliary_Sphere_Type",0.0],UNIT["Meter",1.0]]`,
+			x: -8348961.809495518, y: 4865942.279503176,
+			lat: 40, lng: -75,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, err := parsePRJ([]byte(tt.prj))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// A millionth of a degree is about 10 cm
+			got := cs.toLatLng(tt.x, tt.y)
+			if math.Abs(got.Lat-tt.lat) > 1e-6 || math.Abs(got.Lng-tt.lng) > 1e-6 {
+				t.Errorf("toLatLng(%v, %v) = %v, want (%v, %v)", tt.x, tt.y, got, tt.lat, tt.lng)
+			}
+		})
+	}
+}
+
+func TestParsePRJErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		prj  string
+	}{
+		{"not WKT", "EPSG:4326"},
+		{"unbalanced brackets", `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984"`},
+		{"unterminated string", `GEOGCS["GCS_WGS_1984]`},
+		{"unsupported system", `GEOCCS["Earth_Centered",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]]]`},
+		{"no ellipsoid", `PROJCS["Test",GEOGCS["Test"],PROJECTION["Transverse_Mercator"],UNIT["Meter",1.0]]`},
+		{"unsupported projection", `PROJCS["Test",` + nad83GeogCS + `,PROJECTION["Polyconic"],UNIT["Meter",1.0]]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if cs, err := parsePRJ([]byte(tt.prj)); err == nil {
+				t.Fatalf("expected an error, got %+v", cs)
+			}
+		})
+	}
+}
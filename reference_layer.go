@@ -0,0 +1,746 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxReferenceFeatures caps the number of features a single 'reference:list_features'
+	// request returns.
+	MaxReferenceFeatures = 5000
+)
+
+// ReferenceLayerSpec defines user-configurable fields for reference layers. Styles are stored
+// exactly as clients send them, like the styles of paths. ProjectID cannot be changed once
+// the layer is created. Visible is only whether the layer is shown by default; each project
+// can show or hide it for itself with a 'reference:set_visibility' request.
+type ReferenceLayerSpec struct {
+	ProjectID   string              `gorm:"project_id;index" msgpack:"project_id"`
+	Name        string              `gorm:"name" msgpack:"name"`
+	Description string              `gorm:"description" msgpack:"description"`
+	Visible     bool                `gorm:"visible" msgpack:"visible"`
+	Styles      *msgpack.RawMessage `gorm:"styles" msgpack:"styles"`
+}
+
+// ReferenceLayerInfo is a read-only set of map features, such as schools or park-and-rides,
+// shown for reference while planning. Layers belong to a single project, or to every project
+// if ProjectID is empty; only admins can manage those shared layers. Features are uploaded
+// from GeoJSON, KML or shapefiles, replacing the layer's features each time.
+type ReferenceLayerInfo struct {
+	ReferenceLayerSpec
+	ID string `gorm:"primaryKey" msgpack:"id"`
+	// CreatedAt is a timestamp of when the layer was created.
+	CreatedAt uint64 `gorm:"created_at" msgpack:"created_at"`
+	// CreatedBy is the ID of the user that created the layer.
+	CreatedBy string `gorm:"created_by" msgpack:"created_by"`
+	// Source is the format the features were last uploaded in, if they have been uploaded.
+	Source string `gorm:"source" msgpack:"source"`
+}
+
+func (ReferenceLayerInfo) TableName() string {
+	return "reference_layers"
+}
+
+// ReferenceFeatureInfo is a single feature of a reference layer, with all the properties it
+// was uploaded with. The project of its layer is repeated so that deleting a project deletes
+// the features of its layers, and the bounds are kept in separate columns so features in view
+// can be found quickly.
+type ReferenceFeatureInfo struct {
+	ID         uint64            `gorm:"primaryKey" msgpack:"id"`
+	LayerID    string            `gorm:"layer_id;index" msgpack:"-"`
+	ProjectID  string            `gorm:"project_id;index" msgpack:"-"`
+	Name       string            `gorm:"name" msgpack:"name"`
+	Geometry   Geometry          `gorm:"geometry" msgpack:"geometry"`
+	Properties FeatureProperties `gorm:"properties" msgpack:"properties"`
+	MinLat     float64           `gorm:"min_lat;index:reference_feature_bounds" msgpack:"-"`
+	MinLng     float64           `gorm:"min_lng;index:reference_feature_bounds" msgpack:"-"`
+	MaxLat     float64           `gorm:"max_lat;index:reference_feature_bounds" msgpack:"-"`
+	MaxLng     float64           `gorm:"max_lng;index:reference_feature_bounds" msgpack:"-"`
+}
+
+func (ReferenceFeatureInfo) TableName() string {
+	return "reference_features"
+}
+
+// ReferenceVisibilityInfo records whether a project shows a layer, overriding the layer's
+// default. It is also the payload of a 'reference:set_visibility' request, which any user of
+// the project may make, so planners can toggle shared layers without affecting other projects.
+type ReferenceVisibilityInfo struct {
+	ProjectID string `gorm:"primaryKey" msgpack:"project_id"`
+	LayerID   string `gorm:"primaryKey" msgpack:"layer_id"`
+	Visible   bool   `gorm:"visible" msgpack:"visible"`
+}
+
+func (ReferenceVisibilityInfo) TableName() string {
+	return "reference_visibility"
+}
+
+// ReferenceLayerSummary is a layer along with how many features it has and the corners of
+// the box containing them (which are nil if it has none).
+type ReferenceLayerSummary struct {
+	ReferenceLayerInfo `msgpack:",inline"`
+	Features           int64   `msgpack:"features"`
+	SW                 *LatLng `msgpack:"sw"`
+	NE                 *LatLng `msgpack:"ne"`
+}
+
+// ReferenceFeatureQuery is the payload of a 'reference:list_features' request. If the bounds
+// are given, only features overlapping the box between the southwest and northeast corners
+// are returned.
+type ReferenceFeatureQuery struct {
+	LayerID string  `msgpack:"layer_id"`
+	SW      *LatLng `msgpack:"sw"`
+	NE      *LatLng `msgpack:"ne"`
+}
+
+// ReferenceFeatureList is the reply to a 'reference:list_features' request. Truncated is set
+// if there were more than MaxReferenceFeatures features to return, in which case clients
+// should zoom in.
+type ReferenceFeatureList struct {
+	Features  []ReferenceFeatureInfo `msgpack:"features"`
+	Truncated bool                   `msgpack:"truncated"`
+}
+
+// ReferenceUploadParams are the upload ticket parameters for the "reference" upload kind,
+// which takes a GeoJSON file, a KML or KMZ file, or a zipped shapefile; Format ("geojson",
+// "kml" or "shapefile") is worked out from the file if it is not given. The features replace
+// all of the layer's features.
+//
+// NameField is the property features are named by. It defaults to the first of a few common
+// property names that the features have.
+type ReferenceUploadParams struct {
+	LayerID   string `msgpack:"layer_id"`
+	Format    string `msgpack:"format"`
+	NameField string `msgpack:"name_field"`
+}
+
+// ReferenceImportReport summarizes an upload of features into a reference layer.
+type ReferenceImportReport struct {
+	LayerID  string   `msgpack:"layer_id"`
+	Source   string   `msgpack:"source"`
+	Features int      `msgpack:"features"`
+	Skipped  int      `msgpack:"skipped"`
+	Errors   []string `msgpack:"errors"`
+}
+
+func (r *ReferenceImportReport) addError(format string, args ...any) {
+	if len(r.Errors) < MaxFeatureImportErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// referenceFeatureSource is a feature read from an uploaded file, before it is checked.
+type referenceFeatureSource struct {
+	label      string
+	geometries []Geometry
+	err        error
+	properties map[string]any
+}
+
+// referenceNameProperties are the properties features are named by when the upload does not
+// say, in order of preference.
+var referenceNameProperties = []string{"name", "title", "label", "stop_name"}
+
+// takeReferenceLayer looks up a layer, returning an ErrorWithCode if there is no such layer.
+func takeReferenceLayer(db *gorm.DB, id string) (ReferenceLayerInfo, error) {
+	var layer ReferenceLayerInfo
+	if err := db.Take(&layer, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return layer, &ErrorWithCode{
+				Code:    "reference-layer-not-found",
+				Message: fmt.Sprintf("there is no reference layer with ID %q", id),
+				Details: id,
+			}
+		}
+		return layer, err
+	}
+	return layer, nil
+}
+
+// requireReferenceAccess checks that a user may change the layers of a project, or the
+// shared layers if the project ID is empty.
+func requireReferenceAccess(s *Server, u *UserConn, projectID string, action string) error {
+	if projectID == "" {
+		// TODO: improve error
+		if u.Rank == 0 {
+			return &ErrorWithCode{
+				Code:    "rank-too-low",
+				Message: fmt.Sprintf("only admins have permission to %s shared reference layers", action),
+			}
+		}
+		return nil
+	}
+	return requireProject(s.Database, projectID)
+}
+
+// publishReferenceEvent notifies the subscribers of a layer's project of a change. Nobody is
+// notified of changes to shared layers, which clients reload when they list the layers.
+func (s *Server) publishReferenceEvent(u *UserConn, projectID, eventType string, data any) {
+	if projectID != "" {
+		s.publish(u, ProjectEvent{ProjectID: projectID, Type: eventType, Data: data})
+	}
+}
+
+// listReferenceLayers lists the layers of a project along with the shared layers. An empty
+// project ID lists only the shared layers. Layers are listed as visible or not according to
+// the project's choice, if it made one.
+func listReferenceLayers(s *Server, u *UserConn, payload []byte) (any, error) {
+	var projectID string
+	if err := msgpack.Unmarshal(payload, &projectID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if projectID != "" {
+		if err := requireProject(s.Database, projectID); err != nil {
+			return nil, err
+		}
+	}
+
+	var layers []ReferenceLayerInfo
+	q := s.Database.Where("project_id = ? OR project_id = ''", projectID)
+	if err := q.Order("name, id").Find(&layers).Error; err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(layers))
+	for i, layer := range layers {
+		ids[i] = layer.ID
+	}
+
+	var visibility []ReferenceVisibilityInfo
+	if err := s.Database.Find(&visibility, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range visibility {
+		for i := range layers {
+			if layers[i].ID == v.LayerID {
+				layers[i].Visible = v.Visible
+			}
+		}
+	}
+
+	var counts []struct {
+		LayerID  string
+		Features int64
+		MinLat   float64
+		MinLng   float64
+		MaxLat   float64
+		MaxLng   float64
+	}
+	err := s.Database.Model(&ReferenceFeatureInfo{}).
+		Select("layer_id, COUNT(*) AS features, MIN(min_lat) AS min_lat, MIN(min_lng) AS min_lng, MAX(max_lat) AS max_lat, MAX(max_lng) AS max_lng").
+		Where("layer_id IN ?", ids).
+		Group("layer_id").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]ReferenceLayerSummary, len(layers))
+	for i, layer := range layers {
+		summaries[i].ReferenceLayerInfo = layer
+		for _, c := range counts {
+			if c.LayerID == layer.ID {
+				summaries[i].Features = c.Features
+				summaries[i].SW = &LatLng{c.MinLat, c.MinLng}
+				summaries[i].NE = &LatLng{c.MaxLat, c.MaxLng}
+			}
+		}
+	}
+	return summaries, nil
+}
+
+func createReferenceLayer(s *Server, u *UserConn, payload []byte) (any, error) {
+	var spec ReferenceLayerSpec
+	if err := msgpack.Unmarshal(payload, &spec); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireReferenceAccess(s, u, spec.ProjectID, "create"); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	info := ReferenceLayerInfo{spec, id.String(), uint64(time.Now().UnixMilli()), u.ID, ""}
+
+	if err := s.Database.Create(info).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publishReferenceEvent(u, info.ProjectID, "reference:layer_created", info)
+
+	return info, nil
+}
+
+func modifyReferenceLayer(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to move the layer to another project, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	layer, err := takeReferenceLayer(s.Database, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireReferenceAccess(s, u, layer.ProjectID, "modify"); err != nil {
+		return nil, err
+	}
+
+	changes := map[string]any{}
+
+	if name, ok := untrustedChanges["name"].(string); ok {
+		changes["name"] = name
+	}
+	if desc, ok := untrustedChanges["description"].(string); ok {
+		changes["description"] = desc
+	}
+	if visible, ok := untrustedChanges["visible"].(bool); ok {
+		changes["visible"] = visible
+	}
+	if val, present := untrustedChanges["styles"]; present {
+		raw, err := toRawMessage(val)
+		if err != nil {
+			// TODO
+			return nil, err
+		}
+		changes["styles"] = raw
+	}
+
+	if len(changes) > 0 {
+		if err := s.Database.Model(&layer).Updates(changes).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	if layer, err = takeReferenceLayer(s.Database, id); err != nil {
+		return nil, err
+	}
+
+	s.publishReferenceEvent(u, layer.ProjectID, "reference:layer_modified", layer)
+
+	return layer, nil
+}
+
+// setReferenceVisibility shows or hides a layer in a project, which may be one of the
+// project's own layers or a shared layer.
+func setReferenceVisibility(s *Server, u *UserConn, payload []byte) (any, error) {
+	var info ReferenceVisibilityInfo
+	if err := msgpack.Unmarshal(payload, &info); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, info.ProjectID); err != nil {
+		return nil, err
+	}
+	layer, err := takeReferenceLayer(s.Database, info.LayerID)
+	if err != nil {
+		return nil, err
+	}
+	if layer.ProjectID != "" && layer.ProjectID != info.ProjectID {
+		return nil, &ErrorWithCode{
+			Code:    "reference-layer-not-found",
+			Message: fmt.Sprintf("there is no reference layer with ID %q in this project", info.LayerID),
+			Details: info.LayerID,
+		}
+	}
+
+	if err := s.Database.Save(&info).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "reference:visibility_changed", Data: info})
+
+	return info, nil
+}
+
+// deleteReferenceLayer deletes a layer along with all of its features.
+func deleteReferenceLayer(s *Server, u *UserConn, payload []byte) (any, error) {
+	var id string
+	if err := msgpack.Unmarshal(payload, &id); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	// Look up the project first so we know who may delete it and who to notify
+	var layer ReferenceLayerInfo
+	if err := s.Database.Select("project_id").Take(&layer, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
+		// TODO
+		return nil, err
+	}
+	if err := requireReferenceAccess(s, u, layer.ProjectID, "delete"); err != nil {
+		return nil, err
+	}
+
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&ReferenceFeatureInfo{}, "layer_id = ?", id).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&ReferenceVisibilityInfo{}, "layer_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&ReferenceLayerInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publishReferenceEvent(u, layer.ProjectID, "reference:layer_deleted", id)
+
+	return nil, nil
+}
+
+func listReferenceFeatures(s *Server, u *UserConn, payload []byte) (any, error) {
+	var query ReferenceFeatureQuery
+	if err := msgpack.Unmarshal(payload, &query); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if _, err := takeReferenceLayer(s.Database, query.LayerID); err != nil {
+		return nil, err
+	}
+
+	q := s.Database.Where("layer_id = ?", query.LayerID)
+	if query.SW != nil && query.NE != nil {
+		q = q.Where(
+			"max_lat >= ? AND min_lat <= ? AND max_lng >= ? AND min_lng <= ?",
+			query.SW.Lat, query.NE.Lat, query.SW.Lng, query.NE.Lng,
+		)
+	}
+
+	var list ReferenceFeatureList
+	if err := q.Order("id").Limit(MaxReferenceFeatures + 1).Find(&list.Features).Error; err != nil {
+		return nil, err
+	}
+	if len(list.Features) > MaxReferenceFeatures {
+		list.Features, list.Truncated = list.Features[:MaxReferenceFeatures], true
+	}
+	return list, nil
+}
+
+// detectReferenceFormat works out whether an uploaded file is GeoJSON, KML (or KMZ) or a
+// zipped shapefile.
+func detectReferenceFormat(data []byte) string {
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return "geojson"
+	}
+	if bytes.HasPrefix(data, []byte("PK")) {
+		if zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+			for _, f := range zr.File {
+				if strings.HasSuffix(strings.ToLower(f.Name), ".shp") {
+					return "shapefile"
+				}
+			}
+		}
+	}
+	return "kml"
+}
+
+// readReferenceFeatures reads the features of an uploaded file in any of the formats
+// reference layers can be uploaded in.
+func readReferenceFeatures(format string, data []byte) ([]referenceFeatureSource, error) {
+	var features []referenceFeatureSource
+
+	switch format {
+	case "geojson":
+		objects, err := readGeoJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		for i := range objects {
+			obj := &objects[i]
+			f := referenceFeatureSource{label: fmt.Sprintf("feature %d", i+1), properties: map[string]any{}}
+			for k, v := range obj.Properties {
+				f.properties[k] = fromJSONValue(v)
+			}
+			if obj.Type != "Feature" || obj.Geometry == nil {
+				f.err = errors.New("it has no geometry")
+			} else {
+				f.geometries, f.err = obj.Geometry.geometries()
+			}
+			features = append(features, f)
+		}
+
+	case "kml":
+		doc, err := readKML(data)
+		if err != nil {
+			return nil, &ErrorWithCode{
+				Code:    "bad-kml",
+				Message: fmt.Sprintf("file is not valid KML or KMZ: %v", err),
+			}
+		}
+		var visit func(c *kmlContainer)
+		visit = func(c *kmlContainer) {
+			for i := range c.Placemarks {
+				pm := &c.Placemarks[i]
+				f := referenceFeatureSource{label: fmt.Sprintf("placemark %d", len(features)+1), properties: pm.properties()}
+				if pm.Name != "" {
+					f.properties["name"] = pm.Name
+				}
+				f.geometries, f.err = pm.geometries()
+				features = append(features, f)
+			}
+			for i := range c.Documents {
+				visit(&c.Documents[i])
+			}
+			for i := range c.Folders {
+				visit(&c.Folders[i])
+			}
+		}
+		visit(doc)
+
+	case "shapefile":
+		files, err := findShapefile(data)
+		if err != nil {
+			return nil, err
+		}
+		sf, err := readShapefile(files)
+		if err != nil {
+			return nil, err
+		}
+		for i, shape := range sf.Shapes {
+			f := referenceFeatureSource{label: fmt.Sprintf("record %d", i+1), properties: map[string]any{}}
+			for _, field := range sf.Fields {
+				f.properties[field.Name] = dbfValue(field, sf.Records[i][field.Name])
+			}
+			if shape == nil {
+				f.err = errors.New("it has no shape")
+			} else {
+				f.geometries = []Geometry{shape.geometry()}
+			}
+			features = append(features, f)
+		}
+
+	default:
+		return nil, &ErrorWithCode{
+			Code:    "invalid-format",
+			Message: fmt.Sprintf("%q is not a format reference layers can be uploaded in; choose geojson, kml or shapefile", format),
+		}
+	}
+
+	return features, nil
+}
+
+// dbfValue converts a .dbf attribute to a number or boolean if its field is one.
+func dbfValue(field dbfField, value string) any {
+	switch field.Type {
+	case 'N', 'F':
+		if value == "" {
+			return nil
+		}
+		if field.Decimals == 0 {
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return n
+			}
+		}
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case 'L':
+		switch strings.ToUpper(value) {
+		case "T", "Y":
+			return true
+		case "F", "N":
+			return false
+		case "", "?":
+			return nil
+		}
+	}
+	return value
+}
+
+// importReferenceFeatures replaces the features of a reference layer with those of an
+// uploaded file. Features with several geometries are kept whole, as multi-geometries.
+func importReferenceFeatures(s *Server, u *UserConn, params []byte, data []byte) (any, error) {
+	var p ReferenceUploadParams
+	if err := msgpack.Unmarshal(params, &p); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	layer, err := takeReferenceLayer(s.Database, p.LayerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireReferenceAccess(s, u, layer.ProjectID, "upload"); err != nil {
+		return nil, err
+	}
+
+	format := p.Format
+	if format == "" {
+		format = detectReferenceFormat(data)
+	}
+	sources, err := readReferenceFeatures(format, data)
+	if err != nil {
+		return nil, err
+	}
+
+	report := ReferenceImportReport{LayerID: layer.ID, Source: format, Errors: []string{}}
+	var features []ReferenceFeatureInfo
+
+	nameFields := referenceNameProperties
+	if p.NameField != "" {
+		nameFields = []string{p.NameField}
+	}
+
+	for _, src := range sources {
+		if src.err == nil && len(src.geometries) == 0 {
+			src.err = errors.New("it has no point, line or polygon")
+		}
+		if src.err != nil {
+			report.Skipped++
+			report.addError("%s: %s", src.label, errorMessage(src.err))
+			continue
+		}
+
+		g, mixed := mergeGeometries(src.geometries)
+		if err := g.validate(); err != nil {
+			report.Skipped++
+			report.addError("%s: %s", src.label, errorMessage(err))
+			continue
+		}
+		if mixed {
+			report.addError("%s mixes points, lines and polygons; only the %s were kept", src.label, geometryKinds[g.Type])
+		}
+
+		var name string
+		for _, field := range nameFields {
+			for k, v := range src.properties {
+				if str, ok := v.(string); ok && str != "" && strings.EqualFold(k, field) {
+					name = strings.TrimSpace(str)
+					break
+				}
+			}
+			if name != "" {
+				break
+			}
+		}
+
+		sw, ne := g.bounds()
+		features = append(features, ReferenceFeatureInfo{
+			LayerID:    layer.ID,
+			ProjectID:  layer.ProjectID,
+			Name:       name,
+			Geometry:   g,
+			Properties: src.properties,
+			MinLat:     sw.Lat,
+			MinLng:     sw.Lng,
+			MaxLat:     ne.Lat,
+			MaxLng:     ne.Lng,
+		})
+	}
+
+	err = s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&ReferenceFeatureInfo{}, "layer_id = ?", layer.ID).Error; err != nil {
+			return err
+		}
+		if len(features) > 0 {
+			if err := tx.CreateInBatches(features, gtfsInsertBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&layer).Update("source", format).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	report.Features = len(features)
+	s.publishReferenceEvent(u, layer.ProjectID, "reference:imported", report)
+
+	return report, nil
+}
+
+// geometryKinds describes the geometries of each multi-geometry type.
+var geometryKinds = map[string]string{
+	GeometryMultiPoint:      "points",
+	GeometryMultiLineString: "lines",
+	GeometryMultiPolygon:    "polygons",
+}
+
+// mergeGeometries combines the geometries of a feature into one. Geometries of different
+// kinds (e.g., a point and a line) cannot be combined, so only the first kind is kept and
+// mixed is set.
+func mergeGeometries(gs []Geometry) (merged Geometry, mixed bool) {
+	if len(gs) == 1 {
+		return gs[0], false
+	}
+
+	for _, g := range gs {
+		kind := multiGeometryType(g.Type)
+		if merged.Type == "" {
+			merged.Type = kind
+		} else if kind != merged.Type {
+			mixed = true
+			continue
+		}
+
+		switch g.Type {
+		case GeometryPoint:
+			merged.MultiPoint = append(merged.MultiPoint, g.Point)
+		case GeometryMultiPoint:
+			merged.MultiPoint = append(merged.MultiPoint, g.MultiPoint...)
+		case GeometryLineString:
+			merged.MultiLineString = append(merged.MultiLineString, g.LineString)
+		case GeometryMultiLineString:
+			merged.MultiLineString = append(merged.MultiLineString, g.MultiLineString...)
+		case GeometryPolygon:
+			merged.MultiPolygon = append(merged.MultiPolygon, g.Polygon)
+		case GeometryMultiPolygon:
+			merged.MultiPolygon = append(merged.MultiPolygon, g.MultiPolygon...)
+		}
+	}
+	return merged, mixed
+}
+
+// multiGeometryType returns the multi-geometry type that can hold geometries of a type.
+func multiGeometryType(geometryType string) string {
+	switch geometryType {
+	case GeometryPoint, GeometryMultiPoint:
+		return GeometryMultiPoint
+	case GeometryLineString, GeometryMultiLineString:
+		return GeometryMultiLineString
+	default:
+		return GeometryMultiPolygon
+	}
+}
@@ -31,7 +31,7 @@ type RegistrationTokenInfo struct {
 	CreatedBy string `gorm:"created_by" msgpack:"created_by"`
 }
 
-func listRegistrationTokens(s *Server, u *UserInfo, payload []byte) (any, error) {
+func listRegistrationTokens(s *Server, u *UserConn, payload []byte) (any, error) {
 	// TODO: improve error
 	if u.Rank == 0 {
 		return nil, &ErrorWithCode{
@@ -47,7 +47,7 @@ func listRegistrationTokens(s *Server, u *UserInfo, payload []byte) (any, error)
 	return tokens, nil
 }
 
-func createRegistrationToken(s *Server, u *UserInfo, payload []byte) (any, error) {
+func createRegistrationToken(s *Server, u *UserConn, payload []byte) (any, error) {
 	// TODO: improve error
 	if u.Rank == 0 {
 		return nil, &ErrorWithCode{
@@ -73,7 +73,7 @@ func createRegistrationToken(s *Server, u *UserInfo, payload []byte) (any, error
 	return info, nil
 }
 
-func deleteRegistrationToken(s *Server, u *UserInfo, payload []byte) (any, error) {
+func deleteRegistrationToken(s *Server, u *UserConn, payload []byte) (any, error) {
 	// TODO: improve error
 	if u.Rank == 0 {
 		return nil, &ErrorWithCode{
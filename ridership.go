@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxRidershipImportErrors caps the number of problems reported by a single APC upload.
+	MaxRidershipImportErrors = 50
+	// DefaultRidershipInterval is the width in seconds of the time of day periods ridership is
+	// grouped into when a request does not say.
+	DefaultRidershipInterval = 3600
+	// ridershipInsertBatchSize is the number of ridership records written per statement.
+	ridershipInsertBatchSize = 500
+)
+
+// RidershipInfo is one row of Automatic Passenger Count (APC) data: the people getting on and
+// off a trip at a stop on a date. Date is formatted as YYYYMMDD and Time is seconds since
+// midnight, or nil if neither the upload nor the schedule said when the trip was there.
+// RouteID and TripID are empty if the row did not match any of the project's routes or
+// trips. Load is the number of people on board leaving the stop, if counted.
+type RidershipInfo struct {
+	ID         uint     `gorm:"primaryKey" json:"id" msgpack:"id"`
+	ProjectID  string   `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	Date       string   `gorm:"date;index" json:"date" msgpack:"date"`
+	Time       *int     `gorm:"time" json:"time" msgpack:"time"`
+	RouteID    string   `gorm:"route_id;index" json:"route_id" msgpack:"route_id"`
+	TripID     string   `gorm:"trip_id" json:"trip_id" msgpack:"trip_id"`
+	StopID     string   `gorm:"stop_id;index" json:"stop_id" msgpack:"stop_id"`
+	Boardings  float64  `gorm:"boardings" json:"boardings" msgpack:"boardings"`
+	Alightings float64  `gorm:"alightings" json:"alightings" msgpack:"alightings"`
+	Load       *float64 `gorm:"load" json:"load" msgpack:"load"`
+}
+
+func (RidershipInfo) TableName() string {
+	return "ridership"
+}
+
+// RidershipImportParams are the upload ticket parameters for the "apc" upload kind, which
+// takes a CSV export from an APC system.
+//
+// Columns maps fields ("date", "time", "route", "trip", "stop", "boardings", "alightings"
+// and "load") to the names of the CSV columns holding them. Fields that are not mapped are
+// looked for under DefaultRidershipColumns, ignoring case. Only the stop and date are
+// required. Stops are matched by ID, then by stop code, and routes by ID, then by short name.
+// Dates may be formatted as YYYYMMDD, YYYY-MM-DD or M/D/YYYY, optionally followed by a time,
+// and times as H:MM or H:MM:SS.
+//
+// Uploaded dates replace whatever was uploaded for those dates before, so that a corrected
+// export can be uploaded again without counting anyone twice.
+type RidershipImportParams struct {
+	ProjectID string            `msgpack:"project_id"`
+	Columns   map[string]string `msgpack:"columns"`
+}
+
+// DefaultRidershipColumns are the column names APC exports commonly use for each field.
+var DefaultRidershipColumns = map[string][]string{
+	"date":       {"date", "service_date", "svc_date", "survey_date"},
+	"time":       {"time", "departure_time", "arrival_time", "stop_time"},
+	"route":      {"route", "route_id", "route_short_name", "route_name"},
+	"trip":       {"trip", "trip_id"},
+	"stop":       {"stop", "stop_id", "stop_code", "stop_number"},
+	"boardings":  {"boardings", "boards", "ons", "on"},
+	"alightings": {"alightings", "alights", "offs", "off"},
+	"load":       {"load", "departing_load", "load_departing", "departure_load"},
+}
+
+// RidershipImportReport summarizes an APC upload. Records is the number of rows stored, and
+// UnmatchedRoutes counts those stored without a route. Rows whose stop is not in the project
+// are skipped.
+type RidershipImportReport struct {
+	ProjectID       string   `msgpack:"project_id"`
+	Records         int      `msgpack:"records"`
+	StartDate       string   `msgpack:"start_date"`
+	EndDate         string   `msgpack:"end_date"`
+	UnmatchedRoutes int      `msgpack:"unmatched_routes"`
+	Skipped         int      `msgpack:"skipped"`
+	Errors          []string `msgpack:"errors"`
+}
+
+func (r *RidershipImportReport) addError(format string, args ...any) {
+	if len(r.Errors) < MaxRidershipImportErrors {
+		r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+	}
+}
+
+// importRidership stores the rows of an APC export, linked to the project's stops, routes
+// and trips.
+func importRidership(s *Server, u *UserConn, params []byte, data []byte) (any, error) {
+	var p RidershipImportParams
+	if err := msgpack.Unmarshal(params, &p); err != nil {
+		// TODO
+		return nil, err
+	}
+	if err := requireProject(s.Database, p.ProjectID); err != nil {
+		return nil, err
+	}
+	for field := range p.Columns {
+		if _, ok := DefaultRidershipColumns[field]; !ok {
+			return nil, &ErrorWithCode{
+				Code:    "unknown-ridership-field",
+				Message: fmt.Sprintf("%q is not a ridership field", field),
+				Details: field,
+			}
+		}
+	}
+
+	table, err := readCSV(bytes.NewReader(data))
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "bad-csv",
+			Message: fmt.Sprintf("APC data is not a valid CSV file: %v", err),
+		}
+	}
+
+	// Work out which column holds each field
+	columns := map[string]string{}
+	for field, aliases := range DefaultRidershipColumns {
+		if name, ok := p.Columns[field]; ok {
+			if table.has(name) {
+				columns[field] = name
+			}
+			continue
+		}
+		for _, alias := range aliases {
+			for name := range table.columns {
+				if strings.EqualFold(name, alias) && columns[field] == "" {
+					columns[field] = name
+				}
+			}
+		}
+	}
+	for _, field := range []string{"date", "stop"} {
+		if columns[field] == "" {
+			return nil, &ErrorWithCode{
+				Code:    "missing-ridership-column",
+				Message: fmt.Sprintf("the uploaded file has no %s column", field),
+				Details: field,
+			}
+		}
+	}
+
+	// Look up what the rows refer to
+	var stops []StopInfo
+	if err := s.Database.Select("id", "code").Find(&stops, "project_id = ?", p.ProjectID).Error; err != nil {
+		return nil, err
+	}
+	stopIDs := map[string]string{}
+	for _, stop := range stops {
+		if stop.Code != "" {
+			stopIDs[stop.Code] = stop.ID
+		}
+	}
+	for _, stop := range stops {
+		stopIDs[stop.ID] = stop.ID
+	}
+
+	var routes []RouteInfo
+	if err := s.Database.Select("id", "short_name").Find(&routes, "project_id = ?", p.ProjectID).Error; err != nil {
+		return nil, err
+	}
+	routeIDs := map[string]string{}
+	for _, route := range routes {
+		if route.ShortName != "" {
+			routeIDs[route.ShortName] = route.ID
+		}
+	}
+	for _, route := range routes {
+		routeIDs[route.ID] = route.ID
+	}
+
+	var trips []TripInfo
+	if err := s.Database.Select("id", "route_id").Find(&trips, "project_id = ?", p.ProjectID).Error; err != nil {
+		return nil, err
+	}
+	tripRoutes := make(map[string]string, len(trips))
+	for _, trip := range trips {
+		tripRoutes[trip.ID] = trip.RouteID
+	}
+
+	report := RidershipImportReport{ProjectID: p.ProjectID, Errors: []string{}}
+	var records []RidershipInfo
+	dates := map[string]bool{}
+
+	for i, row := range table.rows {
+		get := func(field string) string {
+			if columns[field] == "" {
+				return ""
+			}
+			return table.get(row, columns[field])
+		}
+		skip := func(format string, args ...any) {
+			report.Skipped++
+			report.addError("line %d %s", table.line(i), fmt.Sprintf(format, args...))
+		}
+
+		date, clock, ok := parseRidershipDate(get("date"))
+		if !ok {
+			skip("has an invalid date %q", get("date"))
+			continue
+		}
+		stopID, ok := stopIDs[get("stop")]
+		if !ok {
+			skip("refers to stop %q, which is not in the project", get("stop"))
+			continue
+		}
+
+		rec := RidershipInfo{ProjectID: p.ProjectID, Date: date, StopID: stopID}
+
+		var numErr error
+		for _, num := range []struct {
+			field string
+			value *float64
+		}{{"boardings", &rec.Boardings}, {"alightings", &rec.Alightings}} {
+			if str := get(num.field); str != "" {
+				if *num.value, err = strconv.ParseFloat(str, 64); err != nil {
+					numErr = fmt.Errorf("has an invalid number of %s %q", num.field, str)
+				}
+			}
+		}
+		if str := get("load"); str != "" {
+			load, err := strconv.ParseFloat(str, 64)
+			if err != nil {
+				numErr = fmt.Errorf("has an invalid load %q", str)
+			}
+			rec.Load = &load
+		}
+		if numErr != nil {
+			skip("%v", numErr)
+			continue
+		}
+
+		if str := get("time"); str != "" {
+			clock = str
+		}
+		if clock != "" {
+			secs, ok := parseRidershipTime(clock)
+			if ok {
+				rec.Time = &secs
+			} else {
+				report.addError("line %d has an invalid time %q", table.line(i), clock)
+			}
+		}
+
+		if trip := get("trip"); trip != "" {
+			if routeID, ok := tripRoutes[trip]; ok {
+				rec.TripID, rec.RouteID = trip, routeID
+			}
+		}
+		if routeID, ok := routeIDs[get("route")]; ok {
+			rec.RouteID = routeID
+		}
+		if rec.RouteID == "" {
+			report.UnmatchedRoutes++
+		}
+
+		records = append(records, rec)
+		dates[date] = true
+	}
+
+	if err := fillRidershipTimes(s.Database, p.ProjectID, records); err != nil {
+		return nil, err
+	}
+
+	sortedDates := make([]string, 0, len(dates))
+	for date := range dates {
+		sortedDates = append(sortedDates, date)
+	}
+	sort.Strings(sortedDates)
+	if len(sortedDates) > 0 {
+		report.StartDate, report.EndDate = sortedDates[0], sortedDates[len(sortedDates)-1]
+	}
+
+	err = s.Database.Transaction(func(tx *gorm.DB) error {
+		if len(sortedDates) > 0 {
+			if err := tx.Where("project_id = ? AND date IN ?", p.ProjectID, sortedDates).Delete(&RidershipInfo{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(records) > 0 {
+			return tx.CreateInBatches(records, ridershipInsertBatchSize).Error
+		}
+		return nil
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	report.Records = len(records)
+	return report, nil
+}
+
+// fillRidershipTimes gives records that matched a trip but have no time the time the trip is
+// scheduled to leave their stop.
+func fillRidershipTimes(db *gorm.DB, projectID string, records []RidershipInfo) error {
+	var tripIDs []string
+	seen := map[string]bool{}
+	for _, rec := range records {
+		if rec.Time == nil && rec.TripID != "" && !seen[rec.TripID] {
+			seen[rec.TripID] = true
+			tripIDs = append(tripIDs, rec.TripID)
+		}
+	}
+	if len(tripIDs) == 0 {
+		return nil
+	}
+
+	var stopTimes []StopTimeInfo
+	if err := db.Where("project_id = ? AND trip_id IN ?", projectID, tripIDs).Order("stop_sequence").Find(&stopTimes).Error; err != nil {
+		return err
+	}
+
+	// Loops visit a stop more than once, so go with the first visit
+	scheduled := map[[2]string]int{}
+	for _, st := range stopTimes {
+		key := [2]string{st.TripID, st.StopID}
+		if _, ok := scheduled[key]; ok {
+			continue
+		}
+		if st.DepartureTime != nil {
+			scheduled[key] = *st.DepartureTime
+		} else if st.ArrivalTime != nil {
+			scheduled[key] = *st.ArrivalTime
+		}
+	}
+
+	for i := range records {
+		if records[i].Time != nil || records[i].TripID == "" {
+			continue
+		}
+		if secs, ok := scheduled[[2]string{records[i].TripID, records[i].StopID}]; ok {
+			secs := secs
+			records[i].Time = &secs
+		}
+	}
+	return nil
+}
+
+// parseRidershipDate parses the dates found in APC exports into YYYYMMDD, also returning any
+// time of day that came with it.
+func parseRidershipDate(str string) (date, clock string, ok bool) {
+	if i := strings.IndexAny(str, " T"); i >= 0 {
+		str, clock = str[:i], strings.TrimSpace(str[i+1:])
+	}
+	for _, layout := range []string{"20060102", "2006-01-02", "1/2/2006", "2006/1/2"} {
+		if d, err := time.Parse(layout, str); err == nil {
+			return d.Format("20060102"), clock, true
+		}
+	}
+	return "", "", false
+}
+
+// parseRidershipTime parses a time of day formatted as H:MM or H:MM:SS (hours may exceed 23,
+// as in GTFS), ignoring fractional seconds and time zones.
+func parseRidershipTime(str string) (int, bool) {
+	if i := strings.IndexAny(str, ".Z+"); i >= 0 {
+		str = str[:i]
+	}
+	if strings.Count(str, ":") == 1 {
+		str += ":00"
+	}
+	secs, err := parseGTFSTime(str)
+	return secs, err == nil
+}
+
+// RidershipRequest is the payload of a 'ridership:summarize' request, which totals the APC
+// data of a project. GroupBy is one of "stop", "route", "time" (of day, in periods of
+// Interval seconds) and "date". Dates are formatted as YYYYMMDD and both ends are inclusive;
+// either may be omitted. Day limits the data to "weekday", "saturday" or "sunday" dates. Only
+// data for the given route and stops is counted, if any are given.
+type RidershipRequest struct {
+	ProjectID string   `msgpack:"project_id"`
+	GroupBy   string   `msgpack:"group_by"`
+	StartDate string   `msgpack:"start_date"`
+	EndDate   string   `msgpack:"end_date"`
+	Day       string   `msgpack:"day"`
+	RouteID   string   `msgpack:"route_id"`
+	StopIDs   []string `msgpack:"stop_ids"`
+	Interval  int      `msgpack:"interval"`
+}
+
+// RidershipGroup is the ridership of one stop, route, time of day or date, depending on how it
+// was grouped; records that matched no route are grouped under an empty RouteID. Daily
+// averages divide the totals by the number of dates with data. Loads are the average and
+// highest loads counted, or nil if none were.
+type RidershipGroup struct {
+	StopID          string   `msgpack:"stop_id,omitempty"`
+	RouteID         string   `msgpack:"route_id,omitempty"`
+	Date            string   `msgpack:"date,omitempty"`
+	StartTime       *int     `msgpack:"start_time,omitempty"`
+	EndTime         *int     `msgpack:"end_time,omitempty"`
+	Records         int      `msgpack:"records"`
+	Boardings       float64  `msgpack:"boardings"`
+	Alightings      float64  `msgpack:"alightings"`
+	DailyBoardings  float64  `msgpack:"daily_boardings"`
+	DailyAlightings float64  `msgpack:"daily_alightings"`
+	AverageLoad     *float64 `msgpack:"average_load"`
+	MaxLoad         *float64 `msgpack:"max_load"`
+}
+
+// RidershipSummary is the reply to a 'ridership:summarize' request. StartDate and EndDate
+// are the first and last dates with data, and Days is how many dates have data. Untimed is
+// the number of records left out of a grouping by time of day because their time is unknown.
+type RidershipSummary struct {
+	ProjectID string           `msgpack:"project_id"`
+	GroupBy   string           `msgpack:"group_by"`
+	StartDate string           `msgpack:"start_date"`
+	EndDate   string           `msgpack:"end_date"`
+	Days      int              `msgpack:"days"`
+	Untimed   int              `msgpack:"untimed"`
+	Totals    RidershipGroup   `msgpack:"totals"`
+	Groups    []RidershipGroup `msgpack:"groups"`
+}
+
+// ridershipRow is a row of the queries that total ridership.
+type ridershipRow struct {
+	Grp         string
+	Records     int
+	Boardings   float64
+	Alightings  float64
+	AverageLoad *float64
+	MaxLoad     *float64
+}
+
+func summarizeRidership(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req RidershipRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if req.Interval == 0 {
+		req.Interval = DefaultRidershipInterval
+	}
+	if req.Interval < 0 {
+		// TODO
+		return nil, errors.New("interval must be positive")
+	}
+	for _, date := range []string{req.StartDate, req.EndDate} {
+		if date != "" && !isGTFSDate(date) {
+			// TODO
+			return nil, fmt.Errorf("dates must be formatted as YYYYMMDD, not %q", date)
+		}
+	}
+
+	switch req.Day {
+	case "", "weekday", "saturday", "sunday":
+	default:
+		// TODO
+		return nil, fmt.Errorf("day must be weekday, saturday or sunday, not %q", req.Day)
+	}
+
+	var group string
+	switch req.GroupBy {
+	case "stop":
+		group = "stop_id"
+	case "route":
+		group = "route_id"
+	case "date":
+		group = "date"
+	case "time":
+		group = fmt.Sprintf("(time / %d) * %d", req.Interval, req.Interval)
+	default:
+		return nil, &ErrorWithCode{
+			Code:    "invalid-grouping",
+			Message: fmt.Sprintf("ridership cannot be grouped by %q", req.GroupBy),
+			Details: []string{"stop", "route", "time", "date"},
+		}
+	}
+
+	if err := requireProject(s.Database, req.ProjectID); err != nil {
+		return nil, err
+	}
+	if req.RouteID != "" {
+		if err := requireInProject(s.Database, &RouteInfo{}, "route", req.RouteID, req.ProjectID); err != nil {
+			return nil, err
+		}
+	}
+
+	filter := func() *gorm.DB {
+		q := s.Database.Model(&RidershipInfo{}).Where("project_id = ?", req.ProjectID)
+		if req.StartDate != "" {
+			q = q.Where("date >= ?", req.StartDate)
+		}
+		if req.EndDate != "" {
+			q = q.Where("date <= ?", req.EndDate)
+		}
+		if req.RouteID != "" {
+			q = q.Where("route_id = ?", req.RouteID)
+		}
+		if len(req.StopIDs) > 0 {
+			q = q.Where("stop_id IN ?", req.StopIDs)
+		}
+		return q
+	}
+
+	// Narrow the dates down to the requested day of the week
+	var dates []string
+	if err := filter().Distinct().Order("date").Pluck("date", &dates).Error; err != nil {
+		return nil, err
+	}
+	if req.Day != "" {
+		kept := dates[:0]
+		for _, date := range dates {
+			d, err := time.Parse("20060102", date)
+			if err != nil {
+				continue
+			}
+			switch wd := d.Weekday(); req.Day {
+			case "weekday":
+				if wd != time.Saturday && wd != time.Sunday {
+					kept = append(kept, date)
+				}
+			case "saturday":
+				if wd == time.Saturday {
+					kept = append(kept, date)
+				}
+			case "sunday":
+				if wd == time.Sunday {
+					kept = append(kept, date)
+				}
+			}
+		}
+		dates = kept
+	}
+
+	summary := RidershipSummary{ProjectID: req.ProjectID, GroupBy: req.GroupBy, Days: len(dates), Groups: []RidershipGroup{}}
+	if len(dates) == 0 {
+		return summary, nil
+	}
+	summary.StartDate, summary.EndDate = dates[0], dates[len(dates)-1]
+
+	scoped := func() *gorm.DB {
+		q := filter()
+		if req.Day != "" {
+			q = q.Where("date IN ?", dates)
+		}
+		return q
+	}
+	const totals = "COUNT(*) AS records, SUM(boardings) AS boardings, SUM(alightings) AS alightings, AVG(load) AS average_load, MAX(load) AS max_load"
+
+	var total ridershipRow
+	if err := scoped().Select(totals).Scan(&total).Error; err != nil {
+		return nil, err
+	}
+	summary.Totals = ridershipGroup(total, summary.Days)
+
+	q := scoped()
+	if req.GroupBy == "time" {
+		var untimed int64
+		if err := scoped().Where("time IS NULL").Count(&untimed).Error; err != nil {
+			return nil, err
+		}
+		summary.Untimed = int(untimed)
+		q = q.Where("time IS NOT NULL")
+	}
+
+	var rows []ridershipRow
+	if err := q.Select(group + " AS grp, " + totals).Group("grp").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		g := ridershipGroup(row, summary.Days)
+		switch req.GroupBy {
+		case "stop":
+			g.StopID = row.Grp
+		case "route":
+			g.RouteID = row.Grp
+		case "date":
+			g.Date = row.Grp
+		case "time":
+			start, err := strconv.Atoi(row.Grp)
+			if err != nil {
+				return nil, err
+			}
+			end := start + req.Interval
+			g.StartTime, g.EndTime = &start, &end
+		}
+		summary.Groups = append(summary.Groups, g)
+	}
+
+	// Busiest stops and routes first; dates and times in order
+	sort.SliceStable(summary.Groups, func(i, j int) bool {
+		a, b := summary.Groups[i], summary.Groups[j]
+		switch req.GroupBy {
+		case "date":
+			return a.Date < b.Date
+		case "time":
+			return *a.StartTime < *b.StartTime
+		default:
+			return a.Boardings > b.Boardings
+		}
+	})
+
+	return summary, nil
+}
+
+// ridershipGroup turns a row of totals into a RidershipGroup with daily averages.
+func ridershipGroup(row ridershipRow, days int) RidershipGroup {
+	g := RidershipGroup{
+		Records:     row.Records,
+		Boardings:   row.Boardings,
+		Alightings:  row.Alightings,
+		AverageLoad: row.AverageLoad,
+		MaxLoad:     row.MaxLoad,
+	}
+	if days > 0 {
+		g.DailyBoardings = row.Boardings / float64(days)
+		g.DailyAlightings = row.Alightings / float64(days)
+	}
+	return g
+}
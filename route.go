@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// RouteInfo mirrors a row of a GTFS routes.txt file.
+type RouteInfo struct {
+	ID          string `gorm:"primaryKey" json:"id" msgpack:"id"`
+	ProjectID   string `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	AgencyID    string `gorm:"agency_id" json:"agency_id" msgpack:"agency_id"`
+	ShortName   string `gorm:"short_name" json:"short_name" msgpack:"short_name"`
+	LongName    string `gorm:"long_name" json:"long_name" msgpack:"long_name"`
+	Description string `gorm:"description" json:"description,omitempty" msgpack:"description,omitempty"`
+	Type        uint   `gorm:"type" json:"type" msgpack:"type"`
+	URL         string `gorm:"url" json:"url,omitempty" msgpack:"url,omitempty"`
+	Color       string `gorm:"color" json:"color,omitempty" msgpack:"color,omitempty"`
+	TextColor   string `gorm:"text_color" json:"text_color,omitempty" msgpack:"text_color,omitempty"`
+	SortOrder   uint   `gorm:"sort_order" json:"sort_order,omitempty" msgpack:"sort_order,omitempty"`
+}
+
+func (RouteInfo) TableName() string {
+	return "routes"
+}
+
+// takeRoute fetches a single route.
+func takeRoute(db *gorm.DB, id string) (RouteInfo, error) {
+	route := RouteInfo{ID: id}
+	if err := db.Take(&route).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return route, &ErrorWithCode{
+				Code:    "route-not-found",
+				Message: fmt.Sprintf("there is no route with ID %q", id),
+				Details: id,
+			}
+		}
+		return route, err
+	}
+	return route, nil
+}
+
+func listRoutes(s *Server, u *UserConn, payload []byte) (any, error) {
+	var projectID string
+	if err := msgpack.Unmarshal(payload, &projectID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, projectID); err != nil {
+		return nil, err
+	}
+
+	var routes []RouteInfo
+	if err := s.Database.Find(&routes, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+func createRoute(s *Server, u *UserConn, payload []byte) (any, error) {
+	var info RouteInfo
+	if err := msgpack.Unmarshal(payload, &info); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, info.ProjectID); err != nil {
+		return nil, err
+	}
+
+	if info.AgencyID == "" {
+		// Default to the project's agency if there is exactly one
+		var agencies []AgencyInfo
+		if err := s.Database.Limit(2).Find(&agencies, "project_id = ?", info.ProjectID).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+		if len(agencies) == 1 {
+			info.AgencyID = agencies[0].ID
+		}
+	} else if err := requireInProject(s.Database, &AgencyInfo{}, "agency", info.AgencyID, info.ProjectID); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+	info.ID = id.String()
+
+	if err := s.Database.Create(info).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "route:created", Data: info})
+
+	return info, nil
+}
+
+func modifyRoute(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to modify the ID or project of the route, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	route := RouteInfo{ID: id}
+	if err := s.Database.Take(&route).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrorWithCode{
+				Code:    "route-not-found",
+				Message: fmt.Sprintf("there is no route with ID %q", id),
+				Details: id,
+			}
+		}
+		// TODO
+		return nil, err
+	}
+
+	changes := map[string]any{}
+
+	for _, field := range []string{
+		"short_name", "long_name", "description", "url", "color", "text_color",
+	} {
+		if str, ok := untrustedChanges[field].(string); ok {
+			changes[field] = str
+		}
+	}
+	for _, field := range []string{"type", "sort_order"} {
+		if num, ok := toUint(untrustedChanges[field]); ok {
+			changes[field] = num
+		}
+	}
+	if agencyID, ok := untrustedChanges["agency_id"].(string); ok {
+		if err := requireInProject(s.Database, &AgencyInfo{}, "agency", agencyID, route.ProjectID); err != nil {
+			return nil, err
+		}
+		changes["agency_id"] = agencyID
+	}
+
+	if len(changes) > 0 {
+		if err := s.Database.Model(&route).Updates(changes).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+		if err := s.Database.Take(&route).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: route.ProjectID, Type: "route:modified", Data: route})
+
+	return route, nil
+}
+
+// deleteRoute deletes a route along with its patterns and trips.
+func deleteRoute(s *Server, u *UserConn, payload []byte) (any, error) {
+	var id string
+	if err := msgpack.Unmarshal(payload, &id); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	// Look up the project first so we know who to notify
+	var route RouteInfo
+	if err := s.Database.Select("project_id").Take(&route, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
+		// TODO
+		return nil, err
+	}
+
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		tripIDs := tx.Model(&TripInfo{}).Select("id").Where("route_id = ?", id)
+		patternIDs := tx.Model(&PatternInfo{}).Select("id").Where("route_id = ?", id)
+
+		if err := tx.Delete(&StopTimeInfo{}, "trip_id IN (?)", tripIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&FrequencyInfo{}, "trip_id IN (?)", tripIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&PatternStopInfo{}, "pattern_id IN (?)", patternIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&TripInfo{}, "route_id = ?", id).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&PatternInfo{}, "route_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&RouteInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: route.ProjectID, Type: "route:deleted", Data: id})
+
+	return nil, nil
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultLayoverRatio is the layover added to the end of each trip, as a fraction of its
+	// running time, when a 'route:stats' request does not specify one.
+	DefaultLayoverRatio = 0.1
+	// DefaultMinLayover is the minimum layover in seconds when a 'route:stats' request does not
+	// specify one.
+	DefaultMinLayover = 5 * 60
+)
+
+// RouteStatsRequest is the payload of a 'route:stats' request. The layover settings are
+// optional and fall back to DefaultLayoverRatio and DefaultMinLayover.
+type RouteStatsRequest struct {
+	RouteID      string   `msgpack:"route_id"`
+	LayoverRatio *float64 `msgpack:"layover_ratio"`
+	MinLayover   *int     `msgpack:"min_layover"`
+}
+
+// StopSpacing is the distance in meters between two consecutive stops of a pattern,
+// measured along the pattern's shape if it has one, or in a straight line otherwise.
+type StopSpacing struct {
+	FromStopID string  `msgpack:"from_stop_id"`
+	ToStopID   string  `msgpack:"to_stop_id"`
+	Distance   float64 `msgpack:"distance"`
+}
+
+// PatternStats describes one way of running a route. Routes imported from GTFS usually have
+// no patterns, so their trips are grouped by shape and stop sequence instead; the resulting
+// stats have an empty PatternID.
+type PatternStats struct {
+	PatternID   string   `msgpack:"pattern_id"`
+	Name        string   `msgpack:"name"`
+	DirectionID uint     `msgpack:"direction_id"`
+	ShapeID     string   `msgpack:"shape_id"`
+	StopIDs     []string `msgpack:"stop_ids"`
+	// Length is in meters.
+	Length             float64       `msgpack:"length"`
+	StopSpacing        []StopSpacing `msgpack:"stop_spacing"`
+	AverageStopSpacing float64       `msgpack:"average_stop_spacing"`
+	TripCount          int           `msgpack:"trip_count"`
+}
+
+// DirectionStats summarizes one direction of a route. Length is the length of the
+// direction's busiest pattern, in meters. RunningTime is the longest scheduled trip in the
+// direction and Layover is the recovery time added to it, both in seconds.
+type DirectionStats struct {
+	DirectionID uint    `msgpack:"direction_id"`
+	Length      float64 `msgpack:"length"`
+	RunningTime int     `msgpack:"running_time"`
+	Layover     int     `msgpack:"layover"`
+}
+
+// ServiceStats summarizes a single day of a route's service. RevenueTime is in seconds and
+// RevenueDistance is in meters.
+type ServiceStats struct {
+	ServiceID       string  `msgpack:"service_id"`
+	TripCount       int     `msgpack:"trip_count"`
+	RevenueTime     int     `msgpack:"revenue_time"`
+	RevenueDistance float64 `msgpack:"revenue_distance"`
+	PeakVehicles    int     `msgpack:"peak_vehicles"`
+}
+
+// RouteStats is the reply to a 'route:stats' request. Distances are in meters, times are in
+// seconds, and AverageSpeed is in meters per second.
+//
+// CycleTime is the time it takes a vehicle to make a round trip, including layover at each
+// end. PeakVehicles is the most vehicles in service at once on any service day; it is computed
+// from the schedule (counting layover), so it does not account for interlining or deadhead.
+type RouteStats struct {
+	RouteID      string           `msgpack:"route_id"`
+	Length       float64          `msgpack:"length"`
+	Patterns     []PatternStats   `msgpack:"patterns"`
+	Directions   []DirectionStats `msgpack:"directions"`
+	Services     []ServiceStats   `msgpack:"services"`
+	TripCount    int              `msgpack:"trip_count"`
+	AverageSpeed float64          `msgpack:"average_speed"`
+	CycleTime    int              `msgpack:"cycle_time"`
+	PeakVehicles int              `msgpack:"peak_vehicles"`
+}
+
+// scheduledTrip is a single run of a trip. Trips with frequencies produce one scheduledTrip
+// per dispatch. Start and End are seconds since midnight of the service day.
+type scheduledTrip struct {
+	TripID      string
+	ServiceID   string
+	DirectionID uint
+	Start       int
+	End         int
+	Distance    float64
+}
+
+func routeStats(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req RouteStatsRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	layoverRatio, minLayover := DefaultLayoverRatio, DefaultMinLayover
+	if req.LayoverRatio != nil {
+		layoverRatio = *req.LayoverRatio
+	}
+	if req.MinLayover != nil {
+		minLayover = *req.MinLayover
+	}
+	if layoverRatio < 0 || minLayover < 0 {
+		// TODO
+		return nil, errors.New("layover cannot be negative")
+	}
+
+	return computeRouteStats(s.Database, req.RouteID, layoverRatio, minLayover)
+}
+
+// computeRouteStats gathers everything about a route's geometry and schedule and boils it
+// down into RouteStats.
+func computeRouteStats(db *gorm.DB, routeID string, layoverRatio float64, minLayover int) (*RouteStats, error) {
+	route, err := takeRoute(db, routeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []PatternInfo
+	if err := db.Find(&patterns, "route_id = ?", routeID).Error; err != nil {
+		return nil, err
+	}
+	if err := loadPatternStops(db, patterns); err != nil {
+		return nil, err
+	}
+
+	var trips []TripInfo
+	if err := db.Find(&trips, "route_id = ?", routeID).Error; err != nil {
+		return nil, err
+	}
+
+	routeTrips := db.Model(&TripInfo{}).Select("id").Where("route_id = ?", routeID)
+
+	var stopTimes []StopTimeInfo
+	if err := db.Order("trip_id, stop_sequence").Find(&stopTimes, "trip_id IN (?)", routeTrips).Error; err != nil {
+		return nil, err
+	}
+	var frequencies []FrequencyInfo
+	if err := db.Find(&frequencies, "trip_id IN (?)", routeTrips).Error; err != nil {
+		return nil, err
+	}
+
+	var stops []StopInfo
+	if err := db.Select("id", "lat", "lng").Find(&stops, "project_id = ?", route.ProjectID).Error; err != nil {
+		return nil, err
+	}
+	stopCoords := make(map[string]LatLng, len(stops))
+	for _, stop := range stops {
+		stopCoords[stop.ID] = LatLng{stop.Lat, stop.Lng}
+	}
+
+	stopTimesByTrip := map[string][]StopTimeInfo{}
+	for _, st := range stopTimes {
+		stopTimesByTrip[st.TripID] = append(stopTimesByTrip[st.TripID], st)
+	}
+	frequenciesByTrip := map[string][]FrequencyInfo{}
+	for _, f := range frequencies {
+		frequenciesByTrip[f.TripID] = append(frequenciesByTrip[f.TripID], f)
+	}
+
+	// Group trips into patterns: explicit ones first, then whatever else the trips do
+	stats := &RouteStats{RouteID: routeID, TripCount: len(trips)}
+	variantIndex := map[string]int{}
+	patternsByID := map[string]*PatternInfo{}
+
+	for i := range patterns {
+		p := &patterns[i]
+		patternsByID[p.ID] = p
+		variantIndex["p:"+p.ID] = len(stats.Patterns)
+		stats.Patterns = append(stats.Patterns, PatternStats{
+			PatternID:   p.ID,
+			Name:        p.Name,
+			DirectionID: p.DirectionID,
+			ShapeID:     p.ShapeID,
+			StopIDs:     p.StopIDs,
+		})
+	}
+
+	tripVariant := make(map[string]int, len(trips))
+	for _, trip := range trips {
+		if p := patternsByID[trip.PatternID]; p != nil {
+			vi := variantIndex["p:"+p.ID]
+			if stats.Patterns[vi].ShapeID == "" {
+				stats.Patterns[vi].ShapeID = trip.ShapeID
+			}
+			tripVariant[trip.ID] = vi
+			continue
+		}
+
+		stopIDs := make([]string, len(stopTimesByTrip[trip.ID]))
+		for i, st := range stopTimesByTrip[trip.ID] {
+			stopIDs[i] = st.StopID
+		}
+
+		key := fmt.Sprintf("t:%d|%s|%s", trip.DirectionID, trip.ShapeID, strings.Join(stopIDs, ","))
+		vi, ok := variantIndex[key]
+		if !ok {
+			vi = len(stats.Patterns)
+			variantIndex[key] = vi
+			stats.Patterns = append(stats.Patterns, PatternStats{
+				Name:        trip.Headsign,
+				DirectionID: trip.DirectionID,
+				ShapeID:     trip.ShapeID,
+				StopIDs:     stopIDs,
+			})
+		}
+		tripVariant[trip.ID] = vi
+	}
+
+	// Measure each pattern along its shape
+	shapeCoords := map[string][]LatLng{}
+	for _, ps := range stats.Patterns {
+		if ps.ShapeID != "" {
+			shapeCoords[ps.ShapeID] = nil
+		}
+	}
+	if len(shapeCoords) > 0 {
+		ids := make([]string, 0, len(shapeCoords))
+		for id := range shapeCoords {
+			ids = append(ids, id)
+		}
+
+		var shapes []PathInfo
+		if err := db.Find(&shapes, "id IN ?", ids).Error; err != nil {
+			return nil, err
+		}
+		for _, sh := range shapes {
+			shapeCoords[sh.ID] = sh.Coords
+		}
+	}
+
+	for i := range stats.Patterns {
+		measurePattern(&stats.Patterns[i], shapeCoords[stats.Patterns[i].ShapeID], stopCoords)
+	}
+
+	// Lay out every run of every trip
+	var runs []scheduledTrip
+	for _, trip := range trips {
+		start, end, ok := tripSpan(stopTimesByTrip[trip.ID])
+		if !ok {
+			continue
+		}
+
+		vi := tripVariant[trip.ID]
+		stats.Patterns[vi].TripCount++
+		run := scheduledTrip{trip.ID, trip.ServiceID, trip.DirectionID, start, end, stats.Patterns[vi].Length}
+
+		if freqs := frequenciesByTrip[trip.ID]; len(freqs) > 0 {
+			for _, f := range freqs {
+				if f.HeadwaySecs == 0 {
+					continue
+				}
+				for dep := f.StartTime; dep < f.EndTime; dep += int(f.HeadwaySecs) {
+					run.Start, run.End = dep, dep+(end-start)
+					runs = append(runs, run)
+				}
+			}
+		} else {
+			runs = append(runs, run)
+		}
+	}
+
+	// Directions: the busiest pattern decides the length, the slowest trip the running time
+	directions := map[uint]*DirectionStats{}
+	busiest := map[uint]int{}
+	for _, ps := range stats.Patterns {
+		ds := directions[ps.DirectionID]
+		if ds == nil {
+			ds = &DirectionStats{DirectionID: ps.DirectionID}
+			directions[ps.DirectionID] = ds
+			busiest[ps.DirectionID] = -1
+		}
+		if ps.TripCount > busiest[ps.DirectionID] {
+			busiest[ps.DirectionID] = ps.TripCount
+			ds.Length = ps.Length
+		}
+	}
+
+	totalDistance, totalTime := 0.0, 0
+	for _, run := range runs {
+		if ds := directions[run.DirectionID]; ds != nil && run.End-run.Start > ds.RunningTime {
+			ds.RunningTime = run.End - run.Start
+		}
+		if run.End > run.Start {
+			totalDistance += run.Distance
+			totalTime += run.End - run.Start
+		}
+	}
+	if totalTime > 0 {
+		stats.AverageSpeed = totalDistance / float64(totalTime)
+	}
+
+	layovers := map[uint]int{}
+	for _, ds := range directions {
+		if ds.RunningTime > 0 {
+			ds.Layover = int(math.Max(float64(minLayover), math.Round(layoverRatio*float64(ds.RunningTime))))
+		}
+		layovers[ds.DirectionID] = ds.Layover
+
+		stats.Directions = append(stats.Directions, *ds)
+		stats.Length += ds.Length
+		stats.CycleTime += ds.RunningTime + ds.Layover
+	}
+	sort.Slice(stats.Directions, func(i, j int) bool {
+		return stats.Directions[i].DirectionID < stats.Directions[j].DirectionID
+	})
+
+	// Services: revenue totals plus a sweep over the day for the most vehicles out at once
+	runsByService := map[string][]scheduledTrip{}
+	for _, run := range runs {
+		runsByService[run.ServiceID] = append(runsByService[run.ServiceID], run)
+	}
+	for serviceID, serviceRuns := range runsByService {
+		ss := ServiceStats{ServiceID: serviceID, TripCount: len(serviceRuns)}
+		for _, run := range serviceRuns {
+			ss.RevenueTime += run.End - run.Start
+			ss.RevenueDistance += run.Distance
+		}
+		ss.PeakVehicles = peakVehicles(serviceRuns, layovers)
+
+		stats.Services = append(stats.Services, ss)
+		if ss.PeakVehicles > stats.PeakVehicles {
+			stats.PeakVehicles = ss.PeakVehicles
+		}
+	}
+	sort.Slice(stats.Services, func(i, j int) bool {
+		return stats.Services[i].ServiceID < stats.Services[j].ServiceID
+	})
+
+	return stats, nil
+}
+
+// measurePattern fills in the length and stop spacing of a pattern. Stops are located along
+// the shape in order, so a shape that doubles back on itself is measured correctly. Without
+// a shape, straight lines between stops are used.
+func measurePattern(ps *PatternStats, shape []LatLng, stopCoords map[string]LatLng) {
+	ps.StopSpacing = []StopSpacing{}
+
+	if len(shape) >= 2 {
+		ps.Length = lineLength(shape)
+	}
+
+	prevMeasure := 0.0
+	spacingTotal := 0.0
+
+	for i, stopID := range ps.StopIDs {
+		coord := stopCoords[stopID]
+		measure := 0.0
+		if len(shape) >= 2 {
+			measure = locateAlong(shape, coord, prevMeasure)
+		}
+
+		if i > 0 {
+			prevID := ps.StopIDs[i-1]
+			d := measure - prevMeasure
+			if len(shape) < 2 {
+				d = distance(stopCoords[prevID], coord)
+			}
+			spacingTotal += d
+			ps.StopSpacing = append(ps.StopSpacing, StopSpacing{prevID, stopID, d})
+		}
+		prevMeasure = measure
+	}
+
+	if len(shape) < 2 {
+		ps.Length = spacingTotal
+	}
+	if len(ps.StopSpacing) > 0 {
+		ps.AverageStopSpacing = spacingTotal / float64(len(ps.StopSpacing))
+	}
+}
+
+// tripSpan returns the first departure and last arrival of a trip. Trips without at least
+// two timed stops have no span.
+func tripSpan(stopTimes []StopTimeInfo) (start, end int, ok bool) {
+	first, last := -1, -1
+	for i, st := range stopTimes {
+		if st.ArrivalTime != nil || st.DepartureTime != nil {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 || first == last {
+		return 0, 0, false
+	}
+
+	if t := stopTimes[first].DepartureTime; t != nil {
+		start = *t
+	} else {
+		start = *stopTimes[first].ArrivalTime
+	}
+	if t := stopTimes[last].ArrivalTime; t != nil {
+		end = *t
+	} else {
+		end = *stopTimes[last].DepartureTime
+	}
+
+	return start, end, true
+}
+
+// peakVehicles returns the most runs (each followed by its direction's layover) that overlap
+// at any moment.
+func peakVehicles(runs []scheduledTrip, layovers map[uint]int) int {
+	type event struct {
+		time  int
+		delta int
+	}
+
+	events := make([]event, 0, 2*len(runs))
+	for _, run := range runs {
+		events = append(events, event{run.Start, 1}, event{run.End + layovers[run.DirectionID], -1})
+	}
+
+	// A vehicle that finishes its layover at the same moment another trip starts can make that
+	// trip, so process releases first
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].time != events[j].time {
+			return events[i].time < events[j].time
+		}
+		return events[i].delta < events[j].delta
+	})
+
+	current, peak := 0, 0
+	for _, e := range events {
+		current += e.delta
+		if current > peak {
+			peak = current
+		}
+	}
+	return peak
+}
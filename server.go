@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
@@ -10,7 +11,7 @@ import (
 	"gorm.io/gorm"
 )
 
-type RequestHandler = func(*Server, *UserInfo, []byte) (any, error)
+type RequestHandler = func(*Server, *UserConn, []byte) (any, error)
 
 // Server represents this server as a whole and contains global configuration
 // information so request-handling code has a single spot to read it from.
@@ -26,6 +27,28 @@ type Server struct {
 
 	// Handlers for various request types, like "user:list" or "registration_token:delete".
 	RequestHandlers map[string]RequestHandler
+
+	// Handlers for the various kinds of files that can be uploaded over HTTP, like "gtfs".
+	UploadHandlers map[string]UploadHandler
+
+	// transfersLock guards UploadTickets and Downloads.
+	transfersLock sync.Mutex
+
+	// UploadTickets maps ticket IDs to tickets that have been issued but not yet used.
+	UploadTickets map[string]UploadTicket
+
+	// Downloads maps download IDs to generated files that have not expired yet.
+	Downloads map[string]Download
+
+	// connsLock guards Conns, Subscribers, and the subscriptions of every connection.
+	connsLock sync.RWMutex
+
+	// Conns is the set of all currently-connected (authenticated) users.
+	Conns map[*UserConn]struct{}
+
+	// Subscribers maps project IDs to the set of connections subscribed to changes in the
+	// corresponding project.
+	Subscribers map[string]map[*UserConn]struct{}
 }
 
 // NewServer attempts to open the given configuration file and initialize a server
@@ -61,6 +84,25 @@ func NewServer(cfgPath string) (*Server, error) {
 		&StopInfo{},
 		&PathInfo{},
 		&CircleInfo{},
+		&AgencyInfo{},
+		&RouteInfo{},
+		&TripInfo{},
+		&StopTimeInfo{},
+		&FrequencyInfo{},
+		&CalendarInfo{},
+		&CalendarDateInfo{},
+		&PatternInfo{},
+		&PatternStopInfo{},
+		&CostModelInfo{},
+		&DemographicLayerInfo{},
+		&DemographicAreaInfo{},
+		&StreetNodeInfo{},
+		&StreetEdgeInfo{},
+		&TurnRestrictionInfo{},
+		&RidershipInfo{},
+		&ReferenceLayerInfo{},
+		&ReferenceFeatureInfo{},
+		&ReferenceVisibilityInfo{},
 	); err != nil {
 		// TODO: close database?
 		return nil, errors.Wrap(err, "error migrating database schema")
@@ -69,6 +111,21 @@ func NewServer(cfgPath string) (*Server, error) {
 	return &Server{
 		Database:     db,
 		RootRegToken: cfg.RootRegistrationToken,
+		Conns:        map[*UserConn]struct{}{},
+		Subscribers:  map[string]map[*UserConn]struct{}{},
+		UploadHandlers: map[string]UploadHandler{
+			"gtfs":      importGTFSUpload,
+			"tiger":     importDemographicShapes,
+			"acs":       importDemographicTable,
+			"osm":       importStreetNetwork,
+			"apc":       importRidership,
+			"kml":       importKML,
+			"shapefile": importShapefile,
+			"geojson":   importGeoJSON,
+			"reference": importReferenceFeatures,
+		},
+		UploadTickets: map[string]UploadTicket{},
+		Downloads:     map[string]Download{},
 		RequestHandlers: map[string]RequestHandler{
 			"registration_token:list":   listRegistrationTokens,
 			"registration_token:create": createRegistrationToken,
@@ -81,11 +138,73 @@ func NewServer(cfgPath string) (*Server, error) {
 			"project:delete":            deleteProject,
 			"project:list_features":     listProjectFeatures,
 			"stop:create":               createStop,
+			"stop:modify":               modifyStop,
 			"stop:delete":               deleteStop,
+			"stop:buffers":              stopBuffers,
+			"stop:walksheds":            stopWalksheds,
+			"stop:routes":               stopRoutes,
 			"path:create":               createPath,
+			"path:modify":               modifyPath,
 			"path:delete":               deletePath,
+			"path:snap":                 snapPath,
 			"circle:create":             createCircle,
+			"circle:modify":             modifyCircle,
 			"circle:delete":             deleteCircle,
+			"agency:list":               listAgencies,
+			"agency:create":             createAgency,
+			"agency:modify":             modifyAgency,
+			"agency:delete":             deleteAgency,
+			"calendar:list":             listCalendars,
+			"calendar:create":           createCalendar,
+			"calendar:modify":           modifyCalendar,
+			"calendar:delete":           deleteCalendar,
+			"route:list":                listRoutes,
+			"route:create":              createRoute,
+			"route:modify":              modifyRoute,
+			"route:delete":              deleteRoute,
+			"route:stats":               routeStats,
+			"route:directions":          routeDirections,
+			"route:stops":               routeStops,
+			"pattern:list":              listPatterns,
+			"pattern:create":            createPattern,
+			"pattern:modify":            modifyPattern,
+			"pattern:delete":            deletePattern,
+			"trip:list":                 listTrips,
+			"trip:create":               createTrip,
+			"trip:modify":               modifyTrip,
+			"trip:delete":               deleteTrip,
+			"stop_time:list":            listStopTimes,
+			"stop_time:create":          createStopTime,
+			"stop_time:modify":          modifyStopTime,
+			"stop_time:delete":          deleteStopTime,
+			"timetable:preview":         previewTimetable,
+			"timetable:commit":          commitTimetable,
+			"cost_model:get":            getCostModel,
+			"cost_model:set":            setCostModel,
+			"cost:estimate":             estimateCosts,
+			"demographics:list_layers":  listDemographicLayers,
+			"demographics:create_layer": createDemographicLayer,
+			"demographics:modify_layer": modifyDemographicLayer,
+			"demographics:delete_layer": deleteDemographicLayer,
+			"demographics:list_areas":   listDemographicAreas,
+			"demographics:coverage":     demographicCoverage,
+			"reference:list_layers":     listReferenceLayers,
+			"reference:create_layer":    createReferenceLayer,
+			"reference:modify_layer":    modifyReferenceLayer,
+			"reference:delete_layer":    deleteReferenceLayer,
+			"reference:set_visibility":  setReferenceVisibility,
+			"reference:list_features":   listReferenceFeatures,
+			"title_vi:analyze":          analyzeTitleVI,
+			"isochrone:compute":         isochrone,
+			"streets:info":              streetNetworkInfo,
+			"ridership:summarize":       summarizeRidership,
+			"gtfs:import":               importGTFSRequest,
+			"gtfs:export":               exportGTFS,
+			"kml:export":                exportKML,
+			"shapefile:export":          exportShapefiles,
+			"geojson:export":            exportGeoJSON,
+			"xlsx:export":               exportXLSX,
+			"upload:create_ticket":      createUploadTicket,
 		},
 	}, nil
 }
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// StopRouteService is how often a route serves a stop, in trips per day. Weekday is the
+// average over Monday through Friday.
+type StopRouteService struct {
+	StopID   string  `msgpack:"stop_id"`
+	RouteID  string  `msgpack:"route_id"`
+	Weekday  float64 `msgpack:"weekday"`
+	Saturday float64 `msgpack:"saturday"`
+	Sunday   float64 `msgpack:"sunday"`
+}
+
+// loadStopRouteService counts the trips per day of every route at every stop in a project. It
+// adds up the same stop visits 'stop:routes' does, so the two always agree.
+func loadStopRouteService(db *gorm.DB, projectID string) ([]StopRouteService, error) {
+	type key struct{ stopID, routeID string }
+	byKey := map[key]*StopRouteService{}
+	var order []key
+
+	for _, day := range []string{"weekday", "saturday", "sunday"} {
+		visits, err := loadStopVisits(db, projectID, "", day, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range visits {
+			k := key{v.stopID, v.routeID}
+			srs := byKey[k]
+			if srs == nil {
+				srs = &StopRouteService{StopID: v.stopID, RouteID: v.routeID}
+				byKey[k] = srs
+				order = append(order, k)
+			}
+
+			switch day {
+			case "saturday":
+				srs.Saturday += v.weight
+			case "sunday":
+				srs.Sunday += v.weight
+			default:
+				srs.Weekday += v.weight
+			}
+		}
+	}
+
+	result := make([]StopRouteService, len(order))
+	for i, k := range order {
+		result[i] = *byKey[k]
+	}
+	return result, nil
+}
+
+// StopServiceRequest is the payload of a 'stop:routes' request, which lists the routes
+// serving each of the selected stops (see StopSelection) on a day: "weekday" (the default,
+// averaged over Monday through Friday), "saturday" or "sunday", or the date given as
+// YYYYMMDD.
+type StopServiceRequest struct {
+	StopSelection `msgpack:",inline"`
+	Day           string `msgpack:"day"`
+	Date          string `msgpack:"date"`
+}
+
+// ServiceSummary is how often something is served in a day. Trips are the trips per day.
+// FirstTrip and LastTrip are the earliest and latest times (in seconds since midnight) a
+// trip is there, and are nil if none of its trips have times at the stop. AverageHeadway is
+// the time in seconds between them divided by one less than the number of trips, or 0 for a
+// single trip.
+type ServiceSummary struct {
+	Trips          float64 `msgpack:"trips"`
+	FirstTrip      *int    `msgpack:"first_trip"`
+	LastTrip       *int    `msgpack:"last_trip"`
+	AverageHeadway float64 `msgpack:"average_headway"`
+}
+
+// StopRoute is a direction of a route serving a stop, with the headsigns its trips show.
+type StopRoute struct {
+	RouteID        string   `msgpack:"route_id"`
+	DirectionID    uint     `msgpack:"direction_id"`
+	Headsigns      []string `msgpack:"headsigns"`
+	ServiceSummary `msgpack:",inline"`
+}
+
+// StopService lists the routes serving a stop, busiest first. Stops nothing serves have no
+// routes.
+type StopService struct {
+	StopID string      `msgpack:"stop_id"`
+	Routes []StopRoute `msgpack:"routes"`
+}
+
+// StopServiceIndex is the reply to a 'stop:routes' request.
+type StopServiceIndex struct {
+	ProjectID string        `msgpack:"project_id"`
+	Day       string        `msgpack:"day"`
+	Date      string        `msgpack:"date,omitempty"`
+	Stops     []StopService `msgpack:"stops"`
+}
+
+// RouteStopsRequest is the payload of a 'route:stops' request, which lists the stops served
+// by each direction of a route. Day and Date are as in StopServiceRequest.
+type RouteStopsRequest struct {
+	RouteID string `msgpack:"route_id"`
+	Day     string `msgpack:"day"`
+	Date    string `msgpack:"date"`
+}
+
+// RouteStop is a stop served by a direction of a route.
+type RouteStop struct {
+	StopID         string `msgpack:"stop_id"`
+	ServiceSummary `msgpack:",inline"`
+}
+
+// RouteDirectionStops are the stops served by one direction of a route, in the order trips
+// usually visit them.
+type RouteDirectionStops struct {
+	DirectionID uint        `msgpack:"direction_id"`
+	Headsigns   []string    `msgpack:"headsigns"`
+	Stops       []RouteStop `msgpack:"stops"`
+}
+
+// RouteStopsIndex is the reply to a 'route:stops' request.
+type RouteStopsIndex struct {
+	RouteID    string                `msgpack:"route_id"`
+	Day        string                `msgpack:"day"`
+	Date       string                `msgpack:"date,omitempty"`
+	Directions []RouteDirectionStops `msgpack:"directions"`
+}
+
+// stopVisit is a trip, or one dispatch of a trip with frequencies, stopping at a stop. Weight
+// is how many times a day it happens on the day asked about. Position is how far through the
+// trip's stops the stop is, from 0 to 1. Time is nil for stops without times.
+type stopVisit struct {
+	stopID      string
+	routeID     string
+	directionID uint
+	headsign    string
+	time        *int
+	weight      float64
+	position    float64
+}
+
+// serviceTally accumulates stop visits into a ServiceSummary.
+type serviceTally struct {
+	trips       float64
+	first, last *int
+	headsigns   []string
+	position    float64
+}
+
+func (t *serviceTally) add(v stopVisit) {
+	t.trips += v.weight
+	t.position += v.weight * v.position
+	if v.time != nil {
+		if t.first == nil || *v.time < *t.first {
+			t.first = v.time
+		}
+		if t.last == nil || *v.time > *t.last {
+			t.last = v.time
+		}
+	}
+	if v.headsign == "" {
+		return
+	}
+	for _, h := range t.headsigns {
+		if h == v.headsign {
+			return
+		}
+	}
+	t.headsigns = append(t.headsigns, v.headsign)
+}
+
+func (t *serviceTally) summary() ServiceSummary {
+	ss := ServiceSummary{Trips: t.trips, FirstTrip: t.first, LastTrip: t.last}
+	if t.first != nil && t.trips > 1 {
+		ss.AverageHeadway = float64(*t.last-*t.first) / (t.trips - 1)
+	}
+	return ss
+}
+
+// serviceDayWeights works out how many times each service of a project runs on a day
+// ("weekday", "saturday" or "sunday"), or on a date if one is given.
+func serviceDayWeights(db *gorm.DB, projectID, day, date string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	if date != "" {
+		services, err := servicesOn(db, projectID, date)
+		if err != nil {
+			return nil, err
+		}
+		for id := range services {
+			weights[id] = 1
+		}
+		return weights, nil
+	}
+
+	serviceDays, err := loadServiceDays(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+	for id, days := range serviceDays {
+		switch day {
+		case "saturday":
+			if days.Weekdays[time.Saturday] {
+				weights[id] = 1
+			}
+		case "sunday":
+			if days.Weekdays[time.Sunday] {
+				weights[id] = 1
+			}
+		default:
+			for wd := time.Monday; wd <= time.Friday; wd++ {
+				if days.Weekdays[wd] {
+					weights[id] += 0.2
+				}
+			}
+		}
+	}
+	return weights, nil
+}
+
+// loadStopVisits finds every visit to a stop on a day by the trips of a project, or of just
+// one route if routeID is not empty. Stops where a trip neither picks up nor drops off are
+// passed through rather than visited.
+func loadStopVisits(db *gorm.DB, projectID, routeID, day, date string) ([]stopVisit, error) {
+	weights, err := serviceDayWeights(db, projectID, day, date)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		StopTimeInfo
+		RouteID     string
+		DirectionID uint
+		ServiceID   string
+		Headsign    string
+	}
+	q := db.Table("stop_times").
+		Select("stop_times.trip_id, stop_times.stop_id, trips.route_id, trips.direction_id, trips.service_id, "+
+			"trips.headsign, stop_times.stop_headsign, stop_times.arrival_time, stop_times.departure_time").
+		Joins("JOIN trips ON trips.id = stop_times.trip_id").
+		Where("stop_times.project_id = ?", projectID).
+		Where("NOT (stop_times.pickup_type = 1 AND stop_times.drop_off_type = 1)")
+	if routeID != "" {
+		q = q.Where("trips.route_id = ?", routeID)
+	}
+	if err := q.Order("stop_times.trip_id, stop_times.stop_sequence").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	var frequencies []FrequencyInfo
+	if err := db.Find(&frequencies, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	frequenciesByTrip := map[string][]FrequencyInfo{}
+	for _, f := range frequencies {
+		frequenciesByTrip[f.TripID] = append(frequenciesByTrip[f.TripID], f)
+	}
+
+	var visits []stopVisit
+	for start := 0; start < len(rows); {
+		end := start + 1
+		for end < len(rows) && rows[end].TripID == rows[start].TripID {
+			end++
+		}
+		trip := rows[start:end]
+		start = end
+
+		weight := weights[trip[0].ServiceID]
+		if weight == 0 {
+			continue
+		}
+
+		// Frequencies repeat the trip's times, shifted to each dispatch
+		origin := 0
+		for _, st := range trip {
+			if st.ArrivalTime != nil || st.DepartureTime != nil {
+				origin = stopTimeDeparture(st.StopTimeInfo)
+				break
+			}
+		}
+		dispatches := []int{origin}
+		if freqs := frequenciesByTrip[trip[0].TripID]; len(freqs) > 0 {
+			dispatches = nil
+			for _, f := range freqs {
+				for t := f.StartTime; f.HeadwaySecs > 0 && t < f.EndTime; t += int(f.HeadwaySecs) {
+					dispatches = append(dispatches, t)
+				}
+			}
+		}
+
+		for i, st := range trip {
+			v := stopVisit{
+				stopID:      st.StopID,
+				routeID:     st.RouteID,
+				directionID: st.DirectionID,
+				headsign:    st.Headsign,
+				weight:      weight,
+			}
+			if st.StopHeadsign != "" {
+				v.headsign = st.StopHeadsign
+			}
+			if len(trip) > 1 {
+				v.position = float64(i) / float64(len(trip)-1)
+			}
+
+			timed := st.ArrivalTime != nil || st.DepartureTime != nil
+			for _, dispatch := range dispatches {
+				if timed {
+					t := stopTimeDeparture(st.StopTimeInfo) - origin + dispatch
+					v.time = &t
+				}
+				visits = append(visits, v)
+			}
+		}
+	}
+	return visits, nil
+}
+
+// validServiceDay checks the day and date of a 'stop:routes' or 'route:stops' request.
+func validServiceDay(day, date string) error {
+	if day != "weekday" && day != "saturday" && day != "sunday" {
+		// TODO
+		return fmt.Errorf("day must be weekday, saturday, or sunday, not %q", day)
+	}
+	if date != "" && !isGTFSDate(date) {
+		// TODO
+		return fmt.Errorf("date must be formatted as YYYYMMDD, not %q", date)
+	}
+	return nil
+}
+
+func stopRoutes(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req StopServiceRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if req.Day == "" {
+		req.Day = "weekday"
+	}
+	if err := validServiceDay(req.Day, req.Date); err != nil {
+		return nil, err
+	}
+
+	stops, err := selectStops(s.Database, req.StopSelection)
+	if err != nil {
+		return nil, err
+	}
+	visits, err := loadStopVisits(s.Database, req.ProjectID, "", req.Day, req.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		stopID, routeID string
+		directionID     uint
+	}
+	tallies := map[key]*serviceTally{}
+	byStop := map[string][]key{}
+	for _, v := range visits {
+		k := key{v.stopID, v.routeID, v.directionID}
+		t := tallies[k]
+		if t == nil {
+			t = &serviceTally{}
+			tallies[k] = t
+			byStop[v.stopID] = append(byStop[v.stopID], k)
+		}
+		t.add(v)
+	}
+
+	index := StopServiceIndex{ProjectID: req.ProjectID, Day: req.Day, Date: req.Date, Stops: make([]StopService, len(stops))}
+	for i, stop := range stops {
+		ss := StopService{StopID: stop.ID, Routes: []StopRoute{}}
+		for _, k := range byStop[stop.ID] {
+			t := tallies[k]
+			ss.Routes = append(ss.Routes, StopRoute{
+				RouteID:        k.routeID,
+				DirectionID:    k.directionID,
+				Headsigns:      append([]string{}, t.headsigns...),
+				ServiceSummary: t.summary(),
+			})
+		}
+		sort.Slice(ss.Routes, func(a, b int) bool {
+			ra, rb := ss.Routes[a], ss.Routes[b]
+			if ra.Trips != rb.Trips {
+				return ra.Trips > rb.Trips
+			}
+			if ra.RouteID != rb.RouteID {
+				return ra.RouteID < rb.RouteID
+			}
+			return ra.DirectionID < rb.DirectionID
+		})
+		index.Stops[i] = ss
+	}
+
+	return index, nil
+}
+
+func routeStops(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req RouteStopsRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if req.Day == "" {
+		req.Day = "weekday"
+	}
+	if err := validServiceDay(req.Day, req.Date); err != nil {
+		return nil, err
+	}
+
+	route := RouteInfo{ID: req.RouteID}
+	if err := s.Database.Take(&route).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrorWithCode{
+				Code:    "route-not-found",
+				Message: fmt.Sprintf("there is no route with ID %q", req.RouteID),
+				Details: req.RouteID,
+			}
+		}
+		return nil, err
+	}
+
+	visits, err := loadStopVisits(s.Database, route.ProjectID, route.ID, req.Day, req.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		directionID uint
+		stopID      string
+	}
+	tallies := map[key]*serviceTally{}
+	directions := map[uint]*serviceTally{}
+	byDirection := map[uint][]key{}
+	for _, v := range visits {
+		k := key{v.directionID, v.stopID}
+		t := tallies[k]
+		if t == nil {
+			t = &serviceTally{}
+			tallies[k] = t
+			byDirection[v.directionID] = append(byDirection[v.directionID], k)
+		}
+		t.add(v)
+
+		if directions[v.directionID] == nil {
+			directions[v.directionID] = &serviceTally{}
+		}
+		directions[v.directionID].add(stopVisit{headsign: v.headsign})
+	}
+
+	index := RouteStopsIndex{RouteID: route.ID, Day: req.Day, Date: req.Date, Directions: []RouteDirectionStops{}}
+	for dir, keys := range byDirection {
+		rds := RouteDirectionStops{
+			DirectionID: dir,
+			Headsigns:   append([]string{}, directions[dir].headsigns...),
+			Stops:       make([]RouteStop, len(keys)),
+		}
+
+		// Put the stops in the order trips visit them, on average
+		sort.SliceStable(keys, func(a, b int) bool {
+			ta, tb := tallies[keys[a]], tallies[keys[b]]
+			return ta.position/ta.trips < tb.position/tb.trips
+		})
+		for i, k := range keys {
+			rds.Stops[i] = RouteStop{StopID: k.stopID, ServiceSummary: tallies[k].summary()}
+		}
+		index.Directions = append(index.Directions, rds)
+	}
+	sort.Slice(index.Directions, func(a, b int) bool {
+		return index.Directions[a].DirectionID < index.Directions[b].DirectionID
+	})
+
+	return index, nil
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Shapefile shape types. The Z and M variants carry extra per-point values, which are read
+// past and ignored.
+const (
+	ShapeNull        = 0
+	ShapePoint       = 1
+	ShapePolyLine    = 3
+	ShapePolygon     = 5
+	ShapeMultiPoint  = 8
+	ShapePointZ      = 11
+	ShapePolyLineZ   = 13
+	ShapePolygonZ    = 15
+	ShapeMultiPointZ = 18
+	ShapePointM      = 21
+	ShapePolyLineM   = 23
+	ShapePolygonM    = 25
+	ShapeMultiPointM = 28
+)
+
+// shpShape is a single record of a .shp file. Points holds the coordinates of point and
+// multipoint shapes, and Parts holds the lines or rings of polyline and polygon shapes.
+type shpShape struct {
+	Type   int
+	Points []LatLng
+	Parts  [][]LatLng
+}
+
+// dbfField describes a column of a .dbf file.
+type dbfField struct {
+	Name     string
+	Type     byte
+	Length   int
+	Decimals int
+}
+
+// shapefile is the contents of a .shp file and its .dbf attribute table. Shapes and Records
+// line up; a null shape is a nil entry.
+type shapefile struct {
+	Shapes  []*shpShape
+	Fields  []dbfField
+	Records []map[string]string
+}
+
+// shapefileFiles are the raw member files of a zipped shapefile.
+type shapefileFiles struct {
+	Name string
+	SHP  []byte
+	DBF  []byte
+	PRJ  []byte
+}
+
+// findShapefile picks the first .shp file out of a zip archive along with its sibling files,
+// which share its base name.
+func findShapefile(data []byte) (*shapefileFiles, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-shapefile",
+			Message: "shapefiles must be uploaded as a zip file",
+			Details: err.Error(),
+		}
+	}
+
+	members := map[string]*zip.File{}
+	var base string
+	for _, f := range zr.File {
+		lower := strings.ToLower(f.Name)
+		if strings.HasPrefix(path.Base(lower), "._") {
+			continue // macOS resource forks
+		}
+		members[lower] = f
+		if base == "" && strings.HasSuffix(lower, ".shp") {
+			base = strings.TrimSuffix(lower, ".shp")
+		}
+	}
+	if base == "" {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-shapefile",
+			Message: "zip file does not contain a .shp file",
+		}
+	}
+
+	read := func(ext string, required bool) ([]byte, error) {
+		f := members[base+ext]
+		if f == nil {
+			if required {
+				return nil, &ErrorWithCode{
+					Code:    "invalid-shapefile",
+					Message: fmt.Sprintf("zip file is missing %s%s", path.Base(base), ext),
+				}
+			}
+			return nil, nil
+		}
+		return readZipFile(f, MaxUploadBytes)
+	}
+
+	files := &shapefileFiles{Name: path.Base(members[base+".shp"].Name)}
+	files.Name = strings.TrimSuffix(files.Name, path.Ext(files.Name))
+	if files.SHP, err = read(".shp", true); err != nil {
+		return nil, err
+	}
+	if files.DBF, err = read(".dbf", true); err != nil {
+		return nil, err
+	}
+	if files.PRJ, err = read(".prj", false); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// readShapefile parses a shapefile, converting its coordinates to longitude and latitude
+// according to its .prj file. Shapefiles without a .prj file are assumed to be in longitude and
+// latitude already.
+func readShapefile(files *shapefileFiles) (*shapefile, error) {
+	cs, err := parsePRJ(files.PRJ)
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "unsupported-projection",
+			Message: fmt.Sprintf("the coordinate system of %s.prj is not supported: %v", files.Name, err),
+			Details: string(files.PRJ),
+		}
+	}
+
+	shapes, err := readSHP(files.SHP, cs)
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-shapefile",
+			Message: fmt.Sprintf("failed to read %s.shp: %v", files.Name, err),
+		}
+	}
+	fields, records, err := readDBF(files.DBF)
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-shapefile",
+			Message: fmt.Sprintf("failed to read %s.dbf: %v", files.Name, err),
+		}
+	}
+	if len(shapes) != len(records) {
+		return nil, &ErrorWithCode{
+			Code: "invalid-shapefile",
+			Message: fmt.Sprintf(
+				"%s.shp has %d shapes but %s.dbf has %d records",
+				files.Name, len(shapes), files.Name, len(records),
+			),
+		}
+	}
+
+	return &shapefile{shapes, fields, records}, nil
+}
+
+// readSHP parses the geometry of a .shp file whose coordinates are in the given system.
+func readSHP(data []byte, cs *coordSystem) ([]*shpShape, error) {
+	if len(data) < 100 || binary.BigEndian.Uint32(data[0:4]) != 9994 {
+		return nil, errors.New("not a shapefile")
+	}
+
+	var shapes []*shpShape
+	for off := 100; off+8 <= len(data); {
+		contentLen := int(binary.BigEndian.Uint32(data[off+4:off+8])) * 2
+		off += 8
+		if contentLen < 4 || off+contentLen > len(data) {
+			return nil, fmt.Errorf("record %d is truncated", len(shapes)+1)
+		}
+
+		shape, err := readSHPRecord(data[off:off+contentLen], cs)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", len(shapes)+1, err)
+		}
+		shapes = append(shapes, shape)
+		off += contentLen
+	}
+
+	return shapes, nil
+}
+
+func readSHPRecord(rec []byte, cs *coordSystem) (*shpShape, error) {
+	shapeType := int(binary.LittleEndian.Uint32(rec[0:4]))
+	rec = rec[4:]
+
+	point := func(b []byte) LatLng {
+		x := math.Float64frombits(binary.LittleEndian.Uint64(b[0:8]))
+		y := math.Float64frombits(binary.LittleEndian.Uint64(b[8:16]))
+		return cs.toLatLng(x, y)
+	}
+	truncated := errors.New("shape is truncated")
+
+	switch shapeType {
+	case ShapeNull:
+		return nil, nil
+
+	case ShapePoint, ShapePointZ, ShapePointM:
+		if len(rec) < 16 {
+			return nil, truncated
+		}
+		return &shpShape{Type: ShapePoint, Points: []LatLng{point(rec)}}, nil
+
+	case ShapeMultiPoint, ShapeMultiPointZ, ShapeMultiPointM:
+		// Bounding box, then the number of points, then the points
+		if len(rec) < 36 {
+			return nil, truncated
+		}
+		n := int(binary.LittleEndian.Uint32(rec[32:36]))
+		if n < 0 || len(rec) < 36+16*n {
+			return nil, truncated
+		}
+		shape := &shpShape{Type: ShapeMultiPoint, Points: make([]LatLng, n)}
+		for i := range shape.Points {
+			shape.Points[i] = point(rec[36+16*i:])
+		}
+		return shape, nil
+
+	case ShapePolyLine, ShapePolyLineZ, ShapePolyLineM, ShapePolygon, ShapePolygonZ, ShapePolygonM:
+		// Bounding box, the number of parts and points, the index of each part's first point,
+		// then the points
+		if len(rec) < 40 {
+			return nil, truncated
+		}
+		numParts := int(binary.LittleEndian.Uint32(rec[32:36]))
+		numPoints := int(binary.LittleEndian.Uint32(rec[36:40]))
+		pointsOff := 40 + 4*numParts
+		if numParts < 0 || numPoints < 0 || len(rec) < pointsOff+16*numPoints {
+			return nil, truncated
+		}
+
+		shape := &shpShape{Type: ShapePolyLine, Parts: make([][]LatLng, numParts)}
+		if shapeType == ShapePolygon || shapeType == ShapePolygonZ || shapeType == ShapePolygonM {
+			shape.Type = ShapePolygon
+		}
+
+		for p := 0; p < numParts; p++ {
+			start := int(binary.LittleEndian.Uint32(rec[40+4*p:]))
+			end := numPoints
+			if p+1 < numParts {
+				end = int(binary.LittleEndian.Uint32(rec[40+4*(p+1):]))
+			}
+			if start < 0 || end > numPoints || start > end {
+				return nil, errors.New("shape has invalid part indices")
+			}
+			part := make([]LatLng, end-start)
+			for i := range part {
+				part[i] = point(rec[pointsOff+16*(start+i):])
+			}
+			shape.Parts[p] = part
+		}
+		return shape, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported shape type %d", shapeType)
+	}
+}
+
+// readDBF parses a dBASE table. Values are returned as trimmed strings keyed by field name.
+func readDBF(data []byte) ([]dbfField, []map[string]string, error) {
+	if len(data) < 32 {
+		return nil, nil, errors.New("not a dBASE file")
+	}
+
+	numRecords := int(binary.LittleEndian.Uint32(data[4:8]))
+	headerLen := int(binary.LittleEndian.Uint16(data[8:10]))
+	recordLen := int(binary.LittleEndian.Uint16(data[10:12]))
+	if headerLen > len(data) || recordLen < 1 {
+		return nil, nil, errors.New("dBASE header is corrupt")
+	}
+	// The record count comes from the file, so it must fit in the file before it is trusted
+	if numRecords < 0 || numRecords > (len(data)-headerLen)/recordLen {
+		return nil, nil, fmt.Errorf("dBASE file is too short for its %d records", numRecords)
+	}
+
+	var fields []dbfField
+	for off := 32; off+32 <= headerLen && data[off] != 0x0D; off += 32 {
+		desc := data[off : off+32]
+		name := desc[:11]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		fields = append(fields, dbfField{
+			Name:     strings.TrimSpace(string(name)),
+			Type:     desc[11],
+			Length:   int(desc[16]),
+			Decimals: int(desc[17]),
+		})
+	}
+
+	var records []map[string]string
+	for r := 0; r < numRecords; r++ {
+		off := headerLen + r*recordLen
+		rec := data[off : off+recordLen]
+
+		// The first byte is the deletion flag. Deleted records still have a shape, so they are
+		// kept (empty) to stay lined up with the .shp file.
+		values := make(map[string]string, len(fields))
+		if rec[0] != '*' {
+			pos := 1
+			for _, f := range fields {
+				if pos+f.Length > len(rec) {
+					break
+				}
+				values[f.Name] = strings.TrimSpace(string(rec[pos : pos+f.Length]))
+				pos += f.Length
+			}
+		}
+		records = append(records, values)
+	}
+
+	return fields, records, nil
+}
+
+// geometry converts a shape to a geometry, keeping all of its parts and the holes of polygons.
+func (shape *shpShape) geometry() Geometry {
+	switch shape.Type {
+	case ShapePoint:
+		return Geometry{Type: GeometryPoint, Point: shape.Points[0]}
+	case ShapeMultiPoint:
+		return Geometry{Type: GeometryMultiPoint, MultiPoint: shape.Points}
+	case ShapePolyLine:
+		if len(shape.Parts) == 1 {
+			return Geometry{Type: GeometryLineString, LineString: shape.Parts[0]}
+		}
+		lines := make([]LineString, len(shape.Parts))
+		for i, part := range shape.Parts {
+			lines[i] = part
+		}
+		return Geometry{Type: GeometryMultiLineString, MultiLineString: lines}
+	default:
+		polys := shape.polygons()
+		if len(polys) == 1 {
+			return Geometry{Type: GeometryPolygon, Polygon: polys[0]}
+		}
+		return Geometry{Type: GeometryMultiPolygon, MultiPolygon: polys}
+	}
+}
+
+// polygons assembles the rings of a polygon shape into polygons with holes. Shapefile outer
+// rings are clockwise and holes are counter-clockwise.
+func (shape *shpShape) polygons() MultiPolygon {
+	var outers, holes [][][2]float64
+	for _, part := range shape.Parts {
+		if n := len(part); n > 1 && part[0] == part[n-1] {
+			part = part[:n-1]
+		}
+		if len(part) < 3 {
+			continue
+		}
+
+		ring := make([][2]float64, len(part))
+		for i, c := range part {
+			ring[i] = [2]float64{c.Lng, c.Lat}
+		}
+		if signedArea(ring) < 0 {
+			outers = append(outers, ring)
+		} else {
+			holes = append(holes, ring)
+		}
+	}
+
+	// Some writers get the winding backwards; treat lone "holes" as outer rings
+	if len(outers) == 0 {
+		outers, holes = holes, nil
+	}
+
+	polys := make([][][][2]float64, len(outers))
+	for i, outer := range outers {
+		polys[i] = [][][2]float64{outer}
+	}
+	for _, hole := range holes {
+		for i, outer := range outers {
+			if pointInRing(hole[0], outer) {
+				polys[i] = append(polys[i], hole)
+				break
+			}
+		}
+	}
+
+	// Our own convention is the opposite winding, so every ring is reversed
+	result := make(MultiPolygon, len(polys))
+	for i, rings := range polys {
+		result[i] = make(Polygon, len(rings))
+		for r, ring := range rings {
+			coords := make([]LatLng, len(ring))
+			for k, pt := range ring {
+				coords[len(ring)-1-k] = LatLng{pt[1], pt[0]}
+			}
+			result[i][r] = coords
+		}
+	}
+	return result
+}
+
+// polygonShape is the inverse of polygons: it turns polygons back into the rings of a
+// polygon shape, winding and closing them the way shapefiles expect.
+func polygonShape(mp MultiPolygon) *shpShape {
+	shape := &shpShape{Type: ShapePolygon}
+	for _, poly := range mp {
+		for _, ring := range poly {
+			if len(ring) < 3 {
+				continue
+			}
+			part := make([]LatLng, 0, len(ring)+1)
+			for k := len(ring) - 1; k >= 0; k-- {
+				part = append(part, ring[k])
+			}
+			shape.Parts = append(shape.Parts, append(part, part[0]))
+		}
+	}
+	if len(shape.Parts) == 0 {
+		return nil
+	}
+	return shape
+}
+
+// writeShapefile adds the .shp, .shx, .dbf and .prj files of a shapefile named name to a zip
+// archive. Every shape must have the given type or be nil, and coordinates are written as
+// WGS84 longitude and latitude. Fields without a Length are sized to fit their longest
+// value. Values are written as given, so numbers must already be formatted, and text is
+// UTF-8 (which a .cpg file says).
+func writeShapefile(zw *zip.Writer, name string, shapeType int, sf *shapefile) error {
+	// Geometry, and the index of where each record is
+	var shp, shx bytes.Buffer
+	shp.Write(make([]byte, 100))
+	shx.Write(make([]byte, 100))
+
+	// Bounding boxes are xmin, ymin, xmax, ymax
+	empty := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	extend := func(box *[4]float64, c LatLng) {
+		*box = [4]float64{math.Min(box[0], c.Lng), math.Min(box[1], c.Lat), math.Max(box[2], c.Lng), math.Max(box[3], c.Lat)}
+	}
+	bounds := empty
+
+	le := binary.LittleEndian
+	for i, shape := range sf.Shapes {
+		var content bytes.Buffer
+		switch {
+		case shape == nil:
+			binary.Write(&content, le, int32(ShapeNull))
+
+		case shapeType == ShapePoint:
+			binary.Write(&content, le, int32(ShapePoint))
+			binary.Write(&content, le, [2]float64{shape.Points[0].Lng, shape.Points[0].Lat})
+			extend(&bounds, shape.Points[0])
+
+		default:
+			box, numPoints := empty, 0
+			for _, part := range shape.Parts {
+				for _, c := range part {
+					extend(&box, c)
+					extend(&bounds, c)
+				}
+				numPoints += len(part)
+			}
+
+			binary.Write(&content, le, int32(shapeType))
+			binary.Write(&content, le, box)
+			binary.Write(&content, le, int32(len(shape.Parts)))
+			binary.Write(&content, le, int32(numPoints))
+			start := 0
+			for _, part := range shape.Parts {
+				binary.Write(&content, le, int32(start))
+				start += len(part)
+			}
+			for _, part := range shape.Parts {
+				for _, c := range part {
+					binary.Write(&content, le, [2]float64{c.Lng, c.Lat})
+				}
+			}
+		}
+
+		binary.Write(&shx, binary.BigEndian, [2]int32{int32(shp.Len() / 2), int32(content.Len() / 2)})
+		binary.Write(&shp, binary.BigEndian, [2]int32{int32(i + 1), int32(content.Len() / 2)})
+		shp.Write(content.Bytes())
+	}
+
+	if bounds == empty {
+		bounds = [4]float64{}
+	}
+	for _, buf := range []*bytes.Buffer{&shp, &shx} {
+		header := buf.Bytes()[:100]
+		binary.BigEndian.PutUint32(header[0:4], 9994)
+		binary.BigEndian.PutUint32(header[24:28], uint32(buf.Len()/2))
+		le.PutUint32(header[28:32], 1000)
+		le.PutUint32(header[32:36], uint32(shapeType))
+		for k, v := range bounds {
+			le.PutUint64(header[36+8*k:], math.Float64bits(v))
+		}
+	}
+
+	// Attributes
+	fields := make([]dbfField, len(sf.Fields))
+	copy(fields, sf.Fields)
+	for f := range fields {
+		if fields[f].Length > 0 {
+			continue
+		}
+		fields[f].Length = 1
+		for _, rec := range sf.Records {
+			if n := len(rec[fields[f].Name]); n > fields[f].Length {
+				fields[f].Length = n
+			}
+		}
+		if fields[f].Length > 254 {
+			fields[f].Length = 254
+		}
+	}
+
+	recordLen := 1
+	for _, f := range fields {
+		recordLen += f.Length
+	}
+
+	var dbf bytes.Buffer
+	now := time.Now()
+	dbf.Write([]byte{0x03, byte(now.Year() - 1900), byte(now.Month()), byte(now.Day())})
+	binary.Write(&dbf, le, uint32(len(sf.Records)))
+	binary.Write(&dbf, le, uint16(32+32*len(fields)+1))
+	binary.Write(&dbf, le, uint16(recordLen))
+	dbf.Write(make([]byte, 20))
+	for _, f := range fields {
+		desc := make([]byte, 32)
+		copy(desc[:10], f.Name)
+		desc[11] = f.Type
+		desc[16] = byte(f.Length)
+		desc[17] = byte(f.Decimals)
+		dbf.Write(desc)
+	}
+	dbf.WriteByte(0x0D)
+
+	for _, rec := range sf.Records {
+		dbf.WriteByte(' ')
+		for _, f := range fields {
+			v := rec[f.Name]
+			for len(v) > f.Length || !utf8.ValidString(v) {
+				v = v[:len(v)-1] // don't cut characters in half
+			}
+			pad := strings.Repeat(" ", f.Length-len(v))
+			if f.Type == 'N' || f.Type == 'F' {
+				dbf.WriteString(pad + v)
+			} else {
+				dbf.WriteString(v + pad)
+			}
+		}
+	}
+	dbf.WriteByte(0x1A)
+
+	for _, member := range []struct {
+		ext  string
+		data []byte
+	}{
+		{".shp", shp.Bytes()},
+		{".shx", shx.Bytes()},
+		{".dbf", dbf.Bytes()},
+		{".prj", []byte(wgs84PRJ)},
+		{".cpg", []byte("UTF-8")},
+	} {
+		w, err := zw.Create(name + member.ext)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(member.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ShapefileExportRequest is the payload of a 'shapefile:export' request. Layers lists which
+// shapefiles go in the zip file: "stops" (points) and/or "routes" (a line for each pattern,
+// following its shape, or else straight from stop to stop). Both are included by default.
+type ShapefileExportRequest struct {
+	ProjectID string   `msgpack:"project_id"`
+	Layers    []string `msgpack:"layers"`
+}
+
+func exportShapefiles(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req ShapefileExportRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, req.ProjectID); err != nil {
+		return nil, err
+	}
+
+	var proj ProjectInfo
+	if err := s.Database.Take(&proj, "id = ?", req.ProjectID).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	layers := req.Layers
+	if len(layers) == 0 {
+		layers = []string{"stops", "routes"}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, layer := range layers {
+		var (
+			shapeType int
+			sf        *shapefile
+			err       error
+		)
+		switch layer {
+		case "stops":
+			shapeType = ShapePoint
+			sf, err = stopsShapefile(s, req.ProjectID)
+		case "routes":
+			shapeType = ShapePolyLine
+			sf, err = routesShapefile(s, req.ProjectID)
+		default:
+			return nil, &ErrorWithCode{
+				Code:    "invalid-layer",
+				Message: fmt.Sprintf("%q is not a layer that can be exported; choose stops or routes", layer),
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := writeShapefile(zw, layer, shapeType, sf); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	dl, err := s.addDownload(fileNameFor(proj.Name, "shapefiles")+".zip", "application/zip", buf.Bytes())
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	return dl, nil
+}
+
+// stopsShapefile lays out a project's stops as a point shapefile.
+func stopsShapefile(s *Server, projectID string) (*shapefile, error) {
+	var stops []StopInfo
+	if err := s.Database.Order("name, id").Find(&stops, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+
+	sf := &shapefile{Fields: []dbfField{
+		{Name: "STOP_ID", Type: 'C'},
+		{Name: "STOP_CODE", Type: 'C'},
+		{Name: "STOP_NAME", Type: 'C'},
+		{Name: "STOP_DESC", Type: 'C'},
+		{Name: "WHEELCHAIR", Type: 'N'},
+		{Name: "LAT", Type: 'N', Length: 12, Decimals: 7},
+		{Name: "LON", Type: 'N', Length: 12, Decimals: 7},
+	}}
+	for _, stop := range stops {
+		sf.Shapes = append(sf.Shapes, &shpShape{Type: ShapePoint, Points: []LatLng{{stop.Lat, stop.Lng}}})
+		sf.Records = append(sf.Records, map[string]string{
+			"STOP_ID":    stop.ID,
+			"STOP_CODE":  stop.Code,
+			"STOP_NAME":  stop.Name,
+			"STOP_DESC":  stop.Description,
+			"WHEELCHAIR": strconv.FormatUint(uint64(stop.WheelchairBoarding), 10),
+			"LAT":        strconv.FormatFloat(stop.Lat, 'f', 7, 64),
+			"LON":        strconv.FormatFloat(stop.Lng, 'f', 7, 64),
+		})
+	}
+	return sf, nil
+}
+
+// routesShapefile lays out the patterns of a project's routes as a line shapefile. Patterns
+// with neither a shape nor two stops are left out.
+func routesShapefile(s *Server, projectID string) (*shapefile, error) {
+	var routes []RouteInfo
+	if err := s.Database.Order("sort_order, short_name, long_name, id").Find(&routes, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	var patterns []PatternInfo
+	if err := s.Database.Order("direction_id, name, id").Find(&patterns, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	if err := loadPatternStops(s.Database, patterns); err != nil {
+		return nil, err
+	}
+	var stops []StopInfo
+	if err := s.Database.Find(&stops, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	var shapes []PathInfo
+	if err := s.Database.Find(&shapes, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+
+	stopsByID := make(map[string]StopInfo, len(stops))
+	for _, stop := range stops {
+		stopsByID[stop.ID] = stop
+	}
+	shapesByID := make(map[string]PathInfo, len(shapes))
+	for _, shape := range shapes {
+		shapesByID[shape.ID] = shape
+	}
+	patternsByRoute := map[string][]PatternInfo{}
+	for _, p := range patterns {
+		patternsByRoute[p.RouteID] = append(patternsByRoute[p.RouteID], p)
+	}
+
+	sf := &shapefile{Fields: []dbfField{
+		{Name: "ROUTE_ID", Type: 'C'},
+		{Name: "SHORT_NAME", Type: 'C'},
+		{Name: "LONG_NAME", Type: 'C'},
+		{Name: "COLOR", Type: 'C'},
+		{Name: "PATTERN_ID", Type: 'C'},
+		{Name: "PATTERN", Type: 'C'},
+		{Name: "DIRECTION", Type: 'N'},
+		{Name: "STOPS", Type: 'N'},
+		{Name: "LENGTH_M", Type: 'N', Decimals: 1},
+	}}
+	for _, route := range routes {
+		for _, p := range patternsByRoute[route.ID] {
+			var line []LatLng
+			if shape, ok := shapesByID[p.ShapeID]; ok {
+				line = shape.Coords
+			}
+			if len(line) < 2 {
+				line = nil
+				for _, id := range p.StopIDs {
+					if stop, ok := stopsByID[id]; ok {
+						line = append(line, LatLng{stop.Lat, stop.Lng})
+					}
+				}
+			}
+			if len(line) < 2 {
+				continue
+			}
+
+			sf.Shapes = append(sf.Shapes, &shpShape{Type: ShapePolyLine, Parts: [][]LatLng{line}})
+			sf.Records = append(sf.Records, map[string]string{
+				"ROUTE_ID":   route.ID,
+				"SHORT_NAME": route.ShortName,
+				"LONG_NAME":  route.LongName,
+				"COLOR":      route.Color,
+				"PATTERN_ID": p.ID,
+				"PATTERN":    p.Name,
+				"DIRECTION":  strconv.FormatUint(uint64(p.DirectionID), 10),
+				"STOPS":      strconv.Itoa(len(p.StopIDs)),
+				"LENGTH_M":   strconv.FormatFloat(lineLength(line), 'f', 1, 64),
+			})
+		}
+	}
+	return sf, nil
+}
+
+// addPolygonDownload makes the polygons of an analysis available for download as a zipped
+// shapefile, with a record (and row of attributes) for each of them.
+func (s *Server) addPolygonDownload(name string, fields []dbfField, polygons []MultiPolygon, records []map[string]string) (*DownloadInfo, error) {
+	sf := &shapefile{Fields: fields, Records: records}
+	for _, mp := range polygons {
+		sf.Shapes = append(sf.Shapes, polygonShape(mp))
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if err := writeShapefile(zw, name, ShapePolygon, sf); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return s.addDownload(name+".zip", "application/zip", buf.Bytes())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ShapefileImportParams are the upload ticket parameters for the "shapefile" upload kind,
+// which takes a zipped shapefile (.shp, .shx and .dbf, plus a .prj unless the coordinates are
+// longitude and latitude). Its records become features of the project: points become stops,
+// lines become line paths and polygons become closed paths. Records with several parts
+// become one feature per part.
+//
+// NameField, CodeField and DescriptionField pick the attributes the features are named and
+// described by. Each one defaults to the first of a few common field names that the file has.
+type ShapefileImportParams struct {
+	ProjectID        string `msgpack:"project_id"`
+	NameField        string `msgpack:"name_field"`
+	CodeField        string `msgpack:"code_field"`
+	DescriptionField string `msgpack:"description_field"`
+}
+
+// importShapefile adds the records of a zipped shapefile to a project.
+func importShapefile(s *Server, u *UserConn, params []byte, data []byte) (any, error) {
+	var p ShapefileImportParams
+	if err := msgpack.Unmarshal(params, &p); err != nil {
+		// TODO
+		return nil, err
+	}
+	if err := requireProject(s.Database, p.ProjectID); err != nil {
+		return nil, err
+	}
+
+	files, err := findShapefile(data)
+	if err != nil {
+		return nil, err
+	}
+	sf, err := readShapefile(files)
+	if err != nil {
+		return nil, err
+	}
+
+	pick := func(field string, defaults ...string) (string, error) {
+		if field == "" {
+			return firstField(sf.Fields, defaults...), nil
+		}
+		if found := firstField(sf.Fields, field); found != "" {
+			return found, nil
+		}
+		return "", &ErrorWithCode{
+			Code:    "invalid-shapefile",
+			Message: "shapefile has no field named " + field,
+		}
+	}
+	nameField, err := pick(p.NameField, "NAME", "STOP_NAME", "LABEL", "TITLE")
+	if err != nil {
+		return nil, err
+	}
+	codeField, err := pick(p.CodeField, "STOP_CODE", "CODE")
+	if err != nil {
+		return nil, err
+	}
+	descField, err := pick(p.DescriptionField, "DESC", "STOP_DESC", "DESCRIPTIO")
+	if err != nil {
+		return nil, err
+	}
+
+	report := FeatureImportReport{ProjectID: p.ProjectID, Errors: []string{}}
+	var stops []StopInfo
+	var paths []PathInfo
+
+	for i, shape := range sf.Shapes {
+		rec := sf.Records[i]
+		name := rec[nameField]
+		if shape == nil {
+			report.Skipped++
+			report.addError("record %d has no shape", i+1)
+			continue
+		}
+
+		switch shape.Type {
+		case ShapePoint, ShapeMultiPoint:
+			for _, pt := range shape.Points {
+				id, err := uuid.NewRandom()
+				if err != nil {
+					// TODO
+					return nil, err
+				}
+				stops = append(stops, StopInfo{
+					ID:          id.String(),
+					ProjectID:   p.ProjectID,
+					Code:        rec[codeField],
+					Name:        name,
+					Description: rec[descField],
+					Lat:         pt.Lat,
+					Lng:         pt.Lng,
+				})
+			}
+
+		case ShapePolyLine:
+			if len(shape.Parts) == 0 {
+				report.Skipped++
+				report.addError("record %d has no lines", i+1)
+				continue
+			}
+			lines := 0
+			for _, part := range shape.Parts {
+				if len(part) < 2 {
+					report.addError("record %d has a line with fewer than two points", i+1)
+					continue
+				}
+				path, err := newPathInfo(p.ProjectID, name, true, part, PathStyles{})
+				if err != nil {
+					// TODO
+					return nil, err
+				}
+				paths = append(paths, path)
+				lines++
+			}
+			if lines == 0 {
+				report.Skipped++
+			}
+
+		case ShapePolygon:
+			polys := shape.polygons()
+			if len(polys) == 0 {
+				report.Skipped++
+				report.addError("record %d has no rings", i+1)
+				continue
+			}
+			for _, poly := range polys {
+				path, err := newPathInfo(p.ProjectID, name, false, poly[0], PathStyles{})
+				if err != nil {
+					// TODO
+					return nil, err
+				}
+				path.Holes = holesOf(poly)
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	if err := saveImportedFeatures(s.Database, stops, paths, nil); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	report.Stops, report.Paths = len(stops), len(paths)
+	s.publish(u, ProjectEvent{ProjectID: p.ProjectID, Type: "shapefile:imported", Data: report})
+
+	return report, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// buildDBF builds a dBASE table of character fields, each record a list of values (or nil for
+// a deleted record). The record count in the header can be overridden to make corrupt files.
+func buildDBF(fields []dbfField, records [][]string, numRecords uint32) []byte {
+	headerLen := 32 + 32*len(fields) + 1
+	recordLen := 1
+	for _, f := range fields {
+		recordLen += f.Length
+	}
+
+	data := make([]byte, 32, headerLen+recordLen*len(records)+1)
+	data[0] = 3
+	binary.LittleEndian.PutUint32(data[4:], numRecords)
+	binary.LittleEndian.PutUint16(data[8:], uint16(headerLen))
+	binary.LittleEndian.PutUint16(data[10:], uint16(recordLen))
+	for _, f := range fields {
+		desc := make([]byte, 32)
+		copy(desc, f.Name)
+		desc[11] = 'C'
+		desc[16] = byte(f.Length)
+		data = append(data, desc...)
+	}
+	data = append(data, 0x0D)
+
+	for _, rec := range records {
+		if rec == nil {
+			data = append(data, '*')
+			for _, f := range fields {
+				data = append(data, make([]byte, f.Length)...)
+			}
+			continue
+		}
+		data = append(data, ' ')
+		for i, f := range fields {
+			value := make([]byte, f.Length)
+			for j := range value {
+				value[j] = ' '
+			}
+			copy(value, rec[i])
+			data = append(data, value...)
+		}
+	}
+	return append(data, 0x1A)
+}
+
+func TestReadDBF(t *testing.T) {
+	fields := []dbfField{{Name: "NAME", Type: 'C', Length: 10}, {Name: "CODE", Type: 'C', Length: 4}}
+	valid := buildDBF(fields, [][]string{{"Main St", "12"}, nil, {"Oak Ave", ""}}, 3)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		records []map[string]string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			data: valid,
+			records: []map[string]string{
+				{"NAME": "Main St", "CODE": "12"},
+				{},
+				{"NAME": "Oak Ave", "CODE": ""},
+			},
+		},
+		{
+			name: "no records",
+			data: buildDBF(fields, nil, 0),
+		},
+		{
+			name:    "too short for a header",
+			data:    valid[:31],
+			wantErr: true,
+		},
+		{
+			// A 33-byte file claiming 0xFFFFFFFF records must not allocate room for them
+			name:    "huge record count",
+			data:    append(buildDBF(nil, nil, math.MaxUint32)[:32], 0x0D),
+			wantErr: true,
+		},
+		{
+			name:    "more records than fit",
+			data:    buildDBF(fields, [][]string{{"Main St", "12"}}, 2),
+			wantErr: true,
+		},
+		{
+			name:    "truncated record",
+			data:    valid[:len(valid)-5],
+			wantErr: true,
+		},
+		{
+			name: "header longer than the file",
+			data: func() []byte {
+				data := append([]byte{}, valid...)
+				binary.LittleEndian.PutUint16(data[8:], uint16(len(data)+1))
+				return data
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "zero record length",
+			data: func() []byte {
+				data := append([]byte{}, valid...)
+				binary.LittleEndian.PutUint16(data[10:], 0)
+				return data
+			}(),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotFields, records, err := readDBF(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d records", len(records))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(gotFields, fields) {
+				t.Errorf("fields = %v, want %v", gotFields, fields)
+			}
+			if !reflect.DeepEqual(records, tt.records) {
+				t.Errorf("records = %v, want %v", records, tt.records)
+			}
+		})
+	}
+}
+
+// buildSHP builds a .shp file from the contents of its records.
+func buildSHP(records ...[]byte) []byte {
+	data := make([]byte, 100)
+	binary.BigEndian.PutUint32(data, 9994)
+	for i, rec := range records {
+		hdr := make([]byte, 8)
+		binary.BigEndian.PutUint32(hdr, uint32(i+1))
+		binary.BigEndian.PutUint32(hdr[4:], uint32(len(rec)/2))
+		data = append(append(data, hdr...), rec...)
+	}
+	binary.BigEndian.PutUint32(data[24:], uint32(len(data)/2))
+	return data
+}
+
+// polyLineRecord builds the contents of a PolyLine record. numPoints is written as given, so
+// it can disagree with the points.
+func polyLineRecord(parts []uint32, numPoints uint32, points ...float64) []byte {
+	rec := make([]byte, 44+4*len(parts)+8*len(points))
+	binary.LittleEndian.PutUint32(rec, uint32(ShapePolyLine))
+	binary.LittleEndian.PutUint32(rec[36:], uint32(len(parts)))
+	binary.LittleEndian.PutUint32(rec[40:], numPoints)
+	for i, p := range parts {
+		binary.LittleEndian.PutUint32(rec[44+4*i:], p)
+	}
+	for i, v := range points {
+		binary.LittleEndian.PutUint64(rec[44+4*len(parts)+8*i:], math.Float64bits(v))
+	}
+	return rec
+}
+
+func TestReadSHP(t *testing.T) {
+	line := polyLineRecord([]uint32{0}, 2, -75, 40, -74, 41)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		parts   [][]LatLng
+		wantErr bool
+	}{
+		{
+			name:  "polyline",
+			data:  buildSHP(line),
+			parts: [][]LatLng{{{40, -75}, {41, -74}}},
+		},
+		{
+			name:    "not a shapefile",
+			data:    make([]byte, 100),
+			wantErr: true,
+		},
+		{
+			name:    "record longer than the file",
+			data:    buildSHP(line)[:len(buildSHP(line))-8],
+			wantErr: true,
+		},
+		{
+			name:    "more points than the record holds",
+			data:    buildSHP(polyLineRecord([]uint32{0}, 1000, -75, 40, -74, 41)),
+			wantErr: true,
+		},
+		{
+			name:    "part indices cut off",
+			data:    buildSHP(polyLineRecord([]uint32{0}, 2, -75, 40, -74, 41)[:40]),
+			wantErr: true,
+		},
+		{
+			name:    "part index past the points",
+			data:    buildSHP(polyLineRecord([]uint32{5}, 2, -75, 40, -74, 41)),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shapes, err := readSHP(tt.data, geographicCoords)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %d shapes", len(shapes))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(shapes) != 1 || !reflect.DeepEqual(shapes[0].Parts, tt.parts) {
+				t.Errorf("shapes = %v, want one with parts %v", shapes, tt.parts)
+			}
+		})
+	}
+}
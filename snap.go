@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxSnapDistance is the farthest (in meters) a stop or via point may be from the nearest
+	// street for the path to be routed through it.
+	MaxSnapDistance = 150
+	// snapSearchMargin is the least distance (in meters) around the stops within which streets
+	// are searched for a path. Paths that need bigger detours are not found.
+	snapSearchMargin = 1500
+)
+
+// SnapVia is a point the path must pass through after the stop at index After (of the
+// pattern or request) and before the next one.
+type SnapVia struct {
+	After int    `msgpack:"after"`
+	Point LatLng `msgpack:"point"`
+}
+
+// PathSnapRequest is the payload of a 'path:snap' request, which routes a bus path along the
+// imported street network through a sequence of stops. The stops are either those of a
+// pattern or listed explicitly with the project they belong to.
+//
+// The path is saved to PathID if given, otherwise to the pattern's shape, otherwise to a new
+// path named Name; a pattern without a shape is given the new path. Preview computes the path
+// without saving anything. Avoid lists street classes (OpenStreetMap highway tags like
+// "residential") the path should stay off.
+type PathSnapRequest struct {
+	PatternID string    `msgpack:"pattern_id"`
+	ProjectID string    `msgpack:"project_id"`
+	StopIDs   []string  `msgpack:"stop_ids"`
+	Vias      []SnapVia `msgpack:"vias"`
+	Avoid     []string  `msgpack:"avoid"`
+	PathID    string    `msgpack:"path_id"`
+	Name      string    `msgpack:"name"`
+	Preview   bool      `msgpack:"preview"`
+}
+
+// SnapLeg is the part of a snapped path between two consecutive waypoints (stops or via
+// points). The stop IDs are empty for via points. Legs that could not be routed along streets,
+// because a waypoint is too far from any street or no legal way was found, are drawn as
+// straight lines. Length is in meters and Time is the driving time at the speed limit, in
+// seconds.
+type SnapLeg struct {
+	FromStopID string  `msgpack:"from_stop_id"`
+	ToStopID   string  `msgpack:"to_stop_id"`
+	Length     float64 `msgpack:"length"`
+	Time       float64 `msgpack:"time"`
+	Routed     bool    `msgpack:"routed"`
+}
+
+// PathSnapResult is the reply to a 'path:snap' request. Path is the saved path, and is
+// omitted for previews.
+type PathSnapResult struct {
+	Path   *PathInfo `msgpack:"path,omitempty"`
+	Coords []LatLng  `msgpack:"coords"`
+	Length float64   `msgpack:"length"`
+	Time   float64   `msgpack:"time"`
+	Legs   []SnapLeg `msgpack:"legs"`
+}
+
+// snapWaypoint is a stop or via point a snapped path passes through.
+type snapWaypoint struct {
+	stopID  string
+	point   LatLng
+	pos     streetPos
+	snapped bool
+}
+
+func snapPath(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req PathSnapRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	var pattern *PatternInfo
+	if req.PatternID != "" {
+		p, err := takePattern(s.Database, req.PatternID)
+		if err != nil {
+			return nil, err
+		}
+		pattern = &p
+		req.ProjectID, req.StopIDs = pattern.ProjectID, pattern.StopIDs
+		if req.Name == "" {
+			req.Name = pattern.Name
+		}
+	} else if err := requireProject(s.Database, req.ProjectID); err != nil {
+		return nil, err
+	}
+	if len(req.StopIDs) < 2 {
+		// TODO
+		return nil, errors.New("a path needs at least two stops")
+	}
+	if req.PathID != "" {
+		if err := requireInProject(s.Database, &PathInfo{}, "path", req.PathID, req.ProjectID); err != nil {
+			return nil, err
+		}
+	}
+
+	var stops []StopInfo
+	if err := s.Database.Find(&stops, "project_id = ? AND id IN ?", req.ProjectID, req.StopIDs).Error; err != nil {
+		return nil, err
+	}
+	stopsByID := make(map[string]StopInfo, len(stops))
+	for _, stop := range stops {
+		stopsByID[stop.ID] = stop
+	}
+
+	// Line up the stops and via points
+	vias := map[int][]LatLng{}
+	for _, via := range req.Vias {
+		if via.After < 0 || via.After >= len(req.StopIDs)-1 {
+			// TODO
+			return nil, fmt.Errorf("via point after stop %d is not between two stops", via.After)
+		}
+		vias[via.After] = append(vias[via.After], via.Point)
+	}
+
+	var waypoints []snapWaypoint
+	for i, id := range req.StopIDs {
+		stop, ok := stopsByID[id]
+		if !ok {
+			return nil, &ErrorWithCode{
+				Code:    "stop-not-found",
+				Message: fmt.Sprintf("there is no stop with ID %q in this project", id),
+				Details: id,
+			}
+		}
+		waypoints = append(waypoints, snapWaypoint{stopID: id, point: LatLng{stop.Lat, stop.Lng}})
+		for _, p := range vias[i] {
+			waypoints = append(waypoints, snapWaypoint{point: p})
+		}
+	}
+
+	// Load the streets around the waypoints
+	sw, ne := waypoints[0].point, waypoints[0].point
+	for _, wp := range waypoints {
+		sw = LatLng{math.Min(sw.Lat, wp.point.Lat), math.Min(sw.Lng, wp.point.Lng)}
+		ne = LatLng{math.Max(ne.Lat, wp.point.Lat), math.Max(ne.Lng, wp.point.Lng)}
+	}
+	margin := math.Max(snapSearchMargin, distance(sw, ne)/2)
+	proj := newLocalProjection(sw)
+	x1, y1 := proj.toXY(ne)
+	sw, ne = proj.toLatLng(-margin, -margin), proj.toLatLng(x1+margin, y1+margin)
+
+	avoid := map[string]bool{}
+	for _, class := range req.Avoid {
+		avoid[class] = true
+	}
+	graph, err := loadStreetGraph(s, sw, ne, streetModeDrive, avoid, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(graph.edges) == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "no-street-network",
+			Message: "there are no streets near these stops; has a street network been imported?",
+		}
+	}
+
+	for i := range waypoints {
+		waypoints[i].pos, waypoints[i].snapped = graph.snap(waypoints[i].point, MaxSnapDistance)
+	}
+
+	// Route each leg, carrying on in the direction the previous leg arrived in
+	result := PathSnapResult{Coords: []LatLng{}}
+	var arrived *streetStep
+	for i := 1; i < len(waypoints); i++ {
+		from, to := waypoints[i-1], waypoints[i]
+		leg := SnapLeg{FromStopID: from.stopID, ToStopID: to.stopID}
+
+		var line []LatLng
+		if from.snapped && to.snapped {
+			var forward *bool
+			if arrived != nil && arrived.Edge == from.pos.Edge {
+				forward = &arrived.Forward
+			}
+			route, ok := graph.route(from.pos, to.pos, forward)
+			if !ok && forward != nil {
+				route, ok = graph.route(from.pos, to.pos, nil)
+			}
+			if ok {
+				line = graph.geometry(route)
+				leg.Routed, leg.Length, leg.Time = true, route.Length, route.Time
+				arrived = &route.Steps[len(route.Steps)-1]
+			}
+		}
+
+		if !leg.Routed {
+			a, b := from.point, to.point
+			if from.snapped {
+				a = from.pos.Point
+			}
+			if to.snapped {
+				b = to.pos.Point
+			}
+			line = []LatLng{a, b}
+			leg.Length = distance(a, b)
+			arrived = nil
+		}
+
+		if n := len(result.Coords); n > 0 && len(line) > 0 && distance(result.Coords[n-1], line[0]) < 0.01 {
+			line = line[1:]
+		}
+		result.Coords = append(result.Coords, line...)
+		result.Length += leg.Length
+		result.Time += leg.Time
+		result.Legs = append(result.Legs, leg)
+	}
+
+	if req.Preview {
+		return result, nil
+	}
+
+	coords := LineString(result.Coords)
+
+	pathID := req.PathID
+	if pathID == "" && pattern != nil {
+		pathID = pattern.ShapeID
+	}
+
+	var path PathInfo
+	created := pathID == ""
+	err = s.Database.Transaction(func(tx *gorm.DB) error {
+		if created {
+			id, err := uuid.NewRandom()
+			if err != nil {
+				return err
+			}
+			if req.Name == "" {
+				req.Name = "Snapped path"
+			}
+			path = PathInfo{PathSpec: PathSpec{ProjectID: req.ProjectID, Line: true, Coords: coords, Name: req.Name}, ID: id.String()}
+			if err := tx.Create(&path).Error; err != nil {
+				return err
+			}
+			if pattern != nil && pattern.ShapeID == "" {
+				return tx.Model(&PatternInfo{ID: pattern.ID}).Update("shape_id", path.ID).Error
+			}
+			return nil
+		}
+
+		if err := tx.Model(&PathInfo{ID: pathID}).Updates(map[string]any{"coords": coords, "line": true, "shape_dist_traveled": ShapeDistances(nil)}).Error; err != nil {
+			return err
+		}
+		return tx.Take(&path, "id = ?", pathID).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if created {
+		s.publish(u, ProjectEvent{ProjectID: path.ProjectID, Type: "path:created", Data: path})
+		if pattern != nil && pattern.ShapeID == "" {
+			modified, err := takePattern(s.Database, pattern.ID)
+			if err != nil {
+				return nil, err
+			}
+			s.publish(u, ProjectEvent{ProjectID: modified.ProjectID, Type: "pattern:modified", Data: modified})
+		}
+	} else {
+		s.publish(u, ProjectEvent{ProjectID: path.ProjectID, Type: "path:modified", Data: path})
+	}
+
+	result.Path = &path
+	return result, nil
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"math"
 
 	"github.com/google/uuid"
 	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
 )
 
 type StopInfo struct {
 	ID                 string  `gorm:"primaryKey" json:"id" msgpack:"id"`
+	ProjectID          string  `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
 	Code               string  `gorm:"code" json:"code" msgpack:"code"`
 	Name               string  `gorm:"name" json:"name" msgpack:"name"`
 	NameTTS            string  `gorm:"name_tts" json:"name_tts,omitempty" msgpack:"name_tts,omitempty"`
@@ -23,9 +27,12 @@ type StopInfo struct {
 	WheelchairBoarding uint    `gorm:"wheelchair_boarding" json:"wheelchair_boarding" msgpack:"wheelchair_boarding"`
 	LevelID            string  `gorm:"level_id" json:"level_id,omitempty" msgpack:"level_id,omitempty"`
 	PlatformCode       string  `gorm:"platform_code" json:"platform_code,omitempty" msgpack:"platform_code,omitempty"`
+
+	// Properties are kept from imported files so they can be exported again
+	Properties FeatureProperties `gorm:"properties" json:"properties,omitempty" msgpack:"properties,omitempty"`
 }
 
-func createStop(s *Server, u *UserInfo, payload []byte) (any, error) {
+func createStop(s *Server, u *UserConn, payload []byte) (any, error) {
 	var info StopInfo
 	if err := msgpack.Unmarshal(payload, &info); err != nil {
 		// TODO
@@ -41,15 +48,98 @@ func createStop(s *Server, u *UserInfo, payload []byte) (any, error) {
 		info.ID = id.String()
 	}
 
+	if err := requireProject(s.Database, info.ProjectID); err != nil {
+		return nil, err
+	}
+	if err := validateCoords("stop", []LatLng{{info.Lat, info.Lng}}, 1); err != nil {
+		return nil, err
+	}
+
 	if err := s.Database.Create(info).Error; err != nil {
 		// TODO
 		return nil, err
 	}
 
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "stop:created", Data: info})
+
 	return info, nil
 }
 
-func deleteStop(s *Server, u *UserInfo, payload []byte) (any, error) {
+func modifyStop(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to modify the ID or project of the stop, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	changes := map[string]any{}
+
+	for _, field := range []string{
+		"code", "name", "name_tts", "description", "zone_id", "url",
+		"parent_station", "timezone", "level_id", "platform_code",
+	} {
+		if str, ok := untrustedChanges[field].(string); ok {
+			changes[field] = str
+		}
+	}
+	if lat, ok := toFloat64(untrustedChanges["lat"]); ok {
+		if math.IsNaN(lat) || math.Abs(lat) > 90 {
+			return nil, invalidGeometry("%v is not a valid latitude", lat)
+		}
+		changes["lat"] = lat
+	}
+	if lng, ok := toFloat64(untrustedChanges["lng"]); ok {
+		if math.IsNaN(lng) || math.Abs(lng) > 180 {
+			return nil, invalidGeometry("%v is not a valid longitude", lng)
+		}
+		changes["lng"] = lng
+	}
+	for _, field := range []string{"type", "wheelchair_boarding"} {
+		if num, ok := toUint(untrustedChanges[field]); ok {
+			changes[field] = num
+		}
+	}
+	if val, present := untrustedChanges["properties"]; present {
+		var props FeatureProperties
+		if err := convertValue(val, &props); err != nil {
+			return nil, &ErrorWithCode{Code: "invalid-properties", Message: "properties must be a map"}
+		}
+		changes["properties"] = props
+	}
+
+	stop := StopInfo{ID: id}
+	if len(changes) > 0 {
+		if err := s.Database.Model(&stop).Updates(changes).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	if err := s.Database.Take(&stop).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrorWithCode{
+				Code:    "stop-not-found",
+				Message: fmt.Sprintf("there is no stop with ID %q", id),
+				Details: id,
+			}
+		}
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: stop.ProjectID, Type: "stop:modified", Data: stop})
+
+	return stop, nil
+}
+
+func deleteStop(s *Server, u *UserConn, payload []byte) (any, error) {
 	var id string
 	if err := msgpack.Unmarshal(payload, &id); err != nil {
 		// TODO
@@ -61,10 +151,32 @@ func deleteStop(s *Server, u *UserInfo, payload []byte) (any, error) {
 		return nil, errors.New("a non-empty string ID must be supplied")
 	}
 
-	if err := s.Database.Delete(&StopInfo{}, "id = ?", id).Error; err != nil {
+	// Look up the project first so we know who to notify
+	var stop StopInfo
+	if err := s.Database.Select("project_id").Take(&stop, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
+		// TODO
+		return nil, err
+	}
+
+	// Patterns and trips stop serving the stop rather than referring to a missing one
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&StopTimeInfo{}, "stop_id = ?", id).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&PatternStopInfo{}, "stop_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&StopInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
 		// TODO
 		return nil, err
 	}
 
+	s.publish(u, ProjectEvent{ProjectID: stop.ProjectID, Type: "stop:deleted", Data: id})
+
 	return nil, nil
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Stream message types. Every ProtocolStream message, in either direction, consists of the
+// protocol byte, one of these type bytes, and then a MessagePack payload:
+//
+//	[ProtocolStream] [StreamType...] [MessagePack payload...]
+//
+// Clients send StreamTypeSubscribe/StreamTypeUnsubscribe with a project ID string as the
+// payload. The server answers each of those with StreamTypeSubscribed/StreamTypeUnsubscribed
+// (also carrying the project ID) or StreamTypeError (carrying an ErrorWithCode), and pushes
+// StreamTypeEvent messages carrying a ProjectEvent for every project the client is subscribed
+// to.
+const (
+	StreamTypeSubscribe = iota
+	StreamTypeUnsubscribe
+	StreamTypeSubscribed
+	StreamTypeUnsubscribed
+	StreamTypeEvent
+	StreamTypeError
+)
+
+// ProjectEvent describes a change made to a project, or to one of its features, by some
+// connection. It is pushed to every other connection that is subscribed to the project.
+type ProjectEvent struct {
+	ProjectID string `msgpack:"project_id"`
+	// Type is what happened, e.g., "stop:created", "path:modified", "circle:deleted", or
+	// "project:modified".
+	Type string `msgpack:"type"`
+	// UserID is the ID of the user who made the change.
+	UserID string `msgpack:"user_id"`
+	// Data is the new/updated record for creations and modifications, or just the ID of the
+	// record for deletions.
+	Data any `msgpack:"data"`
+}
+
+// addConn registers a newly-authenticated connection with the server.
+func (s *Server) addConn(c *UserConn) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+
+	s.Conns[c] = struct{}{}
+}
+
+// removeConn unregisters a connection and drops all of its subscriptions.
+func (s *Server) removeConn(c *UserConn) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+
+	for projectID := range c.subscriptions {
+		s.unsubscribeLocked(c, projectID)
+	}
+	delete(s.Conns, c)
+}
+
+// unsubscribeLocked removes a single subscription. The caller must hold the connections lock.
+func (s *Server) unsubscribeLocked(c *UserConn, projectID string) {
+	delete(c.subscriptions, projectID)
+
+	if subs := s.Subscribers[projectID]; subs != nil {
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(s.Subscribers, projectID)
+		}
+	}
+}
+
+// handleStreamMessage handles a single ProtocolStream message (minus the protocol byte) sent
+// by a client.
+func (s *Server) handleStreamMessage(c *UserConn, stype byte, payload []byte) {
+	var projectID string
+	if err := msgpack.Unmarshal(payload, &projectID); err != nil {
+		c.writeStreamOrLog(StreamTypeError, ErrorWithCode{
+			"bad-stream-payload",
+			"stream subscription messages must contain a project ID string",
+			nil,
+		})
+		return
+	}
+
+	switch stype {
+	case StreamTypeSubscribe:
+		if err := requireProject(s.Database, projectID); err != nil {
+			c.writeStreamOrLog(StreamTypeError, err)
+			return
+		}
+
+		s.connsLock.Lock()
+		subs := s.Subscribers[projectID]
+		if subs == nil {
+			subs = map[*UserConn]struct{}{}
+			s.Subscribers[projectID] = subs
+		}
+		subs[c] = struct{}{}
+		c.subscriptions[projectID] = struct{}{}
+		s.connsLock.Unlock()
+
+		c.writeStreamOrLog(StreamTypeSubscribed, projectID)
+
+	case StreamTypeUnsubscribe:
+		s.connsLock.Lock()
+		s.unsubscribeLocked(c, projectID)
+		s.connsLock.Unlock()
+
+		c.writeStreamOrLog(StreamTypeUnsubscribed, projectID)
+
+	default:
+		c.writeStreamOrLog(StreamTypeError, ErrorWithCode{
+			"unknown-stream-type",
+			"clients may only send subscribe (0) and unsubscribe (1) stream messages",
+			stype,
+		})
+	}
+}
+
+// publish pushes an event to every connection subscribed to the event's project, except for
+// the connection that caused it (which already knows what it did from the reply). The origin
+// may be nil for changes that did not come from a websocket connection. Events are queued
+// rather than written, so one slow client cannot hold up the request that caused the event.
+func (s *Server) publish(origin *UserConn, evt ProjectEvent) {
+	if origin != nil {
+		evt.UserID = origin.ID
+	}
+
+	s.connsLock.RLock()
+	targets := make([]*UserConn, 0, len(s.Subscribers[evt.ProjectID]))
+	for c := range s.Subscribers[evt.ProjectID] {
+		if c != origin {
+			targets = append(targets, c)
+		}
+	}
+	s.connsLock.RUnlock()
+
+	if len(targets) == 0 {
+		return
+	}
+
+	payload, err := msgpack.Marshal(evt)
+	if err != nil {
+		log.Printf("Failed to encode %q event for project [%s]: %v", evt.Type, evt.ProjectID, err)
+		return
+	}
+
+	msg := append([]byte{ProtocolStream, StreamTypeEvent}, payload...)
+	for _, c := range targets {
+		c.queueEvent(msg)
+	}
+}
+
+// dropSubscribers removes every subscription to a project, e.g., because it was deleted.
+func (s *Server) dropSubscribers(projectID string) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+
+	for c := range s.Subscribers[projectID] {
+		delete(c.subscriptions, projectID)
+	}
+	delete(s.Subscribers, projectID)
+}
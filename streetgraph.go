@@ -0,0 +1,368 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+)
+
+// streetMode says who is travelling a street graph: buses follow one-way streets and turn
+// restrictions, pedestrians walk any walkable edge in either direction.
+type streetMode int
+
+const (
+	streetModeDrive streetMode = iota
+	streetModeWalk
+)
+
+// streetGraph is part of the street network loaded into memory for routing. Each edge can be
+// travelled in two directions, which are numbered 2*i (from FromNodeID to ToNodeID) and 2*i+1
+// (the other way) for edge i. Costs are travel times in seconds.
+type streetGraph struct {
+	mode         streetMode
+	edges        []StreetEdgeInfo
+	coords       [][]LatLng
+	pace         []float64 // seconds per meter of each edge
+	out          map[int64][]int
+	restrictions map[int64][]TurnRestrictionInfo
+}
+
+// streetPos is a point on an edge of a street graph. Offset is the distance in meters along
+// the edge from its FromNodeID, and Distance is how far the point is from whatever was
+// snapped to it.
+type streetPos struct {
+	Edge     int
+	Offset   float64
+	Point    LatLng
+	Distance float64
+}
+
+// streetStep is one edge of a route, travelled from one offset to another. The first and last
+// steps of a route usually cover only part of their edges.
+type streetStep struct {
+	Edge     int
+	Forward  bool
+	From, To float64
+}
+
+// streetRoute is a way through a street graph from one position to another.
+type streetRoute struct {
+	Steps  []streetStep
+	Length float64
+	Time   float64
+}
+
+// loadStreetGraph loads the edges of the street network within some bounds that the given
+// mode may use, leaving out any edges of the given classes. Walking uses walkSpeed (m/s);
+// driving uses each edge's speed.
+func loadStreetGraph(s *Server, sw, ne LatLng, mode streetMode, avoid map[string]bool, walkSpeed float64) (*streetGraph, error) {
+	q := s.Database.Where("max_lat >= ? AND min_lat <= ? AND max_lng >= ? AND min_lng <= ?", sw.Lat, ne.Lat, sw.Lng, ne.Lng)
+	if mode == streetModeWalk {
+		q = q.Where("walkable")
+	} else {
+		q = q.Where("forward OR backward")
+	}
+
+	var edges []StreetEdgeInfo
+	if err := q.Order("id").Find(&edges).Error; err != nil {
+		return nil, err
+	}
+
+	g := &streetGraph{mode: mode, out: map[int64][]int{}, restrictions: map[int64][]TurnRestrictionInfo{}}
+	for _, edge := range edges {
+		if avoid[edge.Class] {
+			continue
+		}
+		coords, err := edge.coords()
+		if err != nil {
+			return nil, err
+		}
+
+		speed := walkSpeed
+		if mode == streetModeDrive {
+			speed = edge.Speed
+		}
+		if speed <= 0 || len(coords) < 2 {
+			continue
+		}
+
+		i := len(g.edges)
+		edge.Geometry = nil
+		g.edges = append(g.edges, edge)
+		g.coords = append(g.coords, coords)
+		g.pace = append(g.pace, 1/speed)
+
+		if g.usable(2 * i) {
+			g.out[edge.FromNodeID] = append(g.out[edge.FromNodeID], 2*i)
+		}
+		if g.usable(2*i + 1) {
+			g.out[edge.ToNodeID] = append(g.out[edge.ToNodeID], 2*i+1)
+		}
+	}
+
+	if mode == streetModeDrive && len(g.out) > 0 {
+		var restrictions []TurnRestrictionInfo
+		if err := s.Database.Find(&restrictions).Error; err != nil {
+			return nil, err
+		}
+		for _, tr := range restrictions {
+			if _, ok := g.out[tr.ViaNodeID]; ok {
+				g.restrictions[tr.ViaNodeID] = append(g.restrictions[tr.ViaNodeID], tr)
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// usable reports whether a direction of an edge may be travelled.
+func (g *streetGraph) usable(dir int) bool {
+	e := &g.edges[dir/2]
+	switch {
+	case g.mode == streetModeWalk:
+		return e.Walkable
+	case dir%2 == 0:
+		return e.Forward
+	default:
+		return e.Backward
+	}
+}
+
+// tail and head return the nodes a direction of an edge starts and ends at.
+func (g *streetGraph) tail(dir int) int64 {
+	if dir%2 == 0 {
+		return g.edges[dir/2].FromNodeID
+	}
+	return g.edges[dir/2].ToNodeID
+}
+
+func (g *streetGraph) head(dir int) int64 {
+	return g.tail(dir ^ 1)
+}
+
+// canTurn reports whether a vehicle arriving along one direction of an edge may continue
+// along another. U-turns are only allowed at dead ends, and turn restrictions apply when
+// driving.
+func (g *streetGraph) canTurn(from, to int) bool {
+	if g.mode == streetModeWalk {
+		return true
+	}
+	node := g.head(from)
+	if to == from^1 && len(g.out[node]) > 1 {
+		return false
+	}
+
+	fromWay, toWay := g.edges[from/2].WayID, g.edges[to/2].WayID
+	for _, tr := range g.restrictions[node] {
+		if tr.FromWayID != fromWay {
+			continue
+		}
+		if tr.Only != (tr.ToWayID == toWay) {
+			return false
+		}
+	}
+	return true
+}
+
+// snap finds the closest point on the graph to p, no more than maxDist meters away.
+func (g *streetGraph) snap(p LatLng, maxDist float64) (streetPos, bool) {
+	best := streetPos{Edge: -1, Distance: math.Inf(1)}
+	for i, e := range g.edges {
+		// Cheap rejection using the edge's bounds
+		if p.Lat < e.MinLat || p.Lat > e.MaxLat || p.Lng < e.MinLng || p.Lng > e.MaxLng {
+			near := LatLng{math.Max(e.MinLat, math.Min(p.Lat, e.MaxLat)), math.Max(e.MinLng, math.Min(p.Lng, e.MaxLng))}
+			if distance(p, near) > math.Min(maxDist, best.Distance) {
+				continue
+			}
+		}
+
+		offset := locateAlong(g.coords[i], p, 0)
+		point := pointAlong(g.coords[i], offset)
+		if d := distance(p, point); d < best.Distance {
+			best = streetPos{i, offset, point, d}
+		}
+	}
+	return best, best.Edge >= 0 && best.Distance <= maxDist
+}
+
+// snapHeading is like snap, but only considers edges that run within tolerance degrees of a
+// heading (in either direction), so that a point travelling along one street is not snapped
+// to a cross street near an intersection.
+func (g *streetGraph) snapHeading(p LatLng, heading, tolerance, maxDist float64) (streetPos, bool) {
+	best := streetPos{Edge: -1, Distance: math.Inf(1)}
+	for i, e := range g.edges {
+		if p.Lat < e.MinLat || p.Lat > e.MaxLat || p.Lng < e.MinLng || p.Lng > e.MaxLng {
+			near := LatLng{math.Max(e.MinLat, math.Min(p.Lat, e.MaxLat)), math.Max(e.MinLng, math.Min(p.Lng, e.MaxLng))}
+			if distance(p, near) > math.Min(maxDist, best.Distance) {
+				continue
+			}
+		}
+
+		offset := locateAlong(g.coords[i], p, 0)
+		point := pointAlong(g.coords[i], offset)
+		d := distance(p, point)
+		if d >= best.Distance {
+			continue
+		}
+
+		// The edge's own heading at that point, measured over a couple of meters
+		a := pointAlong(g.coords[i], math.Max(0, offset-1))
+		b := pointAlong(g.coords[i], math.Min(e.Length, offset+1))
+		if turn := math.Abs(turnAngle(heading, bearing(a, b))); turn > tolerance && turn < 180-tolerance {
+			continue
+		}
+		best = streetPos{i, offset, point, d}
+	}
+	return best, best.Edge >= 0 && best.Distance <= maxDist
+}
+
+// route finds the quickest way from one position to another. If forward is non-nil, the
+// route must leave the starting edge in that direction, e.g., to carry on the way a vehicle
+// arrived instead of making a U-turn.
+func (g *streetGraph) route(from, to streetPos, forward *bool) (*streetRoute, bool) {
+	fromLen, toLen := g.edges[from.Edge].Length, g.edges[to.Edge].Length
+
+	type pred struct {
+		dir  int
+		cost float64
+	}
+	best := map[int]pred{}
+	pq := &streetQueue{}
+
+	// Leave the start in whichever directions are allowed
+	var direct *streetRoute
+	for _, dir := range []int{2 * from.Edge, 2*from.Edge + 1} {
+		fwd := dir%2 == 0
+		if !g.usable(dir) || (forward != nil && *forward != fwd) {
+			continue
+		}
+
+		end := fromLen
+		if !fwd {
+			end = 0
+		}
+		cost := math.Abs(end-from.Offset) * g.pace[from.Edge]
+		best[dir] = pred{-1, cost}
+		heap.Push(pq, streetQueueItem{dir, cost})
+
+		// The destination may be further along the same edge
+		if from.Edge == to.Edge && (to.Offset >= from.Offset) == fwd {
+			length := math.Abs(to.Offset - from.Offset)
+			if direct == nil || length*g.pace[from.Edge] < direct.Time {
+				direct = &streetRoute{
+					Steps:  []streetStep{{from.Edge, fwd, from.Offset, to.Offset}},
+					Length: length,
+					Time:   length * g.pace[from.Edge],
+				}
+			}
+		}
+	}
+
+	// Then search until nothing left could beat the best way onto the destination's edge
+	bestEnd, bestEndDir, bestTime := -1, -1, math.Inf(1)
+	if direct != nil {
+		bestTime = direct.Time
+	}
+
+	for pq.Len() > 0 {
+		item := heap.Pop(pq).(streetQueueItem)
+		if item.cost > best[item.dir].cost {
+			continue // stale
+		}
+		if item.cost >= bestTime {
+			break
+		}
+
+		node := g.head(item.dir)
+		for _, next := range g.out[node] {
+			if !g.canTurn(item.dir, next) {
+				continue
+			}
+
+			// Onto the destination's edge, stopping partway along it
+			if next/2 == to.Edge {
+				partial := to.Offset
+				if next%2 == 1 {
+					partial = toLen - to.Offset
+				}
+				if t := item.cost + partial*g.pace[to.Edge]; t < bestTime {
+					bestEnd, bestEndDir, bestTime = item.dir, next, t
+				}
+			}
+
+			cost := item.cost + g.edges[next/2].Length*g.pace[next/2]
+			if prev, seen := best[next]; !seen || cost < prev.cost {
+				best[next] = pred{item.dir, cost}
+				heap.Push(pq, streetQueueItem{next, cost})
+			}
+		}
+	}
+
+	if bestEnd < 0 {
+		return direct, direct != nil
+	}
+
+	// Walk back from the destination
+	route := &streetRoute{Time: bestTime}
+	endFwd := bestEndDir%2 == 0
+	endFrom := 0.0
+	if !endFwd {
+		endFrom = toLen
+	}
+	route.Steps = append(route.Steps, streetStep{to.Edge, endFwd, endFrom, to.Offset})
+
+	for dir := bestEnd; dir >= 0; dir = best[dir].dir {
+		fwd := dir%2 == 0
+		step := streetStep{dir / 2, fwd, 0, g.edges[dir/2].Length}
+		if !fwd {
+			step.From, step.To = step.To, step.From
+		}
+		if best[dir].dir < 0 {
+			step.From = from.Offset
+		}
+		route.Steps = append(route.Steps, step)
+	}
+
+	for i, j := 0, len(route.Steps)-1; i < j; i, j = i+1, j-1 {
+		route.Steps[i], route.Steps[j] = route.Steps[j], route.Steps[i]
+	}
+	for _, step := range route.Steps {
+		route.Length += math.Abs(step.To - step.From)
+	}
+	return route, true
+}
+
+// geometry traces a route as a polyline.
+func (g *streetGraph) geometry(route *streetRoute) []LatLng {
+	var line []LatLng
+	for _, step := range route.Steps {
+		for _, c := range cutLine(g.coords[step.Edge], step.From, step.To) {
+			// Steps meet end to end, and the last one may have no length at all
+			if len(line) == 0 || distance(line[len(line)-1], c) >= 0.01 {
+				line = append(line, c)
+			}
+		}
+	}
+	return line
+}
+
+// streetQueueItem is a direction of an edge waiting to be searched from, with the cost of
+// reaching its end.
+type streetQueueItem struct {
+	dir  int
+	cost float64
+}
+
+// streetQueue is a min-heap of streetQueueItems.
+type streetQueue []streetQueueItem
+
+func (q streetQueue) Len() int           { return len(q) }
+func (q streetQueue) Less(i, j int) bool { return q[i].cost < q[j].cost }
+func (q streetQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *streetQueue) Push(x any)        { *q = append(*q, x.(streetQueueItem)) }
+
+func (q *streetQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
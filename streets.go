@@ -0,0 +1,492 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// streetInsertBatchSize is how many street nodes or edges are inserted per statement.
+const streetInsertBatchSize = 500
+
+// StreetNodeInfo is an intersection or dead end of the street network, i.e., a node where
+// edges meet. ID is the OpenStreetMap node ID.
+type StreetNodeInfo struct {
+	ID  int64   `gorm:"primaryKey;autoIncrement:false"`
+	Lat float64 `gorm:"lat;index:street_node_position"`
+	Lng float64 `gorm:"lng;index:street_node_position"`
+}
+
+func (StreetNodeInfo) TableName() string {
+	return "street_nodes"
+}
+
+// StreetEdgeInfo is a stretch of street between two nodes, with no intersections in between.
+// Geometry is a MessagePack-encoded []LatLng running from FromNodeID to ToNodeID, and Length
+// is in meters.
+//
+// Forward and Backward say whether a bus may drive the edge in each direction, and Speed is
+// its speed limit (or a typical speed for its class) in m/s. Walkable edges may be walked in
+// either direction. Class is the OpenStreetMap highway tag, e.g., "residential".
+type StreetEdgeInfo struct {
+	ID         uint    `gorm:"primaryKey"`
+	WayID      int64   `gorm:"way_id;index"`
+	FromNodeID int64   `gorm:"from_node_id;index"`
+	ToNodeID   int64   `gorm:"to_node_id;index"`
+	Name       string  `gorm:"name"`
+	Class      string  `gorm:"class"`
+	Length     float64 `gorm:"length"`
+	Speed      float64 `gorm:"speed"`
+	Forward    bool    `gorm:"forward"`
+	Backward   bool    `gorm:"backward"`
+	Walkable   bool    `gorm:"walkable"`
+	Geometry   []byte  `gorm:"geometry"`
+	MinLat     float64 `gorm:"min_lat;index:street_edge_bounds"`
+	MinLng     float64 `gorm:"min_lng;index:street_edge_bounds"`
+	MaxLat     float64 `gorm:"max_lat;index:street_edge_bounds"`
+	MaxLng     float64 `gorm:"max_lng;index:street_edge_bounds"`
+}
+
+func (StreetEdgeInfo) TableName() string {
+	return "street_edges"
+}
+
+// coords decodes the geometry of the edge.
+func (e *StreetEdgeInfo) coords() ([]LatLng, error) {
+	var coords []LatLng
+	if err := msgpack.Unmarshal(e.Geometry, &coords); err != nil {
+		return nil, fmt.Errorf("failed to decode geometry of street edge %d: %w", e.ID, err)
+	}
+	return coords, nil
+}
+
+// TurnRestrictionInfo is an OpenStreetMap turn restriction from one way onto another at the
+// node where they meet. Kind is the restriction tag, e.g., "no_left_turn" or
+// "only_straight_on"; Only is true for the "only_" kinds, which forbid every other turn.
+type TurnRestrictionInfo struct {
+	ID        int64  `gorm:"primaryKey;autoIncrement:false"`
+	FromWayID int64  `gorm:"from_way_id"`
+	ViaNodeID int64  `gorm:"via_node_id;index"`
+	ToWayID   int64  `gorm:"to_way_id"`
+	Kind      string `gorm:"kind"`
+	Only      bool   `gorm:"only"`
+}
+
+func (TurnRestrictionInfo) TableName() string {
+	return "turn_restrictions"
+}
+
+// StreetNetworkSummary is the reply to a 'streets:info' request. The bounds are zero when
+// no street network has been imported.
+type StreetNetworkSummary struct {
+	Nodes        int64  `msgpack:"nodes"`
+	Edges        int64  `msgpack:"edges"`
+	Restrictions int64  `msgpack:"restrictions"`
+	SW           LatLng `msgpack:"sw"`
+	NE           LatLng `msgpack:"ne"`
+}
+
+// StreetImportReport is the reply to an "osm" upload. Ways is the number of ways that made it
+// into the network; the rest of the extract (buildings, railways, etc.) is ignored.
+// Restrictions that are not from a way onto another way via a single node are skipped.
+type StreetImportReport struct {
+	Ways         int `msgpack:"ways"`
+	Nodes        int `msgpack:"nodes"`
+	Edges        int `msgpack:"edges"`
+	Restrictions int `msgpack:"restrictions"`
+	Skipped      int `msgpack:"skipped"`
+}
+
+// drivableClasses maps the OpenStreetMap highway classes a bus may drive on to a typical speed
+// in m/s, used when a way has no usable maxspeed tag.
+var drivableClasses = map[string]float64{
+	"motorway":       65 * MetersPerMile / 3600,
+	"motorway_link":  45 * MetersPerMile / 3600,
+	"trunk":          55 * MetersPerMile / 3600,
+	"trunk_link":     40 * MetersPerMile / 3600,
+	"primary":        45 * MetersPerMile / 3600,
+	"primary_link":   35 * MetersPerMile / 3600,
+	"secondary":      40 * MetersPerMile / 3600,
+	"secondary_link": 30 * MetersPerMile / 3600,
+	"tertiary":       35 * MetersPerMile / 3600,
+	"tertiary_link":  30 * MetersPerMile / 3600,
+	"unclassified":   25 * MetersPerMile / 3600,
+	"residential":    25 * MetersPerMile / 3600,
+	"road":           25 * MetersPerMile / 3600,
+	"busway":         35 * MetersPerMile / 3600,
+	"service":        15 * MetersPerMile / 3600,
+	"living_street":  10 * MetersPerMile / 3600,
+}
+
+// walkableClasses lists the OpenStreetMap highway classes that may be walked on by default.
+// Motorways and trunk roads are left out, though a foot=yes tag still makes them walkable.
+var walkableClasses = map[string]bool{
+	"primary": true, "primary_link": true, "secondary": true, "secondary_link": true,
+	"tertiary": true, "tertiary_link": true, "unclassified": true, "residential": true,
+	"road": true, "service": true, "living_street": true, "pedestrian": true, "footway": true,
+	"path": true, "steps": true, "track": true, "cycleway": true, "bridleway": true,
+	"corridor": true, "platform": true,
+}
+
+// streetWay is a way of the extract that belongs in the street network.
+type streetWay struct {
+	id                          int64
+	nodes                       []int64
+	name, class                 string
+	speed                       float64
+	forward, backward, walkable bool
+}
+
+// classifyStreet decides whether and how a way belongs in the street network. It returns nil
+// for ways that neither buses nor pedestrians may use.
+func classifyStreet(way *osmWay) *streetWay {
+	tags := way.Tags
+	class := tags["highway"]
+	if class == "" || tags["area"] == "yes" || len(way.Nodes) < 2 {
+		return nil
+	}
+
+	sw := &streetWay{id: way.ID, nodes: way.Nodes, name: tags["name"], class: class}
+	if sw.name == "" {
+		sw.name = tags["ref"]
+	}
+
+	no := func(v string) bool { return v == "no" || v == "private" }
+	yes := func(v string) bool { return v == "yes" || v == "designated" || v == "permissive" }
+	busAllowed := yes(tags["bus"]) || yes(tags["psv"])
+
+	// Buses: the class must be drivable and general access must not be denied, unless buses
+	// are let through explicitly
+	if speed, ok := drivableClasses[class]; ok {
+		denied := no(tags["access"]) || no(tags["vehicle"]) || no(tags["motor_vehicle"])
+		if class == "busway" {
+			denied = false
+		}
+		if !no(tags["bus"]) && !no(tags["psv"]) && (!denied || busAllowed) {
+			sw.forward, sw.backward = true, true
+			sw.speed = speed
+			if limit := parseMaxSpeed(tags["maxspeed"]); limit > 0 {
+				sw.speed = limit
+			}
+		}
+	}
+
+	// One-way streets, unless they let buses through both ways
+	if sw.forward {
+		oneway := tags["oneway"]
+		if oneway == "" && (class == "motorway" || tags["junction"] == "roundabout" || tags["junction"] == "circular") {
+			oneway = "yes"
+		}
+		twoWayForBuses := tags["oneway:bus"] == "no" || tags["oneway:psv"] == "no" ||
+			tags["busway"] == "opposite_lane" || tags["busway:left"] == "opposite_lane"
+
+		switch oneway {
+		case "yes", "true", "1":
+			sw.backward = twoWayForBuses
+		case "-1", "reverse":
+			sw.forward = twoWayForBuses
+		}
+	}
+
+	// Pedestrians
+	foot := tags["foot"]
+	sw.walkable = (walkableClasses[class] && !no(foot) && !no(tags["access"])) || yes(foot) ||
+		tags["sidewalk"] == "both" || tags["sidewalk"] == "left" || tags["sidewalk"] == "right"
+	if no(foot) {
+		sw.walkable = false
+	}
+
+	if !sw.forward && !sw.backward && !sw.walkable {
+		return nil
+	}
+	return sw
+}
+
+// parseMaxSpeed converts an OpenStreetMap maxspeed tag, e.g., "50" (km/h) or "25 mph", to
+// m/s. It returns 0 for values it does not understand, like "signals".
+func parseMaxSpeed(tag string) float64 {
+	tag = strings.TrimSpace(tag)
+	unit := 1000.0 / 3600
+	switch {
+	case strings.HasSuffix(tag, "mph"):
+		tag, unit = strings.TrimSpace(strings.TrimSuffix(tag, "mph")), MetersPerMile/3600
+	case strings.HasSuffix(tag, "km/h"):
+		tag = strings.TrimSpace(strings.TrimSuffix(tag, "km/h"))
+	case strings.HasSuffix(tag, "knots"):
+		tag, unit = strings.TrimSpace(strings.TrimSuffix(tag, "knots")), 1852.0/3600
+	}
+	v, err := strconv.ParseFloat(tag, 64)
+	if err != nil || v <= 0 {
+		return 0
+	}
+	return v * unit
+}
+
+// turnRestriction extracts a simple turn restriction from a relation. Restrictions that do
+// not apply to buses are left out, since only bus paths are routed along one-way streets.
+func turnRestriction(rel *osmRelation) (TurnRestrictionInfo, bool) {
+	tags := rel.Tags
+	if tags["type"] != "restriction" && tags["type"] != "restriction:bus" && tags["type"] != "restriction:psv" {
+		return TurnRestrictionInfo{}, false
+	}
+
+	kind := tags["restriction:bus"]
+	if kind == "" {
+		kind = tags["restriction:psv"]
+	}
+	if kind == "" {
+		kind = tags["restriction"]
+	}
+	for _, except := range strings.Split(tags["except"], ";") {
+		if except = strings.TrimSpace(except); except == "bus" || except == "psv" {
+			return TurnRestrictionInfo{}, false
+		}
+	}
+	if !strings.HasPrefix(kind, "no_") && !strings.HasPrefix(kind, "only_") {
+		return TurnRestrictionInfo{}, false
+	}
+
+	tr := TurnRestrictionInfo{ID: rel.ID, Kind: kind, Only: strings.HasPrefix(kind, "only_")}
+	var from, via, to int
+	for _, m := range rel.Members {
+		switch {
+		case m.Role == "from" && m.Type == "way":
+			tr.FromWayID = m.Ref
+			from++
+		case m.Role == "via" && m.Type == "node":
+			tr.ViaNodeID = m.Ref
+			via++
+		case m.Role == "via":
+			via += 2 // via ways are not supported
+		case m.Role == "to" && m.Type == "way":
+			tr.ToWayID = m.Ref
+			to++
+		}
+	}
+	return tr, from == 1 && via == 1 && to == 1
+}
+
+// importStreetNetwork builds the street network from an OpenStreetMap extract (PBF or XML),
+// replacing whatever network was imported before. The extract should cover the whole service
+// area. Ways are split into edges wherever they meet another way, and wherever they leave the
+// extract.
+func importStreetNetwork(s *Server, u *UserConn, params []byte, data []byte) (any, error) {
+	// TODO: improve error
+	if u.Rank == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "rank-too-low",
+			Message: "only admins have permission to import street networks",
+		}
+	}
+
+	var report StreetImportReport
+	var ways []*streetWay
+	var restrictions []TurnRestrictionInfo
+	uses := map[int64]int{}
+
+	// First pass: the ways and restrictions, and which nodes they need
+	err := readOSM(data, osmHandlers{
+		Way: func(way *osmWay) {
+			sw := classifyStreet(way)
+			if sw == nil {
+				return
+			}
+			ways = append(ways, sw)
+			for i, id := range sw.nodes {
+				uses[id]++
+				if i == 0 || i == len(sw.nodes)-1 {
+					uses[id]++ // ends of ways are always nodes of the network
+				}
+			}
+		},
+		Relation: func(rel *osmRelation) {
+			if tr, ok := turnRestriction(rel); ok {
+				restrictions = append(restrictions, tr)
+			} else if rel.Tags["type"] == "restriction" {
+				report.Skipped++
+			}
+		},
+	})
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-osm",
+			Message: fmt.Sprintf("failed to read OpenStreetMap extract: %v", err),
+		}
+	}
+	if len(ways) == 0 {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-osm",
+			Message: "OpenStreetMap extract does not contain any streets",
+		}
+	}
+
+	// Second pass: where those nodes are
+	positions := make(map[int64]LatLng, len(uses))
+	err = readOSM(data, osmHandlers{
+		Node: func(n osmNode) {
+			if uses[n.ID] > 0 {
+				positions[n.ID] = LatLng{n.Lat, n.Lng}
+			}
+		},
+	})
+	if err != nil {
+		return nil, &ErrorWithCode{
+			Code:    "invalid-osm",
+			Message: fmt.Sprintf("failed to read OpenStreetMap extract: %v", err),
+		}
+	}
+
+	// Split the ways into edges
+	var edges []StreetEdgeInfo
+	nodes := map[int64]bool{}
+	for _, sw := range ways {
+		before := len(edges)
+		var run []int64
+		flush := func() {
+			if len(run) > 1 {
+				edge, err := newStreetEdge(sw, run, positions)
+				if err == nil {
+					edges = append(edges, edge)
+					nodes[run[0]], nodes[run[len(run)-1]] = true, true
+				}
+			}
+			run = run[:0]
+		}
+
+		for i, id := range sw.nodes {
+			if _, ok := positions[id]; !ok {
+				flush()
+				continue
+			}
+			run = append(run, id)
+			if i > 0 && uses[id] > 1 {
+				flush()
+				run = append(run, id)
+			}
+		}
+		flush()
+		if len(edges) > before {
+			report.Ways++
+		}
+	}
+
+	// Restrictions must refer to ways and nodes that made it into the network
+	wayIDs := make(map[int64]bool, len(ways))
+	for _, edge := range edges {
+		wayIDs[edge.WayID] = true
+	}
+	kept := restrictions[:0]
+	for _, tr := range restrictions {
+		if wayIDs[tr.FromWayID] && wayIDs[tr.ToWayID] && nodes[tr.ViaNodeID] {
+			kept = append(kept, tr)
+		} else {
+			report.Skipped++
+		}
+	}
+	restrictions = kept
+
+	streetNodes := make([]StreetNodeInfo, 0, len(nodes))
+	for id := range nodes {
+		pos := positions[id]
+		streetNodes = append(streetNodes, StreetNodeInfo{id, pos.Lat, pos.Lng})
+	}
+
+	err = s.Database.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&StreetEdgeInfo{}, &StreetNodeInfo{}, &TurnRestrictionInfo{}} {
+			if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if len(streetNodes) > 0 {
+			if err := tx.CreateInBatches(streetNodes, streetInsertBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		if len(edges) > 0 {
+			if err := tx.CreateInBatches(edges, streetInsertBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		if len(restrictions) > 0 {
+			if err := tx.CreateInBatches(restrictions, streetInsertBatchSize).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Nodes = len(streetNodes)
+	report.Edges = len(edges)
+	report.Restrictions = len(restrictions)
+	return report, nil
+}
+
+// newStreetEdge makes an edge out of a run of nodes along a way.
+func newStreetEdge(sw *streetWay, run []int64, positions map[int64]LatLng) (StreetEdgeInfo, error) {
+	coords := make([]LatLng, len(run))
+	edge := StreetEdgeInfo{
+		WayID:      sw.id,
+		FromNodeID: run[0],
+		ToNodeID:   run[len(run)-1],
+		Name:       sw.name,
+		Class:      sw.class,
+		Speed:      sw.speed,
+		Forward:    sw.forward,
+		Backward:   sw.backward,
+		Walkable:   sw.walkable,
+		MinLat:     math.Inf(1),
+		MinLng:     math.Inf(1),
+		MaxLat:     math.Inf(-1),
+		MaxLng:     math.Inf(-1),
+	}
+	for i, id := range run {
+		c := positions[id]
+		coords[i] = c
+		edge.MinLat, edge.MaxLat = math.Min(edge.MinLat, c.Lat), math.Max(edge.MaxLat, c.Lat)
+		edge.MinLng, edge.MaxLng = math.Min(edge.MinLng, c.Lng), math.Max(edge.MaxLng, c.Lng)
+	}
+	edge.Length = lineLength(coords)
+
+	geometry, err := msgpack.Marshal(coords)
+	if err != nil {
+		return edge, err
+	}
+	edge.Geometry = geometry
+	return edge, nil
+}
+
+func streetNetworkInfo(s *Server, u *UserConn, payload []byte) (any, error) {
+	var summary StreetNetworkSummary
+	db := s.Database
+
+	if err := db.Model(&StreetNodeInfo{}).Count(&summary.Nodes).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&StreetEdgeInfo{}).Count(&summary.Edges).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&TurnRestrictionInfo{}).Count(&summary.Restrictions).Error; err != nil {
+		return nil, err
+	}
+
+	if summary.Edges > 0 {
+		var bounds struct{ MinLat, MinLng, MaxLat, MaxLng float64 }
+		err := db.Model(&StreetEdgeInfo{}).
+			Select("MIN(min_lat) AS min_lat, MIN(min_lng) AS min_lng, MAX(max_lat) AS max_lat, MAX(max_lng) AS max_lng").
+			Scan(&bounds).Error
+		if err != nil {
+			return nil, err
+		}
+		summary.SW = LatLng{bounds.MinLat, bounds.MinLng}
+		summary.NE = LatLng{bounds.MaxLat, bounds.MaxLng}
+	}
+
+	return summary, nil
+}
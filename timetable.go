@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// MaxGeneratedTrips is the most trips a single timetable may contain, so that a typo in a
+// headway (e.g., 1 second instead of 1 minute) does not produce millions of rows.
+const MaxGeneratedTrips = 5000
+
+// HeadwayPeriod is a time period (seconds since midnight of the service day) during which
+// trips are dispatched every Headway seconds. RunTimes optionally overrides the timetable's
+// default segment run times during the period, e.g., to account for rush hour traffic.
+type HeadwayPeriod struct {
+	StartTime int   `msgpack:"start_time"`
+	EndTime   int   `msgpack:"end_time"`
+	Headway   int   `msgpack:"headway"`
+	RunTimes  []int `msgpack:"run_times"`
+}
+
+// TimetableRequest is the payload of 'timetable:preview' and 'timetable:commit' requests.
+// Trips are dispatched from the first stop of the pattern starting at StartTime, and no trip
+// departs after EndTime. RunTimes are the seconds it takes to travel between each pair of
+// consecutive stops of the pattern, so there must be one fewer of them than there are stops.
+// DwellTime is how many seconds vehicles wait at each intermediate stop.
+type TimetableRequest struct {
+	PatternID string          `msgpack:"pattern_id"`
+	ServiceID string          `msgpack:"service_id"`
+	Headsign  string          `msgpack:"headsign"`
+	StartTime int             `msgpack:"start_time"`
+	EndTime   int             `msgpack:"end_time"`
+	Periods   []HeadwayPeriod `msgpack:"periods"`
+	RunTimes  []int           `msgpack:"run_times"`
+	DwellTime int             `msgpack:"dwell_time"`
+	// Replace deletes the trips that already follow the pattern on the same service before
+	// committing the new ones. It is ignored by previews.
+	Replace bool `msgpack:"replace"`
+}
+
+// GeneratedStopTime is a single stop of a generated trip.
+type GeneratedStopTime struct {
+	StopID        string `msgpack:"stop_id"`
+	StopSequence  uint   `msgpack:"stop_sequence"`
+	ArrivalTime   int    `msgpack:"arrival_time"`
+	DepartureTime int    `msgpack:"departure_time"`
+}
+
+// GeneratedTrip is a single trip of a generated timetable.
+type GeneratedTrip struct {
+	StopTimes []GeneratedStopTime `msgpack:"stop_times"`
+}
+
+// Timetable is the reply to a 'timetable:preview' request.
+type Timetable struct {
+	PatternID string          `msgpack:"pattern_id"`
+	ServiceID string          `msgpack:"service_id"`
+	Trips     []GeneratedTrip `msgpack:"trips"`
+}
+
+// TimetableCommitResult is the reply to a 'timetable:commit' request.
+type TimetableCommitResult struct {
+	PatternID string   `msgpack:"pattern_id"`
+	ServiceID string   `msgpack:"service_id"`
+	TripIDs   []string `msgpack:"trip_ids"`
+	// Replaced is the number of existing trips that were deleted first.
+	Replaced int64 `msgpack:"replaced"`
+}
+
+func invalidTimetable(format string, args ...any) error {
+	return &ErrorWithCode{
+		Code:    "invalid-timetable",
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// generateTimetable validates a timetable request against the pattern's stops and lays out
+// every trip.
+func generateTimetable(req *TimetableRequest, pattern *PatternInfo) ([]GeneratedTrip, error) {
+	if len(pattern.StopIDs) < 2 {
+		return nil, invalidTimetable("pattern must have at least 2 stops")
+	}
+	if req.EndTime < req.StartTime {
+		return nil, invalidTimetable("service span ends before it starts")
+	}
+	if req.DwellTime < 0 {
+		return nil, invalidTimetable("dwell time cannot be negative")
+	}
+
+	checkRunTimes := func(runTimes []int) error {
+		if len(runTimes) != len(pattern.StopIDs)-1 {
+			return invalidTimetable(
+				"expected %d run times for %d stops, got %d",
+				len(pattern.StopIDs)-1, len(pattern.StopIDs), len(runTimes),
+			)
+		}
+		for _, rt := range runTimes {
+			if rt < 0 {
+				return invalidTimetable("run times cannot be negative")
+			}
+		}
+		return nil
+	}
+
+	if err := checkRunTimes(req.RunTimes); err != nil {
+		return nil, err
+	}
+	if len(req.Periods) == 0 {
+		return nil, invalidTimetable("at least one headway period is required")
+	}
+
+	periods := make([]HeadwayPeriod, len(req.Periods))
+	copy(periods, req.Periods)
+	sort.Slice(periods, func(i, j int) bool { return periods[i].StartTime < periods[j].StartTime })
+
+	for i, p := range periods {
+		if p.Headway <= 0 {
+			return nil, invalidTimetable("headways must be positive")
+		}
+		if p.EndTime <= p.StartTime {
+			return nil, invalidTimetable("headway period ends before it starts")
+		}
+		if i > 0 && p.StartTime < periods[i-1].EndTime {
+			return nil, invalidTimetable("headway periods cannot overlap")
+		}
+		if p.RunTimes != nil {
+			if err := checkRunTimes(p.RunTimes); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var trips []GeneratedTrip
+	t := req.StartTime
+	pi := 0
+
+	for t <= req.EndTime {
+		// Skip past periods that are over; if we are in a gap between periods, jump ahead to
+		// the start of the next one
+		for pi < len(periods) && periods[pi].EndTime <= t {
+			pi++
+		}
+		if pi == len(periods) {
+			break
+		}
+		period := periods[pi]
+		if t < period.StartTime {
+			t = period.StartTime
+			continue
+		}
+
+		if len(trips) == MaxGeneratedTrips {
+			return nil, invalidTimetable("timetable would have more than %d trips", MaxGeneratedTrips)
+		}
+
+		runTimes := req.RunTimes
+		if period.RunTimes != nil {
+			runTimes = period.RunTimes
+		}
+
+		stopTimes := make([]GeneratedStopTime, len(pattern.StopIDs))
+		clock := t
+		for i, stopID := range pattern.StopIDs {
+			st := GeneratedStopTime{StopID: stopID, StopSequence: uint(i + 1)}
+			if i > 0 {
+				clock += runTimes[i-1]
+			}
+			st.ArrivalTime = clock
+			if i > 0 && i < len(pattern.StopIDs)-1 {
+				clock += req.DwellTime
+			}
+			st.DepartureTime = clock
+			stopTimes[i] = st
+		}
+
+		trips = append(trips, GeneratedTrip{stopTimes})
+		t += period.Headway
+	}
+
+	return trips, nil
+}
+
+// loadTimetableRequest decodes a timetable request and fetches the pattern it refers to.
+func loadTimetableRequest(s *Server, payload []byte) (TimetableRequest, PatternInfo, error) {
+	var req TimetableRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return req, PatternInfo{}, err
+	}
+
+	pattern, err := takePattern(s.Database, req.PatternID)
+	if err != nil {
+		return req, pattern, err
+	}
+	if err := requireInProject(s.Database, &CalendarInfo{}, "service", req.ServiceID, pattern.ProjectID); err != nil {
+		return req, pattern, err
+	}
+
+	return req, pattern, nil
+}
+
+func previewTimetable(s *Server, u *UserConn, payload []byte) (any, error) {
+	req, pattern, err := loadTimetableRequest(s, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	trips, err := generateTimetable(&req, &pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return Timetable{pattern.ID, req.ServiceID, trips}, nil
+}
+
+// commitTimetable generates a timetable and saves it as trips and stop times of the pattern's
+// route.
+func commitTimetable(s *Server, u *UserConn, payload []byte) (any, error) {
+	req, pattern, err := loadTimetableRequest(s, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	generated, err := generateTimetable(&req, &pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	template := TripInfo{
+		ProjectID:   pattern.ProjectID,
+		RouteID:     pattern.RouteID,
+		ServiceID:   req.ServiceID,
+		Headsign:    req.Headsign,
+		DirectionID: pattern.DirectionID,
+		PatternID:   pattern.ID,
+	}
+	if err := validateTripRefs(s.Database, &template); err != nil {
+		return nil, err
+	}
+
+	result := TimetableCommitResult{
+		PatternID: pattern.ID,
+		ServiceID: req.ServiceID,
+		TripIDs:   make([]string, len(generated)),
+	}
+	trips := make([]TripInfo, len(generated))
+	stopTimes := make([]StopTimeInfo, 0, len(generated)*len(pattern.StopIDs))
+
+	for i, gen := range generated {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			// TODO
+			return nil, err
+		}
+
+		trips[i] = template
+		trips[i].ID = id.String()
+		result.TripIDs[i] = trips[i].ID
+
+		for _, gst := range gen.StopTimes {
+			arrival, departure := gst.ArrivalTime, gst.DepartureTime
+			stopTimes = append(stopTimes, StopTimeInfo{
+				TripID:        trips[i].ID,
+				StopSequence:  gst.StopSequence,
+				ProjectID:     pattern.ProjectID,
+				StopID:        gst.StopID,
+				ArrivalTime:   &arrival,
+				DepartureTime: &departure,
+				Timepoint:     1,
+			})
+		}
+	}
+
+	err = s.Database.Transaction(func(tx *gorm.DB) error {
+		if req.Replace {
+			existing := tx.Model(&TripInfo{}).Select("id").
+				Where("pattern_id = ? AND service_id = ?", pattern.ID, req.ServiceID)
+
+			if err := tx.Delete(&StopTimeInfo{}, "trip_id IN (?)", existing).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&FrequencyInfo{}, "trip_id IN (?)", existing).Error; err != nil {
+				return err
+			}
+			res := tx.Delete(&TripInfo{}, "pattern_id = ? AND service_id = ?", pattern.ID, req.ServiceID)
+			if res.Error != nil {
+				return res.Error
+			}
+			result.Replaced = res.RowsAffected
+		}
+
+		if len(trips) == 0 {
+			return nil // GORM refuses to insert empty slices
+		}
+		if err := tx.CreateInBatches(trips, gtfsInsertBatchSize).Error; err != nil {
+			return err
+		}
+		return tx.CreateInBatches(stopTimes, gtfsInsertBatchSize).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: pattern.ProjectID, Type: "timetable:committed", Data: result})
+
+	return result, nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// DefaultAdverseChange is the fraction by which service must fall (or rise) for people to
+	// count as adversely affected (or benefited) when a 'title_vi:analyze' request does not
+	// specify one.
+	DefaultAdverseChange = 0.25
+	// DefaultTitleVIThreshold is the disparate impact and disproportionate burden threshold
+	// when a 'title_vi:analyze' request does not specify one. With absolute thresholds it is a
+	// difference in percentage points (as a fraction), and with relative thresholds it is a
+	// fraction of the service area share.
+	DefaultTitleVIThreshold = 0.1
+)
+
+// Title VI threshold types. Absolute thresholds compare the difference between two shares,
+// e.g., 40% vs 30% is 10 points apart; relative thresholds compare their ratio, e.g., 40% vs
+// 30% is 33% higher.
+const (
+	ThresholdAbsolute = "absolute"
+	ThresholdRelative = "relative"
+)
+
+// TitleVIRequest is the payload of a 'title_vi:analyze' request, which compares the service
+// of two projects: usually the current network and a proposed major service change. People
+// living within Distance meters (a quarter mile by default) of a stop have access to the
+// trips serving it on the given day ("weekday", the default, "saturday", or "sunday").
+//
+// The optional settings fall back to DefaultAdverseChange and DefaultTitleVIThreshold, and
+// ThresholdType defaults to ThresholdAbsolute.
+type TitleVIRequest struct {
+	BaselineProjectID               string   `msgpack:"baseline_project_id"`
+	ProposedProjectID               string   `msgpack:"proposed_project_id"`
+	LayerID                         string   `msgpack:"layer_id"`
+	Distance                        float64  `msgpack:"distance"`
+	Day                             string   `msgpack:"day"`
+	AdverseChange                   *float64 `msgpack:"adverse_change"`
+	DisparateImpactThreshold        *float64 `msgpack:"disparate_impact_threshold"`
+	DisproportionateBurdenThreshold *float64 `msgpack:"disproportionate_burden_threshold"`
+	ThresholdType                   string   `msgpack:"threshold_type"`
+}
+
+// TitleVIGroup is the population of one part of the service area: all of it
+// ("service_area"), or the people whose service falls ("adverse"), rises ("benefit"), or
+// stays about the same ("unchanged"). Shares are fractions of the group's population.
+type TitleVIGroup struct {
+	Group          string  `msgpack:"group"`
+	Population     float64 `msgpack:"population"`
+	Minority       float64 `msgpack:"minority"`
+	MinorityShare  float64 `msgpack:"minority_share"`
+	LowIncome      float64 `msgpack:"low_income"`
+	LowIncomeShare float64 `msgpack:"low_income_share"`
+}
+
+// TitleVIFinding is the outcome of one test. Test is "disparate_impact" (minority
+// populations) or "disproportionate_burden" (low-income populations), and Effect says
+// whether it looks at who bears the adverse effects or who receives the benefits. For
+// adverse effects, Difference is how much higher the group's share is than the service
+// area's; for benefits, how much lower. A finding is flagged when Difference exceeds the
+// threshold.
+type TitleVIFinding struct {
+	Test             string  `msgpack:"test"`
+	Effect           string  `msgpack:"effect"`
+	GroupShare       float64 `msgpack:"group_share"`
+	ServiceAreaShare float64 `msgpack:"service_area_share"`
+	Difference       float64 `msgpack:"difference"`
+	Threshold        float64 `msgpack:"threshold"`
+	Flagged          bool    `msgpack:"flagged"`
+}
+
+// TitleVIReport is the reply to a 'title_vi:analyze' request. The service area is everywhere
+// within the walk distance of a stop in either project. Table holds the groups and findings
+// as rows of text (the first row being the header), ready to display, and Download is the
+// same table as a CSV file.
+type TitleVIReport struct {
+	BaselineProjectID string           `msgpack:"baseline_project_id"`
+	ProposedProjectID string           `msgpack:"proposed_project_id"`
+	LayerID           string           `msgpack:"layer_id"`
+	Distance          float64          `msgpack:"distance"`
+	Day               string           `msgpack:"day"`
+	AdverseChange     float64          `msgpack:"adverse_change"`
+	ThresholdType     string           `msgpack:"threshold_type"`
+	Groups            []TitleVIGroup   `msgpack:"groups"`
+	Findings          []TitleVIFinding `msgpack:"findings"`
+	Table             [][]string       `msgpack:"table"`
+	Download          *DownloadInfo    `msgpack:"download"`
+}
+
+// titleVIStop is a stop with the trips per day of each route serving it.
+type titleVIStop struct {
+	x, y   float64
+	routes map[string]float64
+}
+
+func analyzeTitleVI(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req TitleVIRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if req.Distance == 0 {
+		req.Distance = DefaultBufferDistances[0]
+	}
+	if req.Day == "" {
+		req.Day = "weekday"
+	}
+	if req.ThresholdType == "" {
+		req.ThresholdType = ThresholdAbsolute
+	}
+	adverseChange := DefaultAdverseChange
+	if req.AdverseChange != nil {
+		adverseChange = *req.AdverseChange
+	}
+	impactThreshold, burdenThreshold := DefaultTitleVIThreshold, DefaultTitleVIThreshold
+	if req.DisparateImpactThreshold != nil {
+		impactThreshold = *req.DisparateImpactThreshold
+	}
+	if req.DisproportionateBurdenThreshold != nil {
+		burdenThreshold = *req.DisproportionateBurdenThreshold
+	}
+
+	if req.Distance < 0 {
+		// TODO
+		return nil, errors.New("walk distance must be positive")
+	}
+	if req.Day != "weekday" && req.Day != "saturday" && req.Day != "sunday" {
+		// TODO
+		return nil, fmt.Errorf("day must be weekday, saturday, or sunday, not %q", req.Day)
+	}
+	if req.ThresholdType != ThresholdAbsolute && req.ThresholdType != ThresholdRelative {
+		// TODO
+		return nil, fmt.Errorf("threshold type must be absolute or relative, not %q", req.ThresholdType)
+	}
+	if adverseChange < 0 || adverseChange >= 1 || impactThreshold < 0 || burdenThreshold < 0 {
+		// TODO
+		return nil, errors.New("adverse change must be between 0 and 1, and thresholds must not be negative")
+	}
+
+	if err := requireProject(s.Database, req.BaselineProjectID); err != nil {
+		return nil, err
+	}
+	if err := requireProject(s.Database, req.ProposedProjectID); err != nil {
+		return nil, err
+	}
+	if err := requireDemographicLayer(s.Database, req.LayerID); err != nil {
+		return nil, err
+	}
+
+	var proposed ProjectInfo
+	if err := s.Database.First(&proposed, "id = ?", req.ProposedProjectID).Error; err != nil {
+		return nil, err
+	}
+
+	// Both projects' stops make up the service area
+	var baselineStops, proposedStops []StopInfo
+	if err := s.Database.Find(&baselineStops, "project_id = ?", req.BaselineProjectID).Error; err != nil {
+		return nil, err
+	}
+	if err := s.Database.Find(&proposedStops, "project_id = ?", req.ProposedProjectID).Error; err != nil {
+		return nil, err
+	}
+
+	report := TitleVIReport{
+		BaselineProjectID: req.BaselineProjectID,
+		ProposedProjectID: req.ProposedProjectID,
+		LayerID:           req.LayerID,
+		Distance:          req.Distance,
+		Day:               req.Day,
+		AdverseChange:     adverseChange,
+		ThresholdType:     req.ThresholdType,
+	}
+
+	var groups [4]DemographicCounts // service area, adverse, benefit, unchanged
+
+	field := newDiscField(stopDiscs(append(append([]StopInfo{}, baselineStops...), proposedStops...), req.Distance))
+	if field != nil {
+		baseline, err := loadTitleVIStops(s, field.proj, req.BaselineProjectID, baselineStops, req.Day)
+		if err != nil {
+			return nil, err
+		}
+		proposal, err := loadTitleVIStops(s, field.proj, req.ProposedProjectID, proposedStops, req.Day)
+		if err != nil {
+			return nil, err
+		}
+
+		sw := field.proj.toLatLng(field.x0, field.y0)
+		ne := field.proj.toLatLng(field.x0+float64(field.nx)*field.cell, field.y0+float64(field.ny)*field.cell)
+
+		var areas []DemographicAreaInfo
+		err = s.Database.
+			Where("layer_id = ? AND geometry IS NOT NULL", req.LayerID).
+			Where("max_lat >= ? AND min_lat <= ? AND max_lng >= ? AND min_lng <= ?", sw.Lat, ne.Lat, sw.Lng, ne.Lng).
+			Find(&areas).Error
+		if err != nil {
+			return nil, err
+		}
+
+		// Each sample of each area gets the service within walking distance before and after,
+		// and its share of the area's people go to the matching group
+		for i := range areas {
+			polys, err := areas[i].polygons()
+			if err != nil {
+				return nil, err
+			}
+
+			for _, smp := range sampleArea(field.proj, polys, i, req.Distance/coverageSamplesPerDistance) {
+				before := titleVIService(baseline, smp.x, smp.y, req.Distance)
+				after := titleVIService(proposal, smp.x, smp.y, req.Distance)
+				if before == 0 && after == 0 && !field.containsXY(smp.x, smp.y) {
+					continue
+				}
+
+				groups[0].add(areas[i].DemographicCounts, smp.share)
+				switch {
+				case after < before*(1-adverseChange):
+					groups[1].add(areas[i].DemographicCounts, smp.share)
+				case after > before*(1+adverseChange):
+					groups[2].add(areas[i].DemographicCounts, smp.share)
+				default:
+					groups[3].add(areas[i].DemographicCounts, smp.share)
+				}
+			}
+		}
+	}
+
+	for i, name := range []string{"service_area", "adverse", "benefit", "unchanged"} {
+		g := TitleVIGroup{
+			Group:      name,
+			Population: groups[i].Population,
+			Minority:   groups[i].Minority,
+			LowIncome:  groups[i].LowIncome,
+		}
+		if g.Population > 0 {
+			g.MinorityShare = g.Minority / g.Population
+			g.LowIncomeShare = g.LowIncome / g.Population
+		}
+		report.Groups = append(report.Groups, g)
+	}
+
+	area, adverse, benefit := report.Groups[0], report.Groups[1], report.Groups[2]
+	report.Findings = []TitleVIFinding{
+		titleVIFinding("disparate_impact", "adverse", adverse.MinorityShare, area.MinorityShare, impactThreshold, req.ThresholdType, adverse.Population),
+		titleVIFinding("disparate_impact", "benefit", benefit.MinorityShare, area.MinorityShare, impactThreshold, req.ThresholdType, benefit.Population),
+		titleVIFinding("disproportionate_burden", "adverse", adverse.LowIncomeShare, area.LowIncomeShare, burdenThreshold, req.ThresholdType, adverse.Population),
+		titleVIFinding("disproportionate_burden", "benefit", benefit.LowIncomeShare, area.LowIncomeShare, burdenThreshold, req.ThresholdType, benefit.Population),
+	}
+
+	report.Table = titleVITable(&report)
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(report.Table); err != nil {
+		return nil, err
+	}
+	dl, err := s.addDownload(fileNameFor(proposed.Name, "title-vi")+".csv", "text/csv", buf.Bytes())
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+	report.Download = dl
+
+	return report, nil
+}
+
+// loadTitleVIStops projects a project's stops and attaches the trips per day of each route
+// serving them on the given day.
+func loadTitleVIStops(s *Server, proj localProjection, projectID string, stops []StopInfo, day string) ([]titleVIStop, error) {
+	service, err := loadStopRouteService(s.Database, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	byStop := map[string]map[string]float64{}
+	for _, srs := range service {
+		trips := srs.Weekday
+		switch day {
+		case "saturday":
+			trips = srs.Saturday
+		case "sunday":
+			trips = srs.Sunday
+		}
+		if trips == 0 {
+			continue
+		}
+		if byStop[srs.StopID] == nil {
+			byStop[srs.StopID] = map[string]float64{}
+		}
+		byStop[srs.StopID][srs.RouteID] += trips
+	}
+
+	result := make([]titleVIStop, 0, len(stops))
+	for _, stop := range stops {
+		if routes := byStop[stop.ID]; routes != nil {
+			x, y := proj.toXY(LatLng{stop.Lat, stop.Lng})
+			result = append(result, titleVIStop{x, y, routes})
+		}
+	}
+	return result, nil
+}
+
+// titleVIService is the trips per day available within walking distance of a point. A route
+// counts once, at whichever nearby stop it serves most often, so that walking to a second
+// stop of the same route does not double its service.
+func titleVIService(stops []titleVIStop, x, y, distance float64) float64 {
+	best := map[string]float64{}
+	for _, stop := range stops {
+		if math.Abs(stop.x-x) > distance || math.Abs(stop.y-y) > distance || math.Hypot(stop.x-x, stop.y-y) > distance {
+			continue
+		}
+		for routeID, trips := range stop.routes {
+			best[routeID] = math.Max(best[routeID], trips)
+		}
+	}
+
+	total := 0.0
+	for _, trips := range best {
+		total += trips
+	}
+	return total
+}
+
+// titleVIFinding compares a group's share of a protected population against the service
+// area's. Nobody being affected (or benefited) can never be flagged.
+func titleVIFinding(test, effect string, groupShare, areaShare, threshold float64, thresholdType string, population float64) TitleVIFinding {
+	f := TitleVIFinding{
+		Test:             test,
+		Effect:           effect,
+		GroupShare:       groupShare,
+		ServiceAreaShare: areaShare,
+		Threshold:        threshold,
+	}
+	if population <= 0 {
+		return f
+	}
+
+	diff := groupShare - areaShare
+	if effect == "benefit" {
+		diff = -diff
+	}
+	if thresholdType == ThresholdRelative {
+		if areaShare > 0 {
+			diff /= areaShare
+		} else {
+			diff = 0
+		}
+	}
+
+	f.Difference = diff
+	f.Flagged = diff > threshold
+	return f
+}
+
+// titleVITable lays a report out as rows of text: first the population of each group, then
+// the outcome of each test.
+func titleVITable(report *TitleVIReport) [][]string {
+	num := func(v float64) string {
+		return strconv.FormatFloat(math.Round(v), 'f', 0, 64)
+	}
+	pct := func(v float64) string {
+		return strconv.FormatFloat(v*100, 'f', 1, 64) + "%"
+	}
+
+	table := [][]string{{"Group", "Population", "Minority", "Minority share", "Low-income", "Low-income share"}}
+	for _, g := range report.Groups {
+		table = append(table, []string{
+			g.Group, num(g.Population), num(g.Minority), pct(g.MinorityShare), num(g.LowIncome), pct(g.LowIncomeShare),
+		})
+	}
+
+	table = append(table, []string{}, []string{"Test", "Effect", "Group share", "Service area share", "Difference", "Threshold", "Finding"})
+	for _, f := range report.Findings {
+		diff, threshold := pct(f.Difference), pct(f.Threshold)
+		if report.ThresholdType == ThresholdAbsolute {
+			diff = strconv.FormatFloat(f.Difference*100, 'f', 1, 64) + " pts"
+			threshold = strconv.FormatFloat(f.Threshold*100, 'f', 1, 64) + " pts"
+		}
+		finding := "none"
+		if f.Flagged {
+			finding = f.Test
+		}
+		table = append(table, []string{
+			f.Test, f.Effect, pct(f.GroupShare), pct(f.ServiceAreaShare), diff, threshold, finding,
+		})
+	}
+	return table
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// UploadTicketLifetime is how long a client has to start an upload after it was issued
+	// a ticket.
+	UploadTicketLifetime = 10 * time.Minute
+	// MaxUploadBytes is the largest file the server will accept over HTTP.
+	MaxUploadBytes = 1 << 30
+	// DownloadLifetime is how long a generated file stays available for download.
+	DownloadLifetime = 10 * time.Minute
+)
+
+// UploadHandler imports a file that was uploaded over HTTP. The params are whatever the
+// client sent along with its request for the upload ticket, still MessagePack-encoded. The
+// connection is a stand-in for the websocket connection that requested the ticket, i.e., it
+// has the right user information but cannot be written to.
+type UploadHandler = func(s *Server, u *UserConn, params []byte, data []byte) (any, error)
+
+// UploadTicket authorizes a single HTTP upload. Websocket connections are authenticated
+// during the handshake, but plain HTTP requests are not, so clients must first request a
+// ticket over their websocket and then upload the file to '/upload/<ticket ID>'. Files too
+// big to comfortably send as a single websocket message can be uploaded this way.
+type UploadTicket struct {
+	// Kind selects the UploadHandler, e.g., "gtfs".
+	Kind    string
+	Params  []byte
+	User    UserInfo
+	Expires time.Time
+}
+
+// Download is a generated file (like an exported GTFS feed) waiting to be fetched from
+// '/download/<download ID>'. The ID is random and only handed to the user who requested the
+// file, so possessing it is enough to download the file until it expires.
+type Download struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	Expires     time.Time
+}
+
+// DownloadInfo is returned by requests that generate files for download.
+type DownloadInfo struct {
+	ID       string `msgpack:"id"`
+	URL      string `msgpack:"url"`
+	Filename string `msgpack:"filename"`
+	Size     int    `msgpack:"size"`
+	// ExpiresAt is a timestamp (in milliseconds) after which the file may not be downloaded.
+	ExpiresAt uint64 `msgpack:"expires_at"`
+}
+
+// UploadTicketRequest is the payload of an 'upload:create_ticket' request.
+type UploadTicketRequest struct {
+	Kind   string             `msgpack:"kind"`
+	Params msgpack.RawMessage `msgpack:"params"`
+}
+
+// UploadTicketInfo is the reply to an 'upload:create_ticket' request.
+type UploadTicketInfo struct {
+	ID  string `msgpack:"id"`
+	URL string `msgpack:"url"`
+	// ExpiresAt is a timestamp (in milliseconds) after which the ticket may not be used.
+	ExpiresAt uint64 `msgpack:"expires_at"`
+}
+
+func createUploadTicket(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req UploadTicketRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if _, ok := s.UploadHandlers[req.Kind]; !ok {
+		return nil, &ErrorWithCode{
+			Code:    "unknown-upload-kind",
+			Message: fmt.Sprintf("%q is not a recognized kind of upload", req.Kind),
+			Details: req.Kind,
+		}
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	ticket := UploadTicket{req.Kind, req.Params, u.UserInfo, time.Now().Add(UploadTicketLifetime)}
+
+	s.transfersLock.Lock()
+	for tid, t := range s.UploadTickets {
+		if time.Now().After(t.Expires) {
+			delete(s.UploadTickets, tid)
+		}
+	}
+	s.UploadTickets[id.String()] = ticket
+	s.transfersLock.Unlock()
+
+	return UploadTicketInfo{
+		ID:        id.String(),
+		URL:       "/upload/" + id.String(),
+		ExpiresAt: uint64(ticket.Expires.UnixMilli()),
+	}, nil
+}
+
+// unsafeFileNameChars matches runs of characters that should not appear in generated file names.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.]+`)
+
+// fileNameFor turns a project name (or similar) into a safe file name with a suffix, e.g.,
+// "Route 5 Redesign" becomes "Route-5-Redesign-gtfs".
+func fileNameFor(name, suffix string) string {
+	base := strings.Trim(unsafeFileNameChars.ReplaceAllString(name, "-"), "-")
+	if base == "" {
+		return suffix
+	}
+	return base + "-" + suffix
+}
+
+// addDownload makes a generated file available for download.
+func (s *Server) addDownload(filename, contentType string, data []byte) (*DownloadInfo, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	dl := Download{filename, contentType, data, time.Now().Add(DownloadLifetime)}
+
+	s.transfersLock.Lock()
+	for did, d := range s.Downloads {
+		if time.Now().After(d.Expires) {
+			delete(s.Downloads, did)
+		}
+	}
+	s.Downloads[id.String()] = dl
+	s.transfersLock.Unlock()
+
+	return &DownloadInfo{
+		ID:        id.String(),
+		URL:       "/download/" + id.String(),
+		Filename:  filename,
+		Size:      len(data),
+		ExpiresAt: uint64(dl.Expires.UnixMilli()),
+	}, nil
+}
+
+// serveDownload handles 'GET /download/<download ID>'.
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Downloads must use the GET method.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.transfersLock.Lock()
+	dl, ok := s.Downloads[id]
+	s.transfersLock.Unlock()
+
+	if !ok || time.Now().After(dl.Expires) {
+		http.Error(w, "Download does not exist or has expired.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", dl.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": dl.Filename}))
+	http.ServeContent(w, r, dl.Filename, time.Time{}, bytes.NewReader(dl.Data))
+}
+
+// takeUploadTicket removes and returns a ticket if it exists and has not expired.
+func (s *Server) takeUploadTicket(id string) (UploadTicket, bool) {
+	s.transfersLock.Lock()
+	defer s.transfersLock.Unlock()
+
+	ticket, ok := s.UploadTickets[id]
+	delete(s.UploadTickets, id)
+
+	if !ok || time.Now().After(ticket.Expires) {
+		return UploadTicket{}, false
+	}
+	return ticket, true
+}
+
+// readUploadBody reads the uploaded file from a request, which may either be the raw request
+// body or the first file in a multipart form.
+func readUploadBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := http.MaxBytesReader(w, r.Body, MaxUploadBytes)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return io.ReadAll(body)
+	}
+
+	r.Body = body
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("multipart upload did not contain a file")
+			}
+			return nil, err
+		}
+		if part.FileName() != "" {
+			return io.ReadAll(part)
+		}
+	}
+}
+
+// readZipFile decompresses a file from an uploaded zip file, refusing to decompress more than
+// limit bytes (usually MaxUploadBytes, like uploads themselves) so a small but highly
+// compressed file cannot exhaust the server's memory.
+func readZipFile(f *zip.File, limit int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes when decompressed", f.Name, limit)
+	}
+	return data, nil
+}
+
+// writeHTTPReplyOrLog writes a MessagePack-encoded reply to an HTTP request.
+func writeHTTPReplyOrLog(w http.ResponseWriter, status int, res any) {
+	payload, err := msgpack.Marshal(res)
+	if err != nil {
+		log.Printf("Failed to encode HTTP reply [Payload:%T]: %v", res, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-msgpack")
+	w.WriteHeader(status)
+	if _, err = w.Write(payload); err != nil {
+		log.Printf("Failed to write HTTP reply: %v", err)
+	}
+}
+
+// serveUpload handles 'POST /upload/<ticket ID>'. The reply is the MessagePack-encoded result
+// of the upload handler, or an ErrorWithCode.
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, ticketID string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Uploads must use the POST method.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticket, ok := s.takeUploadTicket(ticketID)
+	if !ok {
+		writeHTTPReplyOrLog(w, http.StatusNotFound, ErrorWithCode{
+			"bad-upload-ticket",
+			"upload ticket does not exist, has expired, or was already used",
+			ticketID,
+		})
+		return
+	}
+
+	data, err := readUploadBody(w, r)
+	if err != nil {
+		writeHTTPReplyOrLog(w, http.StatusBadRequest, ErrorWithCode{"bad-upload", err.Error(), nil})
+		return
+	}
+
+	res, err := s.UploadHandlers[ticket.Kind](s, &UserConn{UserInfo: ticket.User}, ticket.Params, data)
+	if err != nil {
+		var errWithCode *ErrorWithCode
+		if errors.As(err, &errWithCode) {
+			writeHTTPReplyOrLog(w, http.StatusBadRequest, errWithCode)
+		} else {
+			log.Printf("Failed to handle %q upload from %q: %v", ticket.Kind, ticket.User.Username, err)
+			writeHTTPReplyOrLog(w, http.StatusInternalServerError, ErrOpaqueFailure)
+		}
+		return
+	}
+
+	writeHTTPReplyOrLog(w, http.StatusOK, res)
+}
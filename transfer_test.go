@@ -0,0 +1,61 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadZipFile(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, size := range map[string]int{"small.txt": 100, "exact.txt": 1000, "bomb.txt": 1 << 20} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(bytes.Repeat([]byte{'0'}, size))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"small.txt", 100, false},
+		{"exact.txt", 1000, false},
+		{"bomb.txt", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f *zip.File
+			for _, zf := range zr.File {
+				if zf.Name == tt.name {
+					f = zf
+				}
+			}
+
+			data, err := readZipFile(f, 1000)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), tt.name) {
+					t.Fatalf("expected an error naming %s, got %v", tt.name, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(data) != tt.size {
+				t.Errorf("read %d bytes, want %d", len(data), tt.size)
+			}
+		})
+	}
+}
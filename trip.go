@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+// TripInfo mirrors a row of a GTFS trips.txt file. ServiceID refers to a CalendarInfo and
+// ShapeID refers to a PathInfo. PatternID optionally refers to the PatternInfo the trip
+// follows; it is not part of GTFS.
+type TripInfo struct {
+	ID                   string `gorm:"primaryKey" json:"id" msgpack:"id"`
+	ProjectID            string `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	RouteID              string `gorm:"route_id;index" json:"route_id" msgpack:"route_id"`
+	ServiceID            string `gorm:"service_id" json:"service_id" msgpack:"service_id"`
+	Headsign             string `gorm:"headsign" json:"headsign,omitempty" msgpack:"headsign,omitempty"`
+	ShortName            string `gorm:"short_name" json:"short_name,omitempty" msgpack:"short_name,omitempty"`
+	DirectionID          uint   `gorm:"direction_id" json:"direction_id" msgpack:"direction_id"`
+	BlockID              string `gorm:"block_id" json:"block_id,omitempty" msgpack:"block_id,omitempty"`
+	ShapeID              string `gorm:"shape_id" json:"shape_id,omitempty" msgpack:"shape_id,omitempty"`
+	PatternID            string `gorm:"pattern_id;index" json:"pattern_id,omitempty" msgpack:"pattern_id,omitempty"`
+	WheelchairAccessible uint   `gorm:"wheelchair_accessible" json:"wheelchair_accessible" msgpack:"wheelchair_accessible"`
+	BikesAllowed         uint   `gorm:"bikes_allowed" json:"bikes_allowed" msgpack:"bikes_allowed"`
+}
+
+func (TripInfo) TableName() string {
+	return "trips"
+}
+
+// StopTimeInfo mirrors a row of a GTFS stop_times.txt file. Arrival and departure times are
+// stored as seconds since midnight of the service day (so they may exceed 24 hours), and are
+// nil for stops whose times should be interpolated.
+type StopTimeInfo struct {
+	TripID            string   `gorm:"primaryKey" json:"trip_id" msgpack:"trip_id"`
+	StopSequence      uint     `gorm:"primaryKey" json:"stop_sequence" msgpack:"stop_sequence"`
+	ProjectID         string   `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	StopID            string   `gorm:"stop_id;index" json:"stop_id" msgpack:"stop_id"`
+	ArrivalTime       *int     `gorm:"arrival_time" json:"arrival_time" msgpack:"arrival_time"`
+	DepartureTime     *int     `gorm:"departure_time" json:"departure_time" msgpack:"departure_time"`
+	StopHeadsign      string   `gorm:"stop_headsign" json:"stop_headsign,omitempty" msgpack:"stop_headsign,omitempty"`
+	PickupType        uint     `gorm:"pickup_type" json:"pickup_type" msgpack:"pickup_type"`
+	DropOffType       uint     `gorm:"drop_off_type" json:"drop_off_type" msgpack:"drop_off_type"`
+	ShapeDistTraveled *float64 `gorm:"shape_dist_traveled" json:"shape_dist_traveled,omitempty" msgpack:"shape_dist_traveled,omitempty"`
+	Timepoint         uint     `gorm:"timepoint" json:"timepoint" msgpack:"timepoint"`
+}
+
+func (StopTimeInfo) TableName() string {
+	return "stop_times"
+}
+
+// FrequencyInfo mirrors a row of a GTFS frequencies.txt file. Times are seconds since
+// midnight of the service day, like in StopTimeInfo.
+type FrequencyInfo struct {
+	TripID      string `gorm:"primaryKey" json:"trip_id" msgpack:"trip_id"`
+	StartTime   int    `gorm:"primaryKey" json:"start_time" msgpack:"start_time"`
+	ProjectID   string `gorm:"project_id;index" json:"project_id" msgpack:"project_id"`
+	EndTime     int    `gorm:"end_time" json:"end_time" msgpack:"end_time"`
+	HeadwaySecs uint   `gorm:"headway_secs" json:"headway_secs" msgpack:"headway_secs"`
+	ExactTimes  uint   `gorm:"exact_times" json:"exact_times" msgpack:"exact_times"`
+}
+
+func (FrequencyInfo) TableName() string {
+	return "frequencies"
+}
+
+// takeTrip fetches a single trip.
+func takeTrip(db *gorm.DB, id string) (TripInfo, error) {
+	trip := TripInfo{ID: id}
+	if err := db.Take(&trip).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return trip, &ErrorWithCode{
+				Code:    "trip-not-found",
+				Message: fmt.Sprintf("there is no trip with ID %q", id),
+				Details: id,
+			}
+		}
+		return trip, err
+	}
+	return trip, nil
+}
+
+// validateTripRefs makes sure everything a trip refers to exists in the trip's project. If the
+// trip follows a pattern but has no shape of its own, it inherits the pattern's shape.
+func validateTripRefs(db *gorm.DB, trip *TripInfo) error {
+	if err := requireInProject(db, &RouteInfo{}, "route", trip.RouteID, trip.ProjectID); err != nil {
+		return err
+	}
+	if err := requireInProject(db, &CalendarInfo{}, "service", trip.ServiceID, trip.ProjectID); err != nil {
+		return err
+	}
+
+	if trip.PatternID != "" {
+		pattern := PatternInfo{ID: trip.PatternID}
+		if err := db.Take(&pattern).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if pattern.RouteID != trip.RouteID {
+			return &ErrorWithCode{
+				Code:    "pattern-not-found",
+				Message: fmt.Sprintf("there is no pattern with ID %q on the trip's route", trip.PatternID),
+				Details: trip.PatternID,
+			}
+		}
+		if trip.ShapeID == "" {
+			trip.ShapeID = pattern.ShapeID
+		}
+	}
+
+	if trip.ShapeID != "" {
+		if err := requireInProject(db, &PathInfo{}, "path", trip.ShapeID, trip.ProjectID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listTrips(s *Server, u *UserConn, payload []byte) (any, error) {
+	var routeID string
+	if err := msgpack.Unmarshal(payload, &routeID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if _, err := takeRoute(s.Database, routeID); err != nil {
+		return nil, err
+	}
+
+	var trips []TripInfo
+	if err := s.Database.Find(&trips, "route_id = ?", routeID).Error; err != nil {
+		return nil, err
+	}
+	return trips, nil
+}
+
+func createTrip(s *Server, u *UserConn, payload []byte) (any, error) {
+	var info TripInfo
+	if err := msgpack.Unmarshal(payload, &info); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, info.ProjectID); err != nil {
+		return nil, err
+	}
+	if err := validateTripRefs(s.Database, &info); err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+	info.ID = id.String()
+
+	if err := s.Database.Create(info).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "trip:created", Data: info})
+
+	return info, nil
+}
+
+func modifyTrip(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to modify the ID, project, or route of the trip, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	id, _ := untrustedChanges["id"].(string)
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	trip, err := takeTrip(s.Database, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply the changes to a copy first so the references can be validated
+	if serviceID, ok := untrustedChanges["service_id"].(string); ok {
+		trip.ServiceID = serviceID
+	}
+	if headsign, ok := untrustedChanges["headsign"].(string); ok {
+		trip.Headsign = headsign
+	}
+	if shortName, ok := untrustedChanges["short_name"].(string); ok {
+		trip.ShortName = shortName
+	}
+	if blockID, ok := untrustedChanges["block_id"].(string); ok {
+		trip.BlockID = blockID
+	}
+	if shapeID, ok := untrustedChanges["shape_id"].(string); ok {
+		trip.ShapeID = shapeID
+	}
+	if patternID, ok := untrustedChanges["pattern_id"].(string); ok {
+		trip.PatternID = patternID
+	}
+	if dir, ok := toUint(untrustedChanges["direction_id"]); ok {
+		trip.DirectionID = dir
+	}
+	if wheelchair, ok := toUint(untrustedChanges["wheelchair_accessible"]); ok {
+		trip.WheelchairAccessible = wheelchair
+	}
+	if bikes, ok := toUint(untrustedChanges["bikes_allowed"]); ok {
+		trip.BikesAllowed = bikes
+	}
+
+	if err := validateTripRefs(s.Database, &trip); err != nil {
+		return nil, err
+	}
+
+	// Select("*") makes GORM save zero values (like an emptied shape ID) too
+	if err := s.Database.Model(&trip).Select("*").Updates(trip).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: trip.ProjectID, Type: "trip:modified", Data: trip})
+
+	return trip, nil
+}
+
+// deleteTrip deletes a trip along with its stop times and frequencies.
+func deleteTrip(s *Server, u *UserConn, payload []byte) (any, error) {
+	var id string
+	if err := msgpack.Unmarshal(payload, &id); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if id == "" {
+		// TODO
+		return nil, errors.New("a non-empty string ID must be supplied")
+	}
+
+	// Look up the project first so we know who to notify
+	var trip TripInfo
+	if err := s.Database.Select("project_id").Take(&trip, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
+		// TODO
+		return nil, err
+	}
+
+	err := s.Database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&StopTimeInfo{}, "trip_id = ?", id).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&FrequencyInfo{}, "trip_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&TripInfo{}, "id = ?", id).Error
+	})
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: trip.ProjectID, Type: "trip:deleted", Data: id})
+
+	return nil, nil
+}
+
+// StopTimeKey identifies a single stop time.
+type StopTimeKey struct {
+	TripID       string `msgpack:"trip_id"`
+	StopSequence uint   `msgpack:"stop_sequence"`
+}
+
+func listStopTimes(s *Server, u *UserConn, payload []byte) (any, error) {
+	var tripID string
+	if err := msgpack.Unmarshal(payload, &tripID); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if _, err := takeTrip(s.Database, tripID); err != nil {
+		return nil, err
+	}
+
+	var stopTimes []StopTimeInfo
+	if err := s.Database.Order("stop_sequence").Find(&stopTimes, "trip_id = ?", tripID).Error; err != nil {
+		return nil, err
+	}
+	return stopTimes, nil
+}
+
+func createStopTime(s *Server, u *UserConn, payload []byte) (any, error) {
+	var info StopTimeInfo
+	if err := msgpack.Unmarshal(payload, &info); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	trip, err := takeTrip(s.Database, info.TripID)
+	if err != nil {
+		return nil, err
+	}
+	info.ProjectID = trip.ProjectID
+
+	if err := requireInProject(s.Database, &StopInfo{}, "stop", info.StopID, info.ProjectID); err != nil {
+		return nil, err
+	}
+
+	if err := s.Database.Create(info).Error; err != nil {
+		// TODO: probably a duplicate stop sequence
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: info.ProjectID, Type: "stop_time:created", Data: info})
+
+	return info, nil
+}
+
+func modifyStopTime(s *Server, u *UserConn, payload []byte) (any, error) {
+	// They might try to modify the trip or project of the stop time, which is not allowed
+	var untrustedChanges map[string]any
+	if err := msgpack.Unmarshal(payload, &untrustedChanges); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	tripID, _ := untrustedChanges["trip_id"].(string)
+	seq, ok := toUint(untrustedChanges["stop_sequence"])
+	if tripID == "" || !ok {
+		// TODO
+		return nil, errors.New("a non-empty trip ID and a stop sequence must be supplied")
+	}
+
+	stopTime := StopTimeInfo{TripID: tripID, StopSequence: seq}
+	if err := s.Database.Take(&stopTime).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &ErrorWithCode{
+				Code:    "stop-time-not-found",
+				Message: fmt.Sprintf("trip %q has no stop time with sequence %d", tripID, seq),
+				Details: StopTimeKey{tripID, seq},
+			}
+		}
+		// TODO
+		return nil, err
+	}
+
+	changes := map[string]any{}
+
+	if stopID, ok := untrustedChanges["stop_id"].(string); ok {
+		if err := requireInProject(s.Database, &StopInfo{}, "stop", stopID, stopTime.ProjectID); err != nil {
+			return nil, err
+		}
+		changes["stop_id"] = stopID
+	}
+	if headsign, ok := untrustedChanges["stop_headsign"].(string); ok {
+		changes["stop_headsign"] = headsign
+	}
+	for _, field := range []string{"pickup_type", "drop_off_type", "timepoint"} {
+		if num, ok := toUint(untrustedChanges[field]); ok {
+			changes[field] = num
+		}
+	}
+	// Times may be explicitly cleared by sending nil
+	for _, field := range []string{"arrival_time", "departure_time"} {
+		if val, present := untrustedChanges[field]; present {
+			if val == nil {
+				changes[field] = nil
+			} else if secs, ok := toInt(val); ok {
+				changes[field] = secs
+			}
+		}
+	}
+
+	if len(changes) > 0 {
+		if err := s.Database.Model(&stopTime).Updates(changes).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+		if err := s.Database.Take(&stopTime).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: stopTime.ProjectID, Type: "stop_time:modified", Data: stopTime})
+
+	return stopTime, nil
+}
+
+func deleteStopTime(s *Server, u *UserConn, payload []byte) (any, error) {
+	var key StopTimeKey
+	if err := msgpack.Unmarshal(payload, &key); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if key.TripID == "" {
+		// TODO
+		return nil, errors.New("a non-empty trip ID must be supplied")
+	}
+
+	// Look up the project first so we know who to notify
+	var stopTime StopTimeInfo
+	if err := s.Database.Select("project_id").Take(&stopTime, "trip_id = ? AND stop_sequence = ?", key.TripID, key.StopSequence).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // nothing to delete
+		}
+		// TODO
+		return nil, err
+	}
+
+	if err := s.Database.Delete(&StopTimeInfo{}, "trip_id = ? AND stop_sequence = ?", key.TripID, key.StopSequence).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	s.publish(u, ProjectEvent{ProjectID: stopTime.ProjectID, Type: "stop_time:deleted", Data: key})
+
+	return nil, nil
+}
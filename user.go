@@ -6,7 +6,7 @@ import (
 	"github.com/vmihailenco/msgpack/v5"
 )
 
-func listUsers(s *Server, u *UserInfo, payload []byte) (any, error) {
+func listUsers(s *Server, u *UserConn, payload []byte) (any, error) {
 	var users []UserInfo
 	if err := s.Database.Find(&users).Error; err != nil {
 		return nil, err
@@ -14,7 +14,7 @@ func listUsers(s *Server, u *UserInfo, payload []byte) (any, error) {
 	return users, nil
 }
 
-func deleteUser(s *Server, u *UserInfo, payload []byte) (any, error) {
+func deleteUser(s *Server, u *UserConn, payload []byte) (any, error) {
 	// TODO: improve error
 	if u.Rank == 0 {
 		return nil, &ErrorWithCode{
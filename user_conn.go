@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/vmihailenco/msgpack/v5"
@@ -19,13 +20,65 @@ const (
 	ReplyTypeError
 )
 
+// eventQueueSize is how many events may wait to be written to a connection before further
+// events are dropped for it.
+const eventQueueSize = 256
+
 // UserConn is an authenticated websocket connection.
 type UserConn struct {
 	UserInfo
 	*websocket.Conn
+
+	// writeLock serializes writes to the websocket, which only supports one concurrent
+	// writer, because events for subscribed projects are pushed from the goroutines serving
+	// other connections.
+	writeLock sync.Mutex
+
+	// subscriptions is the set of project IDs this connection is subscribed to. It is guarded
+	// by the server's connections lock rather than the write lock.
+	subscriptions map[string]struct{}
+
+	// events holds encoded event messages until writeEvents writes them, so publishing an event
+	// never waits on a slow client. done is closed once the connection is no longer served.
+	events chan []byte
+	done   chan struct{}
+}
+
+// writeBinary writes a single binary message to the websocket. It is safe to call from
+// multiple goroutines.
+func (c *UserConn) writeBinary(msg []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	return c.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+// queueEvent queues an encoded event message for the connection without blocking, dropping
+// it if the client is not keeping up.
+func (c *UserConn) queueEvent(msg []byte) {
+	select {
+	case c.events <- msg:
+	default:
+		log.Printf("Dropped stream message for %q, who is not keeping up", c.Username)
+	}
+}
+
+// writeEvents writes queued event messages to the websocket until the connection is no longer
+// served.
+func (c *UserConn) writeEvents() {
+	for {
+		select {
+		case msg := <-c.events:
+			if err := c.writeBinary(msg); err != nil {
+				log.Printf("Failed to write stream message [Type:%d] to %q: %v", msg[1], c.Username, err)
+			}
+		case <-c.done:
+			return
+		}
+	}
 }
 
-func writeResponseOrLog(c *websocket.Conn, rid uint32, resType byte, res any) {
+func (c *UserConn) writeResponseOrLog(rid uint32, resType byte, res any) {
 	var payload []byte
 	var err error
 
@@ -44,7 +97,7 @@ func writeResponseOrLog(c *websocket.Conn, rid uint32, resType byte, res any) {
 	binary.BigEndian.PutUint32(header[1:], rid)
 	header[5] = resType
 
-	if err = c.WriteMessage(websocket.BinaryMessage, append(header, payload...)); err != nil {
+	if err = c.writeBinary(append(header, payload...)); err != nil {
 		log.Printf(
 			"Failed to write response [ID:%d, Error:%t]: %v",
 			rid, resType != ReplyTypeSuccess, err,
@@ -52,11 +105,39 @@ func writeResponseOrLog(c *websocket.Conn, rid uint32, resType byte, res any) {
 	}
 }
 
+func (c *UserConn) writeStreamOrLog(stype byte, v any) {
+	payload, err := msgpack.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode stream message [Type:%d, Payload:%T]: %v", stype, v, err)
+		return
+	}
+	msg := make([]byte, 2, 2+len(payload))
+	msg[0] = ProtocolStream
+	msg[1] = stype
+	if err := c.writeBinary(append(msg, payload...)); err != nil {
+		log.Printf("Failed to write stream message [Type:%d] to %q: %v", stype, c.Username, err)
+	}
+}
+
 // Serve blocks, repeatedly reading and handling individual requests asynchronously until reading
 // a message from the websocket fails. This function will return nil if the websocket was closed
 // normally. To be clear, any error returned from this function will originate from a failed read,
 // and will be from the websocket library, NOT a wrapper error.
-func (s *Server) ServeAuthenticatedConn(c *websocket.Conn, u UserInfo) error {
+func (s *Server) ServeAuthenticatedConn(ws *websocket.Conn, u UserInfo) error {
+	c := &UserConn{
+		UserInfo:      u,
+		Conn:          ws,
+		subscriptions: map[string]struct{}{},
+		events:        make(chan []byte, eventQueueSize),
+		done:          make(chan struct{}),
+	}
+
+	go c.writeEvents()
+	defer close(c.done)
+
+	s.addConn(c)
+	defer s.removeConn(c)
+
 	for {
 		_, msg, err := c.ReadMessage()
 		if err != nil {
@@ -67,7 +148,7 @@ func (s *Server) ServeAuthenticatedConn(c *websocket.Conn, u UserInfo) error {
 			return err // Do NOT wrap the error, since this function ONLY returns read errors
 		}
 
-		if len(msg) < 7 {
+		if len(msg) < 2 {
 			// TODO: only log in debug mode, or maybe close connection if we receive a short message
 			log.Printf("Received short (%d bytes) message from %q", len(msg), u.Username)
 			continue
@@ -75,10 +156,16 @@ func (s *Server) ServeAuthenticatedConn(c *websocket.Conn, u UserInfo) error {
 
 		switch msg[0] {
 		case ProtocolRequestReply:
+			if len(msg) < 7 {
+				// TODO: only log in debug mode, or maybe close connection if we receive a short message
+				log.Printf("Received short (%d bytes) request from %q", len(msg), u.Username)
+				continue
+			}
+
 			rid := binary.BigEndian.Uint32(msg[1:])
 
 			if msg[5] != 0xd9 {
-				writeResponseOrLog(c, rid, ReplyTypeError, ErrorWithCode{
+				c.writeResponseOrLog(rid, ReplyTypeError, ErrorWithCode{
 					"non-str-8-request-type",
 					"server currently only supports MessagePack str-8 encoding for request types",
 					nil,
@@ -92,7 +179,7 @@ func (s *Server) ServeAuthenticatedConn(c *websocket.Conn, u UserInfo) error {
 			handler, knownType := s.RequestHandlers[rtype]
 
 			if !knownType {
-				writeResponseOrLog(c, rid, ReplyTypeError, ErrorWithCode{
+				c.writeResponseOrLog(rid, ReplyTypeError, ErrorWithCode{
 					"unknown-request-type",
 					fmt.Sprintf("%q is not a recognized request type", rtype),
 					rtype,
@@ -100,15 +187,15 @@ func (s *Server) ServeAuthenticatedConn(c *websocket.Conn, u UserInfo) error {
 				continue
 			}
 
-			res, err := handler(s, &u, payload)
+			res, err := handler(s, c, payload)
 			if err != nil {
-				writeResponseOrLog(c, rid, ReplyTypeError, err)
+				c.writeResponseOrLog(rid, ReplyTypeError, err)
 			} else {
-				writeResponseOrLog(c, rid, ReplyTypeSuccess, res)
+				c.writeResponseOrLog(rid, ReplyTypeSuccess, res)
 			}
 
 		case ProtocolStream:
-			log.Printf("Received stream message from %q", u.Username)
+			s.handleStreamMessage(c, msg[1], msg[2:])
 
 		default:
 			log.Printf(
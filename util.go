@@ -1,7 +1,82 @@
 package main
 
+import "github.com/vmihailenco/msgpack/v5"
+
 func scrub(values []byte) {
 	for i := 0; i < len(values); i++ {
 		values[i] = 0
 	}
 }
+
+// toFloat64 converts a number decoded from MessagePack into an 'any' value (which may be
+// any of the integer or float types depending on how the client encoded it) to a float64.
+// The second return value is false if the value is not a number.
+func toFloat64(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// toUint is like toFloat64, but additionally rejects negative and fractional numbers.
+func toUint(v any) (uint, bool) {
+	f, ok := toFloat64(v)
+	if !ok || f < 0 || f != float64(uint(f)) {
+		return 0, false
+	}
+	return uint(f), true
+}
+
+// toInt is like toFloat64, but additionally rejects fractional numbers.
+func toInt(v any) (int, bool) {
+	f, ok := toFloat64(v)
+	if !ok || f != float64(int(f)) {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// toRawMessage re-encodes a value decoded from MessagePack into an 'any' value so it can
+// be stored in a *msgpack.RawMessage column. A nil value yields a nil message.
+func toRawMessage(v any) (*msgpack.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	raw, err := msgpack.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	msg := msgpack.RawMessage(raw)
+	return &msg, nil
+}
+
+// convertValue decodes a value that was decoded from MessagePack into an 'any' value again,
+// this time into out, e.g., so a field of a modify request can be checked like the matching
+// field of a create request.
+func convertValue(v any, out any) error {
+	raw, err := msgpack.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(raw, out)
+}
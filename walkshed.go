@@ -0,0 +1,281 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// DefaultWalkshedBuffer is how far (in meters) either side of a reached street counts as
+// part of a walkshed when a request does not say, i.e., the depth of the lots along it.
+const DefaultWalkshedBuffer = 50
+
+// WalkshedRequest is the payload of a 'stop:walksheds' request, which finds the areas within
+// some distance or walking time of the selected stops along the pedestrian street network.
+// Distances are in meters and Times in seconds; if neither is given, DefaultBufferDistances
+// are used. Times are converted to distances at WalkSpeed (m/s), which defaults to
+// DefaultWalkSpeed. Buffer defaults to DefaultWalkshedBuffer. If Shapefile is set, the
+// walksheds are also made available for download as a zipped shapefile.
+type WalkshedRequest struct {
+	StopSelection `msgpack:",inline"`
+	Distances     []float64 `msgpack:"distances"`
+	Times         []float64 `msgpack:"times"`
+	WalkSpeed     float64   `msgpack:"walk_speed"`
+	Buffer        float64   `msgpack:"buffer"`
+	Shapefile     bool      `msgpack:"shapefile"`
+}
+
+// Walkshed is the area reachable on foot from any of the selected stops within a distance
+// (in meters), or a time (in seconds) if one was asked for. Area is in square meters.
+type Walkshed struct {
+	Distance float64      `msgpack:"distance"`
+	Time     float64      `msgpack:"time,omitempty"`
+	Area     float64      `msgpack:"area"`
+	Polygons MultiPolygon `msgpack:"polygons"`
+}
+
+// WalkshedAnalysis is the reply to a 'stop:walksheds' request. Unsnapped lists the selected
+// stops that are more than MaxSnapDistance from any walkable street, which are left out.
+type WalkshedAnalysis struct {
+	ProjectID string        `msgpack:"project_id"`
+	StopIDs   []string      `msgpack:"stop_ids"`
+	Unsnapped []string      `msgpack:"unsnapped"`
+	Walksheds []Walkshed    `msgpack:"walksheds"`
+	Download  *DownloadInfo `msgpack:"download,omitempty"`
+}
+
+func stopWalksheds(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req WalkshedRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if req.WalkSpeed == 0 {
+		req.WalkSpeed = DefaultWalkSpeed
+	}
+	if req.Buffer == 0 {
+		req.Buffer = DefaultWalkshedBuffer
+	}
+	if req.WalkSpeed < 0 || req.Buffer < 0 {
+		// TODO
+		return nil, errors.New("walk speed and buffer must be positive")
+	}
+
+	walksheds := make([]Walkshed, 0, len(req.Distances)+len(req.Times))
+	for _, d := range req.Distances {
+		walksheds = append(walksheds, Walkshed{Distance: d})
+	}
+	for _, t := range req.Times {
+		walksheds = append(walksheds, Walkshed{Distance: t * req.WalkSpeed, Time: t})
+	}
+	if len(walksheds) == 0 {
+		for _, d := range DefaultBufferDistances {
+			walksheds = append(walksheds, Walkshed{Distance: d})
+		}
+	}
+	for _, w := range walksheds {
+		if w.Distance <= 0 {
+			// TODO
+			return nil, errors.New("walkshed distances and times must be positive")
+		}
+	}
+
+	stops, err := selectStops(s.Database, req.StopSelection)
+	if err != nil {
+		return nil, err
+	}
+
+	analysis := WalkshedAnalysis{
+		ProjectID: req.ProjectID,
+		StopIDs:   make([]string, len(stops)),
+		Unsnapped: []string{},
+		Walksheds: walksheds,
+	}
+	for i, stop := range stops {
+		analysis.StopIDs[i] = stop.ID
+	}
+
+	reach := 0.0
+	for _, w := range walksheds {
+		reach = math.Max(reach, w.Distance)
+	}
+	graph, sources, err := loadWalkGraph(s, stops, reach+req.Buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapped []streetPos
+	for i, pos := range sources {
+		if pos.Edge < 0 {
+			analysis.Unsnapped = append(analysis.Unsnapped, stops[i].ID)
+		} else {
+			snapped = append(snapped, pos)
+		}
+	}
+
+	for i := range analysis.Walksheds {
+		w := &analysis.Walksheds[i]
+		w.Polygons = MultiPolygon{}
+		if field := newDiscField(graph.walkshedDiscs(snapped, w.Distance, req.Buffer)); field != nil {
+			w.Polygons = field.polygons()
+			w.Area = w.Polygons.area()
+		}
+	}
+
+	if req.Shapefile {
+		fields := []dbfField{
+			{Name: "DISTANCE", Type: 'N', Decimals: 1},
+			{Name: "TIME", Type: 'N'},
+			{Name: "AREA_M2", Type: 'N'},
+			{Name: "STOPS", Type: 'N'},
+		}
+		polygons := make([]MultiPolygon, len(analysis.Walksheds))
+		records := make([]map[string]string, len(analysis.Walksheds))
+		for i, w := range analysis.Walksheds {
+			polygons[i] = w.Polygons
+			records[i] = map[string]string{
+				"DISTANCE": strconv.FormatFloat(w.Distance, 'f', 1, 64),
+				"TIME":     strconv.FormatFloat(w.Time, 'f', 0, 64),
+				"AREA_M2":  strconv.FormatFloat(w.Area, 'f', 0, 64),
+				"STOPS":    strconv.Itoa(len(snapped)),
+			}
+		}
+		if analysis.Download, err = s.addPolygonDownload("walksheds", fields, polygons, records); err != nil {
+			// TODO
+			return nil, err
+		}
+	}
+
+	return analysis, nil
+}
+
+// loadWalkGraph loads the walkable streets within some distance of a set of stops and snaps
+// each stop to the closest one. Stops too far from any walkable street get an Edge of -1.
+func loadWalkGraph(s *Server, stops []StopInfo, margin float64) (*streetGraph, []streetPos, error) {
+	if len(stops) == 0 {
+		return &streetGraph{}, nil, nil
+	}
+
+	sw, ne := LatLng{stops[0].Lat, stops[0].Lng}, LatLng{stops[0].Lat, stops[0].Lng}
+	for _, stop := range stops {
+		sw = LatLng{math.Min(sw.Lat, stop.Lat), math.Min(sw.Lng, stop.Lng)}
+		ne = LatLng{math.Max(ne.Lat, stop.Lat), math.Max(ne.Lng, stop.Lng)}
+	}
+	proj := newLocalProjection(sw)
+	x1, y1 := proj.toXY(ne)
+	sw, ne = proj.toLatLng(-margin, -margin), proj.toLatLng(x1+margin, y1+margin)
+
+	graph, err := loadStreetGraph(s, sw, ne, streetModeWalk, nil, DefaultWalkSpeed)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(graph.edges) == 0 {
+		return nil, nil, &ErrorWithCode{
+			Code:    "no-street-network",
+			Message: "there are no walkable streets near these stops; has a street network been imported?",
+		}
+	}
+
+	sources := make([]streetPos, len(stops))
+	for i, stop := range stops {
+		pos, ok := graph.snap(LatLng{stop.Lat, stop.Lng}, MaxSnapDistance)
+		if !ok {
+			pos.Edge = -1
+		}
+		sources[i] = pos
+	}
+	return graph, sources, nil
+}
+
+// walkDistances finds how far every node within a limit is from the closest of some
+// positions along the graph, counting the distance from whatever was snapped to each
+// position.
+func (g *streetGraph) walkDistances(sources []streetPos, limit float64) map[int64]float64 {
+	nodes := map[int64]float64{}
+	best := map[int]float64{}
+	pq := &streetQueue{}
+
+	push := func(dir int, cost float64) {
+		if prev, seen := best[dir]; cost <= limit && (!seen || cost < prev) {
+			best[dir] = cost
+			heap.Push(pq, streetQueueItem{dir, cost})
+		}
+	}
+	for _, src := range sources {
+		push(2*src.Edge, src.Distance+g.edges[src.Edge].Length-src.Offset)
+		push(2*src.Edge+1, src.Distance+src.Offset)
+	}
+
+	for pq.Len() > 0 {
+		item := heap.Pop(pq).(streetQueueItem)
+		if item.cost > best[item.dir] {
+			continue // stale
+		}
+
+		node := g.head(item.dir)
+		if d, seen := nodes[node]; seen && d <= item.cost {
+			continue
+		}
+		nodes[node] = item.cost
+
+		for _, next := range g.out[node] {
+			push(next, item.cost+g.edges[next/2].Length)
+		}
+	}
+	return nodes
+}
+
+// walkshedDiscs covers every part of the graph within a walking distance of some positions
+// with discs of the buffer's radius, which dissolve into the walkshed.
+func (g *streetGraph) walkshedDiscs(sources []streetPos, limit, buffer float64) []disc {
+	nodes := g.walkDistances(sources, limit)
+	spacing := math.Max(buffer/2, 1)
+
+	var discs []disc
+	cover := func(edge int, from, to float64) {
+		from, to = math.Max(0, from), math.Min(g.edges[edge].Length, to)
+		if to < from {
+			return
+		}
+		n := int(math.Ceil((to - from) / spacing))
+		for k := 0; k <= n; k++ {
+			m := from
+			if n > 0 {
+				m += (to - from) * float64(k) / float64(n)
+			}
+			discs = append(discs, disc{pointAlong(g.coords[edge], m), buffer})
+		}
+	}
+
+	// Edges are reached from their ends...
+	for i, e := range g.edges {
+		fromLeft, fromOK := nodes[e.FromNodeID]
+		toLeft, toOK := nodes[e.ToNodeID]
+		fromLeft, toLeft = limit-fromLeft, limit-toLeft
+
+		switch {
+		case fromOK && toOK && fromLeft+toLeft >= e.Length:
+			cover(i, 0, e.Length)
+		case fromOK && toOK:
+			cover(i, 0, fromLeft)
+			cover(i, e.Length-toLeft, e.Length)
+		case fromOK:
+			cover(i, 0, fromLeft)
+		case toOK:
+			cover(i, e.Length-toLeft, e.Length)
+		}
+	}
+
+	// ...and from the stops along them
+	for _, src := range sources {
+		if left := limit - src.Distance; left > 0 {
+			cover(src.Edge, src.Offset-left, src.Offset+left)
+		}
+	}
+
+	return discs
+}
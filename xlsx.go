@@ -0,0 +1,343 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Cell styles of exported workbooks. They are indexes into the cellXfs of xlsxStyles, so
+// the two must be kept in the same order.
+const (
+	xlsxStyleDefault = iota
+	xlsxStyleHeader
+	xlsxStyleInteger
+	xlsxStyleDecimal
+	xlsxStyleTime
+	xlsxStyleCoordinate
+)
+
+// xlsxStyles defines the fonts and number formats of the cell styles. Times use the [h]:mm
+// format so that times after midnight of the service day show as 24:10 rather than 0:10.
+const xlsxStyles = `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<numFmts count="2"><numFmt numFmtId="164" formatCode="[h]:mm"/><numFmt numFmtId="165" formatCode="0.000000"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="6">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`<xf numFmtId="3" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="4" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`</cellXfs>` +
+	`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+	`</styleSheet>`
+
+// xlsxCell is a single cell of a worksheet. Value is a string, a float64, an int, a bool, or
+// nil for an empty cell.
+type xlsxCell struct {
+	Value any
+	Style int
+}
+
+func xlsxText(s string) xlsxCell {
+	return xlsxCell{Value: s}
+}
+
+func xlsxInt(n int) xlsxCell {
+	return xlsxCell{Value: n, Style: xlsxStyleInteger}
+}
+
+func xlsxDecimal(f float64) xlsxCell {
+	return xlsxCell{Value: f, Style: xlsxStyleDecimal}
+}
+
+func xlsxCoordinate(f float64) xlsxCell {
+	return xlsxCell{Value: f, Style: xlsxStyleCoordinate}
+}
+
+// xlsxTime is a time of day or a duration given in seconds. Spreadsheets count time in days.
+func xlsxTime(secs int) xlsxCell {
+	return xlsxCell{Value: float64(secs) / 86400, Style: xlsxStyleTime}
+}
+
+// xlsxHeadings is a row of bold column titles.
+func xlsxHeadings(titles ...string) []xlsxCell {
+	row := make([]xlsxCell, len(titles))
+	for i, title := range titles {
+		row[i] = xlsxCell{Value: title, Style: xlsxStyleHeader}
+	}
+	return row
+}
+
+// xlsxSheet is a worksheet. FrozenRows and FrozenColumns stay in view while scrolling, for
+// column and row titles.
+type xlsxSheet struct {
+	Name          string
+	Rows          [][]xlsxCell
+	FrozenRows    int
+	FrozenColumns int
+}
+
+// header adds a row of column titles and keeps it in view.
+func (sh *xlsxSheet) header(titles ...string) {
+	sh.Rows = append(sh.Rows, xlsxHeadings(titles...))
+	sh.FrozenRows = len(sh.Rows)
+}
+
+func (sh *xlsxSheet) row(cells ...xlsxCell) {
+	sh.Rows = append(sh.Rows, cells)
+}
+
+// xlsxWorkbook is an Office Open XML spreadsheet, written without any shared strings or
+// formulas so that it stays simple but still opens in Excel, LibreOffice and Google Sheets.
+type xlsxWorkbook struct {
+	Sheets []*xlsxSheet
+}
+
+// addSheet adds an empty worksheet. Excel limits names to 31 characters, forbids a few
+// characters in them and requires them to be unique regardless of case, so the name is
+// adjusted as needed.
+func (wb *xlsxWorkbook) addSheet(name string) *xlsxSheet {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '-'
+		}
+		return r
+	}, name)
+	name = strings.Trim(strings.TrimSpace(name), "'")
+	if name == "" {
+		name = "Sheet"
+	}
+
+	unique := truncateRunes(name, 31)
+	for n := 2; wb.hasSheet(unique); n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		unique = truncateRunes(name, 31-len(suffix)) + suffix
+	}
+
+	sh := &xlsxSheet{Name: unique}
+	wb.Sheets = append(wb.Sheets, sh)
+	return sh
+}
+
+func (wb *xlsxWorkbook) hasSheet(name string) bool {
+	for _, sh := range wb.Sheets {
+		if strings.EqualFold(sh.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// write encodes the workbook as an .xlsx file.
+func (wb *xlsxWorkbook) write() ([]byte, error) {
+	if len(wb.Sheets) == 0 {
+		wb.addSheet("Sheet")
+	}
+
+	var contentTypes, workbook, rels strings.Builder
+	contentTypes.WriteString(xml.Header)
+	contentTypes.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	contentTypes.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	contentTypes.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	contentTypes.WriteString(`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	contentTypes.WriteString(`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+
+	workbook.WriteString(xml.Header)
+	workbook.WriteString(`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+
+	rels.WriteString(xml.Header)
+	rels.WriteString(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+
+	for i, sh := range wb.Sheets {
+		n := i + 1
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xlsxEscape(sh.Name), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+	}
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, len(wb.Sheets)+1)
+
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	rels.WriteString(`</Relationships>`)
+
+	files := []struct{ name, content string }{
+		{"[Content_Types].xml", contentTypes.String()},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", workbook.String()},
+		{"xl/_rels/workbook.xml.rels", rels.String()},
+		{"xl/styles.xml", xml.Header + xlsxStyles},
+	}
+	for i, sh := range wb.Sheets {
+		files = append(files, struct{ name, content string }{
+			fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), sh.xml(),
+		})
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// xml encodes a worksheet. Columns are made wide enough for their longest value.
+func (sh *xlsxSheet) xml() string {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+
+	if sh.FrozenRows > 0 || sh.FrozenColumns > 0 {
+		b.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane`)
+		if sh.FrozenColumns > 0 {
+			fmt.Fprintf(&b, ` xSplit="%d"`, sh.FrozenColumns)
+		}
+		if sh.FrozenRows > 0 {
+			fmt.Fprintf(&b, ` ySplit="%d"`, sh.FrozenRows)
+		}
+		fmt.Fprintf(&b, ` topLeftCell="%s%d" state="frozen"/></sheetView></sheetViews>`,
+			xlsxColumn(sh.FrozenColumns), sh.FrozenRows+1)
+	}
+
+	var widths []int
+	for _, row := range sh.Rows {
+		for i, cell := range row {
+			for len(widths) <= i {
+				widths = append(widths, 0)
+			}
+			if w := cell.width(); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+	if len(widths) > 0 {
+		b.WriteString(`<cols>`)
+		for i, w := range widths {
+			w += 2
+			if w < 8 {
+				w = 8
+			} else if w > 60 {
+				w = 60
+			}
+			fmt.Fprintf(&b, `<col min="%d" max="%d" width="%d" customWidth="1"/>`, i+1, i+1, w)
+		}
+		b.WriteString(`</cols>`)
+	}
+
+	b.WriteString(`<sheetData>`)
+	for r, row := range sh.Rows {
+		fmt.Fprintf(&b, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			cell.writeXML(&b, fmt.Sprintf("%s%d", xlsxColumn(c), r+1))
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+
+	return b.String()
+}
+
+func (cell xlsxCell) writeXML(b *strings.Builder, ref string) {
+	style := ""
+	if cell.Style != xlsxStyleDefault {
+		style = fmt.Sprintf(` s="%d"`, cell.Style)
+	}
+
+	switch v := cell.Value.(type) {
+	case string:
+		if v == "" {
+			break
+		}
+		fmt.Fprintf(b, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, ref, style, xlsxEscape(v))
+		return
+	case int:
+		fmt.Fprintf(b, `<c r="%s"%s><v>%d</v></c>`, ref, style, v)
+		return
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			break
+		}
+		fmt.Fprintf(b, `<c r="%s"%s><v>%s</v></c>`, ref, style, strconv.FormatFloat(v, 'g', -1, 64))
+		return
+	case bool:
+		n := 0
+		if v {
+			n = 1
+		}
+		fmt.Fprintf(b, `<c r="%s"%s t="b"><v>%d</v></c>`, ref, style, n)
+		return
+	}
+
+	// Empty cells are still written if they are styled, e.g., blank headings
+	if style != "" {
+		fmt.Fprintf(b, `<c r="%s"%s/>`, ref, style)
+	}
+}
+
+// width estimates how many characters wide a cell is when displayed.
+func (cell xlsxCell) width() int {
+	switch v := cell.Value.(type) {
+	case string:
+		w := utf8.RuneCountInString(v)
+		if cell.Style == xlsxStyleHeader {
+			w++
+		}
+		return w
+	case int:
+		return len(strconv.Itoa(v)) * 4 / 3
+	case float64:
+		switch cell.Style {
+		case xlsxStyleTime:
+			return 6
+		case xlsxStyleCoordinate:
+			return 11
+		}
+		return len(strconv.FormatFloat(v, 'f', 2, 64)) * 4 / 3
+	case bool:
+		return 5
+	}
+	return 0
+}
+
+// xlsxColumn returns the letters of a zero-based column index: A to Z, then AA, AB, ...
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func xlsxEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gorm.io/gorm"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// XLSXExportRequest is the payload of an 'xlsx:export' request. With a RouteID, the workbook
+// has a summary of the route, its stops with the distances between them, and a timetable
+// for each direction and service day. Without one, it has tables of the project's routes,
+// stops, the routes serving each stop, and costs.
+type XLSXExportRequest struct {
+	ProjectID string `msgpack:"project_id"`
+	RouteID   string `msgpack:"route_id"`
+}
+
+func exportXLSX(s *Server, u *UserConn, payload []byte) (any, error) {
+	var req XLSXExportRequest
+	if err := msgpack.Unmarshal(payload, &req); err != nil {
+		// TODO
+		return nil, err
+	}
+
+	if err := requireProject(s.Database, req.ProjectID); err != nil {
+		return nil, err
+	}
+
+	var proj ProjectInfo
+	if err := s.Database.Take(&proj, "id = ?", req.ProjectID).Error; err != nil {
+		// TODO
+		return nil, err
+	}
+
+	var (
+		wb       *xlsxWorkbook
+		filename string
+		err      error
+	)
+	if req.RouteID != "" {
+		if err := requireInProject(s.Database, &RouteInfo{}, "route", req.RouteID, req.ProjectID); err != nil {
+			return nil, err
+		}
+		route := RouteInfo{ID: req.RouteID}
+		if err := s.Database.Take(&route).Error; err != nil {
+			// TODO
+			return nil, err
+		}
+		wb, err = routeWorkbook(s.Database, route)
+		filename = fileNameFor(proj.Name+" "+routeLabel(route), "timetable")
+	} else {
+		wb, err = projectWorkbook(s.Database, req.ProjectID)
+		filename = fileNameFor(proj.Name, "report")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := wb.write()
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	dl, err := s.addDownload(filename+".xlsx", xlsxContentType, data)
+	if err != nil {
+		// TODO
+		return nil, err
+	}
+
+	return dl, nil
+}
+
+// routeWorkbook lays out the summary, stops and timetables of a route.
+func routeWorkbook(db *gorm.DB, route RouteInfo) (*xlsxWorkbook, error) {
+	stats, err := computeRouteStats(db, route.ID, DefaultLayoverRatio, DefaultMinLayover)
+	if err != nil {
+		return nil, err
+	}
+	stops, err := loadStopsByID(db, route.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+	serviceNames, err := loadServiceNames(db, route.ProjectID)
+	if err != nil {
+		return nil, err
+	}
+
+	wb := &xlsxWorkbook{}
+
+	summary := wb.addSheet("Summary")
+	summary.row(xlsxHeadings("Route")[0], xlsxText(routeLabel(route)))
+	summary.row(xlsxHeadings("Name")[0], xlsxText(route.LongName))
+	summary.row(xlsxHeadings("Length (mi)")[0], xlsxDecimal(stats.Length/MetersPerMile))
+	summary.row(xlsxHeadings("Trips")[0], xlsxInt(stats.TripCount))
+	summary.row(xlsxHeadings("Average speed (mph)")[0], xlsxDecimal(stats.AverageSpeed*3600/MetersPerMile))
+	summary.row(xlsxHeadings("Cycle time")[0], xlsxTime(stats.CycleTime))
+	summary.row(xlsxHeadings("Peak vehicles")[0], xlsxInt(stats.PeakVehicles))
+
+	summary.row()
+	summary.row(xlsxHeadings("Direction", "Length (mi)", "Running time", "Layover")...)
+	for _, ds := range stats.Directions {
+		summary.row(xlsxInt(int(ds.DirectionID)), xlsxDecimal(ds.Length/MetersPerMile), xlsxTime(ds.RunningTime), xlsxTime(ds.Layover))
+	}
+
+	summary.row()
+	summary.row(xlsxHeadings("Service", "Trips", "Revenue hours", "Revenue miles", "Peak vehicles")...)
+	for _, ss := range stats.Services {
+		summary.row(
+			xlsxText(serviceName(serviceNames, ss.ServiceID)),
+			xlsxInt(ss.TripCount),
+			xlsxDecimal(float64(ss.RevenueTime)/3600),
+			xlsxDecimal(ss.RevenueDistance/MetersPerMile),
+			xlsxInt(ss.PeakVehicles),
+		)
+	}
+
+	// Every stop of every pattern, with the distance from the stop before it
+	stopList := wb.addSheet("Stops")
+	stopList.header("Pattern", "Direction", "Sequence", "Stop code", "Stop name", "Distance (ft)", "Distance (mi)", "Cumulative (mi)")
+	for _, ps := range stats.Patterns {
+		cumulative := 0.0
+		for i, stopID := range ps.StopIDs {
+			stop := stops[stopID]
+			dist := 0.0
+			if i > 0 && i-1 < len(ps.StopSpacing) {
+				dist = ps.StopSpacing[i-1].Distance
+			}
+			cumulative += dist
+			stopList.row(
+				xlsxText(ps.Name),
+				xlsxInt(int(ps.DirectionID)),
+				xlsxInt(i+1),
+				xlsxText(stop.Code),
+				xlsxText(stop.Name),
+				xlsxInt(int(dist/MetersPerFoot+0.5)),
+				xlsxDecimal(dist/MetersPerMile),
+				xlsxDecimal(cumulative/MetersPerMile),
+			)
+		}
+	}
+
+	timetables, err := loadTimetables(db, route.ID)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(timetables, func(i, j int) bool {
+		a, b := serviceName(serviceNames, timetables[i].ServiceID), serviceName(serviceNames, timetables[j].ServiceID)
+		if a != b {
+			return a < b
+		}
+		return timetables[i].DirectionID < timetables[j].DirectionID
+	})
+	for _, tt := range timetables {
+		name := fmt.Sprintf("%s - %s", tt.Direction, serviceName(serviceNames, tt.ServiceID))
+		tt.layout(wb.addSheet(name), stops)
+	}
+
+	return wb, nil
+}
+
+// timetable is the schedule of one direction of a route on one service day. Columns are the
+// stops in the order trips serve them, and there is a row for each run of a trip, in order of
+// departure.
+type timetable struct {
+	DirectionID uint
+	Direction   string
+	ServiceID   string
+	StopIDs     []string
+	Runs        []timetableRun
+}
+
+// timetableRun is a single run of a trip. Trips with frequencies have a run per dispatch,
+// with their times shifted by Offset seconds.
+type timetableRun struct {
+	Trip      TripInfo
+	StopTimes []StopTimeInfo
+	Start     int
+	Offset    int
+}
+
+// loadTimetables splits the trips of a route into timetables by direction and service day.
+// Directions are named after the most common headsign of their trips, plus their ID when
+// another direction has the same headsign.
+func loadTimetables(db *gorm.DB, routeID string) ([]*timetable, error) {
+	var trips []TripInfo
+	if err := db.Find(&trips, "route_id = ?", routeID).Error; err != nil {
+		return nil, err
+	}
+
+	routeTrips := db.Model(&TripInfo{}).Select("id").Where("route_id = ?", routeID)
+
+	var stopTimes []StopTimeInfo
+	if err := db.Order("trip_id, stop_sequence").Find(&stopTimes, "trip_id IN (?)", routeTrips).Error; err != nil {
+		return nil, err
+	}
+	var frequencies []FrequencyInfo
+	if err := db.Order("trip_id, start_time").Find(&frequencies, "trip_id IN (?)", routeTrips).Error; err != nil {
+		return nil, err
+	}
+
+	stopTimesByTrip := map[string][]StopTimeInfo{}
+	for _, st := range stopTimes {
+		stopTimesByTrip[st.TripID] = append(stopTimesByTrip[st.TripID], st)
+	}
+	frequenciesByTrip := map[string][]FrequencyInfo{}
+	for _, f := range frequencies {
+		frequenciesByTrip[f.TripID] = append(frequenciesByTrip[f.TripID], f)
+	}
+
+	headsigns := map[uint]map[string]int{}
+	byKey := map[string]*timetable{}
+	var timetables []*timetable
+
+	for _, trip := range trips {
+		sts := stopTimesByTrip[trip.ID]
+		start, _, ok := tripSpan(sts)
+		if !ok {
+			continue
+		}
+
+		if headsigns[trip.DirectionID] == nil {
+			headsigns[trip.DirectionID] = map[string]int{}
+		}
+		headsigns[trip.DirectionID][trip.Headsign]++
+
+		key := fmt.Sprintf("%d|%s", trip.DirectionID, trip.ServiceID)
+		tt := byKey[key]
+		if tt == nil {
+			tt = &timetable{DirectionID: trip.DirectionID, ServiceID: trip.ServiceID}
+			byKey[key] = tt
+			timetables = append(timetables, tt)
+		}
+
+		if freqs := frequenciesByTrip[trip.ID]; len(freqs) > 0 {
+			for _, f := range freqs {
+				if f.HeadwaySecs == 0 {
+					continue
+				}
+				for dep := f.StartTime; dep < f.EndTime; dep += int(f.HeadwaySecs) {
+					tt.Runs = append(tt.Runs, timetableRun{trip, sts, dep, dep - start})
+				}
+			}
+		} else {
+			tt.Runs = append(tt.Runs, timetableRun{trip, sts, start, 0})
+		}
+	}
+
+	directionNames := map[uint]string{}
+	nameCounts := map[string]int{}
+	for directionID, counts := range headsigns {
+		name, best := "", 0
+		for headsign, n := range counts {
+			if headsign != "" && (n > best || n == best && headsign < name) {
+				name, best = headsign, n
+			}
+		}
+		directionNames[directionID] = name
+		nameCounts[name]++
+	}
+
+	for _, tt := range timetables {
+		switch name := directionNames[tt.DirectionID]; {
+		case name == "":
+			tt.Direction = fmt.Sprintf("Direction %d", tt.DirectionID)
+		case nameCounts[name] > 1:
+			tt.Direction = fmt.Sprintf("%s (direction %d)", name, tt.DirectionID)
+		default:
+			tt.Direction = name
+		}
+
+		// Trips with the most stops go first so the columns follow the full route
+		byLength := make([]timetableRun, len(tt.Runs))
+		copy(byLength, tt.Runs)
+		sort.SliceStable(byLength, func(i, j int) bool {
+			return len(byLength[i].StopTimes) > len(byLength[j].StopTimes)
+		})
+		for _, run := range byLength {
+			tt.StopIDs = mergeStopSequence(tt.StopIDs, run.StopTimes)
+		}
+
+		sort.SliceStable(tt.Runs, func(i, j int) bool { return tt.Runs[i].Start < tt.Runs[j].Start })
+	}
+
+	return timetables, nil
+}
+
+// mergeStopSequence adds the stops of a trip that are missing from a list of columns, each
+// right after the stop the trip served before it.
+func mergeStopSequence(columns []string, stopTimes []StopTimeInfo) []string {
+	pos := 0
+	for _, st := range stopTimes {
+		if i := indexOfStop(columns[pos:], st.StopID); i >= 0 {
+			pos += i + 1
+			continue
+		}
+		columns = append(columns, "")
+		copy(columns[pos+1:], columns[pos:])
+		columns[pos] = st.StopID
+		pos++
+	}
+	return columns
+}
+
+func indexOfStop(stopIDs []string, stopID string) int {
+	for i, id := range stopIDs {
+		if id == stopID {
+			return i
+		}
+	}
+	return -1
+}
+
+// layout fills a worksheet with the timetable. Stops whose times are interpolated are left
+// blank.
+func (tt *timetable) layout(sh *xlsxSheet, stops map[string]StopInfo) {
+	titles := []string{"Trip"}
+	for _, id := range tt.StopIDs {
+		titles = append(titles, stops[id].Name)
+	}
+	sh.header(titles...)
+	sh.FrozenColumns = 1
+
+	for _, run := range tt.Runs {
+		label := run.Trip.ShortName
+		if label == "" {
+			label = run.Trip.ID
+		}
+
+		row := make([]xlsxCell, len(tt.StopIDs)+1)
+		row[0] = xlsxText(label)
+
+		pos := 0
+		for _, st := range run.StopTimes {
+			i := indexOfStop(tt.StopIDs[pos:], st.StopID)
+			if i < 0 {
+				continue
+			}
+			pos += i + 1
+			if st.ArrivalTime != nil || st.DepartureTime != nil {
+				row[pos] = xlsxTime(stopTimeDeparture(st) + run.Offset)
+			}
+		}
+		sh.row(row...)
+	}
+}
+
+// projectWorkbook lays out tables of a project's routes, stops and costs.
+func projectWorkbook(db *gorm.DB, projectID string) (*xlsxWorkbook, error) {
+	var routes []RouteInfo
+	if err := db.Order("sort_order, short_name, long_name, id").Find(&routes, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	var stops []StopInfo
+	if err := db.Order("name, code, id").Find(&stops, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	service, err := loadStopRouteService(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+	estimate, err := computeCostEstimate(db, projectID)
+	if err != nil {
+		return nil, err
+	}
+
+	routesByID := make(map[string]RouteInfo, len(routes))
+	for _, route := range routes {
+		routesByID[route.ID] = route
+	}
+	serviceByStop := map[string][]StopRouteService{}
+	for _, srs := range service {
+		serviceByStop[srs.StopID] = append(serviceByStop[srs.StopID], srs)
+	}
+	for _, list := range serviceByStop {
+		sort.Slice(list, func(i, j int) bool {
+			return routeLabel(routesByID[list[i].RouteID]) < routeLabel(routesByID[list[j].RouteID])
+		})
+	}
+
+	wb := &xlsxWorkbook{}
+
+	routeSheet := wb.addSheet("Routes")
+	routeSheet.header("Route", "Name", "Patterns", "Trips", "Length (mi)", "Average speed (mph)", "Cycle time", "Peak vehicles")
+	for _, route := range routes {
+		stats, err := computeRouteStats(db, route.ID, DefaultLayoverRatio, DefaultMinLayover)
+		if err != nil {
+			return nil, err
+		}
+		routeSheet.row(
+			xlsxText(routeLabel(route)),
+			xlsxText(route.LongName),
+			xlsxInt(len(stats.Patterns)),
+			xlsxInt(stats.TripCount),
+			xlsxDecimal(stats.Length/MetersPerMile),
+			xlsxDecimal(stats.AverageSpeed*3600/MetersPerMile),
+			xlsxTime(stats.CycleTime),
+			xlsxInt(stats.PeakVehicles),
+		)
+	}
+
+	stopSheet := wb.addSheet("Stops")
+	stopSheet.header("Stop code", "Stop name", "Description", "Latitude", "Longitude", "Routes", "Weekday trips", "Saturday trips", "Sunday trips")
+	for _, stop := range stops {
+		var labels []string
+		var total StopRouteService
+		for _, srs := range serviceByStop[stop.ID] {
+			labels = append(labels, routeLabel(routesByID[srs.RouteID]))
+			total.Weekday += srs.Weekday
+			total.Saturday += srs.Saturday
+			total.Sunday += srs.Sunday
+		}
+		stopSheet.row(
+			xlsxText(stop.Code),
+			xlsxText(stop.Name),
+			xlsxText(stop.Description),
+			xlsxCoordinate(stop.Lat),
+			xlsxCoordinate(stop.Lng),
+			xlsxText(strings.Join(labels, ", ")),
+			xlsxDecimal(total.Weekday),
+			xlsxDecimal(total.Saturday),
+			xlsxDecimal(total.Sunday),
+		)
+	}
+
+	stopRouteSheet := wb.addSheet("Stop Routes")
+	stopRouteSheet.header("Stop code", "Stop name", "Route", "Weekday trips", "Saturday trips", "Sunday trips")
+	for _, stop := range stops {
+		for _, srs := range serviceByStop[stop.ID] {
+			stopRouteSheet.row(
+				xlsxText(stop.Code),
+				xlsxText(stop.Name),
+				xlsxText(routeLabel(routesByID[srs.RouteID])),
+				xlsxDecimal(srs.Weekday),
+				xlsxDecimal(srs.Saturday),
+				xlsxDecimal(srs.Sunday),
+			)
+		}
+	}
+
+	costSheet := wb.addSheet("Costs")
+	costSheet.header("Route", "Peak vehicles",
+		"Daily hours", "Daily miles", "Daily cost",
+		"Weekly hours", "Weekly miles", "Weekly cost",
+		"Annual hours", "Annual miles", "Annual cost", "Cost per hour")
+	costRow := func(rc RouteCost, label xlsxCell) {
+		costSheet.row(
+			label,
+			xlsxInt(rc.PeakVehicles),
+			xlsxDecimal(rc.Daily.RevenueHours), xlsxDecimal(rc.Daily.RevenueMiles), xlsxDecimal(rc.Daily.Cost),
+			xlsxDecimal(rc.Weekly.RevenueHours), xlsxDecimal(rc.Weekly.RevenueMiles), xlsxDecimal(rc.Weekly.Cost),
+			xlsxDecimal(rc.Annual.RevenueHours), xlsxDecimal(rc.Annual.RevenueMiles), xlsxDecimal(rc.Annual.Cost),
+			xlsxDecimal(rc.Annual.CostPerHour),
+		)
+	}
+	for _, rc := range estimate.Routes {
+		costRow(rc, xlsxText(rc.Name))
+	}
+	costRow(estimate.Totals, xlsxHeadings(estimate.Totals.Name)[0])
+
+	costSheet.row()
+	costSheet.row(xlsxHeadings("Cost model")...)
+	costSheet.row(xlsxText("Cost per revenue hour"), xlsxDecimal(estimate.Model.CostPerRevenueHour))
+	costSheet.row(xlsxText("Cost per revenue mile"), xlsxDecimal(estimate.Model.CostPerRevenueMile))
+	costSheet.row(xlsxText("Annual cost per vehicle"), xlsxDecimal(estimate.Model.CostPerVehicle))
+	costSheet.row(xlsxText("Annual fixed overhead"), xlsxDecimal(estimate.Model.FixedOverhead))
+
+	return wb, nil
+}
+
+func loadStopsByID(db *gorm.DB, projectID string) (map[string]StopInfo, error) {
+	var stops []StopInfo
+	if err := db.Find(&stops, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[string]StopInfo, len(stops))
+	for _, stop := range stops {
+		byID[stop.ID] = stop
+	}
+	return byID, nil
+}
+
+// loadServiceNames maps the IDs of a project's service calendars to their names.
+func loadServiceNames(db *gorm.DB, projectID string) (map[string]string, error) {
+	var calendars []CalendarInfo
+	if err := db.Select("id", "name").Find(&calendars, "project_id = ?", projectID).Error; err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(calendars))
+	for _, cal := range calendars {
+		names[cal.ID] = cal.Name
+	}
+	return names, nil
+}
+
+// serviceName is the name of a service, or its ID if it has no name (services that only
+// have calendar dates have no calendar to be named by).
+func serviceName(names map[string]string, serviceID string) string {
+	if name := names[serviceID]; name != "" {
+		return name
+	}
+	return serviceID
+}